@@ -0,0 +1,289 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/fsdb/v4/cdb/decode"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// AllDocs returns a row for each document in the database, sorted by ID in
+// byte order, with the winning rev as its value. Deleted and local documents
+// are omitted. The include_docs, descending, startkey, endkey, inclusive_end,
+// limit and skip options are supported, with keys given as document IDs.
+func (d *db) AllDocs(ctx context.Context, options driver.Options) (driver.Rows, error) {
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	includeDocs, err := boolOption(opts, "include_docs")
+	if err != nil {
+		return nil, err
+	}
+	descending, err := boolOption(opts, "descending")
+	if err != nil {
+		return nil, err
+	}
+	inclusiveEnd := true
+	if _, ok := opts["inclusive_end"]; ok {
+		if inclusiveEnd, err = boolOption(opts, "inclusive_end"); err != nil {
+			return nil, err
+		}
+	}
+	startkey, err := keyOption(opts, "startkey", "start_key")
+	if err != nil {
+		return nil, err
+	}
+	endkey, err := keyOption(opts, "endkey", "end_key")
+	if err != nil {
+		return nil, err
+	}
+	limit, err := intOption(opts, "limit", -1)
+	if err != nil {
+		return nil, err
+	}
+	skip, err := intOption(opts, "skip", 0)
+	if err != nil {
+		return nil, err
+	}
+	docIDs, err := d.docIDs()
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]*driver.Row, 0, len(docIDs))
+	for _, docID := range docIDs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rev, err := d.winningRev(ctx, docID)
+		if kivik.HTTPStatus(err) == http.StatusNotFound {
+			// Deleted
+			continue
+		}
+		if err != nil {
+			if d.warn != nil {
+				d.warnf(cdb.WarnUndecodable, d.path(cdb.EscapeID(docID)), "%s", err)
+				continue
+			}
+			return nil, err
+		}
+		value, _ := json.Marshal(map[string]string{"rev": rev})
+		key, _ := json.Marshal(docID)
+		rows = append(rows, &driver.Row{
+			ID:    docID,
+			Key:   key,
+			Value: bytes.NewReader(value),
+		})
+	}
+	total := len(rows)
+	if descending {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	before := func(a, b string) bool {
+		if descending {
+			return a > b
+		}
+		return a < b
+	}
+	var offset int
+	if startkey != nil {
+		for offset < len(rows) && before(rows[offset].ID, *startkey) {
+			offset++
+		}
+	}
+	rows = rows[offset:]
+	if endkey != nil {
+		for i, row := range rows {
+			if before(*endkey, row.ID) || (!inclusiveEnd && row.ID == *endkey) {
+				rows = rows[:i]
+				break
+			}
+		}
+	}
+	if skip > len(rows) {
+		skip = len(rows)
+	}
+	offset += skip
+	rows = rows[skip:]
+	if limit >= 0 && limit < len(rows) {
+		rows = rows[:limit]
+	}
+	if includeDocs {
+		for _, row := range rows {
+			if err := d.includeDoc(ctx, row); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &allDocsRows{
+		bulkGetRows: &bulkGetRows{rows: rows},
+		offset:      int64(offset),
+		totalRows:   int64(total),
+	}, nil
+}
+
+// docIDs returns the IDs of the documents in the database, sorted, from the
+// names of document files and revisions directories. In lint mode, skipped
+// files are reported.
+func (d *db) docIDs() ([]string, error) {
+	infos, err := d.fsys().ReadDir(d.path())
+	if err != nil {
+		return nil, kerr(err)
+	}
+	seen := make(map[string]struct{}, len(infos))
+	docIDs := make([]string, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		path := d.path(name)
+		var base string
+		switch {
+		case info.IsDir() && (name == lockDirName || name == cdb.JournalDirName):
+			continue
+		case info.IsDir() && name[0] == '.':
+			base = name[1:]
+		case info.IsDir():
+			// Attachments of the winning revision
+			continue
+		default:
+			var ok bool
+			if base, _, ok = decode.ExplodeFilename(name); !ok {
+				if !strings.HasPrefix(name, ".tmp.") {
+					d.warnf(cdb.WarnStrayFile, path, "not in a registered format")
+				}
+				continue
+			}
+		}
+		docID, err := filename2id(base)
+		if err != nil {
+			d.warnf(cdb.WarnBadFilename, path, "%s", err)
+			continue
+		}
+		if ignoreDocID(docID) {
+			if !isSpecialDocID(docID) {
+				d.warnf(cdb.WarnStrayFile, path, "invalid document ID: %s", docID)
+			}
+			continue
+		}
+		if strings.HasPrefix(docID, "_local/") {
+			continue
+		}
+		if _, ok := seen[docID]; ok {
+			continue
+		}
+		seen[docID] = struct{}{}
+		docIDs = append(docIDs, docID)
+	}
+	sort.Strings(docIDs)
+	return docIDs, nil
+}
+
+func (d *db) winningRev(ctx context.Context, docID string) (string, error) {
+	unlock, err := d.readLockDoc(ctx, docID)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	return d.cdb.GetRev(docID, "")
+}
+
+// includeDoc sets the Doc of row to the winning revision of the document.
+func (d *db) includeDoc(ctx context.Context, row *driver.Row) error {
+	unlock, err := d.readLockDoc(ctx, row.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	doc, err := d.cdb.OpenDocID(row.ID, kivik.Params(nil))
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	row.Doc = bytes.NewReader(body)
+	return nil
+}
+
+type allDocsRows struct {
+	*bulkGetRows
+	offset, totalRows int64
+}
+
+var _ driver.Rows = &allDocsRows{}
+
+func (r *allDocsRows) Offset() int64    { return r.offset }
+func (r *allDocsRows) TotalRows() int64 { return r.totalRows }
+
+// keyOption returns the document ID given by the first of keys set in opts,
+// or nil if none is set.
+func keyOption(opts map[string]interface{}, keys ...string) (*string, error) {
+	for _, key := range keys {
+		switch t := opts[key].(type) {
+		case nil:
+			continue
+		case string:
+			return &t, nil
+		case json.RawMessage:
+			var id string
+			if err := json.Unmarshal(t, &id); err != nil {
+				return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %s", key, t)}
+			}
+			return &id, nil
+		default:
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %v", key, t)}
+		}
+	}
+	return nil, nil
+}
+
+// intOption returns the value of opts[key], which must be a non-negative
+// integer, or def if unset.
+func intOption(opts map[string]interface{}, key string, def int) (int, error) {
+	var v int
+	switch t := opts[key].(type) {
+	case nil:
+		return def, nil
+	case int:
+		v = t
+	case int64:
+		v = int(t)
+	case float64:
+		v = int(t)
+		if float64(v) != t {
+			v = -1
+		}
+	case string:
+		var err error
+		if v, err = strconv.Atoi(t); err != nil {
+			v = -1
+		}
+	default:
+		v = -1
+	}
+	if v < 0 {
+		return 0, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %v", key, opts[key])}
+	}
+	return v, nil
+}
@@ -0,0 +1,159 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+func TestAllDocs(t *testing.T) {
+	type tt struct {
+		options  kivik.Option
+		want     []string
+		offset   int64
+		status   int
+		err      string
+		wantDocs bool
+	}
+	tests := testy.NewTable()
+	tests.Add("defaults", tt{
+		want: []string{"a", "b", "c", "d"},
+	})
+	tests.Add("descending", tt{
+		options: kivik.Param("descending", true),
+		want:    []string{"d", "c", "b", "a"},
+	})
+	tests.Add("key range", tt{
+		options: kivik.Params(map[string]interface{}{"startkey": "b", "endkey": "c"}),
+		want:    []string{"b", "c"},
+		offset:  1,
+	})
+	tests.Add("key range, exclusive end", tt{
+		options: kivik.Params(map[string]interface{}{"start_key": "b", "end_key": "c", "inclusive_end": false}),
+		want:    []string{"b"},
+		offset:  1,
+	})
+	tests.Add("descending key range", tt{
+		options: kivik.Params(map[string]interface{}{"descending": true, "startkey": "c", "endkey": "b"}),
+		want:    []string{"c", "b"},
+		offset:  1,
+	})
+	tests.Add("skip and limit", tt{
+		options: kivik.Params(map[string]interface{}{"skip": 1, "limit": "2"}),
+		want:    []string{"b", "c"},
+		offset:  1,
+	})
+	tests.Add("include docs", tt{
+		options:  kivik.Param("include_docs", true),
+		want:     []string{"a", "b", "c", "d"},
+		wantDocs: true,
+	})
+	tests.Add("invalid limit", tt{
+		options: kivik.Param("limit", -1),
+		status:  http.StatusBadRequest,
+		err:     "invalid value for limit: -1",
+	})
+	tests.Add("invalid startkey", tt{
+		options: kivik.Param("startkey", 3),
+		status:  http.StatusBadRequest,
+		err:     "invalid value for startkey: 3",
+	})
+
+	d := allDocsTestDB(t)
+	tests.Run(t, func(t *testing.T, tt tt) {
+		options := tt.options
+		if options == nil {
+			options = kivik.Params(nil)
+		}
+		rows, err := d.AllDocs(context.Background(), options)
+		testy.StatusError(t, tt.err, tt.status, err)
+		var ids []string
+		for {
+			row := new(driver.Row)
+			if err := rows.Next(row); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, row.ID)
+			var value struct {
+				Rev string `json:"rev"`
+			}
+			if err := json.NewDecoder(row.Value).Decode(&value); err != nil || value.Rev == "" {
+				t.Errorf("Unexpected value for %s: %v", row.ID, err)
+			}
+			if tt.wantDocs != (row.Doc != nil) {
+				t.Errorf("Unexpected doc for %s", row.ID)
+			}
+			if row.Doc != nil {
+				var doc map[string]interface{}
+				if err := json.NewDecoder(row.Doc).Decode(&doc); err != nil {
+					t.Fatal(err)
+				}
+				if doc["_id"] != row.ID || doc["_rev"] != value.Rev {
+					t.Errorf("Unexpected doc: %v", doc)
+				}
+			}
+		}
+		if d := testy.DiffInterface(tt.want, ids); d != nil {
+			t.Error(d)
+		}
+		if rows.Offset() != tt.offset {
+			t.Errorf("Unexpected offset: %d", rows.Offset())
+		}
+		if rows.TotalRows() != 4 {
+			t.Errorf("Unexpected total rows: %d", rows.TotalRows())
+		}
+	})
+}
+
+// allDocsTestDB returns an in-memory database holding documents a, b, c and
+// d, as well as a deleted document and a local document, which AllDocs omits.
+func allDocsTestDB(t *testing.T) driver.DB {
+	t.Helper()
+	c, err := NewDriver(filesystem.NewMemFS()).NewClient("/", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := c.CreateDB(ctx, "db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.DB("db", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"c", "a", "_local/x", "d", "b"} {
+		if _, err := d.Put(ctx, id, map[string]string{"value": id}, kivik.Params(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rev, err := d.Put(ctx, "deleted", map[string]string{}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Put(ctx, "deleted", map[string]interface{}{"_rev": rev, "_deleted": true}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
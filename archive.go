@@ -0,0 +1,511 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/fsdb/v4/cdb/decode"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// The archive formats supported by Export and Import.
+const (
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// DBExporter is implemented by the databases of this driver.
+type DBExporter interface {
+	// Export writes the database, or the documents named by the doc_ids
+	// option, to w as an archive of its on-disk layout. The archive option
+	// selects the format, ArchiveTarGz, the default, or ArchiveZip.
+	Export(ctx context.Context, w io.Writer, options driver.Options) error
+}
+
+// ClientImporter is implemented by the clients of this driver.
+type ClientImporter interface {
+	// Import creates the named database from an archive, as written by
+	// Export, after validating its revision files and attachment digests.
+	Import(ctx context.Context, dbName string, r io.Reader, options driver.Options) error
+}
+
+var (
+	_ DBExporter     = &db{}
+	_ ClientImporter = &client{}
+)
+
+// archiveEntry is a file to be exported.
+type archiveEntry struct {
+	// name is the slash-separated path, relative to the database root.
+	name string
+	path string
+	info os.FileInfo
+}
+
+// Export writes the database to w as an archive, in the format selected by
+// the archive option, "tar.gz", the default, or "zip". Entries are stored
+// under a single directory, named for the database, and preserve the on-disk
+// layout: winning revisions, revisions directories, attachments, the
+// _security document and the database's settings. With the doc_ids option,
+// only the named documents are exported, along with _security and the
+// settings. Temporary files, locks and journals are never exported. Document
+// updates are excluded while the archive is written, so that it is
+// consistent.
+func (d *db) Export(ctx context.Context, w io.Writer, options driver.Options) error {
+	opts := map[string]interface{}{}
+	if options != nil {
+		options.Apply(opts)
+	}
+	format, err := stringOption(opts, "archive")
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "":
+		format = ArchiveTarGz
+	case ArchiveTarGz, ArchiveZip:
+	default:
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("unsupported archive format: %s", format)}
+	}
+	var want map[string]bool
+	if ids, ok := opts["doc_ids"]; ok {
+		docIDs, err := toStrings(ids)
+		if err != nil {
+			return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid doc_ids: %w", err)}
+		}
+		want = make(map[string]bool, len(docIDs))
+		for _, id := range docIDs {
+			want[id] = false
+		}
+	}
+	unlock, err := d.lockDB(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := d.archiveEntries(want)
+	if err != nil {
+		return err
+	}
+	for _, id := range sortedKeys(want) {
+		if !want[id] {
+			return statusError{status: http.StatusNotFound, error: fmt.Errorf("document %s not found", id)}
+		}
+	}
+	prefix := filepath.Base(d.dbPath)
+	if format == ArchiveZip {
+		return d.writeZip(ctx, w, prefix, entries)
+	}
+	return d.writeTarGz(ctx, w, prefix, entries)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// archiveEntries returns the files to export, in order. If want is not nil,
+// only the documents it names are included, and each one found is marked
+// true.
+func (d *db) archiveEntries(want map[string]bool) ([]archiveEntry, error) {
+	infos, err := d.fsys().ReadDir(d.path())
+	if err != nil {
+		return nil, kerr(err)
+	}
+	var entries []archiveEntry
+	for _, info := range infos {
+		name := info.Name()
+		var base string
+		switch {
+		case strings.HasPrefix(name, ".tmp."):
+			continue
+		case info.IsDir() && (name == lockDirName || name == cdb.JournalDirName):
+			continue
+		case info.IsDir() && name[0] == '.':
+			base = name[1:]
+		case info.IsDir():
+			// Attachments of the winning revision
+			base = name
+		default:
+			var ok bool
+			if base, _, ok = decode.ExplodeFilename(name); !ok {
+				d.warnf(cdb.WarnStrayFile, d.path(name), "not in a registered format")
+				continue
+			}
+		}
+		if want != nil {
+			docID, err := filename2id(base)
+			if err != nil {
+				d.warnf(cdb.WarnBadFilename, d.path(name), "%s", err)
+				continue
+			}
+			if !isSpecialDocID(docID) {
+				if _, ok := want[docID]; !ok {
+					continue
+				}
+				want[docID] = true
+			}
+		}
+		if entries, err = d.appendEntries(entries, name, info); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// appendEntries appends the file named name, relative to the database root,
+// or if a directory, the files within it, to entries.
+func (d *db) appendEntries(entries []archiveEntry, name string, info os.FileInfo) ([]archiveEntry, error) {
+	path := d.path(filepath.FromSlash(name))
+	if !info.IsDir() {
+		return append(entries, archiveEntry{name: name, path: path, info: info}), nil
+	}
+	infos, err := d.fsys().ReadDir(path)
+	if err != nil {
+		return nil, kerr(err)
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".tmp.") {
+			continue
+		}
+		if entries, err = d.appendEntries(entries, name+"/"+info.Name(), info); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (d *db) writeTarGz(ctx context.Context, w io.Writer, prefix string, entries []archiveEntry) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(entry.info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix + "/" + entry.name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := d.copyFile(tw, entry.path); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (d *db) writeZip(ctx context.Context, w io.Writer, prefix string, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(entry.info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix + "/" + entry.name
+		hdr.Method = zip.Deflate
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err := d.copyFile(fw, entry.path); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (d *db) copyFile(w io.Writer, path string) error {
+	f, err := d.fsys().Open(path)
+	if err != nil {
+		return kerr(err)
+	}
+	defer f.Close() // nolint: errcheck
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Import creates the named database from a tar.gz or zip archive, as written
+// by Export, or by hand. The format is detected from the content. If every
+// entry is within a single directory, as written by Export, that directory
+// is the database root; otherwise the archive root is. The archive is
+// unpacked into a temporary directory, and rejected, with 400 Bad Request,
+// if it contains anything which isn't part of a database, paths outside of
+// it, or entries other than files and directories, or if Fsck finds any
+// issue but empty directories, which are removed. In particular, revision
+// files must match their _rev fields, and attachments their digests. The
+// database's settings are kept, but it is given a new UUID and creation
+// time. Only then is it moved into place, so a failed import leaves nothing
+// behind.
+func (c *client) Import(ctx context.Context, dbName string, r io.Reader, _ driver.Options) error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if !validDBNameRE.MatchString(dbName) {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid database name: %s", dbName)}
+	}
+	exists, err := c.DBExists(ctx, dbName, nil)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return statusError{status: http.StatusPreconditionFailed, error: errors.New("database already exists")}
+	}
+	target := filepath.Join(c.root, cdb.EscapeID(dbName))
+	if _, err := c.fs.Stat(target); err == nil {
+		return statusError{status: http.StatusPreconditionFailed, error: fmt.Errorf("%s exists, but is not a database", target)}
+	}
+	staging, err := c.stagingDir()
+	if err != nil {
+		return err
+	}
+	defer c.fs.RemoveAll(staging) // nolint: errcheck
+	if err := c.unpack(ctx, staging, r); err != nil {
+		return err
+	}
+	root, err := c.archiveRoot(staging)
+	if err != nil {
+		return err
+	}
+	if err := c.validateImport(ctx, root); err != nil {
+		return err
+	}
+	return kerr(c.fs.Rename(root, target))
+}
+
+// stagingDir creates a temporary directory in the client's root, into which
+// an archive is unpacked.
+func (c *client) stagingDir() (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	path := filepath.Join(c.root, ".tmp.import-"+hex.EncodeToString(suffix))
+	if err := c.fs.Mkdir(path, dirMode); err != nil {
+		return "", kerr(err)
+	}
+	return path, nil
+}
+
+// unpack extracts the archive read from r into dir.
+func (c *client) unpack(ctx context.Context, dir string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	switch {
+	case bytes.Equal(magic, []byte{0x1f, 0x8b}):
+		return c.unpackTarGz(ctx, dir, br)
+	case bytes.Equal(magic, []byte("PK")):
+		return c.unpackZip(ctx, dir, br)
+	}
+	return statusError{status: http.StatusBadRequest, error: errors.New("unrecognized archive format")}
+}
+
+func (c *client) unpackTarGz(ctx context.Context, dir string, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return badArchive(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return badArchive(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = c.unpackEntry(dir, hdr.Name, true, nil)
+		case tar.TypeReg, tar.TypeRegA: // nolint: staticcheck
+			err = c.unpackEntry(dir, hdr.Name, false, tr)
+		default:
+			err = statusError{status: http.StatusBadRequest, error: fmt.Errorf("%s: unsupported entry type", hdr.Name)}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *client) unpackZip(ctx context.Context, dir string, r io.Reader) error {
+	// zip archives are read from the end, so must be buffered.
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return badArchive(err)
+	}
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = c.unpackEntry(dir, f.Name, true, nil)
+		case mode.IsRegular():
+			err = c.unpackZipFile(dir, f)
+		default:
+			err = statusError{status: http.StatusBadRequest, error: fmt.Errorf("%s: unsupported entry type", f.Name)}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) unpackZipFile(dir string, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return badArchive(err)
+	}
+	defer rc.Close() // nolint: errcheck
+	return c.unpackEntry(dir, f.Name, false, rc)
+}
+
+// unpackEntry creates the directory, or the file with the content read from
+// r, named by the archive entry name, within dir. Temporary files and locks
+// are skipped.
+func (c *client) unpackEntry(dir, name string, isDir bool, r io.Reader) error {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || strings.Contains(clean, `\`) {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("%s: path outside of the database", name)}
+	}
+	if clean == "." {
+		return nil
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if strings.HasPrefix(part, ".tmp.") || part == lockDirName {
+			return nil
+		}
+	}
+	target := filepath.Join(dir, filepath.FromSlash(clean))
+	if isDir {
+		return kerr(c.fs.MkdirAll(target, dirMode))
+	}
+	if err := c.fs.MkdirAll(filepath.Dir(target), dirMode); err != nil {
+		return kerr(err)
+	}
+	f, err := c.fs.Create(target)
+	if err != nil {
+		return kerr(err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return badArchive(err)
+	}
+	return f.Close()
+}
+
+func badArchive(err error) error {
+	return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid archive: %w", err)}
+}
+
+// archiveRoot returns the database root within the unpacked archive in dir:
+// its only entry, if that's a directory which isn't part of a database, or
+// else dir itself.
+func (c *client) archiveRoot(dir string) (string, error) {
+	infos, err := c.fs.ReadDir(dir)
+	if err != nil {
+		return "", kerr(err)
+	}
+	if len(infos) == 1 && infos[0].IsDir() && infos[0].Name()[0] != '.' {
+		return filepath.Join(dir, infos[0].Name()), nil
+	}
+	return dir, nil
+}
+
+// validateImport checks the unpacked database at root, and gives it new
+// settings.
+func (c *client) validateImport(ctx context.Context, root string) error {
+	fs := cdb.New(root, c.fs)
+	unknown, err := fs.Unrecognized()
+	if err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("archive contains unrecognized files: %s", strings.Join(unknown, ", "))}
+	}
+	issues, err := fs.Fsck(ctx, false)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	emptyDirs := false
+	for _, issue := range issues {
+		if issue.Kind == cdb.IssueEmptyDir {
+			emptyDirs = true
+			continue
+		}
+		problems = append(problems, issue.String())
+	}
+	if len(problems) > 0 {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid archive: %s", strings.Join(problems, "; "))}
+	}
+	if emptyDirs {
+		if _, err := fs.Fsck(ctx, true); err != nil {
+			return err
+		}
+	}
+	meta, err := fs.ReadMeta()
+	if err != nil {
+		return statusError{status: http.StatusBadRequest, error: err}
+	}
+	fresh, err := cdb.NewMeta()
+	if err != nil {
+		return err
+	}
+	meta.Created = fresh.Created
+	meta.UUID = fresh.UUID
+	return fs.WriteMeta(meta)
+}
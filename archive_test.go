@@ -0,0 +1,461 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// archiveTestClient returns a client, rooted in a new temporary directory,
+// with a database named src, holding a document with two revisions, the
+// second with an attachment, another document, and a security object.
+func archiveTestClient(t *testing.T) (*client, string) {
+	t.Helper()
+	dir := tempDir(t)
+	t.Cleanup(func() { rmdir(t, dir) })
+	c, err := NewDriver(filesystem.Default()).NewClient(dir, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := c.CreateDB(ctx, "src", kivik.Param("format", "yaml")); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.DB("src", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := d.Put(ctx, "foo", map[string]interface{}{"value": 1}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Put(ctx, "foo", map[string]interface{}{
+		"_rev":  rev,
+		"value": 2,
+		"_attachments": map[string]interface{}{
+			"foo.txt": map[string]interface{}{
+				"content_type": "text/plain",
+				"data":         []byte("Testing"),
+			},
+		},
+	}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Put(ctx, "bar", map[string]interface{}{"value": 3}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.(*db).SetSecurity(ctx, &driver.Security{Admins: driver.Members{Names: []string{"bob"}}}); err != nil {
+		t.Fatal(err)
+	}
+	return c.(*client), dir
+}
+
+func exportDB(t *testing.T, c *client, dbName string, options kivik.Option) ([]byte, error) {
+	t.Helper()
+	d, err := c.DB(dbName, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = d.(DBExporter).Export(context.Background(), buf, options)
+	return buf.Bytes(), err
+}
+
+// dirFiles returns the contents of the files in dir, by slash-separated path,
+// skipping empty directories.
+func dirFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// archiveNames returns the names of the entries in a tar.gz or zip archive.
+func archiveNames(t *testing.T, archive []byte) []string {
+	t.Helper()
+	var names []string
+	if bytes.HasPrefix(archive, []byte("PK")) {
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+// tarGz returns a tar.gz archive of the given entries. Names ending in "/"
+// are directories.
+func tarGz(t *testing.T, entries map[string]string) []byte {
+	t.Helper()
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hdrs := make([]*tar.Header, 0, len(names))
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(entries[name]))}
+		if strings.HasSuffix(name, "/") {
+			hdr = &tar.Header{Name: name, Mode: 0o755, Typeflag: tar.TypeDir}
+		}
+		hdrs = append(hdrs, hdr)
+	}
+	return tarGzHeaders(t, hdrs, entries)
+}
+
+func tarGzHeaders(t *testing.T, hdrs []*tar.Header, content map[string]string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+	type tt struct {
+		options kivik.Option
+	}
+	tests := testy.NewTable()
+	tests.Add("default", tt{options: kivik.Params(nil)})
+	tests.Add("tar.gz", tt{options: kivik.Param("archive", ArchiveTarGz)})
+	tests.Add("zip", tt{options: kivik.Param("archive", ArchiveZip)})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		ctx := context.Background()
+		c, dir := archiveTestClient(t)
+		archive, err := exportDB(t, c, "src", tt.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Import(ctx, "dst", bytes.NewReader(archive), kivik.Params(nil)); err != nil {
+			t.Fatal(err)
+		}
+
+		src, dst := dirFiles(t, filepath.Join(dir, "src")), dirFiles(t, filepath.Join(dir, "dst"))
+		if src[cdb.MetaFileName] == dst[cdb.MetaFileName] {
+			t.Errorf("Expected new settings, got: %s", dst[cdb.MetaFileName])
+		}
+		delete(src, cdb.MetaFileName)
+		delete(dst, cdb.MetaFileName)
+		if d := testy.DiffInterface(src, dst); d != nil {
+			t.Error(d)
+		}
+		srcMeta, err := cdb.New(filepath.Join(dir, "src")).ReadMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dstMeta, err := cdb.New(filepath.Join(dir, "dst")).ReadMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dstMeta.Format != "yaml" || dstMeta.UUID == srcMeta.UUID {
+			t.Errorf("Unexpected settings: %+v", dstMeta)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("Expected only src and dst, found %d entries", len(entries))
+		}
+
+		d, err := c.DB("dst", kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := d.Get(ctx, "foo", kivik.Param("attachments", true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(doc.Rev, "2-") {
+			t.Errorf("Unexpected rev: %s", doc.Rev)
+		}
+	})
+}
+
+func TestExportOptions(t *testing.T) {
+	type tt struct {
+		options kivik.Option
+		want    []string
+		status  int
+		err     string
+	}
+	tests := testy.NewTable()
+	tests.Add("all", tt{
+		options: kivik.Params(nil),
+		want: []string{
+			"src/.foo/1-b7b2ce9ff4f00a21d5d0d8d2ac18ef57.yaml",
+			"src/_meta.json",
+			"src/_security.yaml",
+			"src/bar.yaml",
+			"src/foo.yaml",
+			"src/foo/foo.txt",
+		},
+	})
+	tests.Add("doc_ids", tt{
+		options: kivik.Param("doc_ids", []string{"bar"}),
+		want:    []string{"src/_meta.json", "src/_security.yaml", "src/bar.yaml"},
+	})
+	tests.Add("missing doc_id", tt{
+		options: kivik.Param("doc_ids", []interface{}{"bar", "baz"}),
+		status:  http.StatusNotFound,
+		err:     "document baz not found",
+	})
+	tests.Add("invalid doc_ids", tt{
+		options: kivik.Param("doc_ids", 3),
+		status:  http.StatusBadRequest,
+		err:     "invalid doc_ids: json: cannot unmarshal number into Go value of type []string",
+	})
+	tests.Add("unsupported format", tt{
+		options: kivik.Param("archive", "rar"),
+		status:  http.StatusBadRequest,
+		err:     "unsupported archive format: rar",
+	})
+
+	c, dir := archiveTestClient(t)
+	if err := os.WriteFile(filepath.Join(dir, "src", ".tmp.bar.yaml-123"), []byte("x"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	tests.Run(t, func(t *testing.T, tt tt) {
+		archive, err := exportDB(t, c, "src", tt.options)
+		testy.StatusError(t, tt.err, tt.status, err)
+		got := archiveNames(t, archive)
+		sort.Strings(got)
+		if len(got) != len(tt.want) {
+			t.Fatalf("Unexpected entries: %v", got)
+		}
+		for i, name := range got {
+			want := tt.want[i]
+			if strings.HasPrefix(want, "src/.foo/") {
+				// The revision ID depends on the hashing mode
+				if !strings.HasPrefix(name, "src/.foo/1-") || !strings.HasSuffix(name, ".yaml") {
+					t.Errorf("Unexpected entry: %s", name)
+				}
+				continue
+			}
+			if name != want {
+				t.Errorf("Unexpected entry: %s, expected %s", name, want)
+			}
+		}
+	})
+}
+
+func TestExportReadOnly(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := readOnlyDB(t).Export(context.Background(), buf, kivik.Param("archive", ArchiveZip)); err != nil {
+		t.Fatal(err)
+	}
+	got := archiveNames(t, buf.Bytes())
+	want := []string{"db/.foo/1-aaa.json", "db/_meta.json", "db/_security.json", "db/bar.json", "db/deleted.json", "db/foo.json"}
+	if d := testy.DiffInterface(want, got); d != nil {
+		t.Error(d)
+	}
+}
+
+func TestImport(t *testing.T) {
+	type tt struct {
+		dbName  string
+		archive []byte
+		status  int
+		err     string
+		want    map[string]string
+	}
+	tests := testy.NewTable()
+	tests.Add("without prefix directory", tt{
+		archive: tarGz(t, map[string]string{
+			"foo.json":            `{"_rev":"2-bbb","_revisions":{"start":2,"ids":["bbb","aaa"]},"value":2}`,
+			".foo/":               "",
+			".foo/1-aaa.json":     `{"_rev":"1-aaa","value":1}`,
+			"_security.json":      `{}`,
+			".tmp.foo.json-12345": "partial",
+		}),
+		want: map[string]string{
+			"foo.json":        `{"_rev":"2-bbb","_revisions":{"start":2,"ids":["bbb","aaa"]},"value":2}`,
+			".foo/1-aaa.json": `{"_rev":"1-aaa","value":1}`,
+			"_security.json":  `{}`,
+		},
+	})
+	tests.Add("empty directories", tt{
+		archive: tarGz(t, map[string]string{
+			"db/":         "",
+			"db/foo.json": `{"_rev":"1-aaa"}`,
+			"db/.bar/":    "",
+			"db/._locks/": "",
+		}),
+		want: map[string]string{
+			"foo.json": `{"_rev":"1-aaa"}`,
+		},
+	})
+	tests.Add("already exists", tt{
+		dbName:  "src",
+		archive: tarGz(t, map[string]string{"db/foo.json": `{"_rev":"1-aaa"}`}),
+		status:  http.StatusPreconditionFailed,
+		err:     "database already exists",
+	})
+	tests.Add("invalid name", tt{
+		dbName:  "Bad",
+		archive: tarGz(t, map[string]string{"db/foo.json": `{"_rev":"1-aaa"}`}),
+		status:  http.StatusBadRequest,
+		err:     "invalid database name: Bad",
+	})
+	tests.Add("not an archive", tt{
+		archive: []byte(`{"_rev":"1-aaa"}`),
+		status:  http.StatusBadRequest,
+		err:     "unrecognized archive format",
+	})
+	tests.Add("corrupt archive", tt{
+		archive: []byte{0x1f, 0x8b, 0, 0},
+		status:  http.StatusBadRequest,
+		err:     "invalid archive: unexpected EOF",
+	})
+	tests.Add("path traversal", tt{
+		archive: tarGz(t, map[string]string{"db/../../evil.json": `{}`}),
+		status:  http.StatusBadRequest,
+		err:     "db/../../evil.json: path outside of the database",
+	})
+	tests.Add("absolute path", tt{
+		archive: tarGz(t, map[string]string{"/etc/evil.json": `{}`}),
+		status:  http.StatusBadRequest,
+		err:     "/etc/evil.json: path outside of the database",
+	})
+	tests.Add("symlink", tt{
+		archive: tarGzHeaders(t, []*tar.Header{
+			{Name: "db/foo.json", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		}, nil),
+		status: http.StatusBadRequest,
+		err:    "db/foo.json: unsupported entry type",
+	})
+	tests.Add("unrecognized file", tt{
+		archive: tarGz(t, map[string]string{
+			"db/foo.json":  `{"_rev":"1-aaa"}`,
+			"db/README.md": "read me",
+		}),
+		status: http.StatusBadRequest,
+		err:    "archive contains unrecognized files: README.md",
+	})
+	tests.Add("rev mismatch", tt{
+		archive: tarGz(t, map[string]string{
+			"db/foo.json":        `{"_rev":"2-bbb","_revisions":{"start":2,"ids":["bbb","aaa"]}}`,
+			"db/.foo/1-aaa.json": `{"_rev":"1-ccc"}`,
+		}),
+		status: http.StatusBadRequest,
+		err:    "invalid archive: rev_mismatch: .*/.foo/1-aaa.json: filename has rev 1-aaa, but _rev is 1-ccc",
+	})
+	tests.Add("digest mismatch", tt{
+		archive: tarGz(t, map[string]string{
+			"db/foo.json":    `{"_rev":"1-aaa","_attachments":{"foo.txt":{"content_type":"text/plain","digest":"md5-dvbbgnljbD6tNrGuNZKN1Q==","length":7,"stub":true}}}`,
+			"db/foo/foo.txt": "Tampered",
+		}),
+		status: http.StatusBadRequest,
+		err:    "invalid archive: digest_mismatch: .*/foo/foo.txt: attachment foo.txt of rev 1-aaa has digest md5-.*, expected md5-dvbbgnljbD6tNrGuNZKN1Q==",
+	})
+	tests.Add("invalid settings", tt{
+		archive: tarGz(t, map[string]string{
+			"db/_meta.json": `{"format":"xml"}`,
+			"db/foo.json":   `{"_rev":"1-aaa"}`,
+		}),
+		status: http.StatusBadRequest,
+		err:    "invalid _meta.json: unsupported format: xml",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		c, dir := archiveTestClient(t)
+		dbName := tt.dbName
+		if dbName == "" {
+			dbName = "imported"
+		}
+		err := c.Import(context.Background(), dbName, bytes.NewReader(tt.archive), kivik.Params(nil))
+		if err != nil {
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 1 {
+				t.Errorf("Expected failed import to leave nothing behind, found %d entries", len(entries))
+			}
+		}
+		testy.StatusErrorRE(t, tt.err, tt.status, err)
+		got := dirFiles(t, filepath.Join(dir, dbName))
+		if _, ok := got[cdb.MetaFileName]; !ok {
+			t.Errorf("Expected %s to be written", cdb.MetaFileName)
+		}
+		delete(got, cdb.MetaFileName)
+		if d := testy.DiffInterface(tt.want, got); d != nil {
+			t.Error(d)
+		}
+		if _, err := os.Stat(filepath.Join(dir, dbName, ".bar")); !os.IsNotExist(err) {
+			t.Errorf("Expected empty directory to be removed, got: %v", err)
+		}
+	})
+}
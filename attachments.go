@@ -0,0 +1,132 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// GetAttachment opens the named attachment of the winning revision of the
+// document, or of the revision given by the rev option.
+func (d *db) GetAttachment(ctx context.Context, docID, filename string, options driver.Options) (*driver.Attachment, error) {
+	unlock, err := d.readLockDoc(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	doc, err := d.cdb.OpenDocID(docID, options)
+	if err != nil {
+		return nil, err
+	}
+	att, ok := doc.Revisions[0].Attachments[filename]
+	if !ok {
+		return nil, statusError{status: http.StatusNotFound, error: fmt.Errorf("attachment %s not found", filename)}
+	}
+	f, err := att.Open()
+	if err != nil {
+		return nil, err
+	}
+	var revpos int64
+	if att.RevPos != nil {
+		revpos = *att.RevPos
+	}
+	return &driver.Attachment{
+		Filename:    filename,
+		ContentType: att.ContentType,
+		Content:     f,
+		Size:        att.Size,
+		Digest:      att.Digest,
+		RevPos:      revpos,
+	}, nil
+}
+
+// PutAttachment adds the attachment to the revision of the document given by
+// the rev option, replacing any attachment of the same name, or creates the
+// document, if the rev option is omitted.
+func (d *db) PutAttachment(ctx context.Context, docID string, att *driver.Attachment, options driver.Options) (string, error) {
+	if err := d.checkWritable(); err != nil {
+		return "", err
+	}
+	if att.Filename == "" {
+		return "", statusError{status: http.StatusBadRequest, error: errors.New("attachment filename missing")}
+	}
+	doc, err := d.attachmentsBody(ctx, docID, options)
+	if err != nil {
+		return "", err
+	}
+	var content []byte
+	if att.Content != nil {
+		if content, err = io.ReadAll(att.Content); err != nil {
+			return "", err
+		}
+	}
+	atts, _ := doc["_attachments"].(map[string]interface{})
+	if atts == nil {
+		atts = map[string]interface{}{}
+		doc["_attachments"] = atts
+	}
+	atts[att.Filename] = map[string]interface{}{
+		"content_type": att.ContentType,
+		"data":         content,
+	}
+	return d.Put(ctx, docID, doc, options)
+}
+
+// DeleteAttachment removes the named attachment from the revision of the
+// document given by the rev option.
+func (d *db) DeleteAttachment(ctx context.Context, docID, filename string, options driver.Options) (string, error) {
+	if err := d.checkWritable(); err != nil {
+		return "", err
+	}
+	doc, err := d.attachmentsBody(ctx, docID, options)
+	if err != nil {
+		return "", err
+	}
+	atts, _ := doc["_attachments"].(map[string]interface{})
+	if _, ok := atts[filename]; !ok {
+		return "", statusError{status: http.StatusNotFound, error: fmt.Errorf("attachment %s not found", filename)}
+	}
+	delete(atts, filename)
+	return d.Put(ctx, docID, doc, options)
+}
+
+// attachmentsBody returns the body of the revision of the document given by
+// the rev option, with its attachments as stubs, ready to be updated, or an
+// empty body if the rev option is omitted.
+func (d *db) attachmentsBody(ctx context.Context, docID string, options driver.Options) (map[string]interface{}, error) {
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	doc := map[string]interface{}{}
+	rev, _ := opts["rev"].(string)
+	if rev == "" {
+		return doc, nil
+	}
+	current, err := d.Get(ctx, docID, kivik.Rev(rev))
+	if err != nil {
+		return nil, err
+	}
+	defer current.Body.Close() // nolint: errcheck
+	if err := json.NewDecoder(current.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	delete(doc, "_id")
+	return doc, nil
+}
@@ -0,0 +1,105 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+func TestAttachments(t *testing.T) {
+	c, _ := archiveTestClient(t)
+	d, err := c.DB("src", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rev1, err := d.(*db).GetRev(ctx, "foo", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev2, err := d.PutAttachment(ctx, "foo", &driver.Attachment{
+		Filename:    "bar.txt",
+		ContentType: "text/plain",
+		Content:     io.NopCloser(strings.NewReader("bar")),
+	}, kivik.Rev(rev1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filename, want := range map[string]string{"foo.txt": "Testing", "bar.txt": "bar"} {
+		att, err := d.GetAttachment(ctx, "foo", filename, kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(att.Content)
+		_ = att.Content.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want || att.ContentType != "text/plain" || att.Size != int64(len(want)) {
+			t.Errorf("Unexpected attachment %s: %q, %+v", filename, content, att)
+		}
+	}
+	if _, err := d.GetAttachment(ctx, "foo", "bar.txt", kivik.Rev(rev1)); kivik.HTTPStatus(err) != http.StatusNotFound {
+		t.Errorf("Expected bar.txt to be missing from %s, got %v", rev1, err)
+	}
+	if _, err := d.PutAttachment(ctx, "foo", &driver.Attachment{Filename: "baz.txt"}, kivik.Rev(rev1)); kivik.HTTPStatus(err) != http.StatusConflict {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	rev3, err := d.DeleteAttachment(ctx, "foo", "foo.txt", kivik.Rev(rev2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetAttachment(ctx, "foo", "foo.txt", kivik.Params(nil)); kivik.HTTPStatus(err) != http.StatusNotFound {
+		t.Errorf("Expected foo.txt to be deleted, got %v", err)
+	}
+	if _, err := d.GetAttachment(ctx, "foo", "bar.txt", kivik.Rev(rev3)); err != nil {
+		t.Errorf("Expected bar.txt to remain: %s", err)
+	}
+	_, err = d.DeleteAttachment(ctx, "foo", "foo.txt", kivik.Rev(rev3))
+	testy.StatusError(t, "attachment foo.txt not found", http.StatusNotFound, err)
+}
+
+func TestPutAttachmentNewDoc(t *testing.T) {
+	c, _ := archiveTestClient(t)
+	d, err := c.DB("src", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := d.PutAttachment(ctx, "new", &driver.Attachment{
+		Filename:    "new.txt",
+		ContentType: "text/plain",
+		Content:     io.NopCloser(strings.NewReader("new")),
+	}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	att, err := d.GetAttachment(ctx, "new", "new.txt", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer att.Content.Close() // nolint: errcheck
+	if att.Size != 3 {
+		t.Errorf("Unexpected size: %d", att.Size)
+	}
+	_, err = d.PutAttachment(ctx, "new", &driver.Attachment{Filename: "new.txt"}, kivik.Params(nil))
+	testy.StatusError(t, "document update conflict", http.StatusConflict, err)
+}
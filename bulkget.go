@@ -0,0 +1,170 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+var _ driver.BulkGetter = &db{}
+
+// BulkGet fetches the requested document revisions. Each document is read
+// from disk only once, no matter how many of its revisions are requested.
+// Revision history is always included, as with revs=true. If atts_since is
+// specified for a reference, attachment content is included only for
+// attachments added since the named revisions; other attachments are returned
+// as stubs. The attachments option includes all attachment content.
+func (d *db) BulkGet(ctx context.Context, docs []driver.BulkGetReference, options driver.Options) (driver.Rows, error) {
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	attachments, _ := opts["attachments"].(bool)
+	rows := make([]*driver.Row, 0, len(docs))
+	// The references, and their rows, are grouped by document, so that each
+	// document is opened, and its rows marshaled, under a single lock.
+	groups := make(map[string]*bulkGetGroup)
+	var order []string
+	for _, ref := range docs {
+		row := &driver.Row{ID: ref.ID}
+		rows = append(rows, row)
+		if ref.ID == "" {
+			row.Error = statusError{status: http.StatusBadRequest, error: errors.New("document id missing")}
+			continue
+		}
+		group, ok := groups[ref.ID]
+		if !ok {
+			group = &bulkGetGroup{}
+			groups[ref.ID] = group
+			order = append(order, ref.ID)
+		}
+		group.refs = append(group.refs, ref)
+		group.rows = append(group.rows, row)
+	}
+	for _, docID := range order {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := d.bulkGetDoc(ctx, docID, groups[docID], attachments); err != nil {
+			return nil, err
+		}
+	}
+	return &bulkGetRows{rows: rows}, nil
+}
+
+// bulkGetGroup holds the references to a single document, and their rows.
+type bulkGetGroup struct {
+	refs []driver.BulkGetReference
+	rows []*driver.Row
+}
+
+// bulkGetDoc fills in the rows for the references to docID. The read lock is
+// held until the rows have been marshaled, as attachment content is only read
+// from disk then.
+func (d *db) bulkGetDoc(ctx context.Context, docID string, group *bulkGetGroup, attachments bool) error {
+	unlock, err := d.readLockDoc(ctx, docID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	doc, err := d.cdb.OpenDocRevs(docID)
+	if kivik.HTTPStatus(err) == http.StatusNotFound {
+		for _, row := range group.rows {
+			row.Error = err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, ref := range group.refs {
+		group.rows[i].Doc, group.rows[i].Error = bulkGetBody(doc, ref, attachments)
+	}
+	return nil
+}
+
+// bulkGetBody returns the marshaled revision of doc requested by ref.
+func bulkGetBody(doc *cdb.Document, ref driver.BulkGetReference, attachments bool) (io.Reader, error) {
+	rev, err := bulkGetRev(doc, ref.Rev)
+	if err != nil {
+		return nil, err
+	}
+	revOpts := map[string]interface{}{
+		"revs":          true,
+		"header:accept": "application/json",
+	}
+	if attachments || len(ref.AttsSince) > 0 {
+		revOpts["attachments"] = true
+	}
+	if len(ref.AttsSince) > 0 {
+		revOpts["atts_since"] = ref.AttsSince
+	}
+	body, err := json.Marshal(&cdb.Document{
+		ID:        doc.ID,
+		Revisions: cdb.Revisions{rev},
+		Options:   revOpts,
+	})
+	if err != nil {
+		return nil, statusError{status: http.StatusInternalServerError, error: err}
+	}
+	return bytes.NewReader(body), nil
+}
+
+// bulkGetRev returns the requested rev from doc, or the winning rev if revid
+// is empty.
+func bulkGetRev(doc *cdb.Document, revid string) (*cdb.Revision, error) {
+	if revid == "" {
+		if doc.Revisions.Deleted() {
+			return nil, statusError{status: http.StatusNotFound, error: errors.New("deleted")}
+		}
+		return doc.Revisions[0], nil
+	}
+	for _, rev := range doc.Revisions {
+		if rev.Rev.String() == revid {
+			return rev, nil
+		}
+	}
+	return nil, statusError{status: http.StatusNotFound, error: fmt.Errorf("missing rev %s", revid)}
+}
+
+type bulkGetRows struct {
+	rows []*driver.Row
+}
+
+var _ driver.Rows = &bulkGetRows{}
+
+func (r *bulkGetRows) Next(row *driver.Row) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	*row = *r.rows[0]
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func (r *bulkGetRows) Close() error {
+	r.rows = nil
+	return nil
+}
+
+func (r *bulkGetRows) Offset() int64     { return 0 }
+func (r *bulkGetRows) TotalRows() int64  { return 0 }
+func (r *bulkGetRows) UpdateSeq() string { return "" }
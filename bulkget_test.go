@@ -0,0 +1,180 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+func TestBulkGet(t *testing.T) {
+	type result struct {
+		ID     string
+		Rev    string
+		Status int
+		Atts   map[string]bool
+	}
+	type tt struct {
+		docs    []driver.BulkGetReference
+		options kivik.Option
+		status  int
+		err     string
+		want    []result
+	}
+	tests := testy.NewTable()
+	tests.Add("missing doc", tt{
+		docs: []driver.BulkGetReference{{ID: "notfound"}},
+		want: []result{{ID: "notfound", Status: http.StatusNotFound}},
+	})
+	tests.Add("missing id", tt{
+		docs: []driver.BulkGetReference{{Rev: "1-xxx"}},
+		want: []result{{Status: http.StatusBadRequest}},
+	})
+	tests.Add("winning rev", tt{
+		docs: []driver.BulkGetReference{{ID: "withattach"}},
+		want: []result{{ID: "withattach", Rev: "2-yyyyyyyyy", Atts: map[string]bool{"foo.txt": false}}},
+	})
+	tests.Add("multiple revs", tt{
+		docs: []driver.BulkGetReference{
+			{ID: "withattach", Rev: "1-xxxxxxxxxx"},
+			{ID: "withattach", Rev: "2-yyyyyyyyy"},
+			{ID: "withattach", Rev: "3-zzz"},
+			{ID: "yamltest", Rev: "2-xxx"},
+		},
+		want: []result{
+			{ID: "withattach", Rev: "1-xxxxxxxxxx", Atts: map[string]bool{"foo.txt": false}},
+			{ID: "withattach", Rev: "2-yyyyyyyyy", Atts: map[string]bool{"foo.txt": false}},
+			{ID: "withattach", Status: http.StatusNotFound},
+			{ID: "yamltest", Rev: "2-xxx"},
+		},
+	})
+	tests.Add("interleaved documents", tt{
+		docs: []driver.BulkGetReference{
+			{ID: "withattach", Rev: "1-xxxxxxxxxx"},
+			{ID: "yamltest", Rev: "2-xxx"},
+			{ID: "withattach", Rev: "2-yyyyyyyyy"},
+		},
+		want: []result{
+			{ID: "withattach", Rev: "1-xxxxxxxxxx", Atts: map[string]bool{"foo.txt": false}},
+			{ID: "yamltest", Rev: "2-xxx"},
+			{ID: "withattach", Rev: "2-yyyyyyyyy", Atts: map[string]bool{"foo.txt": false}},
+		},
+	})
+	tests.Add("attachments", tt{
+		docs:    []driver.BulkGetReference{{ID: "withattach"}},
+		options: kivik.Param("attachments", true),
+		want:    []result{{ID: "withattach", Rev: "2-yyyyyyyyy", Atts: map[string]bool{"foo.txt": true}}},
+	})
+	tests.Add("deleted", tt{
+		docs: []driver.BulkGetReference{{ID: "deleted"}},
+		want: []result{{ID: "deleted", Status: http.StatusNotFound}},
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		c := &client{root: "testdata", fs: filesystem.Default()}
+		db, err := c.newDB("db_foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := tt.options
+		if opts == nil {
+			opts = kivik.Params(nil)
+		}
+		rows, err := db.BulkGet(context.Background(), tt.docs, opts)
+		testy.StatusError(t, tt.err, tt.status, err)
+		got := []result{}
+		var row driver.Row
+		for {
+			if err := rows.Next(&row); err != nil {
+				if err == io.EOF {
+					break
+				}
+				t.Fatal(err)
+			}
+			r := result{ID: row.ID, Status: kivik.HTTPStatus(row.Error)}
+			if row.Doc != nil {
+				var doc struct {
+					Rev         string                     `json:"_rev"`
+					Revisions   *json.RawMessage           `json:"_revisions"`
+					Attachments map[string]json.RawMessage `json:"_attachments"`
+				}
+				if err := json.NewDecoder(row.Doc).Decode(&doc); err != nil {
+					t.Fatal(err)
+				}
+				if doc.Revisions == nil {
+					t.Errorf("No revision history for %s", row.ID)
+				}
+				r.Rev = doc.Rev
+				for filename, att := range doc.Attachments {
+					if r.Atts == nil {
+						r.Atts = map[string]bool{}
+					}
+					var a struct {
+						Data []byte `json:"data"`
+					}
+					_ = json.Unmarshal(att, &a)
+					r.Atts[filename] = len(a.Data) > 0
+				}
+			}
+			got = append(got, r)
+		}
+		if d := testy.DiffInterface(tt.want, got); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestBulkGetAttsSince(t *testing.T) {
+	c := &client{root: "testdata", fs: filesystem.Default()}
+	d, err := c.newDB("db_bulkget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := d.BulkGet(context.Background(), []driver.BulkGetReference{
+		{ID: "foo", Rev: "2-bbb", AttsSince: []string{"1-aaa"}},
+	}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var row driver.Row
+	if err := rows.Next(&row); err != nil {
+		t.Fatal(err)
+	}
+	if row.Error != nil {
+		t.Fatal(row.Error)
+	}
+	var doc struct {
+		Attachments map[string]struct {
+			Stub bool   `json:"stub"`
+			Data []byte `json:"data"`
+		} `json:"_attachments"`
+	}
+	if err := json.NewDecoder(row.Doc).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if att := doc.Attachments["old.txt"]; !att.Stub {
+		t.Errorf("Expected old.txt to be a stub")
+	}
+	if att := doc.Attachments["new.txt"]; string(att.Data) != "new" {
+		t.Errorf("Unexpected new.txt content: %q", att.Data)
+	}
+}
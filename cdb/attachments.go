@@ -44,6 +44,10 @@ type Attachment struct {
 	// path is the full path to the file on disk, or the empty string if the
 	// attachment is not (yet) on disk.
 	path string
+	// linkFrom is the path of an existing file with the attachment's content,
+	// which is hard-linked, rather than copied, when the attachment is
+	// persisted.
+	linkFrom string
 	// fs is the filesystem to use for disk access.
 	fs filesystem.Filesystem
 
@@ -94,6 +98,45 @@ func (a *Attachment) MarshalJSON() ([]byte, error) {
 	return json.Marshal(att)
 }
 
+// MarshalYAML implements the yaml.Marshaler interface.
+func (a *Attachment) MarshalYAML() (interface{}, error) {
+	var err error
+	switch {
+	case len(a.Content) != 0:
+		a.setMetadata()
+	case a.outputStub || a.Follows:
+		err = a.readMetadata()
+	default:
+		err = a.readContent()
+	}
+	if err != nil {
+		return nil, err
+	}
+	att := struct {
+		ContentType string `yaml:"content_type"`
+		RevPos      *int64 `yaml:"revpos,omitempty"`
+		Content     string `yaml:"content,omitempty"`
+		Size        int64  `yaml:"size"`
+		Digest      string `yaml:"digest"`
+		Stub        bool   `yaml:"stub,omitempty"`
+		Follows     bool   `yaml:"follows,omitempty"`
+	}{
+		ContentType: a.ContentType,
+		RevPos:      a.RevPos,
+		Size:        a.Size,
+		Digest:      a.Digest,
+	}
+	switch {
+	case a.outputStub:
+		att.Stub = true
+	case a.Follows:
+		att.Follows = true
+	case len(a.Content) > 0:
+		att.Content = string(a.Content)
+	}
+	return att, nil
+}
+
 func (a *Attachment) readContent() error {
 	f, err := a.fs.Open(a.path)
 	if err != nil {
@@ -116,16 +159,29 @@ func (a *Attachment) readMetadata() error {
 	if err != nil {
 		return err
 	}
-	a.Size, a.Digest = digest(f)
-	return nil
+	defer f.Close() // nolint: errcheck
+	a.Size, a.Digest, err = digest(f)
+	return err
 }
 
 func (a *Attachment) setMetadata() {
-	a.Size, a.Digest = digest(bytes.NewReader(a.Content))
+	a.Size, a.Digest, _ = digest(bytes.NewReader(a.Content))
 }
 
 func (a *Attachment) persist(path, attname string) error {
 	target := filepath.Join(path, attname)
+	if a.linkFrom != "" {
+		if err := a.fs.Link(a.linkFrom, target); err == nil {
+			a.linkFrom = ""
+			a.path = target
+			return nil
+		}
+		// Linking may fail, for instance across devices, so fall back to
+		// copying the content.
+		if err := a.readLinkSource(); err != nil {
+			return err
+		}
+	}
 	if err := atomicWriteFile(a.fs, target, bytes.NewReader(a.Content)); err != nil {
 		return err
 	}
@@ -134,6 +190,17 @@ func (a *Attachment) persist(path, attname string) error {
 	return nil
 }
 
+func (a *Attachment) readLinkSource() error {
+	f, err := a.fs.Open(a.linkFrom)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	a.Content, err = io.ReadAll(f)
+	a.linkFrom = ""
+	return err
+}
+
 type attsIter []*driver.Attachment
 
 var _ driver.Attachments = &attsIter{}
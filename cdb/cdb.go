@@ -40,3 +40,11 @@ func (h *RevHistory) AddRevision(rev RevID) *RevHistory {
 		IDs:   append([]string{rev.Sum}, h.IDs...),
 	}
 }
+
+// truncate drops all but the newest limit entries from the history.
+func (h *RevHistory) truncate(limit int) *RevHistory {
+	if len(h.IDs) > limit {
+		h.IDs = h.IDs[:limit]
+	}
+	return h
+}
@@ -0,0 +1,281 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// couchHash returns the hash CouchDB would generate for r, as a child of the
+// revision named by r.Rev, or as a new document if r.Rev is zero. oldrev is
+// the parent revision, if any, whose attachments r's stubs refer to.
+//
+// CouchDB's hash is the MD5 sum of the Erlang external term format encoding
+// of the list [Deleted, OldStart, OldRev, Body, Atts], where Atts is a list of
+// {Name, Type, MD5} tuples, in the reverse of their order in the document.
+// CouchDB hashes object keys in the order they were sent, and numbers as
+// integers or floats as they were written. Here, keys are hashed in sorted
+// order, and numbers with integral values as integers, which is how Go's JSON
+// encoder writes them, so revision IDs match those of CouchDB for documents
+// sent to it in that form.
+func (r *Revision) couchHash(oldrev *Revision) (string, error) {
+	atts, err := r.couchAttachments(oldrev)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(r.Data)
+	if err != nil {
+		return "", err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var data interface{}
+	if err := dec.Decode(&data); err != nil {
+		return "", err
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	var oldRev interface{} = 0
+	if !r.Rev.IsZero() {
+		oldRev = parseRevSum(r.Rev.Sum)
+	}
+	t := &termEncoder{}
+	t.WriteByte(etfVersion)
+	t.list([]interface{}{
+		r.Deleted != nil && *r.Deleted,
+		r.Rev.Seq,
+		oldRev,
+		data,
+		atts,
+	})
+	sum := md5.Sum(t.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// parseRevSum returns the revision hash sum as CouchDB stores it: as 16
+// bytes, if it is an MD5 sum in hex, or as it is otherwise.
+func parseRevSum(sum string) []byte {
+	if len(sum) == 32 {
+		if b, err := hex.DecodeString(sum); err == nil {
+			return b
+		}
+	}
+	return []byte(sum)
+}
+
+// attTerm is the {Name, Type, MD5} tuple by which CouchDB hashes an
+// attachment.
+type attTerm struct {
+	name, contentType string
+	md5               []byte
+}
+
+// couchAttachments returns r's attachments as CouchDB hashes them, in reverse
+// order of name.
+func (r *Revision) couchAttachments(oldrev *Revision) ([]interface{}, error) {
+	names := sortedAttachments(r.Attachments)
+	atts := make([]interface{}, 0, len(names))
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		att := r.Attachments[name]
+		var oldatt *Attachment
+		if oldrev != nil {
+			oldatt = oldrev.Attachments[name]
+		}
+		sum, err := att.md5(oldatt)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %s: %w", name, err)
+		}
+		atts = append(atts, attTerm{name: name, contentType: att.ContentType, md5: sum})
+	}
+	return atts, nil
+}
+
+// md5 returns the MD5 sum of the attachment's content. The content of a stub
+// is that of oldatt, the attachment it refers to.
+func (a *Attachment) md5(oldatt *Attachment) ([]byte, error) {
+	switch {
+	case a.Stub && oldatt != nil:
+		return oldatt.md5(nil)
+	case a.Content != nil:
+		sum := md5.Sum(a.Content)
+		return sum[:], nil
+	case a.linkFrom != "" || a.path != "":
+		path := a.linkFrom
+		if path == "" {
+			path = a.path
+		}
+		f, err := a.fs.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close() // nolint: errcheck
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	case strings.HasPrefix(a.Digest, "md5-"):
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(a.Digest, "md5-"))
+	}
+	// A stub without a parent is rejected by addRevision.
+	return nil, nil
+}
+
+// Tags of the Erlang external term format.
+const (
+	etfVersion      = 131
+	etfNewFloat     = 70
+	etfSmallInteger = 97
+	etfInteger      = 98
+	etfAtom         = 100
+	etfSmallTuple   = 104
+	etfNil          = 106
+	etfList         = 108
+	etfBinary       = 109
+	etfSmallBig     = 110
+)
+
+// termEncoder encodes values in the Erlang external term format, as
+// term_to_binary does with the {minor_version, 1} option, with JSON objects
+// represented as by CouchDB: a 1-tuple of a list of {Key, Value} tuples.
+type termEncoder struct {
+	bytes.Buffer
+}
+
+func (t *termEncoder) encode(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		t.atom("null")
+	case bool:
+		if v {
+			t.atom("true")
+		} else {
+			t.atom("false")
+		}
+	case string:
+		t.binary([]byte(v))
+	case []byte:
+		t.binary(v)
+	case int:
+		t.integer(big.NewInt(int64(v)))
+	case int64:
+		t.integer(big.NewInt(v))
+	case json.Number:
+		t.number(v)
+	case []interface{}:
+		t.list(v)
+	case map[string]interface{}:
+		t.object(v)
+	case attTerm:
+		t.WriteByte(etfSmallTuple)
+		t.WriteByte(3)
+		t.binary([]byte(v.name))
+		t.binary([]byte(v.contentType))
+		t.binary(v.md5)
+	default:
+		panic(fmt.Sprintf("unexpected type %T", v))
+	}
+}
+
+func (t *termEncoder) atom(name string) {
+	t.WriteByte(etfAtom)
+	_ = binary.Write(t, binary.BigEndian, uint16(len(name)))
+	t.WriteString(name)
+}
+
+func (t *termEncoder) binary(b []byte) {
+	t.WriteByte(etfBinary)
+	_ = binary.Write(t, binary.BigEndian, uint32(len(b)))
+	t.Write(b)
+}
+
+func (t *termEncoder) list(items []interface{}) {
+	if len(items) > 0 {
+		t.WriteByte(etfList)
+		_ = binary.Write(t, binary.BigEndian, uint32(len(items)))
+		for _, item := range items {
+			t.encode(item)
+		}
+	}
+	t.WriteByte(etfNil)
+}
+
+func (t *termEncoder) object(obj map[string]interface{}) {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	t.WriteByte(etfSmallTuple)
+	t.WriteByte(1)
+	if len(keys) > 0 {
+		t.WriteByte(etfList)
+		_ = binary.Write(t, binary.BigEndian, uint32(len(keys)))
+		for _, key := range keys {
+			t.WriteByte(etfSmallTuple)
+			t.WriteByte(2)
+			t.binary([]byte(key))
+			t.encode(obj[key])
+		}
+	}
+	t.WriteByte(etfNil)
+}
+
+// number encodes n as an integer if it is written as one, or as a float
+// otherwise.
+func (t *termEncoder) number(n json.Number) {
+	if i, ok := new(big.Int).SetString(n.String(), 10); ok {
+		t.integer(i)
+		return
+	}
+	f, _ := n.Float64()
+	t.WriteByte(etfNewFloat)
+	_ = binary.Write(t, binary.BigEndian, math.Float64bits(f))
+}
+
+func (t *termEncoder) integer(i *big.Int) {
+	switch {
+	case i.Sign() >= 0 && i.Cmp(big.NewInt(255)) <= 0:
+		t.WriteByte(etfSmallInteger)
+		t.WriteByte(byte(i.Int64()))
+	case i.IsInt64() && i.Int64() >= math.MinInt32 && i.Int64() <= math.MaxInt32:
+		t.WriteByte(etfInteger)
+		_ = binary.Write(t, binary.BigEndian, int32(i.Int64()))
+	default:
+		digits := new(big.Int).Abs(i).Bytes()
+		t.WriteByte(etfSmallBig)
+		t.WriteByte(byte(len(digits)))
+		if i.Sign() < 0 {
+			t.WriteByte(1)
+		} else {
+			t.WriteByte(0)
+		}
+		// Digits are stored least significant first.
+		for j := len(digits) - 1; j >= 0; j-- {
+			t.WriteByte(digits[j])
+		}
+	}
+}
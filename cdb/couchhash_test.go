@@ -0,0 +1,146 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-kivik/kivik/v4"
+	"gitlab.com/flimzy/testy"
+)
+
+func TestCouchHash(t *testing.T) {
+	type tt struct {
+		doc    interface{}
+		oldrev *Revision
+		want   string
+	}
+	tests := testy.NewTable()
+	// Revision IDs as generated by CouchDB
+	tests.Add("empty doc", tt{
+		doc:  map[string]interface{}{},
+		want: "967a00dff5e02add41819138abb3284d",
+	})
+	tests.Add("simple doc", tt{
+		doc:  map[string]interface{}{"foo": "bar"},
+		want: "4c6114c65e295552ab1019e2b046b10e",
+	})
+	tests.Add("deleted", tt{
+		doc: map[string]interface{}{
+			"_rev":     "1-967a00dff5e02add41819138abb3284d",
+			"_deleted": true,
+		},
+		want: "eec205a9d413992850a6e32678485900",
+	})
+	tests.Add("update", tt{
+		doc: map[string]interface{}{
+			"_rev": "1-967a00dff5e02add41819138abb3284d",
+			"foo":  "bar",
+		},
+		want: "13839535feb250d3d8290998b8af17c3",
+	})
+	tests.Add("numbers, nesting and attachments", tt{
+		doc: map[string]interface{}{
+			"foo":  "bar",
+			"n":    1,
+			"f":    1.5,
+			"big":  json.Number("100000000000000000000"),
+			"neg":  -300,
+			"list": []interface{}{true, nil, "x"},
+			"obj":  map[string]interface{}{},
+			"_attachments": map[string]interface{}{
+				"foo.txt": map[string]interface{}{
+					"content_type": "text/plain",
+					"data":         []byte("Testing\n"),
+				},
+				"bar.txt": map[string]interface{}{
+					"content_type": "text/plain",
+					"stub":         true,
+				},
+			},
+		},
+		oldrev: &Revision{RevMeta: RevMeta{Attachments: map[string]*Attachment{
+			"bar.txt": {ContentType: "text/plain", Digest: "md5-N7UdGUp1E+RbVvZSTy1R8g=="},
+		}}},
+		want: "3e24f838c25639e0aeed898a49eefa93",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		rev, err := New("/").NewRevision(tt.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := rev.couchHash(tt.oldrev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Unexpected hash: %s", got)
+		}
+	})
+}
+
+func TestTermEncoderNumbers(t *testing.T) {
+	type tt struct {
+		n    interface{}
+		want string
+	}
+	tests := testy.NewTable()
+	tests.Add("small", tt{n: 255, want: "61ff"})
+	tests.Add("negative", tt{n: -1, want: "62ffffffff"})
+	tests.Add("int32", tt{n: 256, want: "6200000100"})
+	tests.Add("int64", tt{n: int64(1) << 40, want: "6e0600000000000001"})
+	tests.Add("negative big", tt{n: json.Number("-4294967296"), want: "6e05010000000001"})
+	tests.Add("float", tt{n: json.Number("1.5"), want: "463ff8000000000000"})
+	tests.Add("integral", tt{n: json.Number("3"), want: "6103"})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		e := &termEncoder{}
+		e.encode(tt.n)
+		if got := hex.EncodeToString(e.Bytes()); got != tt.want {
+			t.Errorf("Unexpected encoding: %s", got)
+		}
+	})
+}
+
+func TestCouchDBHashing(t *testing.T) {
+	dir := t.TempDir()
+	fs := New(dir)
+	if err := fs.SetHashing(HashCouchDB); err != nil {
+		t.Fatal(err)
+	}
+	if rev := putRev(t, fs, "foo", "bar"); rev != "1-5e0998dde0f1a2c1306d0b58fed262ae" {
+		t.Errorf("Unexpected rev: %s", rev)
+	}
+	doc, err := fs.OpenDocID("foo", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := fs.NewRevision(map[string]interface{}{
+		"_rev":     doc.Revisions[0].Rev.String(),
+		"_deleted": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revid, err := doc.AddRevision(context.TODO(), rev, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revid != "2-862efbd9e72c99eca2757ebe2647079e" {
+		t.Errorf("Unexpected rev: %s", revid)
+	}
+}
@@ -10,7 +10,8 @@
 // License for the specific language governing permissions and limitations under
 // the License.
 
-// Package decode assists in document decoding.
+// Package decode assists in document decoding and encoding. Documents may be
+// stored in any format for which a Codec is registered.
 package decode
 
 import (
@@ -20,33 +21,74 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/go-kivik/fsdb/v4/filesystem"
 )
 
-type decoder interface {
-	Decode(io.Reader, interface{}) error
+// Codec decodes and encodes documents in a particular file format.
+//
+// Values are passed to a codec as they would be to the encoding/json
+// package, and may implement json.Marshaler and json.Unmarshaler. A codec
+// built on a library which doesn't honor these interfaces should be wrapped
+// with ViaJSON.
+type Codec interface {
+	// Decode decodes the document read from r into i, which is a pointer.
+	Decode(r io.Reader, i interface{}) error
+	// Encode encodes i as a document, written to w.
+	Encode(w io.Writer, i interface{}) error
 }
 
-var decoders = map[string]decoder{
-	"json": &jsonDecoder{},
-	"yaml": &yamlDecoder{},
-	"yml":  &yamlDecoder{},
-}
+var (
+	mu     sync.RWMutex
+	codecs = map[string]Codec{
+		"json":  &jsonCodec{},
+		"json5": ViaJSON(&json5Codec{}),
+		"toml":  ViaJSON(&tomlCodec{}),
+		"yaml":  &yamlCodec{},
+		"yml":   &yamlCodec{},
+	}
+	extensions = sortedExtensions()
+)
 
-var extensions = func() []string {
-	exts := make([]string, 0, len(decoders))
-	for ext := range decoders {
+func sortedExtensions() []string {
+	exts := make([]string, 0, len(codecs))
+	for ext := range codecs {
 		exts = append(exts, ext)
 	}
 	sort.Strings(exts)
 	return exts
-}()
+}
+
+// Register registers codec for document files with the extension ext, such
+// as "toml", replacing any codec already registered for ext. Files with the
+// extension are then recognized as documents. Register panics if ext is
+// empty or contains a dot or path separator, or if codec is nil.
+func Register(ext string, codec Codec) {
+	if ext == "" || strings.ContainsAny(ext, "./\\") {
+		panic(fmt.Sprintf("decode: invalid extension %q", ext))
+	}
+	if codec == nil {
+		panic("decode: Register codec is nil")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	codecs[ext] = codec
+	extensions = sortedExtensions()
+}
+
+func lookup(ext string) (Codec, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	codec, ok := codecs[strings.TrimPrefix(ext, ".")]
+	return codec, ok
+}
 
-// OpenAny attempts to open base + any supported extension. It returns the open
-// file, the matched extension, or an error.
+// OpenAny attempts to open base + any supported extension, in the order
+// returned by Extensions. It returns the open file, the matched extension, or
+// an error.
 func OpenAny(fs filesystem.Filesystem, base string) (f filesystem.File, ext string, err error) {
-	for ext = range decoders {
+	for _, ext = range Extensions() {
 		f, err = fs.Open(base + "." + ext)
 		if err == nil || !os.IsNotExist(err) {
 			return
@@ -55,14 +97,28 @@ func OpenAny(fs filesystem.Filesystem, base string) (f filesystem.File, ext stri
 	return
 }
 
-// Decode decodes r according to ext's registered decoder, into i.
+// Decode decodes r according to ext's registered codec, into i.
 func Decode(r io.Reader, ext string, i interface{}) error {
-	ext = strings.TrimPrefix(ext, ".")
-	dec, ok := decoders[ext]
+	codec, ok := lookup(ext)
+	if !ok {
+		return fmt.Errorf("No decoder for %s", strings.TrimPrefix(ext, "."))
+	}
+	return codec.Decode(r, i)
+}
+
+// Encode encodes i to w, according to ext's registered codec.
+func Encode(w io.Writer, ext string, i interface{}) error {
+	codec, ok := lookup(ext)
 	if !ok {
-		return fmt.Errorf("No decoder for %s", ext)
+		return fmt.Errorf("No encoder for %s", strings.TrimPrefix(ext, "."))
 	}
-	return dec.Decode(r, i)
+	return codec.Encode(w, i)
+}
+
+// CanEncode returns true if ext has a registered codec.
+func CanEncode(ext string) bool {
+	_, ok := lookup(ext)
+	return ok
 }
 
 // ExplodeFilename returns the base name, extension, and a boolean indicating
@@ -71,11 +127,23 @@ func ExplodeFilename(filename string) (basename, ext string, ok bool) {
 	dotExt := filepath.Ext(filename)
 	basename = strings.TrimSuffix(filename, dotExt)
 	ext = strings.TrimPrefix(dotExt, ".")
-	_, ok = decoders[ext]
+	_, ok = lookup(ext)
 	return basename, ext, ok
 }
 
-// Extensions returns a list of supported extensions.
+// Extensions returns a sorted list of supported extensions. The caller may
+// modify the returned slice.
 func Extensions() []string {
-	return extensions
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]string(nil), extensions...)
 }
+
+// statusError is an error with an associated HTTP status code.
+type statusError struct {
+	error
+	status int
+}
+
+func (e statusError) Unwrap() error   { return e.error }
+func (e statusError) HTTPStatus() int { return e.status }
@@ -0,0 +1,130 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package decode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+// kvCodec is a minimal codec for flat documents of key=value lines, which
+// knows nothing of json.Marshaler or json.Unmarshaler.
+type kvCodec struct{}
+
+func (kvCodec) Decode(r io.Reader, i interface{}) error {
+	doc := map[string]interface{}{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid line: %s", s.Text())
+		}
+		if n, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			doc[parts[0]] = n
+		} else {
+			doc[parts[0]] = parts[1]
+		}
+	}
+	*(i.(*map[string]interface{})) = doc
+	return s.Err()
+}
+
+func (kvCodec) Encode(w io.Writer, i interface{}) error {
+	doc := i.(map[string]interface{})
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(w, "%s=%v\n", k, doc[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type kvDoc struct {
+	Rev   string `json:"_rev"`
+	Count int    `json:"count"`
+}
+
+func TestRegister(t *testing.T) {
+	Register("kv", ViaJSON(kvCodec{}))
+
+	if !CanEncode("kv") {
+		t.Error("Expected kv to be registered")
+	}
+	if _, ext, ok := ExplodeFilename("foo.kv"); !ok || ext != "kv" {
+		t.Errorf("Unexpected result for foo.kv: %s, %t", ext, ok)
+	}
+	want := []string{"json", "json5", "kv", "toml", "yaml", "yml"}
+	if d := testy.DiffInterface(want, Extensions()); d != nil {
+		t.Error(d)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, "kv", kvDoc{Rev: "1-xxx", Count: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "_rev=1-xxx\ncount=3\n"; got != want {
+		t.Errorf("Unexpected encoding: %q", got)
+	}
+	var doc kvDoc
+	if err := Decode(buf, ".kv", &doc); err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffInterface(kvDoc{Rev: "1-xxx", Count: 3}, doc); d != nil {
+		t.Error(d)
+	}
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	tests := testy.NewTable()
+	tests.Add("empty extension", "")
+	tests.Add("leading dot", ".kv")
+	tests.Add("path separator", "a/b")
+
+	tests.Run(t, func(t *testing.T, ext string) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a panic")
+			}
+		}()
+		Register(ext, kvCodec{})
+	})
+}
+
+func TestExtensionsCopy(t *testing.T) {
+	exts := Extensions()
+	exts[0] = "xml"
+	if CanEncode("xml") {
+		t.Error("Modifying the returned extensions changed the registry")
+	}
+	if got := Extensions()[0]; got == "xml" {
+		t.Errorf("Unexpected first extension: %s", got)
+	}
+}
+
+func TestDecodeUnknown(t *testing.T) {
+	err := Decode(strings.NewReader(""), "xml", nil)
+	testy.Error(t, "No decoder for xml", err)
+}
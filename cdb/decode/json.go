@@ -17,8 +17,12 @@ import (
 	"io"
 )
 
-type jsonDecoder struct{}
+type jsonCodec struct{}
 
-func (d *jsonDecoder) Decode(r io.Reader, i interface{}) error {
+func (c *jsonCodec) Decode(r io.Reader, i interface{}) error {
 	return json.NewDecoder(r).Decode(i)
 }
+
+func (c *jsonCodec) Encode(w io.Writer, i interface{}) error {
+	return json.NewEncoder(w).Encode(i)
+}
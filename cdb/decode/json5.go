@@ -0,0 +1,36 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package decode
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/titanous/json5"
+)
+
+// json5Codec reads JSON5 documents, which may contain comments, trailing
+// commas, unquoted keys and the like. As JSON is valid JSON5, documents are
+// written as indented JSON. It is registered wrapped with ViaJSON, as json5
+// doesn't honor json.Unmarshaler.
+type json5Codec struct{}
+
+func (c *json5Codec) Decode(r io.Reader, i interface{}) error {
+	return json5.NewDecoder(r).Decode(i)
+}
+
+func (c *json5Codec) Encode(w io.Writer, i interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(i)
+}
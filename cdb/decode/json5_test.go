@@ -0,0 +1,63 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package decode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+func TestJSON5(t *testing.T) {
+	input := `{
+  // Comments, unquoted keys and trailing commas are all allowed.
+  _id: 'foo',
+  _rev: "1-xxx",
+  value: 0x10,
+  tags: ['a', 'b',],
+}
+`
+	var doc map[string]interface{}
+	if err := Decode(strings.NewReader(input), "json5", &doc); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"_id":   "foo",
+		"_rev":  "1-xxx",
+		"value": float64(16),
+		"tags":  []interface{}{"a", "b"},
+	}
+	if d := testy.DiffInterface(want, doc); d != nil {
+		t.Error(d)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, "json5", doc); err != nil {
+		t.Fatal(err)
+	}
+	wantText := `{
+  "_id": "foo",
+  "_rev": "1-xxx",
+  "tags": [
+    "a",
+    "b"
+  ],
+  "value": 16
+}
+`
+	if d := testy.DiffText(wantText, buf.String()); d != nil {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,103 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package decode
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// tomlCodec reads and writes TOML documents. It is registered wrapped with
+// ViaJSON, so only ever sees generic values.
+type tomlCodec struct{}
+
+func (c *tomlCodec) Decode(r io.Reader, i interface{}) error {
+	if _, err := toml.NewDecoder(r).Decode(i); err != nil {
+		return err
+	}
+	if doc, ok := i.(*map[string]interface{}); ok {
+		convertTimes(*doc)
+	}
+	return nil
+}
+
+// Layouts of TOML's local date and time types, which BurntSushi/toml decodes
+// as a time.Time in a zone with the given name.
+var localLayouts = map[string]string{
+	"datetime-local": "2006-01-02T15:04:05.999999999",
+	"date-local":     "2006-01-02",
+	"time-local":     "15:04:05.999999999",
+}
+
+// convertTimes replaces each TOML datetime in v with its string form, in
+// RFC 3339 format, or for local dates and times, the corresponding TOML
+// format, as JSON has no datetime type.
+func convertTimes(v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Time:
+		if layout, ok := localLayouts[t.Location().String()]; ok {
+			return t.Format(layout)
+		}
+		return t.Format(time.RFC3339Nano)
+	case map[string]interface{}:
+		for k, v := range t {
+			t[k] = convertTimes(v)
+		}
+	case []map[string]interface{}:
+		for _, v := range t {
+			convertTimes(v)
+		}
+	case []interface{}:
+		for i, v := range t {
+			t[i] = convertTimes(v)
+		}
+	}
+	return v
+}
+
+func (c *tomlCodec) Encode(w io.Writer, i interface{}) error {
+	doc, ok := i.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("toml: cannot encode %T", i)
+	}
+	if err := checkNulls(doc, ""); err != nil {
+		return err
+	}
+	return toml.NewEncoder(w).Encode(doc)
+}
+
+// checkNulls returns a 400 Bad Request error if v contains a null value,
+// which TOML cannot represent.
+func checkNulls(v interface{}, path string) error {
+	switch t := v.(type) {
+	case nil:
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("toml: cannot encode null value of %s", path)}
+	case map[string]interface{}:
+		for k, v := range t {
+			if err := checkNulls(v, path+"."+k); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, v := range t {
+			if err := checkNulls(v, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
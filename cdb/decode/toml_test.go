@@ -0,0 +1,146 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package decode
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+func TestTOMLDecode(t *testing.T) {
+	type tt struct {
+		input string
+		want  map[string]interface{}
+		err   string
+	}
+	tests := testy.NewTable()
+	tests.Add("reserved keys", tt{
+		input: `_rev = "2-yyy"
+value = "foo"
+
+[_attachments."foo.txt"]
+content_type = "text/plain"
+stub = true
+
+[_revisions]
+start = 2
+ids = ["yyy", "xxx"]
+`,
+		want: map[string]interface{}{
+			"_rev":  "2-yyy",
+			"value": "foo",
+			"_attachments": map[string]interface{}{
+				"foo.txt": map[string]interface{}{
+					"content_type": "text/plain",
+					"stub":         true,
+				},
+			},
+			"_revisions": map[string]interface{}{
+				"start": float64(2),
+				"ids":   []interface{}{"yyy", "xxx"},
+			},
+		},
+	})
+	tests.Add("datetimes", tt{
+		input: `offset = 1979-05-27T07:32:00.5-07:00
+utc = 1979-05-27T07:32:00Z
+local = 1979-05-27T07:32:00
+date = 1979-05-27
+time = 07:32:00.999
+nested = [{ when = 1979-05-27 }]
+`,
+		want: map[string]interface{}{
+			"offset": "1979-05-27T07:32:00.5-07:00",
+			"utc":    "1979-05-27T07:32:00Z",
+			"local":  "1979-05-27T07:32:00",
+			"date":   "1979-05-27",
+			"time":   "07:32:00.999",
+			"nested": []interface{}{
+				map[string]interface{}{"when": "1979-05-27"},
+			},
+		},
+	})
+	tests.Add("invalid", tt{
+		input: "value = ",
+		err:   `toml: line 0 (last key "value"): unexpected EOF; expected value`,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		var got map[string]interface{}
+		err := Decode(strings.NewReader(tt.input), "toml", &got)
+		testy.Error(t, tt.err, err)
+		if d := testy.DiffInterface(tt.want, got); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestTOMLEncode(t *testing.T) {
+	type tt struct {
+		doc    interface{}
+		want   string
+		status int
+		err    string
+	}
+	tests := testy.NewTable()
+	tests.Add("reserved keys", tt{
+		doc: map[string]interface{}{
+			"_rev":  "2-yyy",
+			"value": "foo",
+			"count": 3,
+			"_attachments": map[string]interface{}{
+				"foo.txt": map[string]interface{}{
+					"content_type": "text/plain",
+					"stub":         true,
+				},
+			},
+		},
+		want: `_rev = "2-yyy"
+count = 3
+value = "foo"
+
+[_attachments]
+  [_attachments."foo.txt"]
+    content_type = "text/plain"
+    stub = true
+`,
+	})
+	tests.Add("null", tt{
+		doc: map[string]interface{}{
+			"value": map[string]interface{}{"foo": nil},
+		},
+		status: http.StatusBadRequest,
+		err:    "toml: cannot encode null value of .value.foo",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		buf := &bytes.Buffer{}
+		err := Encode(buf, "toml", tt.doc)
+		testy.StatusError(t, tt.err, tt.status, err)
+		if d := testy.DiffText(tt.want, buf.String()); d != nil {
+			t.Error(d)
+		}
+		// Read it back
+		var got map[string]interface{}
+		if err := Decode(buf, "toml", &got); err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffAsJSON(tt.doc, got); d != nil {
+			t.Error(d)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package decode
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/icza/dyno"
+)
+
+// ViaJSON wraps codec, so that documents pass through encoding/json on their
+// way to and from it. The wrapped codec only ever decodes into, and encodes
+// from, a map[string]interface{}, holding strings, bools, int64s, float64s,
+// nils, and slices and maps of these. Nested maps may be decoded as
+// map[interface{}]interface{}. This suits codecs built on libraries which
+// don't honor json.Marshaler and json.Unmarshaler.
+func ViaJSON(codec Codec) Codec {
+	return &viaJSON{codec: codec}
+}
+
+type viaJSON struct {
+	codec Codec
+}
+
+func (c *viaJSON) Decode(r io.Reader, i interface{}) error {
+	var doc map[string]interface{}
+	if err := c.codec.Decode(r, &doc); err != nil {
+		return err
+	}
+	body, err := json.Marshal(dyno.ConvertMapI2MapS(doc))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, i)
+}
+
+func (c *viaJSON) Encode(w io.Writer, i interface{}) error {
+	body, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	return c.codec.Encode(w, normalizeNumbers(doc))
+}
+
+// normalizeNumbers replaces each json.Number in v with an int64, if it is an
+// integer, or a float64 otherwise.
+func normalizeNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, v := range t {
+			t[k] = normalizeNumbers(v)
+		}
+	case []interface{}:
+		for i, v := range t {
+			t[i] = normalizeNumbers(v)
+		}
+	}
+	return v
+}
@@ -18,8 +18,16 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
-type yamlDecoder struct{}
+type yamlCodec struct{}
 
-func (d yamlDecoder) Decode(r io.Reader, i interface{}) error {
+func (c yamlCodec) Decode(r io.Reader, i interface{}) error {
 	return yaml.NewDecoder(r).Decode(i)
 }
+
+func (c yamlCodec) Encode(w io.Writer, i interface{}) error {
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(i); err != nil {
+		return err
+	}
+	return enc.Close()
+}
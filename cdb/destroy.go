@@ -0,0 +1,76 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// trashTimeFormat is the format of the timestamp appended to the name of a
+// database moved to the trash.
+const trashTimeFormat = "20060102T150405.000000000Z"
+
+// Destroy removes the database. Unless force is true, Destroy fails, listing
+// them, if the root contains anything the driver doesn't recognize (see
+// Unrecognized), and otherwise removes only the entries it recognizes,
+// followed by the root itself, which fails if anything new has appeared.
+func (fs *FS) Destroy(force bool) error {
+	entries, err := fs.checkRecognized(force)
+	if err != nil {
+		return err
+	}
+	for _, info := range entries {
+		if err := fs.fs.RemoveAll(filepath.Join(fs.root, info.Name())); err != nil {
+			return kerr(err)
+		}
+	}
+	return kerr(fs.fs.Remove(fs.root))
+}
+
+// Trash moves the database into the directory dir, which is created if
+// necessary, rather than removing it, so that it can be restored by moving it
+// back. Within dir, the database is named for its directory, followed by a
+// dot and the current UTC time. Unless force is true, Trash fails as Destroy
+// does if the root contains anything the driver doesn't recognize. The path
+// to which the database was moved is returned.
+func (fs *FS) Trash(dir string, force bool) (string, error) {
+	if _, err := fs.checkRecognized(force); err != nil {
+		return "", err
+	}
+	if err := fs.fs.MkdirAll(dir, tempPerms); err != nil {
+		return "", kerr(err)
+	}
+	dest := filepath.Join(dir, filepath.Base(fs.root)+"."+time.Now().UTC().Format(trashTimeFormat))
+	if err := fs.fs.Rename(fs.root, dest); err != nil {
+		return "", kerr(err)
+	}
+	return dest, nil
+}
+
+// checkRecognized returns the entries of the root, or, unless force is true,
+// an error listing those the driver doesn't recognize.
+func (fs *FS) checkRecognized(force bool) ([]os.FileInfo, error) {
+	entries, unknown, err := fs.scanRoot()
+	if err != nil {
+		return nil, err
+	}
+	if len(unknown) > 0 && !force {
+		return nil, statusError{status: http.StatusPreconditionFailed, error: fmt.Errorf("%s contains unrecognized files, and was left unchanged: %s", fs.root, strings.Join(unknown, ", "))}
+	}
+	return entries, nil
+}
@@ -0,0 +1,178 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/go-kivik/kivik/v4"
+	"gitlab.com/flimzy/testy"
+)
+
+// database is the content of a database with one document, with an
+// attachment and an old revision, and its settings.
+var database = map[string]string{
+	"foo.json":         `{"_rev":"2-b"}`,
+	"foo/att.txt":      "att",
+	".foo/1-a.json":    `{"_rev":"1-a"}`,
+	".foo/1-a/att.txt": "att",
+	"_security.json":   `{}`,
+	MetaFileName:       `{}`,
+	LockDirName + "/":  "",
+}
+
+func TestDestroy(t *testing.T) {
+	type tt struct {
+		files  map[string]string
+		force  bool
+		want   []string
+		status int
+		err    string
+	}
+	tests := testy.NewTable()
+	tests.Add("recognized", tt{
+		files: database,
+	})
+	tests.Add("unrecognized", tt{
+		files: map[string]string{
+			"foo.json":  `{"_rev":"1-a"}`,
+			"README.md": "read me",
+			"photos/a":  "jpeg",
+		},
+		status: http.StatusPreconditionFailed,
+		err:    `db contains unrecognized files, and was left unchanged: README.md, photos$`,
+	})
+	tests.Add("force", tt{
+		files: map[string]string{
+			"foo.json":  `{"_rev":"1-a"}`,
+			"README.md": "read me",
+			"photos/a":  "jpeg",
+		},
+		force: true,
+	})
+	tests.Add("nested unrecognized", tt{
+		files: map[string]string{
+			"foo.json":          `{"_rev":"2-b"}`,
+			"foo/att.txt":       "att",
+			"foo/photos/a":      "jpeg",
+			".foo/1-a.json":     `{"_rev":"1-a"}`,
+			".foo/1-a/att.txt":  "att",
+			".foo/1-a/photos/a": "jpeg",
+			".foo/notes.txt":    "notes",
+			".bar/1-a.json":     `{"_rev":"1-a"}`,
+			".bar/.git/HEAD":    "ref",
+		},
+		status: http.StatusPreconditionFailed,
+		err:    `db contains unrecognized files, and was left unchanged: \.bar/\.git, \.foo/1-a/photos, \.foo/notes\.txt, foo/photos$`,
+	})
+	tests.Add("nested unrecognized, force", tt{
+		files: map[string]string{
+			"foo.json":       `{"_rev":"2-b"}`,
+			"foo/photos/a":   "jpeg",
+			".foo/1-a.json":  `{"_rev":"1-a"}`,
+			".foo/notes.txt": "notes",
+		},
+		force: true,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		dir := t.TempDir()
+		writeFiles(t, filepath.Join(dir, "db"), tt.files)
+		err := New(filepath.Join(dir, "db")).Destroy(tt.force)
+		testy.StatusErrorRE(t, tt.err, tt.status, err)
+		if d := testy.DiffInterface(tt.want, readFiles(t, dir)); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestDestroyUnrecognizedUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"foo.json":  `{"_rev":"1-a"}`,
+		"README.md": "read me",
+	}
+	writeFiles(t, dir, files)
+	if err := New(dir).Destroy(false); err == nil {
+		t.Fatal("expected an error")
+	}
+	want := []string{"README.md=read me", `foo.json={"_rev":"1-a"}`}
+	if d := testy.DiffInterface(want, readFiles(t, dir)); d != nil {
+		t.Error(d)
+	}
+}
+
+func TestDestroySymlink(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"db/foo.json":    `{"_rev":"1-a"}`,
+		"other/keep.txt": "keep",
+	})
+	if err := os.Symlink(filepath.Join(dir, "other"), filepath.Join(dir, "db", "foo")); err != nil {
+		t.Skip(err)
+	}
+	fs := New(filepath.Join(dir, "db"))
+	if err := fs.Destroy(false); kivik.HTTPStatus(err) != http.StatusPreconditionFailed {
+		t.Fatalf("Unexpected error for a symbolic link: %v", err)
+	}
+	// Forced, the link is removed, but not its target.
+	if err := fs.Destroy(true); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"other/", "other/keep.txt=keep"}
+	if d := testy.DiffInterface(want, readFiles(t, dir)); d != nil {
+		t.Error(d)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, filepath.Join(dir, "db"), database)
+	fs := New(filepath.Join(dir, "db"))
+	dest, err := fs.Trash(filepath.Join(dir, "trash"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := filepath.Rel(filepath.Join(dir, "trash"), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^db\.\d{8}T\d{6}\.\d{9}Z$`).MatchString(name) {
+		t.Errorf("Unexpected trash name: %s", name)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "db")); !os.IsNotExist(err) {
+		t.Errorf("Database not moved: %v", err)
+	}
+	// Restore the database by moving it back.
+	if err := os.Rename(dest, filepath.Join(dir, "db")); err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := fs.Unrecognized()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != 0 {
+		t.Errorf("Unexpected unrecognized entries: %v", unknown)
+	}
+}
+
+func TestTrashUnrecognized(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, filepath.Join(dir, "db"), map[string]string{"README.md": "read me"})
+	_, err := New(filepath.Join(dir, "db")).Trash(filepath.Join(dir, "trash"), false)
+	testy.StatusErrorRE(t, "contains unrecognized files", http.StatusPreconditionFailed, err)
+}
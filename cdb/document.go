@@ -17,12 +17,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 
+	"github.com/go-kivik/fsdb/v4/cdb/decode"
 	"github.com/go-kivik/fsdb/v4/filesystem"
 	"github.com/go-kivik/kivik/v4/driver"
 )
@@ -65,12 +67,17 @@ func (d *Document) MarshalJSON() ([]byte, error) {
 	return joinJSON(docJSON, revJSON), nil
 }
 
-// revs populates the Rev
+// revs populates the RevHistory field, if appropriate according to options.
+// Without the rev option, the revision includes its own history, which must
+// not be repeated.
 func (d *Document) revs() {
 	d.RevHistory = nil
 	if ok, _ := d.Options["revs"].(bool); !ok {
 		return
 	}
+	if _, ok := d.Options["rev"]; !ok {
+		return
+	}
 	if len(d.Revisions) < 1 {
 		return
 	}
@@ -141,18 +148,15 @@ func copyAttachments(fs filesystem.Filesystem, leaf, old *Revision) error {
 		}
 		if strings.HasPrefix(att.path, basepath) {
 			name := filepath.Base(att.path)
-			if err := os.MkdirAll(leafpath, tempPerms); err != nil {
+			if err := fs.MkdirAll(leafpath, tempPerms); err != nil {
 				return err
 			}
 			if err := fs.Link(att.path, filepath.Join(leafpath, name)); err != nil {
-				lerr := new(os.LinkError)
-				if errors.As(err, &lerr) {
-					if strings.HasSuffix(lerr.Error(), ": file exists") {
-						if err := fs.Remove(att.path); err != nil {
-							return err
-						}
-						continue
+				if os.IsExist(err) {
+					if err := fs.Remove(att.path); err != nil {
+						return err
 					}
+					continue
 				}
 				return err
 			}
@@ -216,7 +220,7 @@ func (d *Document) addRevision(ctx context.Context, rev *Revision, options drive
 		}
 	}
 
-	hash, err := rev.hash()
+	hash, err := d.cdb.revHash(rev, oldrev)
 	if err != nil {
 		return "", err
 	}
@@ -225,7 +229,7 @@ func (d *Document) addRevision(ctx context.Context, rev *Revision, options drive
 		Sum: hash,
 	}
 	if oldrev != nil {
-		rev.RevHistory = oldrev.RevHistory.AddRevision(rev.Rev)
+		rev.RevHistory = oldrev.RevHistory.AddRevision(rev.Rev).truncate(d.cdb.RevsLimit())
 	}
 
 	revpath := filepath.Join(d.cdb.root, "."+EscapeID(d.ID), rev.Rev.String())
@@ -265,6 +269,9 @@ func (d *Document) addRevision(ctx context.Context, rev *Revision, options drive
 			// Can't upload stubs if there's no previous revision
 			return "", statusError{status: http.StatusInternalServerError, error: fmt.Errorf("attachment %s: %w", filename, err)}
 		}
+		if oldatt == nil {
+			return "", statusError{status: http.StatusPreconditionFailed, error: fmt.Errorf("invalid attachment stub for %s", filename)}
+		}
 		if att.Digest != "" && att.Digest != oldatt.Digest {
 			return "", statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid attachment data for %s", filename)}
 		}
@@ -293,12 +300,21 @@ Persist strategy:
   - If winning rev does not exist in {db}/{docid}:
   - Move old winning rev to {db}/.{docid}/{rev}
   - Move new winning rev to {db}/{docid}
+
+The moves are recorded in a journal before they begin, so that an interrupted
+update can be completed, or undone, by Recover.
 */
 func (d *Document) persist(ctx context.Context) error {
 	if d == nil || len(d.Revisions) == 0 {
 		return statusError{status: http.StatusBadRequest, error: errors.New("document has no revisions")}
 	}
 	docID := EscapeID(d.ID)
+	ext := d.format()
+
+	// Make sure the winner is in the first position
+	sort.Sort(d.Revisions)
+
+	winningRev := d.Revisions[0]
 	for _, rev := range d.Revisions {
 		if rev.path != "" {
 			continue
@@ -306,87 +322,130 @@ func (d *Document) persist(ctx context.Context) error {
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if err := rev.persist(ctx, filepath.Join(d.cdb.root, "."+docID, rev.Rev.String())); err != nil {
+		rev := rev
+		encode := func(w io.Writer) error {
+			return d.cdb.encodeRevision(w, ext, rev, rev == winningRev)
+		}
+		if err := rev.persist(ctx, filepath.Join(d.cdb.root, "."+docID, rev.Rev.String()), ext, encode); err != nil {
 			return err
 		}
 	}
 
-	// Make sure the winner is in the first position
-	sort.Sort(d.Revisions)
-
-	winningRev := d.Revisions[0]
 	winningPath := filepath.Join(d.cdb.root, docID)
 	if winningPath+filepath.Ext(winningRev.path) == winningRev.path {
 		// Winner already in place, our job is done here
 		return nil
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Plan the moves in a journal, so that an interruption can be recovered
+	// from, and update the paths only once they're complete.
+	j := d.cdb.newJournal(d.ID)
+	var moved []func()
+	move := func(path *string, newpath string) error {
+		if err := j.rename(*path, newpath); err != nil {
+			return err
+		}
+		moved = append(moved, func() { *path = newpath })
+		return nil
+	}
+
 	// See if some other rev is currently the winning rev, and move it if necessary
 	for _, rev := range d.Revisions[1:] {
 		if winningPath+filepath.Ext(rev.path) == rev.path {
-			if err := ctx.Err(); err != nil {
+			// We need to move this rev, and its attachments with it
+			revpath := filepath.Join(d.cdb.root, "."+docID, rev.Rev.String())
+			if err := j.mkdir(filepath.Dir(revpath)); err != nil {
 				return err
 			}
-			// We need to move this rev
-			revpath := filepath.Join(d.cdb.root, "."+EscapeID(d.ID), rev.Rev.String())
-			if err := d.cdb.fs.Mkdir(revpath, tempPerms); err != nil && !os.IsExist(err) {
+			if err := move(&rev.path, revpath+filepath.Ext(rev.path)); err != nil {
 				return err
 			}
-			// First move attachments, since they can exit both places legally.
-			for attname, att := range rev.Attachments {
-				if !strings.HasPrefix(att.path, rev.path+"/") {
-					// This attachment is part of another rev, so skip it
+			var dirMade bool
+			for _, attname := range sortedAttachments(rev.Attachments) {
+				att := rev.Attachments[attname]
+				if filepath.Dir(att.path) != winningPath {
+					// Shared with an ancestor, so already in place
 					continue
 				}
-				newpath := filepath.Join(revpath, attname)
-				if err := d.cdb.fs.Rename(att.path, newpath); err != nil {
+				if !dirMade {
+					if err := j.mkdir(revpath); err != nil {
+						return err
+					}
+					dirMade = true
+				}
+				if err := move(&att.path, filepath.Join(revpath, attname)); err != nil {
 					return err
 				}
-				att.path = newpath
-			}
-			// Try to remove the attachments dir, but don't worry if we fail.
-			_ = d.cdb.fs.Remove(rev.path + "/")
-			// Then make the move final by moving the json doc
-			if err := d.cdb.fs.Rename(rev.path, revpath+filepath.Ext(rev.path)); err != nil {
-				return err
 			}
-			// And remove the old rev path, if it's empty
-			_ = d.cdb.fs.Remove(filepath.Dir(rev.path))
 			break
 		}
 	}
 
 	// Now finally put the new winner in place, first the doc, then attachments
-	if err := d.cdb.fs.Rename(winningRev.path, winningPath+filepath.Ext(winningRev.path)); err != nil {
+	if err := move(&winningRev.path, winningPath+filepath.Ext(winningRev.path)); err != nil {
 		return err
 	}
-	winningRev.path = winningPath + filepath.Ext(winningRev.path)
-
-	if err := d.cdb.fs.Mkdir(winningPath, tempPerms); err != nil && !os.IsExist(err) {
+	if err := j.mkdir(winningPath); err != nil {
 		return err
 	}
-	revpath := filepath.Join(d.cdb.root, "."+EscapeID(d.ID), winningRev.Rev.String()) + "/"
-	for attname, att := range winningRev.Attachments {
-		if !strings.HasPrefix(att.path, revpath) {
+	revpath := filepath.Join(d.cdb.root, "."+docID, winningRev.Rev.String())
+	for _, attname := range sortedAttachments(winningRev.Attachments) {
+		att := winningRev.Attachments[attname]
+		if !strings.HasPrefix(att.path, revpath+"/") {
 			// This attachment is part of another rev, so skip it
 			continue
 		}
-		if err := ctx.Err(); err != nil {
-			return err
-		}
-		newpath := filepath.Join(winningPath, attname)
-		if err := d.cdb.fs.Rename(att.path, newpath); err != nil {
+		if err := move(&att.path, filepath.Join(winningPath, attname)); err != nil {
 			return err
 		}
-		att.path = newpath
 	}
 	// And remove the old rev path, if it's empty
-	_ = d.cdb.fs.Remove(filepath.Dir(revpath))
-	_ = d.cdb.fs.Remove(filepath.Dir(filepath.Dir(revpath)))
+	if err := j.remove(revpath); err != nil {
+		return err
+	}
+	if err := j.remove(filepath.Dir(revpath)); err != nil {
+		return err
+	}
 
+	if err := d.cdb.runJournal(j); err != nil {
+		return err
+	}
+	for _, fn := range moved {
+		fn()
+	}
 	return nil
 }
 
+// format returns the extension in which new revisions of the document are
+// written: that of the winning revision on disk, so that a document keeps the
+// format in which it was authored, or else the database default.
+func (d *Document) format() string {
+	for _, rev := range d.Revisions {
+		if rev.path == "" {
+			continue
+		}
+		if ext := strings.TrimPrefix(filepath.Ext(rev.path), "."); decode.CanEncode(ext) {
+			return ext
+		}
+	}
+	return d.cdb.Format()
+}
+
+// sortedAttachments returns the attachment filenames in sorted order, so
+// that journals are deterministic.
+func sortedAttachments(atts map[string]*Attachment) []string {
+	names := make([]string, 0, len(atts))
+	for name := range atts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // leaves returns a map of leave revid to rev
 func (d *Document) leaves() map[string]*Revision {
 	if len(d.Revisions) == 1 {
@@ -406,3 +465,16 @@ func (d *Document) leaves() map[string]*Revision {
 	}
 	return leaves
 }
+
+// Leaves returns the leaf revisions of the document, the winner and any
+// conflicts, including deleted ones, in the order of d.Revisions.
+func (d *Document) Leaves() Revisions {
+	leaves := d.leaves()
+	revs := make(Revisions, 0, len(leaves))
+	for _, rev := range d.Revisions {
+		if _, ok := leaves[rev.Rev.String()]; ok {
+			revs = append(revs, rev)
+		}
+	}
+	return revs
+}
@@ -14,13 +14,18 @@ package cdb
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 
 	"gitlab.com/flimzy/testy"
 
+	"github.com/go-kivik/fsdb/v4/cdb/decode"
 	"github.com/go-kivik/fsdb/v4/filesystem"
 	"github.com/go-kivik/kivik/v4"
 )
@@ -382,3 +387,171 @@ func TestDocumentAddRevision(t *testing.T) {
 		}
 	})
 }
+
+// mapCodec is a JSON codec which, like many third-party codecs, only
+// handles generic values, to exercise decode.ViaJSON.
+type mapCodec struct{}
+
+func (mapCodec) Decode(r io.Reader, i interface{}) error {
+	if _, ok := i.(*map[string]interface{}); !ok {
+		return fmt.Errorf("unexpected decode target %T", i)
+	}
+	return json.NewDecoder(r).Decode(i)
+}
+
+func (mapCodec) Encode(w io.Writer, i interface{}) error {
+	if _, ok := i.(map[string]interface{}); !ok {
+		return fmt.Errorf("unexpected encode source %T", i)
+	}
+	return json.NewEncoder(w).Encode(i)
+}
+
+func init() {
+	decode.Register("mapjson", decode.ViaJSON(mapCodec{}))
+}
+
+func TestDocumentFormat(t *testing.T) {
+	type tt struct {
+		files  map[string]string
+		format string
+		// want is the expected winning revision file, relative to the root.
+		want string
+	}
+	tests := testy.NewTable()
+	tests.Add("new doc", tt{
+		want: "foo.json",
+	})
+	tests.Add("new doc, yaml default", tt{
+		format: "yaml",
+		want:   "foo.yaml",
+	})
+	tests.Add("existing yaml doc", tt{
+		files: map[string]string{
+			"foo.yaml": "_rev: 1-xxx\nvalue: foo\n",
+		},
+		want: "foo.yaml",
+	})
+	tests.Add("existing yml doc, json default", tt{
+		files: map[string]string{
+			"foo.yml": "_rev: 1-xxx\nvalue: foo\n",
+		},
+		format: "json",
+		want:   "foo.yml",
+	})
+	tests.Add("registered codec", tt{
+		format: "mapjson",
+		want:   "foo.mapjson",
+	})
+	tests.Add("existing doc, registered codec", tt{
+		files: map[string]string{
+			"foo.mapjson": `{"_rev":"1-xxx","value":"foo"}`,
+		},
+		want: "foo.mapjson",
+	})
+	tests.Add("existing toml doc", tt{
+		files: map[string]string{
+			"foo.toml": "_rev = \"1-xxx\"\nvalue = \"foo\"\n",
+		},
+		want: "foo.toml",
+	})
+	tests.Add("existing json5 doc", tt{
+		files: map[string]string{
+			"foo.json5": "{\n  // a comment\n  _rev: '1-xxx',\n  value: 'foo',\n}\n",
+		},
+		want: "foo.json5",
+	})
+	tests.Add("new doc, toml default", tt{
+		format: "toml",
+		want:   "foo.toml",
+	})
+	tests.Add("existing json doc, yaml default", tt{
+		files: map[string]string{
+			"foo.json": `{"_rev":"1-xxx","value":"foo"}`,
+		},
+		format: "yaml",
+		want:   "foo.json",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		dir := t.TempDir()
+		writeFiles(t, dir, tt.files)
+		fs := New(dir)
+		if tt.format != "" {
+			if err := fs.SetFormat(tt.format); err != nil {
+				t.Fatal(err)
+			}
+		}
+		doc, err := fs.OpenDocID("foo", kivik.Params(nil))
+		if err != nil && err != errNotFound {
+			t.Fatal(err)
+		}
+		body := map[string]interface{}{
+			"value": "bar",
+			"_attachments": map[string]interface{}{
+				"bar.txt": map[string]interface{}{
+					"content_type": "text/plain",
+					"data":         []byte("bar"),
+				},
+			},
+		}
+		if doc == nil {
+			doc = fs.NewDocument("foo")
+		} else {
+			body["_rev"] = doc.Revisions[0].Rev.String()
+		}
+		rev, err := fs.NewRevision(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		revid, err := doc.AddRevision(context.TODO(), rev, kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, tt.want)); err != nil {
+			t.Fatal(err)
+		}
+		// Read it back
+		doc, err = fs.OpenDocID("foo", kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := doc.Revisions[0]
+		if got.Rev.String() != revid {
+			t.Errorf("Unexpected rev: %s", got.Rev)
+		}
+		if got.Data["value"] != "bar" {
+			t.Errorf("Unexpected data: %v", got.Data)
+		}
+		att := got.Attachments["bar.txt"]
+		if att == nil || att.ContentType != "text/plain" || att.Size != 3 || *att.RevPos != got.Rev.Seq {
+			t.Errorf("Unexpected attachment: %+v", att)
+		}
+	})
+}
+
+func TestFSSetFormat(t *testing.T) {
+	err := New("").SetFormat("xml")
+	testy.StatusError(t, "unsupported format: xml", http.StatusBadRequest, err)
+}
+
+func TestDocumentLeaves(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"foo.json":        `{"_rev":"2-ccc","_revisions":{"start":2,"ids":["ccc","aaa"]}}`,
+		".foo/1-aaa.json": `{"_rev":"1-aaa"}`,
+		".foo/2-bbb.json": `{"_rev":"2-bbb","_revisions":{"start":2,"ids":["bbb","aaa"]}}`,
+		".foo/3-ddd.json": `{"_rev":"3-ddd","_deleted":true,"_revisions":{"start":3,"ids":["ddd","eee","fff"]}}`,
+	})
+	doc, err := New(dir).OpenDocRevs("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rev := range doc.Leaves() {
+		got = append(got, rev.Rev.String())
+	}
+	want := []string{"3-ddd", "2-ccc", "2-bbb"}
+	if d := testy.DiffInterface(want, got); d != nil {
+		t.Error(d)
+	}
+}
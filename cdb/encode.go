@@ -0,0 +1,90 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/go-kivik/fsdb/v4/cdb/decode"
+)
+
+// encodeRevision writes r to w, in the format ext. winner is true if r is to
+// be the document's winning revision.
+func (fs *FS) encodeRevision(w io.Writer, ext string, r *Revision, winner bool) error {
+	r.options = map[string]interface{}{"revs": !(winner && fs.omitRevisions)}
+	if ext == "json" && fs.jsonIndent != "" {
+		return encodeIndentJSON(w, r, fs.jsonIndent)
+	}
+	return decode.Encode(w, ext, r)
+}
+
+// leadingKeys are written before all other keys, by encodeIndentJSON.
+var leadingKeys = []string{"_id", "_rev"}
+
+// encodeIndentJSON writes v to w as indented JSON, with the keys of the top
+// level object in a stable order: leadingKeys first, followed by the rest in
+// sorted order.
+func encodeIndentJSON(w io.Writer, v interface{}, indent string) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if li, lj := leadingIndex(keys[i]), leadingIndex(keys[j]); li != lj {
+			return li < lj
+		}
+		return keys[i] < keys[j]
+	})
+	buf := &bytes.Buffer{}
+	buf.WriteString("{")
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n" + indent)
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteString(": ")
+		if err := json.Indent(buf, doc[key], indent, indent); err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// leadingIndex returns the position of key in leadingKeys, or the length of
+// leadingKeys if it's not among them.
+func leadingIndex(key string) int {
+	for i, k := range leadingKeys {
+		if k == key {
+			return i
+		}
+	}
+	return len(leadingKeys)
+}
@@ -0,0 +1,186 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/go-kivik/kivik/v4"
+	"gitlab.com/flimzy/testy"
+)
+
+func TestEncodeIndentJSON(t *testing.T) {
+	type tt struct {
+		v      interface{}
+		indent string
+		want   string
+	}
+	tests := testy.NewTable()
+	tests.Add("empty", tt{
+		v:      map[string]interface{}{},
+		indent: "  ",
+		want:   "{}\n",
+	})
+	tests.Add("reserved keys first", tt{
+		v: map[string]interface{}{
+			"zed":  1.5,
+			"_rev": "1-xxx",
+			"alpha": map[string]interface{}{
+				"b": []interface{}{1, 2},
+				"a": map[string]interface{}{},
+			},
+			"_id":          "foo",
+			"_attachments": map[string]interface{}{},
+		},
+		indent: "  ",
+		want: `{
+  "_id": "foo",
+  "_rev": "1-xxx",
+  "_attachments": {},
+  "alpha": {
+    "a": {},
+    "b": [
+      1,
+      2
+    ]
+  },
+  "zed": 1.5
+}
+`,
+	})
+	tests.Add("tab", tt{
+		v:      map[string]interface{}{"b": "x", "a": []interface{}{}},
+		indent: "\t",
+		want:   "{\n\t\"a\": [],\n\t\"b\": \"x\"\n}\n",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		buf := &bytes.Buffer{}
+		if err := encodeIndentJSON(buf, tt.v, tt.indent); err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffText(tt.want, buf.String()); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestFSSetJSONIndent(t *testing.T) {
+	fs := New("/foo")
+	err := fs.SetJSONIndent("xx")
+	testy.StatusError(t, `invalid JSON indent: "xx"`, 400, err)
+}
+
+// putRev adds a new revision of docID, with the given value, and returns its
+// rev.
+func putRev(t *testing.T, fs *FS, docID, value string) string {
+	t.Helper()
+	doc, err := fs.OpenDocID(docID, kivik.Params(nil))
+	if err != nil && err != errNotFound {
+		t.Fatal(err)
+	}
+	body := map[string]interface{}{"value": value}
+	if doc == nil {
+		doc = fs.NewDocument(docID)
+	} else {
+		body["_rev"] = doc.Revisions[0].Rev.String()
+	}
+	rev, err := fs.NewRevision(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revid, err := doc.AddRevision(context.TODO(), rev, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return revid
+}
+
+func TestPrettyOutput(t *testing.T) {
+	dir := t.TempDir()
+	fs := New(dir)
+	if err := fs.SetJSONIndent("  "); err != nil {
+		t.Fatal(err)
+	}
+	rev1 := putRev(t, fs, "foo", "bar")
+	rev2 := putRev(t, fs, "foo", "baz")
+
+	want := []string{
+		".foo/",
+		fmt.Sprintf(`.foo/%s.json={
+  "_rev": "%[1]s",
+  "_revisions": {
+    "start": 1,
+    "ids": [
+      "%[2]s"
+    ]
+  },
+  "value": "bar"
+}
+`, rev1, rev1[2:]),
+		fmt.Sprintf(`foo.json={
+  "_rev": "%s",
+  "_revisions": {
+    "start": 2,
+    "ids": [
+      "%s",
+      "%s"
+    ]
+  },
+  "value": "baz"
+}
+`, rev2, rev2[2:], rev1[2:]),
+		"foo/",
+	}
+	if d := testy.DiffInterface(want, readFiles(t, dir)); d != nil {
+		t.Error(d)
+	}
+}
+
+func TestOmitRevisions(t *testing.T) {
+	dir := t.TempDir()
+	fs := New(dir)
+	fs.SetOmitRevisions(true)
+	rev1 := putRev(t, fs, "foo", "bar")
+	rev2 := putRev(t, fs, "foo", "baz")
+	rev3 := putRev(t, fs, "foo", "qux")
+
+	want := []string{
+		".foo/",
+		fmt.Sprintf(`.foo/%s.json={"_rev":"%s","value":"bar"}`+"\n", rev1, rev1),
+		fmt.Sprintf(`.foo/%s.json={"_rev":"%s","value":"baz"}`+"\n", rev2, rev2),
+		fmt.Sprintf(`foo.json={"_rev":"%s","value":"qux"}`+"\n", rev3),
+		"foo/",
+	}
+	sort.Strings(want)
+	if d := testy.DiffInterface(want, readFiles(t, dir)); d != nil {
+		t.Error(d)
+	}
+
+	doc, err := fs.OpenDocRevs("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := doc.Leaves()
+	if len(leaves) != 1 || leaves[0].Rev.String() != rev3 {
+		t.Errorf("Expected only the winning revision %s as a leaf, got %v", rev3, leaves)
+	}
+	wantHistory := []string{rev3, rev2, rev1}
+	if d := testy.DiffInterface(wantHistory, doc.Revisions[0].RevHistory.Ancestors()); d != nil {
+		t.Errorf("Unexpected history: %s", d)
+	}
+}
@@ -13,7 +13,10 @@
 package cdb
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -27,8 +30,14 @@ import (
 
 // FS provides filesystem access to a
 type FS struct {
-	fs   filesystem.Filesystem
-	root string
+	fs            filesystem.Filesystem
+	root          string
+	format        string
+	jsonIndent    string
+	omitRevisions bool
+	hashing       string
+	revsLimit     int
+	warn          func(Warning)
 }
 
 // New initializes a new FS instance, anchored at dbroot. If fs is omitted or
@@ -47,6 +56,63 @@ func New(dbroot string, fs ...filesystem.Filesystem) *FS {
 	}
 }
 
+// defaultFormat is the extension in which new documents are written, unless
+// set otherwise with SetFormat.
+const defaultFormat = "json"
+
+// SetFormat sets the extension, such as "json" or "yaml", in which new
+// documents are written. Updates to existing documents are written in the
+// format of the existing winning revision.
+func (fs *FS) SetFormat(ext string) error {
+	ext = strings.TrimPrefix(ext, ".")
+	if !decode.CanEncode(ext) {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("unsupported format: %s", ext)}
+	}
+	fs.format = ext
+	return nil
+}
+
+// Format returns the extension in which new documents are written.
+func (fs *FS) Format() string {
+	if fs.format == "" {
+		return defaultFormat
+	}
+	return fs.format
+}
+
+// SetJSONIndent sets the indent, such as two spaces or a tab, with which JSON
+// revisions are written. With an indent, revisions are pretty-printed, with
+// the _id and _rev keys first, followed by the rest in sorted order, so that
+// changes to a document make for readable diffs. The default, empty, writes
+// each revision on a single line.
+func (fs *FS) SetJSONIndent(indent string) error {
+	if strings.Trim(indent, " \t") != "" {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid JSON indent: %q", indent)}
+	}
+	fs.jsonIndent = indent
+	return nil
+}
+
+// SetOmitRevisions sets whether the _revisions history is omitted from the
+// file of each new winning revision, for databases whose history is kept
+// elsewhere, such as in version control. When superseded, such a revision is
+// moved among the document's other revisions as usual. As its history is then
+// unknown when read, it is inferred from its parent, the one revision with
+// the preceding sequence number, so that its ancestors don't appear as
+// conflicts. This is done for any revision read without a history, so readers
+// need not set the option themselves. Where more than one revision could be
+// the parent, the history is left incomplete.
+func (fs *FS) SetOmitRevisions(omit bool) {
+	fs.omitRevisions = omit
+}
+
+// WithFilesystem returns a copy of fs, which accesses the disk through vfs.
+func (fs *FS) WithFilesystem(vfs filesystem.Filesystem) *FS {
+	c := *fs
+	c.fs = vfs
+	return &c
+}
+
 func (fs *FS) readMainRev(base string) (*Revision, error) {
 	f, ext, err := decode.OpenAny(fs.fs, base)
 	if err != nil {
@@ -97,8 +163,11 @@ func (r *Revision) restoreAttachments() error {
 			if err != nil {
 				return statusError{status: http.StatusInternalServerError, error: err}
 			}
-			att.Size, att.Digest = digest(f)
+			att.Size, att.Digest, err = digest(f)
 			_ = f.Close()
+			if err != nil {
+				return statusError{status: http.StatusInternalServerError, error: err}
+			}
 		}
 	}
 	return nil
@@ -117,17 +186,18 @@ func (fs *FS) openRevs(docID, revid string) (Revisions, error) {
 		}
 	}
 	dirpath := filepath.Join(fs.root, "."+base)
-	dir, err := fs.fs.Open(dirpath)
+	files, err := fs.fs.ReadDir(dirpath)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
 	if err == nil {
-		files, err := dir.Readdir(-1)
-		if err != nil {
-			return nil, err
-		}
 		for _, info := range files {
-			if info.IsDir() {
+			if _, _, ok := decode.ExplodeFilename(info.Name()); info.IsDir() || !ok {
+				// Ignore attachment directories, and files in unregistered
+				// formats, such as temporary files.
+				if !info.IsDir() && !isTempFile(info.Name()) && revid == "" {
+					fs.warnf(WarnStrayFile, filepath.Join(dirpath, info.Name()), "not in a registered format")
+				}
 				continue
 			}
 			if revid != "" {
@@ -139,6 +209,7 @@ func (fs *FS) openRevs(docID, revid string) (Revisions, error) {
 			rev, err := fs.readSubRev(filepath.Join(dirpath, info.Name()))
 			switch {
 			case err == errUnrecognizedFile:
+				fs.warnf(WarnStrayFile, filepath.Join(dirpath, info.Name()), "name is not a revision ID")
 				continue
 			case err != nil:
 				return nil, err
@@ -149,6 +220,7 @@ func (fs *FS) openRevs(docID, revid string) (Revisions, error) {
 	if len(revs) == 0 {
 		return nil, errNotFound
 	}
+	revs.inferHistories(fs.RevsLimit())
 	sort.Sort(revs)
 	return revs, nil
 }
@@ -165,6 +237,20 @@ func (fs *FS) OpenDocID(docID string, options driver.Options) (*Document, error)
 	if rev == "" && revs.Deleted() {
 		return nil, statusError{status: http.StatusNotFound, error: errors.New("deleted")}
 	}
+	return fs.newDoc(docID, revs)
+}
+
+// OpenDocRevs opens every available revision of the requested document,
+// including deleted revisions, with a single read of the revisions directory.
+func (fs *FS) OpenDocRevs(docID string) (*Document, error) {
+	revs, err := fs.openRevs(docID, "")
+	if err != nil {
+		return nil, err
+	}
+	return fs.newDoc(docID, revs)
+}
+
+func (fs *FS) newDoc(docID string, revs Revisions) (*Document, error) {
 	doc := &Document{
 		ID:        docID,
 		Revisions: revs,
@@ -172,14 +258,142 @@ func (fs *FS) OpenDocID(docID string, options driver.Options) (*Document, error)
 	}
 	for _, rev := range doc.Revisions {
 		for filename, att := range rev.Attachments {
-			file, err := rev.openAttachment(filename)
+			path, err := rev.attachmentPath(filename)
 			if err != nil {
 				return nil, err
 			}
-			_ = file.Close()
-			att.path = file.Name()
+			att.path = path
 			att.fs = fs.fs
 		}
 	}
 	return doc, nil
 }
+
+// MetaDoc holds only those fields of a document needed to identify its
+// revision.
+type MetaDoc struct {
+	Rev     RevID `json:"_rev" yaml:"_rev"`
+	Deleted bool  `json:"_deleted" yaml:"_deleted"`
+}
+
+// ReadMetaDoc reads the _rev and _deleted fields from r, in the format ext.
+// JSON input is read as a stream of tokens, which stops as soon as both
+// fields have been found, and other values are skipped without being decoded.
+func ReadMetaDoc(r io.Reader, ext string) (*MetaDoc, error) {
+	meta := new(MetaDoc)
+	if ext != "json" {
+		return meta, decode.Decode(r, ext, meta)
+	}
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, errors.New("document is not a JSON object")
+	}
+	var haveRev, haveDeleted bool
+	for dec.More() && !(haveRev && haveDeleted) {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch key, _ := tok.(string); key {
+		case "_rev":
+			haveRev = true
+			err = dec.Decode(&meta.Rev)
+		case "_deleted":
+			haveDeleted = true
+			err = dec.Decode(&meta.Deleted)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+func (fs *FS) readMetaDoc(path, ext string) (*MetaDoc, error) {
+	f, err := fs.fs.Open(path)
+	if err != nil {
+		return nil, kerr(missing(err))
+	}
+	defer f.Close() // nolint: errcheck
+	return ReadMetaDoc(f, ext)
+}
+
+// GetRev returns the winning revision of the requested document. If revid is
+// not empty, it instead confirms that the named revision exists. The winner is
+// determined from the revision filenames, and the _rev field of the main
+// document file, without decoding document bodies or reading attachments.
+func (fs *FS) GetRev(docID, revid string) (string, error) {
+	base := EscapeID(docID)
+	var winner RevID
+	var deleted bool
+	f, ext, err := decode.OpenAny(fs.fs, filepath.Join(fs.root, base))
+	switch {
+	case err == nil:
+		meta, err := ReadMetaDoc(f, ext)
+		_ = f.Close()
+		if err != nil {
+			return "", err
+		}
+		if meta.Rev.IsZero() {
+			meta.Rev = RevID{Seq: 1}
+		}
+		if revid != "" && meta.Rev.String() == revid {
+			return revid, nil
+		}
+		winner, deleted = meta.Rev, meta.Deleted
+	case !os.IsNotExist(err):
+		return "", kerr(err)
+	}
+	dirpath := filepath.Join(fs.root, "."+base)
+	files, err := fs.fs.ReadDir(dirpath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", kerr(err)
+	}
+	var winnerPath, winnerExt string
+	if err == nil {
+		for _, info := range files {
+			if info.IsDir() {
+				continue
+			}
+			name, ext, ok := decode.ExplodeFilename(info.Name())
+			if !ok {
+				continue
+			}
+			var rev RevID
+			if err := rev.UnmarshalText([]byte(name)); err != nil {
+				continue
+			}
+			if revid != "" {
+				if rev.String() == revid {
+					return revid, nil
+				}
+				continue
+			}
+			if rev.Seq > winner.Seq || (rev.Seq == winner.Seq && rev.Sum > winner.Sum) {
+				winner = rev
+				winnerPath, winnerExt = filepath.Join(dirpath, info.Name()), ext
+			}
+		}
+	}
+	if revid != "" || winner.IsZero() {
+		return "", errNotFound
+	}
+	if winnerPath != "" {
+		meta, err := fs.readMetaDoc(winnerPath, winnerExt)
+		if err != nil {
+			return "", err
+		}
+		deleted = meta.Deleted
+	}
+	if deleted {
+		return "", statusError{status: http.StatusNotFound, error: errors.New("deleted")}
+	}
+	return winner.String(), nil
+}
@@ -15,6 +15,7 @@ package cdb
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"testing"
 
 	"gitlab.com/flimzy/testy"
@@ -149,3 +150,134 @@ func TestRestoreAttachments(t *testing.T) {
 		testy.StatusError(t, tt.err, tt.status, err)
 	})
 }
+
+func TestFSGetRev(t *testing.T) {
+	type tt struct {
+		fs     filesystem.Filesystem
+		root   string
+		docID  string
+		rev    string
+		want   string
+		status int
+		err    string
+	}
+	tests := testy.NewTable()
+	tests.Add("not found", tt{
+		root:   "testdata/open",
+		docID:  "notfound",
+		status: http.StatusNotFound,
+		err:    "missing",
+	})
+	tests.Add("main rev only", tt{
+		root:  "testdata/open",
+		docID: "foo",
+		want:  "1-xxx",
+	})
+	tests.Add("main rev only, yaml", tt{
+		root:  "testdata/open",
+		docID: "bar",
+		want:  "1-xxx",
+	})
+	tests.Add("no rev", tt{
+		root:  "testdata/open",
+		docID: "norev",
+		want:  "1-",
+	})
+	tests.Add("json auto rev number", tt{
+		root:  "testdata/open",
+		docID: "jsonautorevnum",
+		want:  "3-",
+	})
+	tests.Add("no main rev", tt{
+		root:  "testdata/open",
+		docID: "nomain",
+		want:  "1-xxx",
+	})
+	tests.Add("multiple revs, winner selected", tt{
+		root:  "testdata/open",
+		docID: "multiplerevs",
+		want:  "5-yyy",
+	})
+	tests.Add("specific rev", tt{
+		root:  "testdata/open",
+		docID: "multiplerevs",
+		rev:   "4-xxx",
+		want:  "4-xxx",
+	})
+	tests.Add("missing rev", tt{
+		root:   "testdata/open",
+		docID:  "multiplerevs",
+		rev:    "3-xxx",
+		status: http.StatusNotFound,
+		err:    "missing",
+	})
+	tests.Add("forbidden", tt{
+		fs: &filesystem.MockFS{
+			OpenFunc: func(_ string) (filesystem.File, error) {
+				return nil, statusError{status: http.StatusForbidden, error: errors.New("permission denied")}
+			},
+		},
+		root:   "doesntmatter",
+		docID:  "foo",
+		status: http.StatusForbidden,
+		err:    "permission denied",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		fs := New(tt.root, tt.fs)
+		rev, err := fs.GetRev(tt.docID, tt.rev)
+		testy.StatusError(t, tt.err, tt.status, err)
+		if rev != tt.want {
+			t.Errorf("Unexpected rev: %s", rev)
+		}
+	})
+}
+
+func TestReadMetaDoc(t *testing.T) {
+	type tt struct {
+		input   string
+		ext     string
+		rev     string
+		deleted bool
+		err     string
+	}
+	tests := testy.NewTable()
+	tests.Add("json", tt{
+		input: `{"foo":{"bar":[1,2,3]},"_rev":"2-xxx","_attachments":{"a.txt":{}}}`,
+		ext:   "json",
+		rev:   "2-xxx",
+	})
+	tests.Add("json deleted", tt{
+		input:   `{"_deleted":true,"_rev":"3-xxx"}`,
+		ext:     "json",
+		rev:     "3-xxx",
+		deleted: true,
+	})
+	tests.Add("json stops early", tt{
+		input:   `{"_rev":"3-xxx","_deleted":true, invalid json follows`,
+		ext:     "json",
+		rev:     "3-xxx",
+		deleted: true,
+	})
+	tests.Add("json array", tt{
+		input: `[]`,
+		ext:   "json",
+		err:   "document is not a JSON object",
+	})
+	tests.Add("yaml", tt{
+		input: "_rev: 4-xxx\nvalue: foo\n",
+		ext:   "yaml",
+		rev:   "4-xxx",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		meta, err := ReadMetaDoc(strings.NewReader(tt.input), tt.ext)
+		testy.Error(t, tt.err, err)
+		if rev := meta.Rev.String(); rev != tt.rev {
+			t.Errorf("Unexpected rev: %s", rev)
+		}
+		if meta.Deleted != tt.deleted {
+			t.Errorf("Unexpected deleted: %t", meta.Deleted)
+		}
+	})
+}
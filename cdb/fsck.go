@@ -0,0 +1,435 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-kivik/fsdb/v4/cdb/decode"
+)
+
+// IssueKind identifies the type of problem found by Fsck.
+type IssueKind string
+
+// The kinds of issue reported by Fsck.
+const (
+	// IssueTempFile is a temporary file left behind by an interrupted write.
+	IssueTempFile IssueKind = "temp_file"
+	// IssueWrongWinner is a document whose main file does not contain the
+	// winning revision, or which has no main file at all.
+	IssueWrongWinner IssueKind = "wrong_winner"
+	// IssueDigestMismatch is an attachment whose content does not match its
+	// recorded digest.
+	IssueDigestMismatch IssueKind = "digest_mismatch"
+	// IssueRevMismatch is a revision file whose name disagrees with its _rev
+	// field.
+	IssueRevMismatch IssueKind = "rev_mismatch"
+	// IssueEmptyDir is an empty revision directory.
+	IssueEmptyDir IssueKind = "empty_dir"
+	// IssueUnreadable is a document, or attachment, which could not be read.
+	IssueUnreadable IssueKind = "unreadable"
+	// IssuePendingJournal is the journal of an interrupted update, which
+	// has yet to be recovered.
+	IssuePendingJournal IssueKind = "pending_journal"
+)
+
+// Issue is a problem found by Fsck.
+type Issue struct {
+	Kind IssueKind
+	// DocID is the affected document, if any.
+	DocID string
+	// Path is the file or directory at fault.
+	Path    string
+	Message string
+	// Fixed is true if the issue was repaired.
+	Fixed bool
+}
+
+func (i Issue) String() string {
+	status := ""
+	if i.Fixed {
+		status = " (fixed)"
+	}
+	return fmt.Sprintf("%s: %s: %s%s", i.Kind, i.Path, i.Message, status)
+}
+
+type fsck struct {
+	fs     *FS
+	repair bool
+	issues []Issue
+}
+
+// Fsck checks the database for inconsistencies, such as those left behind by
+// interrupted writes, and returns the issues found. If repair is true, each
+// issue is fixed where possible. Corrupt attachments can't be repaired, and
+// are only reported.
+func (fs *FS) Fsck(ctx context.Context, repair bool) ([]Issue, error) {
+	c := &fsck{fs: fs, repair: repair}
+	// Interrupted updates are recovered first, as they account for any other
+	// issues with the affected documents.
+	if err := c.checkJournals(); err != nil {
+		return nil, err
+	}
+	entries, err := c.readDir(fs.root)
+	if err != nil {
+		return nil, kerr(err)
+	}
+	docIDs := map[string]struct{}{}
+	var revDirs []string
+	for _, info := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		name := info.Name()
+		path := filepath.Join(fs.root, name)
+		switch {
+		case isTempFile(name):
+			c.tempFile(path, "")
+		case info.IsDir() && name[0] == '.':
+			docID := UnescapeID(name[1:])
+			if !isDocID(docID) {
+				continue
+			}
+			docIDs[docID] = struct{}{}
+			revDirs = append(revDirs, path)
+			if err := c.checkRevsDir(docID, path); err != nil {
+				return nil, err
+			}
+		case info.IsDir():
+			docID := UnescapeID(name)
+			if !isDocID(docID) {
+				continue
+			}
+			if err := c.checkTempFiles(docID, path); err != nil {
+				return nil, err
+			}
+		default:
+			base, _, ok := decode.ExplodeFilename(name)
+			if !ok {
+				continue
+			}
+			if docID := UnescapeID(base); isDocID(docID) {
+				docIDs[docID] = struct{}{}
+			}
+		}
+	}
+	ids := make([]string, 0, len(docIDs))
+	for docID := range docIDs {
+		ids = append(ids, docID)
+	}
+	sort.Strings(ids)
+	for _, docID := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := c.checkDoc(ctx, docID); err != nil {
+			return nil, err
+		}
+	}
+	// Empty directories are checked last, as repairs may leave them behind.
+	for _, path := range revDirs {
+		if err := c.checkEmptyDirs(UnescapeID(filepath.Base(path)[1:]), path); err != nil {
+			return nil, err
+		}
+	}
+	return c.issues, nil
+}
+
+// isTempFile returns true if name is a temporary file, as created by
+// atomicWriteFile and atomicFileWriter.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".tmp.")
+}
+
+// isDocID returns true if docID is a valid document ID. Other files and
+// directories found in a database are ignored.
+func isDocID(docID string) bool {
+	if docID == "" {
+		return false
+	}
+	if docID[0] != '_' {
+		return true
+	}
+	return strings.HasPrefix(docID, "_design/") || strings.HasPrefix(docID, "_local/")
+}
+
+func (c *fsck) readDir(path string) ([]os.FileInfo, error) {
+	return c.fs.fs.ReadDir(path)
+}
+
+func (c *fsck) add(issue Issue) {
+	c.issues = append(c.issues, issue)
+}
+
+func (c *fsck) tempFile(path, docID string) {
+	issue := Issue{
+		Kind:    IssueTempFile,
+		DocID:   docID,
+		Path:    path,
+		Message: "orphaned temporary file",
+	}
+	if c.repair {
+		issue.Fixed = c.fs.fs.Remove(path) == nil
+	}
+	c.add(issue)
+}
+
+// checkJournals reports the journals of interrupted updates, recovering them
+// on repair, and any temporary files in the journal directory.
+func (c *fsck) checkJournals() error {
+	path := filepath.Join(c.fs.root, JournalDirName)
+	if _, err := c.fs.fs.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := c.checkTempFiles("", path); err != nil {
+		return err
+	}
+	docIDs, err := c.fs.PendingJournals()
+	if err != nil {
+		return err
+	}
+	for _, docID := range docIDs {
+		issue := Issue{
+			Kind:    IssuePendingJournal,
+			DocID:   docID,
+			Path:    c.fs.journalPath(docID),
+			Message: "interrupted update",
+		}
+		if c.repair {
+			issue.Fixed = c.fs.Recover(docID) == nil
+		}
+		c.add(issue)
+	}
+	return nil
+}
+
+// checkTempFiles reports any temporary files in the attachments directory
+// at path.
+func (c *fsck) checkTempFiles(docID, path string) error {
+	entries, err := c.readDir(path)
+	if err != nil {
+		return kerr(err)
+	}
+	for _, info := range entries {
+		if isTempFile(info.Name()) {
+			c.tempFile(filepath.Join(path, info.Name()), docID)
+		}
+	}
+	return nil
+}
+
+// checkRevsDir checks the revisions directory at path for temporary files,
+// and for revision files whose names disagree with their _rev fields.
+func (c *fsck) checkRevsDir(docID, path string) error {
+	entries, err := c.readDir(path)
+	if err != nil {
+		return kerr(err)
+	}
+	for _, info := range entries {
+		name := info.Name()
+		filename := filepath.Join(path, name)
+		switch {
+		case isTempFile(name):
+			c.tempFile(filename, docID)
+		case info.IsDir():
+			if err := c.checkTempFiles(docID, filename); err != nil {
+				return err
+			}
+		default:
+			if err := c.checkRevFilename(docID, filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkRevFilename compares the revision file's name to its _rev field. The
+// filename is authoritative when reading, so the file, and its attachments
+// directory, are renamed to match _rev on repair, provided nothing by that
+// name already exists.
+func (c *fsck) checkRevFilename(docID, filename string) error {
+	base, ext, ok := decode.ExplodeFilename(filepath.Base(filename))
+	if !ok {
+		return nil
+	}
+	var fileRev RevID
+	if err := fileRev.UnmarshalText([]byte(base)); err != nil {
+		return nil
+	}
+	meta, err := c.fs.readMetaDoc(filename, ext)
+	if err != nil {
+		c.add(Issue{
+			Kind:    IssueUnreadable,
+			DocID:   docID,
+			Path:    filename,
+			Message: err.Error(),
+		})
+		return nil
+	}
+	if meta.Rev.IsZero() || meta.Rev.Equal(fileRev) {
+		return nil
+	}
+	issue := Issue{
+		Kind:    IssueRevMismatch,
+		DocID:   docID,
+		Path:    filename,
+		Message: fmt.Sprintf("filename has rev %s, but _rev is %s", fileRev, meta.Rev),
+	}
+	if c.repair {
+		dir := filepath.Dir(filename)
+		target := filepath.Join(dir, meta.Rev.String())
+		_, err := c.fs.fs.Stat(target + "." + ext)
+		if os.IsNotExist(err) {
+			if _, err := c.fs.fs.Stat(filepath.Join(dir, base)); err == nil {
+				err = c.fs.fs.Rename(filepath.Join(dir, base), target)
+				if err != nil {
+					c.add(issue)
+					return nil
+				}
+			}
+			issue.Fixed = c.fs.fs.Rename(filename, target+"."+ext) == nil
+		}
+	}
+	c.add(issue)
+	return nil
+}
+
+// checkDoc checks that the winning revision of the document is in place, and
+// that its attachments match their recorded digests.
+func (c *fsck) checkDoc(ctx context.Context, docID string) error {
+	doc, err := c.fs.OpenDocRevs(docID)
+	if err != nil {
+		if err == errNotFound {
+			return nil
+		}
+		c.add(Issue{
+			Kind:    IssueUnreadable,
+			DocID:   docID,
+			Path:    filepath.Join(c.fs.root, EscapeID(docID)),
+			Message: err.Error(),
+		})
+		return nil
+	}
+	winner := doc.Revisions[0]
+	winningPath := filepath.Join(c.fs.root, EscapeID(docID))
+	inPlace := false
+	for _, rev := range doc.Revisions {
+		if rev.Rev.Equal(winner.Rev) && rev.path == winningPath+filepath.Ext(rev.path) {
+			inPlace = true
+		}
+	}
+	if !inPlace {
+		issue := Issue{
+			Kind:    IssueWrongWinner,
+			DocID:   docID,
+			Path:    winner.path,
+			Message: fmt.Sprintf("winning rev %s is not in place", winner.Rev),
+		}
+		if c.repair {
+			issue.Fixed = doc.persist(ctx) == nil
+		}
+		c.add(issue)
+	}
+	checked := map[string]bool{}
+	for _, rev := range doc.Revisions {
+		for filename, att := range rev.Attachments {
+			if att.path == "" || att.Digest == "" || checked[att.path] {
+				continue
+			}
+			checked[att.path] = true
+			sum, err := attachmentDigest(att)
+			if err != nil {
+				c.add(Issue{
+					Kind:    IssueUnreadable,
+					DocID:   docID,
+					Path:    att.path,
+					Message: fmt.Sprintf("attachment %s of rev %s could not be read: %s", filename, rev.Rev, err),
+				})
+				continue
+			}
+			if sum != att.Digest {
+				c.add(Issue{
+					Kind:    IssueDigestMismatch,
+					DocID:   docID,
+					Path:    att.path,
+					Message: fmt.Sprintf("attachment %s of rev %s has digest %s, expected %s", filename, rev.Rev, sum, att.Digest),
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// attachmentDigest returns the digest of the attachment's content.
+func attachmentDigest(att *Attachment) (string, error) {
+	f, err := att.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close() // nolint: errcheck
+	_, sum, err := digest(f)
+	return sum, err
+}
+
+// checkEmptyDirs reports empty attachment directories within the revisions
+// directory at path, and the revisions directory itself, if empty.
+func (c *fsck) checkEmptyDirs(docID, path string) error {
+	entries, err := c.readDir(path)
+	if os.IsNotExist(err) {
+		// Removed by a repair
+		return nil
+	}
+	if err != nil {
+		return kerr(err)
+	}
+	remaining := len(entries)
+	for _, info := range entries {
+		if !info.IsDir() {
+			continue
+		}
+		dir := filepath.Join(path, info.Name())
+		sub, err := c.readDir(dir)
+		if err != nil {
+			return kerr(err)
+		}
+		if len(sub) == 0 && c.emptyDir(docID, dir) {
+			remaining--
+		}
+	}
+	if remaining == 0 {
+		c.emptyDir(docID, path)
+	}
+	return nil
+}
+
+// emptyDir reports the empty directory at path, and returns true if it was
+// removed.
+func (c *fsck) emptyDir(docID, path string) bool {
+	issue := Issue{
+		Kind:    IssueEmptyDir,
+		DocID:   docID,
+		Path:    path,
+		Message: "empty revision directory",
+	}
+	if c.repair {
+		issue.Fixed = c.fs.fs.Remove(path) == nil
+	}
+	c.add(issue)
+	return issue.Fixed
+}
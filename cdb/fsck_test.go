@@ -0,0 +1,252 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+// writeFiles creates the named files, relative to dir. Names ending in a
+// slash are created as empty directories.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0o777); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFsck(t *testing.T) {
+	type issue struct {
+		Kind  IssueKind
+		DocID string
+		Path  string
+		Fixed bool
+	}
+	type tt struct {
+		files  map[string]string
+		repair bool
+		want   []issue
+		// after lists the issues remaining after repair.
+		after []issue
+	}
+	tests := testy.NewTable()
+	tests.Add("clean", tt{
+		files: map[string]string{
+			"foo.json":         `{"_rev":"2-b"}`,
+			".foo/1-a.json":    `{"_rev":"1-a"}`,
+			"foo/":             "",
+			"_security.json":   `{}`,
+			"._locks/_db.lock": "",
+		},
+	})
+	tests.Add("temp files", tt{
+		files: map[string]string{
+			"foo.json":                 `{"_rev":"1-a"}`,
+			".tmp.foo.json-123":        `{"_rev":"2-b"}`,
+			".foo/.tmp.2-b.json-456":   `{"_rev":"2-b"}`,
+			".foo/2-b/.tmp.bar.txt-78": "bar",
+		},
+		repair: true,
+		want: []issue{
+			{Kind: IssueEmptyDir, DocID: "foo", Path: ".foo", Fixed: true},
+			{Kind: IssueTempFile, DocID: "foo", Path: ".foo/.tmp.2-b.json-456", Fixed: true},
+			{Kind: IssueEmptyDir, DocID: "foo", Path: ".foo/2-b", Fixed: true},
+			{Kind: IssueTempFile, DocID: "foo", Path: ".foo/2-b/.tmp.bar.txt-78", Fixed: true},
+			{Kind: IssueTempFile, Path: ".tmp.foo.json-123", Fixed: true},
+		},
+	})
+	tests.Add("wrong winner", tt{
+		files: map[string]string{
+			"foo.json":      `{"_rev":"1-a"}`,
+			".foo/2-b.json": `{"_rev":"2-b"}`,
+		},
+		want: []issue{
+			{Kind: IssueWrongWinner, DocID: "foo", Path: ".foo/2-b.json"},
+		},
+	})
+	tests.Add("wrong winner, repaired", tt{
+		files: map[string]string{
+			"foo.json":      `{"_rev":"1-a"}`,
+			".foo/2-b.json": `{"_rev":"2-b"}`,
+		},
+		repair: true,
+		want: []issue{
+			{Kind: IssueWrongWinner, DocID: "foo", Path: ".foo/2-b.json", Fixed: true},
+		},
+	})
+	tests.Add("missing winner", tt{
+		files: map[string]string{
+			".foo/1-a.json": `{"_rev":"1-a"}`,
+			".foo/2-b.json": `{"_rev":"2-b"}`,
+		},
+		repair: true,
+		want: []issue{
+			{Kind: IssueWrongWinner, DocID: "foo", Path: ".foo/2-b.json", Fixed: true},
+		},
+	})
+	tests.Add("rev mismatch", tt{
+		files: map[string]string{
+			"foo.json":      `{"_rev":"3-c"}`,
+			".foo/2-b.json": `{"_rev":"2-x"}`,
+			".foo/2-b/a":    "a",
+		},
+		repair: true,
+		want: []issue{
+			{Kind: IssueRevMismatch, DocID: "foo", Path: ".foo/2-b.json", Fixed: true},
+		},
+	})
+	tests.Add("digest mismatch", tt{
+		files: map[string]string{
+			"foo.json":  `{"_rev":"1-a","_attachments":{"a.txt":{"content_type":"text/plain","length":3,"digest":"md5-wrong"}}}`,
+			"foo/a.txt": "abc",
+		},
+		repair: true,
+		want: []issue{
+			{Kind: IssueDigestMismatch, DocID: "foo", Path: "foo/a.txt"},
+		},
+		after: []issue{
+			{Kind: IssueDigestMismatch, DocID: "foo", Path: "foo/a.txt"},
+		},
+	})
+	tests.Add("unreadable attachment", tt{
+		files: map[string]string{
+			"foo.json":   `{"_rev":"1-a","_attachments":{"a.txt":{"content_type":"text/plain","length":3,"digest":"md5-kAFQmDzST7DWlj99KOF/cg=="}}}`,
+			"foo/a.txt/": "",
+		},
+		want: []issue{
+			{Kind: IssueUnreadable, DocID: "foo", Path: "foo/a.txt"},
+		},
+	})
+	tests.Add("pending journal", tt{
+		files: map[string]string{
+			"._journal/foo.json":          `{"id":"foo","ops":[{"op":"rename","from":".foo/2-b.json","to":"foo.json"},{"op":"remove","path":".foo"}]}`,
+			"._journal/.tmp.foo.json-123": "",
+			".foo/1-a.json":               `{"_rev":"1-a"}`,
+			"foo.json":                    `{"_rev":"2-b"}`,
+		},
+		repair: true,
+		want: []issue{
+			{Kind: IssueTempFile, Path: "._journal/.tmp.foo.json-123", Fixed: true},
+			{Kind: IssuePendingJournal, DocID: "foo", Path: "._journal/foo.json", Fixed: true},
+		},
+	})
+	tests.Add("empty rev dir, check only", tt{
+		files: map[string]string{
+			"foo.json":  `{"_rev":"2-b"}`,
+			".foo/1-a/": "",
+		},
+		want: []issue{
+			{Kind: IssueEmptyDir, DocID: "foo", Path: ".foo/1-a"},
+		},
+		after: []issue{
+			{Kind: IssueEmptyDir, DocID: "foo", Path: ".foo/1-a"},
+		},
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		dir := t.TempDir()
+		writeFiles(t, dir, tt.files)
+		fs := New(dir)
+		simplify := func(issues []Issue) []issue {
+			var result []issue
+			for _, i := range issues {
+				path, _ := filepath.Rel(dir, i.Path)
+				result = append(result, issue{
+					Kind:  i.Kind,
+					DocID: i.DocID,
+					Path:  filepath.ToSlash(path),
+					Fixed: i.Fixed,
+				})
+			}
+			sort.Slice(result, func(i, j int) bool {
+				return result[i].Path < result[j].Path
+			})
+			return result
+		}
+		issues, err := fs.Fsck(context.Background(), tt.repair)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffInterface(tt.want, simplify(issues)); d != nil {
+			t.Error(d)
+		}
+		issues, err = fs.Fsck(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := tt.after
+		if !tt.repair {
+			after = tt.want
+		}
+		if d := testy.DiffInterface(after, simplify(issues)); d != nil {
+			t.Errorf("Unexpected issues on second pass:\n%s", d)
+		}
+		if tt.repair {
+			if _, err := fs.GetRev("foo", ""); err != nil {
+				t.Errorf("Failed to read foo after repair: %s", err)
+			}
+		}
+	})
+}
+
+func TestFsckUnopenableAttachment(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("file permissions are not enforced for root")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"foo.json":  `{"_rev":"1-a","_attachments":{"a.txt":{"content_type":"text/plain","length":3,"digest":"md5-kAFQmDzST7DWlj99KOF/cg=="}}}`,
+		"foo/a.txt": "abc",
+		"bar.json":  `{"_rev":"1-a","_attachments":{"b.txt":{"content_type":"text/plain","length":3,"digest":"md5-wrong"}}}`,
+		"bar/b.txt": "abc",
+	})
+	att := filepath.Join(dir, "foo", "a.txt")
+	if err := os.Chmod(att, 0o000); err != nil {
+		t.Fatal(err)
+	}
+	issues, err := New(dir).Fsck(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The unopenable attachment doesn't stop the rest of the check.
+	kinds := map[string]IssueKind{}
+	for _, i := range issues {
+		kinds[i.Path] = i.Kind
+	}
+	want := map[string]IssueKind{
+		att:                                IssueUnreadable,
+		filepath.Join(dir, "bar", "b.txt"): IssueDigestMismatch,
+	}
+	if d := testy.DiffInterface(want, kinds); d != nil {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,330 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// JournalDirName is the directory, within a database, which holds the
+// journals of revision updates in progress. As document IDs may not begin
+// with an underscore, it cannot collide with a document's revisions directory.
+const JournalDirName = "._journal"
+
+// LockDirName is the directory, within a database, which holds lock files
+// while they are in use.
+const LockDirName = "._locks"
+
+// The journal operations.
+const (
+	opMkdir  = "mkdir"
+	opRename = "rename"
+	opRemove = "remove"
+)
+
+// journalOp is a single step of a journal. Paths are relative to the
+// database root.
+type journalOp struct {
+	Op   string `json:"op"`
+	Path string `json:"path,omitempty"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// journal records the filesystem operations needed to promote a new winning
+// revision, before any of them are performed, so that an interrupted update
+// can be completed, or undone, by Recover.
+type journal struct {
+	DocID string      `json:"id"`
+	Ops   []journalOp `json:"ops"`
+
+	root string
+}
+
+// rel returns path, which must be within the database, relative to the
+// database root.
+func (j *journal) rel(path string) (string, error) {
+	rel, err := filepath.Rel(j.root, path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is outside the database", path)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (j *journal) abs(path string) string {
+	return filepath.Join(j.root, filepath.FromSlash(path))
+}
+
+// mkdir adds a step creating the directory path, if it doesn't already exist.
+func (j *journal) mkdir(path string) error {
+	rel, err := j.rel(path)
+	if err != nil {
+		return err
+	}
+	j.Ops = append(j.Ops, journalOp{Op: opMkdir, Path: rel})
+	return nil
+}
+
+// rename adds a step renaming from to to.
+func (j *journal) rename(from, to string) error {
+	relFrom, err := j.rel(from)
+	if err != nil {
+		return err
+	}
+	relTo, err := j.rel(to)
+	if err != nil {
+		return err
+	}
+	j.Ops = append(j.Ops, journalOp{Op: opRename, From: relFrom, To: relTo})
+	return nil
+}
+
+// remove adds a step removing path, if it is an empty directory.
+func (j *journal) remove(path string) error {
+	rel, err := j.rel(path)
+	if err != nil {
+		return err
+	}
+	j.Ops = append(j.Ops, journalOp{Op: opRemove, Path: rel})
+	return nil
+}
+
+// validate returns an error if any of the journal's paths, as read from disk,
+// would lead outside the database.
+func (j *journal) validate() error {
+	for _, op := range j.Ops {
+		for _, path := range []string{op.Path, op.From, op.To} {
+			if path != "" && !filepath.IsLocal(filepath.FromSlash(path)) {
+				return fmt.Errorf("%s is outside the database", path)
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *FS) journalPath(docID string) string {
+	return filepath.Join(fs.root, JournalDirName, EscapeID(docID)+".json")
+}
+
+func (fs *FS) newJournal(docID string) *journal {
+	return &journal{DocID: docID, root: fs.root}
+}
+
+// runJournal writes the journal, then performs its operations. If an operation
+// fails, those already performed are undone. The journal is removed once the
+// operations have completed or been undone, and left in place for Recover
+// otherwise.
+func (fs *FS) runJournal(j *journal) error {
+	if len(j.Ops) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	path := fs.journalPath(j.DocID)
+	if err := fs.fs.Mkdir(filepath.Dir(path), tempPerms); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := atomicWriteFile(fs.fs, path, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	return fs.finishJournal(path, fs.replay(j))
+}
+
+// finishJournal removes the journal at path, unless err, as returned by
+// replay, indicates that the journal is still needed, then returns err.
+func (fs *FS) finishJournal(path string, err error) error {
+	if errors.As(err, &rollbackError{}) {
+		return err
+	}
+	if rmErr := fs.removeJournal(path); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// removeJournal removes the journal at path, and the journal directory if
+// it's now empty.
+func (fs *FS) removeJournal(path string) error {
+	if err := fs.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Another update may be in progress, so don't worry if we fail.
+	_ = fs.fs.Remove(filepath.Dir(path))
+	return nil
+}
+
+// rollbackError is returned by replay when a journal could be neither rolled
+// forward nor rolled back.
+type rollbackError struct {
+	err, rbErr error
+}
+
+func (e rollbackError) Error() string {
+	return fmt.Sprintf("%s; rollback failed: %s", e.err, e.rbErr)
+}
+
+func (e rollbackError) Unwrap() error { return e.err }
+
+// replay rolls the journal forward, from the first operation not yet
+// performed. If an operation can't be performed, the journal is rolled back
+// instead, and the error returned.
+func (fs *FS) replay(j *journal) error {
+	start := fs.progress(j)
+	for i := start; i < len(j.Ops); i++ {
+		if err := fs.forward(j, j.Ops[i]); err != nil {
+			if rbErr := fs.rollback(j, j.Ops[:i]); rbErr != nil {
+				return rollbackError{err: err, rbErr: rbErr}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// progress returns the index of the first operation of j not yet performed.
+// A path may be the source of one rename and the target of a later one, so
+// each rename can't be judged on its own. Instead, as the operations are
+// performed in order, every operation up to the last rename whose source is
+// gone, and whose target exists, is complete.
+func (fs *FS) progress(j *journal) int {
+	for i := len(j.Ops) - 1; i >= 0; i-- {
+		op := j.Ops[i]
+		if op.Op != opRename {
+			continue
+		}
+		if _, err := fs.fs.Stat(j.abs(op.From)); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := fs.fs.Stat(j.abs(op.To)); err == nil {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (fs *FS) forward(j *journal, op journalOp) error {
+	switch op.Op {
+	case opMkdir:
+		if err := fs.fs.MkdirAll(j.abs(op.Path), tempPerms); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case opRename:
+		return fs.fs.Rename(j.abs(op.From), j.abs(op.To))
+	case opRemove:
+		// Only empty directories are removed, so failure is harmless.
+		_ = fs.fs.Remove(j.abs(op.Path))
+	default:
+		return fmt.Errorf("unknown journal operation %q", op.Op)
+	}
+	return nil
+}
+
+// rollback undoes ops, which have all been performed, in reverse order.
+func (fs *FS) rollback(j *journal, ops []journalOp) error {
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		switch op.Op {
+		case opMkdir:
+			_ = fs.fs.Remove(j.abs(op.Path))
+		case opRename:
+			from, to := j.abs(op.From), j.abs(op.To)
+			// The original directory may since have been removed.
+			if err := fs.fs.MkdirAll(filepath.Dir(from), tempPerms); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if err := fs.fs.Rename(to, from); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Recover completes, or undoes, an interrupted update of docID, if a journal
+// was left behind. It must only be called while no other update of docID can
+// be in progress.
+func (fs *FS) Recover(docID string) error {
+	path := fs.journalPath(docID)
+	f, err := fs.fs.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return kerr(err)
+	}
+	j := fs.newJournal(docID)
+	err = json.NewDecoder(f).Decode(j)
+	_ = f.Close()
+	if err == nil {
+		err = j.validate()
+	}
+	if err != nil {
+		return statusError{status: http.StatusInternalServerError, error: fmt.Errorf("invalid journal %s: %w", path, err)}
+	}
+	err = fs.replay(j)
+	if !errors.As(err, &rollbackError{}) {
+		// Rolled forward or back, the document is consistent either way.
+		err = nil
+	}
+	return kerr(fs.finishJournal(path, err))
+}
+
+// PendingJournals returns the IDs of documents whose updates were interrupted,
+// and which Recover has yet to complete, in sorted order.
+func (fs *FS) PendingJournals() ([]string, error) {
+	files, err := fs.fs.ReadDir(filepath.Join(fs.root, JournalDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, kerr(err)
+	}
+	var docIDs []string
+	for _, info := range files {
+		name := info.Name()
+		if info.IsDir() || isTempFile(name) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		docIDs = append(docIDs, UnescapeID(strings.TrimSuffix(name, ".json")))
+	}
+	sort.Strings(docIDs)
+	return docIDs, nil
+}
+
+// RecoverAll calls Recover for every document with a pending journal. It must
+// only be called while no other updates can be in progress.
+func (fs *FS) RecoverAll() error {
+	docIDs, err := fs.PendingJournals()
+	if err != nil {
+		return err
+	}
+	for _, docID := range docIDs {
+		if err := fs.Recover(docID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/kivik/v4"
+)
+
+// readFiles returns the files under dir, as "path=content" strings, and
+// directories as "path/", in sorted order.
+func readFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var result []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			result = append(result, rel+"/")
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		result = append(result, rel+"="+string(content))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// promotion is the journal of promoting 2-b, with an attachment, over 1-a.
+const promotion = `{"id":"foo","ops":[
+	{"op":"mkdir","path":".foo"},
+	{"op":"rename","from":"foo.json","to":".foo/1-a.json"},
+	{"op":"rename","from":".foo/2-b.json","to":"foo.json"},
+	{"op":"mkdir","path":"foo"},
+	{"op":"rename","from":".foo/2-b/a.txt","to":"foo/a.txt"},
+	{"op":"remove","path":".foo/2-b"},
+	{"op":"remove","path":".foo"}
+]}`
+
+func TestRecover(t *testing.T) {
+	type tt struct {
+		files map[string]string
+		want  []string
+		err   string
+	}
+	tests := testy.NewTable()
+	tests.Add("no journal", tt{
+		files: map[string]string{
+			"foo.json": "1-a",
+		},
+		want: []string{"foo.json=1-a"},
+	})
+	tests.Add("not started", tt{
+		files: map[string]string{
+			"._journal/foo.json": promotion,
+			"foo.json":           "1-a",
+			".foo/2-b.json":      "2-b",
+			".foo/2-b/a.txt":     "a",
+		},
+		want: []string{
+			".foo/",
+			".foo/1-a.json=1-a",
+			"foo.json=2-b",
+			"foo/",
+			"foo/a.txt=a",
+		},
+	})
+	tests.Add("interrupted", tt{
+		files: map[string]string{
+			"._journal/foo.json": promotion,
+			".foo/1-a.json":      "1-a",
+			"foo.json":           "2-b",
+			".foo/2-b/a.txt":     "a",
+		},
+		want: []string{
+			".foo/",
+			".foo/1-a.json=1-a",
+			"foo.json=2-b",
+			"foo/",
+			"foo/a.txt=a",
+		},
+	})
+	tests.Add("old winner moved", tt{
+		files: map[string]string{
+			"._journal/foo.json": promotion,
+			".foo/1-a.json":      "1-a",
+			".foo/2-b.json":      "2-b",
+			".foo/2-b/a.txt":     "a",
+		},
+		want: []string{
+			".foo/",
+			".foo/1-a.json=1-a",
+			"foo.json=2-b",
+			"foo/",
+			"foo/a.txt=a",
+		},
+	})
+	tests.Add("completed", tt{
+		files: map[string]string{
+			"._journal/foo.json": promotion,
+			".foo/1-a.json":      "1-a",
+			"foo.json":           "2-b",
+			"foo/a.txt":          "a",
+		},
+		want: []string{
+			".foo/",
+			".foo/1-a.json=1-a",
+			"foo.json=2-b",
+			"foo/",
+			"foo/a.txt=a",
+		},
+	})
+	tests.Add("rolled back", tt{
+		files: map[string]string{
+			"._journal/foo.json": promotion,
+			".foo/1-a.json":      "1-a",
+			".foo/2-b/a.txt":     "a",
+		},
+		want: []string{
+			".foo/",
+			".foo/2-b/",
+			".foo/2-b/a.txt=a",
+			"foo.json=1-a",
+		},
+	})
+	tests.Add("invalid journal", tt{
+		files: map[string]string{
+			"._journal/foo.json": "garbage",
+			"foo.json":           "1-a",
+		},
+		want: []string{
+			"._journal/",
+			"._journal/foo.json=garbage",
+			"foo.json=1-a",
+		},
+		err: "invalid journal .*: invalid character 'g' looking for beginning of value",
+	})
+	tests.Add("path outside database", tt{
+		files: map[string]string{
+			"._journal/foo.json": `{"id":"foo","ops":[{"op":"rename","from":"foo.json","to":"../foo.json"}]}`,
+			"foo.json":           "1-a",
+		},
+		want: []string{
+			"._journal/",
+			`._journal/foo.json={"id":"foo","ops":[{"op":"rename","from":"foo.json","to":"../foo.json"}]}`,
+			"foo.json=1-a",
+		},
+		err: `invalid journal .*: \.\./foo\.json is outside the database`,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		dir := t.TempDir()
+		writeFiles(t, dir, tt.files)
+		err := New(dir).Recover("foo")
+		testy.ErrorRE(t, tt.err, err)
+		if d := testy.DiffInterface(tt.want, readFiles(t, dir)); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestJournalOutsideDatabase(t *testing.T) {
+	dir := t.TempDir()
+	j := New(dir).newJournal("foo")
+	err := j.rename(filepath.Join(dir, "foo.json"), filepath.Join(dir, "..", "foo.json"))
+	testy.ErrorRE(t, `foo\.json is outside the database`, err)
+	if len(j.Ops) != 0 {
+		t.Errorf("Unexpected ops: %v", j.Ops)
+	}
+}
+
+func TestPendingJournals(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"._journal/foo.json":           promotion,
+		"._journal/_design%2Fbar.json": promotion,
+		"._journal/.tmp.baz.json-123":  promotion,
+	})
+	got, err := New(dir).PendingJournals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"_design/bar", "foo"}
+	if d := testy.DiffInterface(want, got); d != nil {
+		t.Error(d)
+	}
+}
+
+func TestPersistRemovesJournal(t *testing.T) {
+	dir := t.TempDir()
+	fs := New(dir)
+	doc := fs.NewDocument("foo")
+	for _, body := range []map[string]interface{}{
+		{"value": "foo"},
+		{"value": "bar"},
+	} {
+		if len(doc.Revisions) > 0 {
+			body["_rev"] = doc.Revisions[0].Rev.String()
+		}
+		rev, err := fs.NewRevision(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := doc.AddRevision(context.TODO(), rev, kivik.Params(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, JournalDirName)); !os.IsNotExist(err) {
+		t.Errorf("Expected journal directory to be removed, got: %v", err)
+	}
+	loser := doc.Revisions[1]
+	if want := filepath.Join(dir, ".foo", loser.Rev.String()+".json"); loser.path != want {
+		t.Errorf("Unexpected path for losing revision: %s", loser.path)
+	}
+}
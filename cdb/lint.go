@@ -0,0 +1,68 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import "fmt"
+
+// WarningKind identifies why a file was skipped.
+type WarningKind string
+
+// The kinds of warning reported in lint mode.
+const (
+	// WarnInvalidDBName is a directory in the root path skipped by AllDBs,
+	// as its name is not a valid database name.
+	WarnInvalidDBName WarningKind = "invalid_db_name"
+	// WarnNotDatabase is a directory in the root path skipped by AllDBs, as
+	// it contains unrecognized files, and no metadata file.
+	WarnNotDatabase WarningKind = "not_a_database"
+	// WarnUndecodable is a document which could not be decoded.
+	WarnUndecodable WarningKind = "undecodable"
+	// WarnBadFilename is a file whose name can't be unescaped to a document
+	// ID.
+	WarnBadFilename WarningKind = "bad_filename"
+	// WarnStrayFile is a file or directory which is not part of any
+	// document, such as one in an unregistered format.
+	WarnStrayFile WarningKind = "stray_file"
+)
+
+// Warning describes a file skipped while scanning the root path or a
+// database.
+type Warning struct {
+	Kind WarningKind
+	// Path is the file or directory skipped.
+	Path    string
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s: %s", w.Kind, w.Path, w.Message)
+}
+
+// SetWarner sets the function to which warnings about skipped files are
+// reported. With none set, the default, files are skipped silently.
+func (fs *FS) SetWarner(warn func(Warning)) {
+	fs.warn = warn
+}
+
+// Warner returns the function to which warnings about skipped files are
+// reported, or nil.
+func (fs *FS) Warner() func(Warning) {
+	return fs.warn
+}
+
+// warnf reports a warning, if a warner is set.
+func (fs *FS) warnf(kind WarningKind, path, format string, args ...interface{}) {
+	if fs.warn != nil {
+		fs.warn(Warning{Kind: kind, Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
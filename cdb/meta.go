@@ -0,0 +1,382 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kivik/fsdb/v4/cdb/decode"
+)
+
+// MetaFileName is the name of the file, within a database, which holds the
+// database's settings. As document IDs may not begin with an underscore, it
+// cannot collide with a document.
+const MetaFileName = "_meta.json"
+
+// The revision hashing modes.
+const (
+	// HashFSDB generates revision IDs from the MD5 sum of the revision's JSON
+	// representation. It is the default.
+	HashFSDB = "fsdb"
+	// HashCouchDB generates revision IDs with CouchDB's algorithm, so that the
+	// same edit produces the same revision ID in fsdb as in CouchDB.
+	HashCouchDB = "couchdb"
+)
+
+// DefaultRevsLimit is the number of ancestors recorded in each revision's
+// history, unless set otherwise in the database's settings.
+const DefaultRevsLimit = revsLimit
+
+// Meta holds the settings of a database, as stored in its MetaFileName file.
+// Unset fields take their defaults.
+type Meta struct {
+	// RevsLimit is the number of ancestors recorded in each revision's
+	// history. Zero means DefaultRevsLimit.
+	RevsLimit int `json:"revs_limit,omitempty"`
+	// Format is the extension in which new documents are written, unless
+	// overridden when the database is opened.
+	Format string `json:"format,omitempty"`
+	// Hashing is the revision hashing mode. Empty means HashFSDB.
+	Hashing string `json:"hashing,omitempty"`
+	// Partitioned is true if document IDs must have the form partition:id.
+	Partitioned bool `json:"partitioned,omitempty"`
+	// Created is the time the database was created, or nil if unknown, as for
+	// databases created by older versions of this driver.
+	Created *time.Time `json:"created,omitempty"`
+	// UUID uniquely identifies the database.
+	UUID string `json:"uuid,omitempty"`
+}
+
+// NewMeta returns the settings for a new database, created now, with a
+// random UUID.
+func NewMeta() (*Meta, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &Meta{
+		Created: &now,
+		UUID:    hex.EncodeToString(uuid),
+	}, nil
+}
+
+func (m *Meta) validate() error {
+	if err := validHashing(m.Hashing); err != nil {
+		return err
+	}
+	if m.Format != "" && !decode.CanEncode(m.Format) {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("unsupported format: %s", m.Format)}
+	}
+	if m.RevsLimit < 0 {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid revs_limit: %d", m.RevsLimit)}
+	}
+	return nil
+}
+
+func validHashing(mode string) error {
+	switch mode {
+	case "", HashFSDB, HashCouchDB:
+		return nil
+	}
+	return statusError{status: http.StatusBadRequest, error: fmt.Errorf("unsupported hashing mode: %s", mode)}
+}
+
+func (fs *FS) metaPath() string {
+	return filepath.Join(fs.root, MetaFileName)
+}
+
+// ReadMeta reads the database's settings. A database without a MetaFileName
+// file, as created by older versions, has the default settings.
+func (fs *FS) ReadMeta() (*Meta, error) {
+	meta := new(Meta)
+	f, err := fs.fs.Open(fs.metaPath())
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, kerr(err)
+	}
+	defer f.Close() // nolint: errcheck
+	if err := json.NewDecoder(f).Decode(meta); err != nil {
+		return nil, statusError{status: http.StatusInternalServerError, error: fmt.Errorf("invalid %s: %w", MetaFileName, err)}
+	}
+	if err := meta.validate(); err != nil {
+		return nil, statusError{status: http.StatusInternalServerError, error: fmt.Errorf("invalid %s: %w", MetaFileName, err)}
+	}
+	return meta, nil
+}
+
+// WriteMeta writes the database's settings.
+func (fs *FS) WriteMeta(meta *Meta) error {
+	if err := meta.validate(); err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return kerr(atomicWriteFile(fs.fs, fs.metaPath(), bytes.NewReader(append(body, '\n'))))
+}
+
+// SetHashing sets the revision hashing mode, HashFSDB or HashCouchDB, with
+// which new revision IDs are generated. It doesn't update the database's
+// settings; see WriteMeta.
+func (fs *FS) SetHashing(mode string) error {
+	if err := validHashing(mode); err != nil {
+		return err
+	}
+	fs.hashing = mode
+	return nil
+}
+
+// Hashing returns the revision hashing mode.
+func (fs *FS) Hashing() string {
+	if fs.hashing == "" {
+		return HashFSDB
+	}
+	return fs.hashing
+}
+
+// SetRevsLimit sets the number of ancestors recorded in the history of each
+// new revision. Zero means DefaultRevsLimit. It doesn't update the database's
+// settings; see WriteMeta.
+func (fs *FS) SetRevsLimit(limit int) error {
+	if limit < 0 {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid revs_limit: %d", limit)}
+	}
+	fs.revsLimit = limit
+	return nil
+}
+
+// RevsLimit returns the number of ancestors recorded in the history of each
+// new revision.
+func (fs *FS) RevsLimit() int {
+	if fs.revsLimit == 0 {
+		return DefaultRevsLimit
+	}
+	return fs.revsLimit
+}
+
+// IsDB returns true if the root is a database: a directory with a
+// MetaFileName file, or, as created by older versions without one, a
+// directory containing nothing the driver doesn't recognize.
+func (fs *FS) IsDB() (bool, error) {
+	info, err := fs.fs.Stat(fs.root)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, kerr(err)
+	}
+	if !info.IsDir() {
+		return false, nil
+	}
+	if _, err := fs.fs.Stat(fs.metaPath()); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, kerr(err)
+	}
+	unknown, err := fs.Unrecognized()
+	return len(unknown) == 0, err
+}
+
+// Unrecognized returns the names of the files and directories in the root
+// which the driver doesn't recognize as part of a database, in sorted order.
+// Recognized are document files in registered formats, revisions directories,
+// the attachments directories of known documents, the _security document,
+// the MetaFileName file, and the driver's own temporary files and
+// directories. Revisions and attachments directories are searched in turn,
+// and unrecognized entries within them are returned as paths relative to the
+// root.
+func (fs *FS) Unrecognized() ([]string, error) {
+	_, unknown, err := fs.scanRoot()
+	return unknown, err
+}
+
+// scanRoot returns the entries of the root, and the names of those which are
+// unrecognized, in sorted order.
+func (fs *FS) scanRoot() ([]os.FileInfo, []string, error) {
+	entries, err := fs.fs.ReadDir(fs.root)
+	if err != nil {
+		return nil, nil, kerr(err)
+	}
+	docIDs := map[string]struct{}{}
+	for _, info := range entries {
+		if info.IsDir() {
+			continue
+		}
+		if docID, ok := fileDocID(info.Name()); ok {
+			docIDs[docID] = struct{}{}
+		}
+	}
+	revsDirs := map[string]struct{}{}
+	for _, info := range entries {
+		name := info.Name()
+		if !info.IsDir() || !strings.HasPrefix(name, ".") || isTempFile(name) || name == LockDirName || name == JournalDirName {
+			continue
+		}
+		docID := UnescapeID(name[1:])
+		if !isDocID(docID) {
+			continue
+		}
+		if _, ok := docIDs[docID]; !ok {
+			// Without a winning revision, the directory must look the part.
+			ok, err := fs.isRevsDir(filepath.Join(fs.root, name))
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		revsDirs[name] = struct{}{}
+		docIDs[docID] = struct{}{}
+	}
+	var unknown []string
+	for _, info := range entries {
+		name := info.Name()
+		if isTempFile(name) || name == MetaFileName {
+			continue
+		}
+		if info.IsDir() {
+			if name == LockDirName || name == JournalDirName {
+				continue
+			}
+			if _, ok := revsDirs[name]; ok {
+				revsUnknown, err := fs.unrecognizedRevs(name)
+				if err != nil {
+					return nil, nil, err
+				}
+				unknown = append(unknown, revsUnknown...)
+				continue
+			}
+			if _, ok := docIDs[UnescapeID(name)]; ok {
+				attsUnknown, err := fs.unrecognizedAtts(name)
+				if err != nil {
+					return nil, nil, err
+				}
+				unknown = append(unknown, attsUnknown...)
+				continue
+			}
+		} else {
+			if _, ok := fileDocID(name); ok {
+				continue
+			}
+			if base, _, ok := decode.ExplodeFilename(name); ok && base == "_security" {
+				continue
+			}
+		}
+		unknown = append(unknown, name)
+	}
+	sort.Strings(unknown)
+	return entries, unknown, nil
+}
+
+// fileDocID returns the ID of the document stored in the named file, if it
+// is a document file in a registered format.
+func fileDocID(name string) (string, bool) {
+	base, _, ok := decode.ExplodeFilename(name)
+	if !ok {
+		return "", false
+	}
+	docID := UnescapeID(base)
+	return docID, isDocID(docID)
+}
+
+// isRevsDir returns true if path looks like a revisions directory: empty, or
+// containing at least one file or directory named for a revision ID.
+func (fs *FS) isRevsDir(path string) (bool, error) {
+	entries, err := fs.fs.ReadDir(path)
+	if err != nil {
+		return false, kerr(err)
+	}
+	if len(entries) == 0 {
+		return true, nil
+	}
+	for _, info := range entries {
+		name := info.Name()
+		if base, _, ok := decode.ExplodeFilename(name); ok {
+			name = base
+		}
+		if isRevID(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isRevID returns true if name is a complete revision ID.
+func isRevID(name string) bool {
+	var rev RevID
+	return rev.UnmarshalText([]byte(name)) == nil && rev.Seq > 0 && rev.Sum != ""
+}
+
+// unrecognizedRevs returns the entries of the revisions directory dir, and
+// of its revisions' attachments directories, which aren't part of a document,
+// as paths relative to the root. Recognized are revisions, in registered
+// formats, the attachments directories named for them, and temporary files.
+func (fs *FS) unrecognizedRevs(dir string) ([]string, error) {
+	entries, err := fs.fs.ReadDir(filepath.Join(fs.root, dir))
+	if err != nil {
+		return nil, kerr(err)
+	}
+	var unknown []string
+	for _, info := range entries {
+		name := info.Name()
+		if isTempFile(name) {
+			continue
+		}
+		if info.IsDir() {
+			if isRevID(name) {
+				attsUnknown, err := fs.unrecognizedAtts(filepath.Join(dir, name))
+				if err != nil {
+					return nil, err
+				}
+				unknown = append(unknown, attsUnknown...)
+				continue
+			}
+		} else if base, _, ok := decode.ExplodeFilename(name); ok && isRevID(base) {
+			continue
+		}
+		unknown = append(unknown, filepath.Join(dir, name))
+	}
+	return unknown, nil
+}
+
+// unrecognizedAtts returns the entries of the attachments directory dir which
+// can't be attachments, as paths relative to the root. As attachment names
+// may not contain a slash, that's any directory, other than temporary ones.
+func (fs *FS) unrecognizedAtts(dir string) ([]string, error) {
+	entries, err := fs.fs.ReadDir(filepath.Join(fs.root, dir))
+	if err != nil {
+		return nil, kerr(err)
+	}
+	var unknown []string
+	for _, info := range entries {
+		if info.IsDir() && !isTempFile(info.Name()) {
+			unknown = append(unknown, filepath.Join(dir, info.Name()))
+		}
+	}
+	return unknown, nil
+}
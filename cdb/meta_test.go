@@ -0,0 +1,289 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package cdb
+
+import (
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-kivik/kivik/v4"
+	"gitlab.com/flimzy/testy"
+)
+
+func TestReadMeta(t *testing.T) {
+	created := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	type tt struct {
+		files  map[string]string
+		want   *Meta
+		status int
+		err    string
+	}
+	tests := testy.NewTable()
+	tests.Add("missing", tt{
+		want: &Meta{},
+	})
+	tests.Add("couchdb hashing", tt{
+		files: map[string]string{
+			MetaFileName: `{"hashing":"couchdb"}`,
+		},
+		want: &Meta{Hashing: HashCouchDB},
+	})
+	tests.Add("all settings", tt{
+		files: map[string]string{
+			MetaFileName: `{"revs_limit":5,"format":"yaml","hashing":"fsdb","partitioned":true,"created":"2021-03-04T05:06:07Z","uuid":"0123456789abcdef0123456789abcdef"}`,
+		},
+		want: &Meta{
+			RevsLimit:   5,
+			Format:      "yaml",
+			Hashing:     HashFSDB,
+			Partitioned: true,
+			Created:     &created,
+			UUID:        "0123456789abcdef0123456789abcdef",
+		},
+	})
+	tests.Add("invalid json", tt{
+		files: map[string]string{
+			MetaFileName: `{"hashing":`,
+		},
+		status: http.StatusInternalServerError,
+		err:    "invalid _meta.json: unexpected EOF",
+	})
+	tests.Add("unknown hashing mode", tt{
+		files: map[string]string{
+			MetaFileName: `{"hashing":"sha1"}`,
+		},
+		status: http.StatusInternalServerError,
+		err:    "invalid _meta.json: unsupported hashing mode: sha1",
+	})
+	tests.Add("unknown format", tt{
+		files: map[string]string{
+			MetaFileName: `{"format":"xml"}`,
+		},
+		status: http.StatusInternalServerError,
+		err:    "invalid _meta.json: unsupported format: xml",
+	})
+	tests.Add("negative revs_limit", tt{
+		files: map[string]string{
+			MetaFileName: `{"revs_limit":-1}`,
+		},
+		status: http.StatusInternalServerError,
+		err:    "invalid _meta.json: invalid revs_limit: -1",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		dir := t.TempDir()
+		writeFiles(t, dir, tt.files)
+		meta, err := New(dir).ReadMeta()
+		testy.StatusError(t, tt.err, tt.status, err)
+		if d := testy.DiffInterface(tt.want, meta); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestWriteMeta(t *testing.T) {
+	type tt struct {
+		meta   *Meta
+		want   []string
+		status int
+		err    string
+	}
+	tests := testy.NewTable()
+	tests.Add("couchdb hashing", tt{
+		meta: &Meta{Hashing: HashCouchDB},
+		want: []string{MetaFileName + "={\n  \"hashing\": \"couchdb\"\n}\n"},
+	})
+	tests.Add("unknown hashing mode", tt{
+		meta:   &Meta{Hashing: "sha1"},
+		status: http.StatusBadRequest,
+		err:    "unsupported hashing mode: sha1",
+	})
+	tests.Add("unknown format", tt{
+		meta:   &Meta{Format: "xml"},
+		status: http.StatusBadRequest,
+		err:    "unsupported format: xml",
+	})
+	tests.Add("negative revs_limit", tt{
+		meta:   &Meta{RevsLimit: -1},
+		status: http.StatusBadRequest,
+		err:    "invalid revs_limit: -1",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		dir := t.TempDir()
+		fs := New(dir)
+		err := fs.WriteMeta(tt.meta)
+		testy.StatusError(t, tt.err, tt.status, err)
+		if d := testy.DiffInterface(tt.want, readFiles(t, dir)); d != nil {
+			t.Error(d)
+		}
+		meta, err := fs.ReadMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffInterface(tt.meta, meta); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestNewMeta(t *testing.T) {
+	before := time.Now()
+	meta, err := NewMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Created == nil || meta.Created.Before(before.Add(-time.Second)) || meta.Created.Location() != time.UTC {
+		t.Errorf("Unexpected creation time: %v", meta.Created)
+	}
+	if !regexp.MustCompile("^[0-9a-f]{32}$").MatchString(meta.UUID) {
+		t.Errorf("Unexpected UUID: %s", meta.UUID)
+	}
+	other, err := NewMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.UUID == meta.UUID {
+		t.Errorf("UUID repeated: %s", meta.UUID)
+	}
+}
+
+func TestUnrecognized(t *testing.T) {
+	type tt struct {
+		files map[string]string
+		want  []string
+		isDB  bool
+	}
+	tests := testy.NewTable()
+	tests.Add("empty", tt{
+		isDB: true,
+	})
+	tests.Add("database", tt{
+		files: map[string]string{
+			"foo.json":            `{"_rev":"2-b"}`,
+			".foo/1-a.yaml":       `_rev: 1-a`,
+			".foo/1-a/att.txt":    "att",
+			"foo/att.txt":         "att",
+			"bar.yaml":            `_rev: 1-a`,
+			"bar/":                "",
+			".baz/1-a.json":       `{}`,
+			"baz/att.txt":         "att",
+			"_design%2Fx.json":    `{}`,
+			"_design%2Fx/att.txt": "att",
+			"_security.json":      `{}`,
+			MetaFileName:          `{}`,
+			".tmp.foo.json.123":   "",
+			LockDirName + "/x":    "",
+			JournalDirName + "/x": "",
+			".tmp.promote-123/x":  "",
+			"_local%2Fx.json":     `{}`,
+		},
+		isDB: true,
+	})
+	tests.Add("stray files", tt{
+		files: map[string]string{
+			"foo.json":    `{}`,
+			"README.md":   "read me",
+			"photos/a":    "jpeg",
+			"_other.json": `{}`,
+			".git/HEAD":   "ref",
+		},
+		want: []string{".git", "README.md", "_other.json", "photos"},
+	})
+	tests.Add("stray files in document directories", tt{
+		files: map[string]string{
+			MetaFileName:         `{}`,
+			"foo.json":           `{"_rev":"2-b"}`,
+			"foo/att.txt":        "att",
+			"foo/photos/a":       "jpeg",
+			".foo/1-a.json":      `{"_rev":"1-a"}`,
+			".foo/1-a/att.txt":   "att",
+			".foo/1-a/photos/a":  "jpeg",
+			".foo/2-c/":          "",
+			".foo/notes.txt":     "notes",
+			".foo/.tmp.1-b.json": "",
+		},
+		want: []string{".foo/1-a/photos", ".foo/notes.txt", "foo/photos"},
+		isDB: true,
+	})
+	tests.Add("stray files with metadata", tt{
+		files: map[string]string{
+			MetaFileName: `{}`,
+			"README.md":  "read me",
+		},
+		want: []string{"README.md"},
+		isDB: true,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		dir := t.TempDir()
+		writeFiles(t, dir, tt.files)
+		fs := New(dir)
+		got, err := fs.Unrecognized()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffInterface(tt.want, got); d != nil {
+			t.Error(d)
+		}
+		isDB, err := fs.IsDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isDB != tt.isDB {
+			t.Errorf("Unexpected IsDB result: %t", isDB)
+		}
+	})
+}
+
+func TestIsDBMissing(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"file": ""})
+	for _, path := range []string{"missing", "file"} {
+		isDB, err := New(filepath.Join(dir, path)).IsDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isDB {
+			t.Errorf("%s reported as a database", path)
+		}
+	}
+}
+
+func TestRevsLimit(t *testing.T) {
+	dir := t.TempDir()
+	fs := New(dir)
+	if err := fs.SetRevsLimit(-1); err == nil {
+		t.Fatal("expected an error for a negative limit")
+	}
+	if got := fs.RevsLimit(); got != DefaultRevsLimit {
+		t.Errorf("Unexpected default limit: %d", got)
+	}
+	if err := fs.SetRevsLimit(2); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"a", "b", "c", "d"} {
+		putRev(t, fs, "foo", value)
+	}
+	doc, err := fs.OpenDocID("foo", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := doc.Revisions[0].RevHistory
+	if history.Start != 4 || len(history.IDs) != 2 {
+		t.Errorf("Unexpected history: %+v", history)
+	}
+}
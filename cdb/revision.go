@@ -17,6 +17,7 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -24,6 +25,7 @@ import (
 	"strings"
 
 	"github.com/icza/dyno"
+	yaml "gopkg.in/yaml.v2"
 
 	"github.com/go-kivik/fsdb/v4/filesystem"
 )
@@ -40,6 +42,9 @@ type RevMeta struct {
 	isMain bool                  // nolint: structcheck
 	path   string                // nolint: structcheck
 	fs     filesystem.Filesystem // nolint: structcheck
+	// noHistory is true if the revision was read without a _revisions
+	// history, so that RevHistory holds only the revision itself.
+	noHistory bool // nolint: structcheck
 }
 
 // Revision is a specific instance of a document.
@@ -98,6 +103,7 @@ func (r *Revision) finalizeUnmarshal() error {
 			ids = make([]string, int(histSize))
 		} else {
 			ids = []string{r.Rev.Sum}
+			r.noHistory = true
 		}
 		r.RevHistory = &RevHistory{
 			Start: r.Rev.Seq,
@@ -124,9 +130,10 @@ func (r *Revision) MarshalJSON() ([]byte, error) {
 		}
 	}
 	stub, follows := r.stubFollows()
+	since := r.attsSince()
 	for _, att := range r.Attachments {
-		att.outputStub = stub
-		att.Follows = follows
+		att.outputStub = stub || (att.RevPos != nil && *att.RevPos <= since)
+		att.Follows = follows && !att.outputStub
 	}
 	parts := make([]json.RawMessage, 0, 2)
 	metaJSON, err := json.Marshal(meta)
@@ -144,6 +151,43 @@ func (r *Revision) MarshalJSON() ([]byte, error) {
 	return joinJSON(parts...), nil
 }
 
+// MarshalYAML satisfies the yaml.Marshaler interface. The metadata keys are
+// written first, followed by the document's data.
+func (r *Revision) MarshalYAML() (interface{}, error) {
+	revs, _ := r.options["revs"].(bool)
+	if _, ok := r.options["rev"]; ok {
+		revs = false
+	}
+	stub, follows := r.stubFollows()
+	since := r.attsSince()
+	doc := yaml.MapSlice{{Key: "_rev", Value: r.Rev}}
+	if r.Deleted != nil {
+		doc = append(doc, yaml.MapItem{Key: "_deleted", Value: *r.Deleted})
+	}
+	if len(r.Attachments) > 0 {
+		atts := make(yaml.MapSlice, 0, len(r.Attachments))
+		for _, filename := range sortedAttachments(r.Attachments) {
+			att := r.Attachments[filename]
+			att.outputStub = stub || (att.RevPos != nil && *att.RevPos <= since)
+			att.Follows = follows && !att.outputStub
+			atts = append(atts, yaml.MapItem{Key: filename, Value: att})
+		}
+		doc = append(doc, yaml.MapItem{Key: "_attachments", Value: atts})
+	}
+	if revs && r.RevHistory != nil {
+		doc = append(doc, yaml.MapItem{Key: "_revisions", Value: r.RevHistory})
+	}
+	keys := make([]string, 0, len(r.Data))
+	for key := range r.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		doc = append(doc, yaml.MapItem{Key: key, Value: r.Data[key]})
+	}
+	return doc, nil
+}
+
 func (r *Revision) stubFollows() (bool, bool) {
 	attachments, _ := r.options["attachments"].(bool)
 	if !attachments {
@@ -153,11 +197,73 @@ func (r *Revision) stubFollows() (bool, bool) {
 	return false, accept != "application/json"
 }
 
+// attsSince returns the highest sequence number of the revisions listed in
+// the atts_since option, which are also ancestors of r. Attachments with a
+// revpos less than or equal to this value are already known to the client.
+func (r *Revision) attsSince() int64 {
+	since, _ := r.options["atts_since"].([]string)
+	if len(since) == 0 || r.RevHistory == nil {
+		return 0
+	}
+	ancestors := make(map[string]struct{}, len(r.RevHistory.IDs))
+	for _, rev := range r.RevHistory.Ancestors() {
+		ancestors[rev] = struct{}{}
+	}
+	var max int64
+	for _, revid := range since {
+		if _, ok := ancestors[revid]; !ok {
+			continue
+		}
+		var rev RevID
+		if err := rev.UnmarshalText([]byte(revid)); err != nil {
+			continue
+		}
+		if rev.Seq > max {
+			max = rev.Seq
+		}
+	}
+	return max
+}
+
+// inferHistories completes the histories of revisions read without one, such
+// as those written with SetOmitRevisions, or by hand, from that of their parent, where exactly one
+// revision has the preceding sequence number. Parents are completed before
+// their children, so a chain of such revisions is completed in full.
+func (r Revisions) inferHistories(limit int) {
+	bySeq := make(map[int64]Revisions, len(r))
+	for _, rev := range r {
+		bySeq[rev.Rev.Seq] = append(bySeq[rev.Rev.Seq], rev)
+	}
+	revs := make(Revisions, len(r))
+	copy(revs, r)
+	sort.SliceStable(revs, func(i, j int) bool {
+		return revs[i].Rev.Seq < revs[j].Rev.Seq
+	})
+	for _, rev := range revs {
+		parents := bySeq[rev.Rev.Seq-1]
+		if !rev.noHistory || len(parents) != 1 {
+			continue
+		}
+		rev.RevHistory = parents[0].RevHistory.AddRevision(rev.Rev).truncate(limit)
+		rev.noHistory = false
+	}
+}
+
 func (r *Revision) openAttachment(filename string) (filesystem.File, error) {
+	path, err := r.attachmentPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Open(path)
+}
+
+// attachmentPath returns the path of the named attachment's file, which is
+// stored with the revision, or with the first of its ancestors to have it.
+func (r *Revision) attachmentPath(filename string) (string, error) {
 	path := strings.TrimSuffix(r.path, filepath.Ext(r.path))
-	f, err := r.fs.Open(filepath.Join(path, filename))
-	if !os.IsNotExist(err) {
-		return f, err
+	fullpath := filepath.Join(path, filename)
+	if _, err := r.fs.Stat(fullpath); !os.IsNotExist(err) {
+		return fullpath, err
 	}
 	basename := filepath.Base(path)
 	path = strings.TrimSuffix(path, basename)
@@ -167,12 +273,11 @@ func (r *Revision) openAttachment(filename string) (filesystem.File, error) {
 	}
 	for _, rev := range r.RevHistory.Ancestors() {
 		fullpath := filepath.Join(path, rev, filename)
-		f, err := r.fs.Open(fullpath)
-		if !os.IsNotExist(err) {
-			return f, err
+		if _, err := r.fs.Stat(fullpath); !os.IsNotExist(err) {
+			return fullpath, err
 		}
 	}
-	return nil, fmt.Errorf("attachment '%s': %w", filename, errNotFound)
+	return "", fmt.Errorf("attachment '%s': %w", filename, errNotFound)
 }
 
 // Revisions is a sortable list of document revisions.
@@ -205,11 +310,37 @@ func (r Revisions) Deleted() bool {
 
 // Delete deletes the revision.
 func (r *Revision) Delete(context.Context) error {
-	if err := os.Remove(r.path); err != nil {
+	if err := r.fs.Remove(r.path); err != nil {
 		return err
 	}
 	attpath := strings.TrimSuffix(r.path, filepath.Ext(r.path))
-	return os.RemoveAll(attpath)
+	return r.fs.RemoveAll(attpath)
+}
+
+// Copy returns a new, unsaved revision with the same content and attachments
+// as r, suitable for adding to another document. When the new revision is
+// persisted, its attachments are hard-linked to r's attachment files, rather
+// than copied, where the filesystem allows.
+func (r *Revision) Copy() *Revision {
+	rev := new(Revision)
+	rev.fs = r.fs
+	rev.Data = make(map[string]interface{}, len(r.Data))
+	for k, v := range r.Data {
+		rev.Data[k] = v
+	}
+	if len(r.Attachments) > 0 {
+		rev.Attachments = make(map[string]*Attachment, len(r.Attachments))
+	}
+	for filename, att := range r.Attachments {
+		rev.Attachments[filename] = &Attachment{
+			ContentType: att.ContentType,
+			Size:        att.Size,
+			Digest:      att.Digest,
+			fs:          att.fs,
+			linkFrom:    att.path,
+		}
+	}
+	return rev
 }
 
 // NewRevision creates a new revision from i, according to opts.
@@ -232,7 +363,9 @@ func (fs *FS) NewRevision(i interface{}) (*Revision, error) {
 	return rev, nil
 }
 
-func (r *Revision) persist(ctx context.Context, path string) error {
+// persist writes the revision, with encode, to path, plus the extension ext,
+// and its attachments to the directory path.
+func (r *Revision) persist(ctx context.Context, path, ext string, encode func(io.Writer) error) error {
 	if err := r.fs.Mkdir(filepath.Dir(path), tempPerms); err != nil && !os.IsExist(err) {
 		return err
 	}
@@ -255,19 +388,27 @@ func (r *Revision) persist(ctx context.Context, path string) error {
 			return err
 		}
 	}
-	f := atomicFileWriter(r.fs, path+".json")
+	f := atomicFileWriter(r.fs, path+"."+ext)
 	defer f.Close() // nolint: errcheck
-	r.options = map[string]interface{}{"revs": true}
-	if err := json.NewEncoder(f).Encode(r); err != nil {
+	if err := encode(f); err != nil {
 		return err
 	}
 	if err := f.Close(); err != nil {
 		return err
 	}
-	r.path = path + ".json"
+	r.path = path + "." + ext
 	return nil
 }
 
+// revHash returns the hash for the new revision rev, a child of oldrev, or of
+// no revision if oldrev is nil, according to the hashing mode.
+func (fs *FS) revHash(rev, oldrev *Revision) (string, error) {
+	if fs.Hashing() == HashCouchDB {
+		return rev.couchHash(oldrev)
+	}
+	return rev.hash()
+}
+
 // hash passes deterministic JSON content of the revision through md5 to
 // generate a hash to be used in the revision ID.
 func (r *Revision) hash() (string, error) {
@@ -13,7 +13,9 @@
 package cdb
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"os"
 	"path/filepath"
 
@@ -40,3 +42,37 @@ func (fs *FS) ReadSecurity(ctx context.Context, path string) (*driver.Security,
 	}
 	return sec, nil
 }
+
+// WriteSecurity writes sec to the _security.{ext} document in path, in the
+// format of the existing document, if there is one, or else the default. It
+// is encoded as a generic object, so that empty fields are omitted in every
+// format.
+func (fs *FS) WriteSecurity(ctx context.Context, path string, sec *driver.Security) error {
+	ext := fs.Format()
+	for _, e := range decode.Extensions() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := fs.fs.Stat(filepath.Join(path, "_security."+e))
+		if err == nil {
+			ext = e
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	body, err := json.Marshal(sec)
+	if err != nil {
+		return err
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if err := decode.Encode(buf, ext, obj); err != nil {
+		return err
+	}
+	return kerr(atomicWriteFile(fs.fs, filepath.Join(path, "_security."+ext), buf))
+}
@@ -80,10 +80,10 @@ func copyDigest(tgt io.Writer, dst io.Reader) (int64, string, error) {
 	return written, "md5-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), err
 }
 
-func digest(r io.Reader) (int64, string) {
+func digest(r io.Reader) (int64, string, error) {
 	h := md5.New()
-	written, _ := io.Copy(h, r)
-	return written, "md5-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+	written, err := io.Copy(h, r)
+	return written, "md5-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), err
 }
 
 func joinJSON(objects ...json.RawMessage) []byte {
@@ -12,10 +12,13 @@
 
 // Changes feed support
 //
-// At present, this driver provides only rudamentary Changes feed support. It
-// supports only one-off changes feeds (no continuous support), and this is
-// implemented by scanning the database directory, and returning each document
-// and its most recent revision only.
+// At present, this driver provides only rudamentary Changes feed support.
+// Each call returns a one-off feed, implemented by scanning the database
+// directory, and returning each document and its most recent revision only,
+// or with the style=all_docs option, all of its leaf revisions. Continuous
+// replication, and the HTTP server's longpoll and continuous feeds, are built
+// on top of this by polling: the feed is re-read every poll interval, as no
+// sequence IDs are reported to resume from.
 
 package fs
 
@@ -25,6 +28,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/go-kivik/fsdb/v4/cdb"
 	"github.com/go-kivik/fsdb/v4/cdb/decode"
 	"github.com/go-kivik/kivik/v4/driver"
 )
@@ -33,6 +37,9 @@ type changes struct {
 	db    *db
 	ctx   context.Context
 	infos []os.FileInfo
+	// allDocs is true if all leaf revisions are to be returned, rather than
+	// only the winner.
+	allDocs bool
 }
 
 var _ driver.Changes = &changes{}
@@ -54,7 +61,11 @@ func ignoreDocID(name string) bool {
 	return true
 }
 
+// Next returns the next change. In lint mode, skipped files are reported,
+// and documents which can't be decoded are skipped, rather than ending the
+// feed with an error.
 func (c *changes) Next(ch *driver.Change) error {
+next:
 	for {
 		if len(c.infos) == 0 {
 			return io.EOF
@@ -64,49 +75,89 @@ func (c *changes) Next(ch *driver.Change) error {
 		if candidate.IsDir() {
 			continue
 		}
+		path := c.db.path(candidate.Name())
 		for _, ext := range decode.Extensions() {
 			if strings.HasSuffix(candidate.Name(), "."+ext) {
 				base := strings.TrimSuffix(candidate.Name(), "."+ext)
 				docid, err := filename2id(base)
 				if err != nil {
 					// ignore unrecognized files
-					continue
+					c.db.warnf(cdb.WarnBadFilename, path, "%s", err)
+					continue next
 				}
 				if ignoreDocID(docid) {
-					continue
+					if !isSpecialDocID(docid) {
+						c.db.warnf(cdb.WarnStrayFile, path, "invalid document ID: %s", docid)
+					}
+					continue next
 				}
 				rev, deleted, err := c.db.metadata(candidate.Name(), ext)
 				if err != nil {
+					if c.db.warn != nil {
+						c.db.warnf(cdb.WarnUndecodable, path, "%s", err)
+						continue next
+					}
 					return err
 				}
 				if rev == "" {
 					rev = "1-"
 				}
+				revs := []string{rev}
+				if c.allDocs {
+					if revs, err = c.leafRevs(docid, base, rev); err != nil {
+						if c.db.warn != nil {
+							c.db.warnf(cdb.WarnUndecodable, path, "%s", err)
+							continue next
+						}
+						return err
+					}
+				}
 				ch.ID = docid
 				ch.Deleted = deleted
-				ch.Changes = []string{rev}
+				ch.Changes = revs
 				return nil
 			}
 		}
+		if !strings.HasPrefix(candidate.Name(), ".tmp.") {
+			c.db.warnf(cdb.WarnStrayFile, path, "not in a registered format")
+		}
+	}
+}
+
+// leafRevs returns the leaf revisions of the document, winner first, which is
+// only read from disk if the document has a revisions directory.
+func (c *changes) leafRevs(docID, base, winner string) ([]string, error) {
+	if _, err := c.db.fsys().Stat(c.db.path("." + base)); os.IsNotExist(err) {
+		return []string{winner}, nil
+	}
+	doc, err := c.db.cdb.OpenDocRevs(docID)
+	if err != nil {
+		return nil, err
+	}
+	leaves := doc.Leaves()
+	revs := make([]string, len(leaves))
+	for i, rev := range leaves {
+		revs[i] = rev.Rev.String()
 	}
+	return revs, nil
 }
 
 func (c *changes) Close() error {
 	return nil
 }
 
-func (d *db) Changes(ctx context.Context, _ driver.Options) (driver.Changes, error) {
-	f, err := os.Open(d.path())
-	if err != nil {
-		return nil, err
-	}
-	dir, err := f.Readdir(-1)
+func (d *db) Changes(ctx context.Context, options driver.Options) (driver.Changes, error) {
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	style, _ := opts["style"].(string)
+	dir, err := d.fsys().ReadDir(d.path())
 	if err != nil {
 		return nil, err
 	}
 	return &changes{
-		db:    d,
-		ctx:   ctx,
-		infos: dir,
+		db:      d,
+		ctx:     ctx,
+		infos:   dir,
+		allDocs: style == "all_docs",
 	}, nil
 }
@@ -49,7 +49,11 @@ func TestChanges(t *testing.T) {
 	})
 
 	tests.Run(t, func(t *testing.T, tt tt) {
-		changes, err := tt.db.Changes(context.TODO(), tt.options)
+		opts := tt.options
+		if opts == nil {
+			opts = kivik.Params(nil)
+		}
+		changes, err := tt.db.Changes(context.TODO(), opts)
 		testy.StatusError(t, tt.err, tt.status, err)
 		defer changes.Close() // nolint: errcheck
 		result := make(map[string]driver.Change)
@@ -68,3 +72,47 @@ func TestChanges(t *testing.T) {
 		}
 	})
 }
+
+func TestChangesAllDocs(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	d := newTestDB(t, tmpdir, "db")
+	ctx := context.Background()
+	foo, err := d.Put(ctx, "foo", map[string]string{"value": "foo"}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bar, err := d.Put(ctx, "bar", map[string]string{"value": "bar"}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Put(ctx, "bar", map[string]interface{}{
+		"_rev":       "2-zzz",
+		"_revisions": map[string]interface{}{"start": 2, "ids": []string{"zzz", "aaa"}},
+	}, kivik.Param("new_edits", false)); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := d.Changes(ctx, kivik.Param("style", "all_docs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer changes.Close() // nolint: errcheck
+	result := make(map[string][]string)
+	ch := &driver.Change{}
+	for {
+		if err := changes.Next(ch); err != nil {
+			if err == io.EOF {
+				break
+			}
+			t.Fatal(err)
+		}
+		result[ch.ID] = ch.Changes
+	}
+	want := map[string][]string{
+		"bar": {"2-zzz", bar},
+		"foo": {foo},
+	}
+	if d := testy.DiffInterface(want, result); d != nil {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,129 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	fs "github.com/go-kivik/fsdb/v4"
+	"github.com/go-kivik/kivik/v4"
+)
+
+func export(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "", "write the archive to `file`, rather than standard output")
+	format := flags.String("format", "", "the archive `format`, tar.gz or zip")
+	args, err := parseFlags(flags, e, args, 1)
+	if err != nil {
+		return err
+	}
+	d, err := openDB(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	opts := map[string]interface{}{}
+	switch {
+	case *format != "":
+		opts["archive"] = *format
+	case strings.HasSuffix(*output, ".zip"):
+		opts["archive"] = fs.ArchiveZip
+	}
+	if docIDs := args[1:]; len(docIDs) > 0 {
+		opts["doc_ids"] = docIDs
+	}
+	return writeOutput(e, *output, func(w io.Writer) error {
+		return d.(fs.DBExporter).Export(ctx, w, kivik.Params(opts))
+	})
+}
+
+func importDB(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	args, err := parseFlags(flags, e, args, 1)
+	if err != nil {
+		return err
+	}
+	if len(args) > 2 {
+		return errUsage
+	}
+	return readInput(e, inputArg(args), func(r io.Reader) error {
+		return e.client.(fs.ClientImporter).Import(ctx, args[0], r, kivik.Params(nil))
+	})
+}
+
+func dump(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	output := flags.String("o", "", "write the dump to `file`, rather than standard output")
+	bulkDocs := flags.Bool("bulk-docs", false, "write a _bulk_docs request body, rather than JSON lines")
+	args, err := parseFlags(flags, e, args, 1)
+	if err != nil {
+		return err
+	}
+	d, err := openDB(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	opts := map[string]interface{}{}
+	if *bulkDocs {
+		opts["dump_format"] = fs.DumpBulkDocs
+	}
+	if docIDs := args[1:]; len(docIDs) > 0 {
+		opts["doc_ids"] = docIDs
+	}
+	return writeOutput(e, *output, func(w io.Writer) error {
+		return d.(fs.DBDumper).Dump(ctx, w, kivik.Params(opts))
+	})
+}
+
+func load(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("load", flag.ContinueOnError)
+	args, err := parseFlags(flags, e, args, 1)
+	if err != nil {
+		return err
+	}
+	if len(args) > 2 {
+		return errUsage
+	}
+	dbName := args[0]
+	exists, err := e.client.DBExists(ctx, dbName, kivik.Params(nil))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := e.client.CreateDB(ctx, dbName, kivik.Params(nil)); err != nil {
+			return err
+		}
+	}
+	d, err := e.client.DB(dbName, kivik.Params(nil))
+	if err != nil {
+		return err
+	}
+	var result *fs.LoadResult
+	err = readInput(e, inputArg(args), func(r io.Reader) error {
+		result, err = d.(fs.DBLoader).Load(ctx, r, kivik.Params(nil))
+		return err
+	})
+	if result != nil {
+		for _, failure := range result.Failures {
+			fmt.Fprintf(e.stderr, "%s %s: %s\n", failure.ID, failure.Rev, failure.Error)
+		}
+		fmt.Fprintf(e.stderr, "loaded %d of %d documents\n", result.DocsWritten, result.DocsRead)
+	}
+	if err == nil && result.DocWriteFailures > 0 {
+		err = fmt.Errorf("%d documents could not be stored", result.DocWriteFailures)
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	fs "github.com/go-kivik/fsdb/v4"
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+)
+
+func TestExportImport(t *testing.T) {
+	tests := testy.NewTable()
+	tests.Add("tar.gz to stdout", []string{})
+	tests.Add("zip file", []string{"-o", "src.zip"})
+	tests.Add("explicit format", []string{"-format", "zip", "-o", "src.archive"})
+
+	tests.Run(t, func(t *testing.T, exportArgs []string) {
+		ctx := context.Background()
+		root := testRoot(t)
+		for i, arg := range exportArgs {
+			if i > 0 && exportArgs[i-1] == "-o" {
+				exportArgs[i] = filepath.Join(root, arg)
+			}
+		}
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		args := append(append([]string{"-root", root, "export"}, exportArgs...), "src", "foo")
+		if status := run(ctx, args, nil, stdout, stderr); status != 0 {
+			t.Fatalf("export failed: %s", stderr)
+		}
+
+		importArgs := []string{"-root", root, "import", "dst"}
+		stdin := stdout
+		if n := len(exportArgs); n > 0 {
+			file := exportArgs[n-1]
+			archive, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive))); err != nil {
+				t.Errorf("Expected a zip archive: %s", err)
+			}
+			importArgs = append(importArgs, file)
+		}
+		if status := run(ctx, importArgs, stdin, &bytes.Buffer{}, stderr); status != 0 {
+			t.Fatalf("import failed: %s", stderr)
+		}
+
+		c, err := fs.NewDriver(filesystem.Default()).NewClient(root, kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := c.DB("dst", kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Get(ctx, "foo", kivik.Params(nil)); err != nil {
+			t.Errorf("Expected foo to be imported: %s", err)
+		}
+		if _, err := d.Get(ctx, "bar", kivik.Params(nil)); err == nil {
+			t.Error("Expected bar not to be imported")
+		}
+	})
+}
+
+func TestDumpLoad(t *testing.T) {
+	ctx := context.Background()
+	root := testRoot(t)
+	dumpFile := filepath.Join(root, "src.ndjson")
+	stderr := &bytes.Buffer{}
+	if status := run(ctx, []string{"-root", root, "dump", "-o", dumpFile, "src"}, nil, &bytes.Buffer{}, stderr); status != 0 {
+		t.Fatalf("dump failed: %s", stderr)
+	}
+	if status := run(ctx, []string{"-root", root, "load", "dst", dumpFile}, nil, &bytes.Buffer{}, stderr); status != 0 {
+		t.Fatalf("load failed: %s", stderr)
+	}
+	if want := "loaded 4 of 4 documents\n"; stderr.String() != want {
+		t.Errorf("Unexpected stderr: %s", stderr)
+	}
+
+	want, got := &bytes.Buffer{}, &bytes.Buffer{}
+	for db, out := range map[string]*bytes.Buffer{"src": want, "dst": got} {
+		if status := run(ctx, []string{"-root", root, "dump", "-bulk-docs", db}, nil, out, stderr); status != 0 {
+			t.Fatalf("dump failed: %s", stderr)
+		}
+	}
+	if !strings.HasPrefix(got.String(), `{"new_edits":false,"docs":[`) {
+		t.Errorf("Expected a _bulk_docs body, got: %s", got)
+	}
+	if d := testy.DiffText(want.String(), got.String()); d != nil {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,288 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	fs "github.com/go-kivik/fsdb/v4"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+func ls(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	args, err := parseFlags(flags, e, args, 0)
+	if err != nil {
+		return err
+	}
+	switch len(args) {
+	case 0:
+		dbs, err := e.client.AllDBs(ctx, kivik.Params(nil))
+		if err != nil {
+			return err
+		}
+		for _, dbName := range dbs {
+			fmt.Fprintln(e.stdout, dbName)
+		}
+		return nil
+	case 1:
+	default:
+		return errUsage
+	}
+	d, err := openDB(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	rows, err := d.AllDocs(ctx, kivik.Params(nil))
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	row := new(driver.Row)
+	for {
+		err := rows.Next(row)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var value struct {
+			Rev string `json:"rev"`
+		}
+		if err := json.NewDecoder(row.Value).Decode(&value); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "%s\t%s\n", row.ID, value.Rev)
+	}
+}
+
+func compact(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	args, err := parseFlags(flags, e, args, 1)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errUsage
+	}
+	d, err := openDB(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	return d.Compact(ctx)
+}
+
+// fsck reports the issues found in each database, failing if any remain
+// unfixed.
+func fsck(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix issues where possible")
+	args, err := parseFlags(flags, e, args, 0)
+	if err != nil {
+		return err
+	}
+	options := kivik.Param("repair", *repair)
+	issues := map[string][]fs.Issue{}
+	if len(args) == 0 {
+		if issues, err = e.client.(fs.ClientFscker).Fsck(ctx, options); err != nil {
+			return err
+		}
+	}
+	for _, dbName := range args {
+		d, err := openDB(ctx, e, dbName)
+		if err != nil {
+			return err
+		}
+		if issues[dbName], err = d.(fs.DBFscker).Fsck(ctx, options); err != nil {
+			return err
+		}
+	}
+	dbNames := make([]string, 0, len(issues))
+	for dbName := range issues {
+		dbNames = append(dbNames, dbName)
+	}
+	sort.Strings(dbNames)
+	unfixed := 0
+	for _, dbName := range dbNames {
+		for _, issue := range issues[dbName] {
+			fmt.Fprintf(e.stdout, "%s: %s\n", dbName, issue)
+			if !issue.Fixed {
+				unfixed++
+			}
+		}
+	}
+	if unfixed > 0 {
+		fmt.Fprintf(e.stderr, "%d issues remain\n", unfixed)
+		return errFailed
+	}
+	return nil
+}
+
+func changes(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("changes", flag.ContinueOnError)
+	args, err := parseFlags(flags, e, args, 1)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errUsage
+	}
+	d, err := openDB(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	feed, err := d.Changes(ctx, kivik.Params(nil))
+	if err != nil {
+		return err
+	}
+	defer feed.Close() // nolint: errcheck
+	enc := json.NewEncoder(e.stdout)
+	ch := new(driver.Change)
+	for {
+		err := feed.Next(ch)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		type rev struct {
+			Rev string `json:"rev"`
+		}
+		line := struct {
+			ID      string `json:"id"`
+			Changes []rev  `json:"changes"`
+			Deleted bool   `json:"deleted,omitempty"`
+		}{ID: ch.ID, Deleted: ch.Deleted}
+		for _, r := range ch.Changes {
+			line.Changes = append(line.Changes, rev{Rev: r})
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+}
+
+// securityDB is implemented by databases which support security objects.
+type securityDB interface {
+	Security(ctx context.Context) (*driver.Security, error)
+}
+
+func security(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("security", flag.ContinueOnError)
+	args, err := parseFlags(flags, e, args, 1)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errUsage
+	}
+	d, err := openDB(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	sec, err := d.(securityDB).Security(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(e, sec)
+}
+
+// diff compares the leaf revisions of each document in two databases.
+func diff(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	args, err := parseFlags(flags, e, args, 2)
+	if err != nil {
+		return err
+	}
+	if len(args) > 2 {
+		return errUsage
+	}
+	a, err := leafRevs(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	b, err := leafRevs(ctx, e, args[1])
+	if err != nil {
+		return err
+	}
+	docIDs := make([]string, 0, len(a)+len(b))
+	for docID := range a {
+		docIDs = append(docIDs, docID)
+	}
+	for docID := range b {
+		if _, ok := a[docID]; !ok {
+			docIDs = append(docIDs, docID)
+		}
+	}
+	sort.Strings(docIDs)
+	differ := false
+	for _, docID := range docIDs {
+		revsA, inA := a[docID]
+		revsB, inB := b[docID]
+		switch {
+		case !inB:
+			fmt.Fprintf(e.stdout, "- %s\n", docID)
+		case !inA:
+			fmt.Fprintf(e.stdout, "+ %s\n", docID)
+		case strings.Join(revsA, ",") != strings.Join(revsB, ","):
+			fmt.Fprintf(e.stdout, "~ %s: %s != %s\n", docID, strings.Join(revsA, ","), strings.Join(revsB, ","))
+		default:
+			continue
+		}
+		differ = true
+	}
+	if differ {
+		return errFailed
+	}
+	return nil
+}
+
+// leafRevs returns the leaf revisions of each document in the database, other
+// than local documents, sorted.
+func leafRevs(ctx context.Context, e *env, dbName string) (map[string][]string, error) {
+	d, err := openDB(ctx, e, dbName)
+	if err != nil {
+		return nil, err
+	}
+	feed, err := d.Changes(ctx, kivik.Param("style", "all_docs"))
+	if err != nil {
+		return nil, err
+	}
+	defer feed.Close() // nolint: errcheck
+	leaves := map[string][]string{}
+	ch := new(driver.Change)
+	for {
+		err := feed.Next(ch)
+		if err == io.EOF {
+			return leaves, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(ch.ID, "_local/") {
+			continue
+		}
+		revs := append([]string{}, ch.Changes...)
+		sort.Strings(revs)
+		leaves[ch.ID] = revs
+	}
+}
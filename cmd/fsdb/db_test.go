@@ -0,0 +1,135 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+func TestDBCommands(t *testing.T) {
+	type tt struct {
+		setup  func(t *testing.T, root string)
+		args   []string
+		stdout string
+		stderr string
+		status int
+	}
+	tests := testy.NewTable()
+	tests.Add("ls", tt{
+		args:   []string{"ls"},
+		stdout: "^src\n$",
+	})
+	tests.Add("ls db", tt{
+		args:   []string{"ls", "src"},
+		stdout: "^bar\t1-bbb\nconflict\t2-ccc\nfoo\t1-aaa\n$",
+	})
+	tests.Add("ls missing", tt{
+		args:   []string{"ls", "missing"},
+		stderr: "fsdb ls: database missing not found",
+		status: 1,
+	})
+	tests.Add("compact", tt{
+		args: []string{"compact", "src"},
+	})
+	tests.Add("fsck clean", tt{
+		args: []string{"fsck"},
+	})
+	tests.Add("fsck issues", tt{
+		setup: func(t *testing.T, root string) {
+			writeFile(t, filepath.Join(root, "src", ".tmp.foo.json-123"), "")
+		},
+		args:   []string{"fsck", "src"},
+		stdout: `^src: temp_file: .*/src/.tmp.foo.json-123: .*\n$`,
+		stderr: "1 issues remain",
+		status: 1,
+	})
+	tests.Add("fsck repair", tt{
+		setup: func(t *testing.T, root string) {
+			writeFile(t, filepath.Join(root, "src", ".tmp.foo.json-123"), "")
+		},
+		args:   []string{"fsck", "-repair"},
+		stdout: `^src: temp_file: .*/src/.tmp.foo.json-123: .* \(fixed\)\n$`,
+	})
+	tests.Add("changes", tt{
+		args:   []string{"changes", "src"},
+		stdout: `{"id":"conflict","changes":\[{"rev":"2-ccc"}\]}\n`,
+	})
+	tests.Add("security", tt{
+		setup: func(t *testing.T, root string) {
+			writeFile(t, filepath.Join(root, "src", "_security.json"), `{"admins":{"names":["bob"]}}`)
+		},
+		args:   []string{"security", "src"},
+		stdout: `"admins": {\s+"names": \[\s+"bob"\s+\]`,
+	})
+	tests.Add("diff same", tt{
+		setup: func(t *testing.T, root string) {
+			copyDB(t, root, "src", "dst")
+		},
+		args: []string{"diff", "src", "dst"},
+	})
+	tests.Add("diff", tt{
+		setup: func(t *testing.T, root string) {
+			copyDB(t, root, "src", "dst")
+			_, _, _ = fsdb(t, root, `{"value":"baz"}`, "put", "dst", "baz")
+			_, _, _ = fsdb(t, root, "", "delete", "dst", "bar")
+			_, _, _ = fsdb(t, root, "", "delete", "-rev", "2-bbb", "src", "conflict")
+			if err := os.Remove(filepath.Join(root, "dst", "foo.json")); err != nil {
+				t.Fatal(err)
+			}
+		},
+		args:   []string{"diff", "src", "dst"},
+		stdout: `^~ bar: 1-bbb != 2-[0-9a-f]{32}\n\+ baz\n~ conflict: 2-ccc,3-[0-9a-f]{32} != 2-bbb,2-ccc\n- foo\n$`,
+		status: 1,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		root := testRoot(t)
+		if tt.setup != nil {
+			tt.setup(t, root)
+		}
+		stdout, stderr, status := fsdb(t, root, "", tt.args...)
+		if status != tt.status {
+			t.Errorf("Unexpected exit status: %d, stderr: %s", status, stderr)
+		}
+		if !regexp.MustCompile(tt.stdout).MatchString(stdout) {
+			t.Errorf("Unexpected stdout: %s", stdout)
+		}
+		if !regexp.MustCompile(regexp.QuoteMeta(tt.stderr)).MatchString(stderr) {
+			t.Errorf("Unexpected stderr: %s", stderr)
+		}
+	})
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// copyDB copies the database src to dst, by dumping and loading it.
+func copyDB(t *testing.T, root, src, dst string) {
+	t.Helper()
+	dump, stderr, status := fsdb(t, root, "", "dump", src)
+	if status != 0 {
+		t.Fatalf("dump failed: %s", stderr)
+	}
+	if _, stderr, status := fsdb(t, root, dump, "load", dst); status != 0 {
+		t.Fatalf("load failed: %s", stderr)
+	}
+}
@@ -0,0 +1,346 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+func get(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	rev := flags.String("rev", "", "get the given `rev`ision, rather than the winner")
+	withRevs := flags.Bool("revs", false, "include the revision history")
+	conflicts := flags.Bool("conflicts", false, "include conflicting revisions")
+	args, err := parseFlags(flags, e, args, 2)
+	if err != nil {
+		return err
+	}
+	if len(args) > 2 {
+		return errUsage
+	}
+	d, err := openDB(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	opts := map[string]interface{}{"revs": *withRevs}
+	if *rev != "" {
+		opts["rev"] = *rev
+	}
+	doc, err := d.Get(ctx, args[1], kivik.Params(opts))
+	if err != nil {
+		return err
+	}
+	defer doc.Body.Close() // nolint: errcheck
+	if doc.Attachments != nil {
+		_ = doc.Attachments.Close()
+	}
+	body, err := io.ReadAll(doc.Body)
+	if err != nil {
+		return err
+	}
+	body = bytes.TrimSpace(body)
+	if *conflicts {
+		if body, err = addConflicts(ctx, d, args[1], body); err != nil {
+			return err
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := json.Indent(buf, body, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err = buf.WriteTo(e.stdout)
+	return err
+}
+
+// addConflicts adds the _conflicts field, listing the document's undeleted
+// leaf revisions other than the winner, to body, if there are any.
+func addConflicts(ctx context.Context, d driver.DB, docID string, body []byte) ([]byte, error) {
+	leaves, err := leafRevisions(ctx, d, docID)
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []string
+	for _, leaf := range leaves[1:] {
+		rev, err := getRevision(ctx, d, docID, leaf)
+		if err != nil {
+			return nil, err
+		}
+		if rev != nil && !rev.deleted {
+			conflicts = append(conflicts, leaf)
+		}
+	}
+	if len(conflicts) == 0 {
+		return body, nil
+	}
+	field, err := json.Marshal(conflicts)
+	if err != nil {
+		return nil, err
+	}
+	body = append(body[:len(body)-1], `,"_conflicts":`...)
+	body = append(body, field...)
+	return append(body, '}'), nil
+}
+
+// leafRevisions returns the leaf revisions of the document, winner first,
+// from the all_docs style changes feed.
+func leafRevisions(ctx context.Context, d driver.DB, docID string) ([]string, error) {
+	changes, err := d.Changes(ctx, kivik.Param("style", "all_docs"))
+	if err != nil {
+		return nil, err
+	}
+	defer changes.Close() // nolint: errcheck
+	ch := new(driver.Change)
+	for {
+		if err := changes.Next(ch); err != nil {
+			if err == io.EOF {
+				return nil, errors.New("missing")
+			}
+			return nil, err
+		}
+		if ch.ID == docID {
+			return ch.Changes, nil
+		}
+	}
+}
+
+// storedRevision is a revision of a document whose content is stored.
+type storedRevision struct {
+	deleted bool
+	// ancestors is the revision's history, newest first, starting with the
+	// revision itself.
+	ancestors []string
+}
+
+// getRevision reads the given revision of the document, with its history,
+// returning nil if its content is not stored.
+func getRevision(ctx context.Context, d driver.DB, docID, rev string) (*storedRevision, error) {
+	doc, err := d.Get(ctx, docID, kivik.Params(map[string]interface{}{"rev": rev, "revs": true}))
+	if kivik.HTTPStatus(err) == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Body.Close() // nolint: errcheck
+	if doc.Attachments != nil {
+		_ = doc.Attachments.Close()
+	}
+	var body struct {
+		Deleted   bool           `json:"_deleted"`
+		Revisions cdb.RevHistory `json:"_revisions"`
+	}
+	if err := json.NewDecoder(doc.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return &storedRevision{
+		deleted:   body.Deleted,
+		ancestors: body.Revisions.Ancestors(),
+	}, nil
+}
+
+func put(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	args, err := parseFlags(flags, e, args, 2)
+	if err != nil {
+		return err
+	}
+	if len(args) > 3 {
+		return errUsage
+	}
+	d, err := openDB(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	err = readInput(e, inputArg(args[1:]), func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&doc)
+	})
+	if err != nil {
+		return fmt.Errorf("invalid document: %w", err)
+	}
+	rev, err := d.Put(ctx, args[1], doc, kivik.Params(nil))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(e.stdout, rev)
+	return err
+}
+
+// deleteDoc deletes a document by storing a new, deleted revision.
+func deleteDoc(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ContinueOnError)
+	rev := flags.String("rev", "", "delete the given `rev`ision, rather than the winner")
+	args, err := parseFlags(flags, e, args, 2)
+	if err != nil {
+		return err
+	}
+	if len(args) > 2 {
+		return errUsage
+	}
+	d, err := openDB(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	if *rev == "" {
+		if *rev, err = d.(driver.RevGetter).GetRev(ctx, args[1], kivik.Params(nil)); err != nil {
+			return err
+		}
+	}
+	newRev, err := d.Delete(ctx, args[1], kivik.Rev(*rev))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(e.stdout, newRev)
+	return err
+}
+
+// revNode is a revision in the tree printed by revs.
+type revNode struct {
+	rev      string
+	stored   bool
+	deleted  bool
+	children []*revNode
+}
+
+func revs(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("revs", flag.ContinueOnError)
+	args, err := parseFlags(flags, e, args, 2)
+	if err != nil {
+		return err
+	}
+	if len(args) > 2 {
+		return errUsage
+	}
+	d, err := openDB(ctx, e, args[0])
+	if err != nil {
+		return err
+	}
+	leaves, err := leafRevisions(ctx, d, args[1])
+	if err != nil {
+		return err
+	}
+	stored := map[string]*storedRevision{}
+	seen := map[string]bool{}
+	queue := leaves
+	for len(queue) > 0 {
+		rev := queue[0]
+		queue = queue[1:]
+		if seen[rev] {
+			continue
+		}
+		seen[rev] = true
+		r, err := getRevision(ctx, d, args[1], rev)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			continue
+		}
+		stored[rev] = r
+		if len(r.ancestors) > 1 {
+			queue = append(queue, r.ancestors[1:]...)
+		}
+	}
+	for _, root := range revTree(stored) {
+		printRevTree(e.stdout, root, leaves[0], "", "")
+	}
+	return nil
+}
+
+// revTree builds the revision tree from the histories of the stored
+// revisions, by revision ID, returning its roots.
+func revTree(revs map[string]*storedRevision) []*revNode {
+	nodes := map[string]*revNode{}
+	hasParent := map[string]bool{}
+	node := func(rev string) *revNode {
+		n, ok := nodes[rev]
+		if !ok {
+			n = &revNode{rev: rev}
+			nodes[rev] = n
+		}
+		return n
+	}
+	for id, rev := range revs {
+		n := node(id)
+		n.stored = true
+		n.deleted = rev.deleted
+		ancestors := rev.ancestors
+		for i := 1; i < len(ancestors); i++ {
+			child, parent := ancestors[i-1], node(ancestors[i])
+			if !hasParent[child] {
+				parent.children = append(parent.children, node(child))
+				hasParent[child] = true
+			}
+		}
+	}
+	var roots []*revNode
+	for rev, n := range nodes {
+		sortRevNodes(n.children)
+		if !hasParent[rev] {
+			roots = append(roots, n)
+		}
+	}
+	sortRevNodes(roots)
+	return roots
+}
+
+func sortRevNodes(nodes []*revNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		var a, b cdb.RevID
+		_ = a.UnmarshalText([]byte(nodes[i].rev))
+		_ = b.UnmarshalText([]byte(nodes[j].rev))
+		if a.Seq != b.Seq {
+			return a.Seq < b.Seq
+		}
+		return a.Sum < b.Sum
+	})
+}
+
+func printRevTree(w io.Writer, n *revNode, winner, prefix, childPrefix string) {
+	var notes []string
+	if n.rev == winner {
+		notes = append(notes, "winner")
+	}
+	if n.deleted {
+		notes = append(notes, "deleted")
+	}
+	if !n.stored {
+		notes = append(notes, "not stored")
+	}
+	line := prefix + n.rev
+	if len(notes) > 0 {
+		line += " [" + strings.Join(notes, ", ") + "]"
+	}
+	fmt.Fprintln(w, line)
+	for i, child := range n.children {
+		if i == len(n.children)-1 {
+			printRevTree(w, child, winner, childPrefix+"└── ", childPrefix+"    ")
+		} else {
+			printRevTree(w, child, winner, childPrefix+"├── ", childPrefix+"│   ")
+		}
+	}
+}
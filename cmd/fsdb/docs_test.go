@@ -0,0 +1,127 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+func TestDocCommands(t *testing.T) {
+	type tt struct {
+		args   []string
+		stdin  string
+		stdout string
+		stderr string
+		status int
+	}
+	tests := testy.NewTable()
+	tests.Add("get", tt{
+		args: []string{"get", "src", "foo"},
+		stdout: `^{
+  "_id": "foo",
+  "_rev": "1-aaa",
+  "value": "foo"
+}
+$`,
+	})
+	tests.Add("get revs", tt{
+		args:   []string{"get", "-revs", "src", "conflict"},
+		stdout: `"_revisions": {\s+"start": 2,\s+"ids": \[\s+"ccc",\s+"aaa"\s+\]\s+}`,
+	})
+	tests.Add("get rev", tt{
+		args:   []string{"get", "--rev", "2-bbb", "src", "conflict"},
+		stdout: `"_rev": "2-bbb"`,
+	})
+	tests.Add("get conflicts", tt{
+		args:   []string{"get", "-conflicts", "src", "conflict"},
+		stdout: `"_rev": "2-ccc",\s+"_conflicts": \[\s+"2-bbb"\s+\]\s+}`,
+	})
+	tests.Add("get missing", tt{
+		args:   []string{"get", "src", "missing"},
+		stderr: "fsdb get: missing",
+		status: 1,
+	})
+	tests.Add("put", tt{
+		args:   []string{"put", "src", "baz"},
+		stdin:  `{"value":"baz"}`,
+		stdout: `^1-[0-9a-f]{32}\n$`,
+	})
+	tests.Add("put conflict", tt{
+		args:   []string{"put", "src", "foo", "-"},
+		stdin:  `{"value":"new"}`,
+		stderr: "fsdb put: document update conflict",
+		status: 1,
+	})
+	tests.Add("put invalid", tt{
+		args:   []string{"put", "src", "baz"},
+		stdin:  `{`,
+		stderr: "fsdb put: invalid document: unexpected EOF",
+		status: 1,
+	})
+	tests.Add("delete", tt{
+		args:   []string{"delete", "src", "foo"},
+		stdout: `^2-[0-9a-f]{32}\n$`,
+	})
+	tests.Add("delete conflict", tt{
+		args:   []string{"delete", "-rev", "2-bbb", "src", "conflict"},
+		stdout: `^3-[0-9a-f]{32}\n$`,
+	})
+	tests.Add("revs", tt{
+		args: []string{"revs", "src", "conflict"},
+		stdout: `^1-aaa \[not stored\]
+├── 2-bbb
+└── 2-ccc \[winner\]
+$`,
+	})
+	tests.Add("revs usage", tt{
+		args:   []string{"revs", "src"},
+		stderr: "usage: fsdb revs <db> <docid>",
+		status: 2,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		stdout, stderr, status := fsdb(t, testRoot(t), tt.stdin, tt.args...)
+		if status != tt.status {
+			t.Errorf("Unexpected exit status: %d, stderr: %s", status, stderr)
+		}
+		if !regexp.MustCompile(tt.stdout).MatchString(stdout) {
+			t.Errorf("Unexpected stdout: %s", stdout)
+		}
+		if !regexp.MustCompile(regexp.QuoteMeta(tt.stderr)).MatchString(stderr) {
+			t.Errorf("Unexpected stderr: %s", stderr)
+		}
+	})
+}
+
+func TestDeleteThenRevs(t *testing.T) {
+	root := testRoot(t)
+	if _, stderr, status := fsdb(t, root, "", "delete", "src", "foo"); status != 0 {
+		t.Fatalf("delete failed: %s", stderr)
+	}
+	stdout, stderr, status := fsdb(t, root, "", "revs", "src", "foo")
+	if status != 0 {
+		t.Fatalf("revs failed: %s", stderr)
+	}
+	want := `^1-aaa
+└── 2-[0-9a-f]{32} \[winner, deleted\]
+$`
+	if !regexp.MustCompile(want).MatchString(stdout) {
+		t.Errorf("Unexpected revision tree:\n%s", stdout)
+	}
+	if _, stderr, status := fsdb(t, root, "", "get", "src", "foo"); status != 1 || stderr != "fsdb get: deleted\n" {
+		t.Errorf("Expected foo to be deleted, got: %s", stderr)
+	}
+}
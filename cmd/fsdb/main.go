@@ -0,0 +1,318 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// Command fsdb inspects and maintains databases stored by the fsdb driver. It
+// is built on the same packages as the driver, so operates on exactly the
+// same layout.
+//
+// Usage:
+//
+//	fsdb [-root dir] <command> [arguments]
+//
+// The commands are:
+//
+//	ls [db]
+//	    List the databases, or the documents in db, with their winning
+//	    revisions.
+//	get [-rev rev] [-revs] [-conflicts] <db> <docid>
+//	    Print the document, or the given revision, with its revision
+//	    history if -revs is given, and its conflicting revisions if
+//	    -conflicts is given.
+//	put <db> <docid> [file]
+//	    Store the document read from file, or standard input if omitted or
+//	    "-", and print its new revision. To update a document, its current
+//	    revision must be given in _rev.
+//	delete [-rev rev] <db> <docid>
+//	    Delete the winning revision of the document, or the given revision,
+//	    and print the new revision.
+//	revs <db> <docid>
+//	    Print the document's revision tree, marking the winner, deleted
+//	    revisions, and those whose content is no longer stored.
+//	compact <db>
+//	    Remove the content of non-leaf revisions.
+//	fsck [-repair] [db...]
+//	    Check the databases, or all of them, for inconsistencies, and with
+//	    -repair, fix them where possible.
+//	changes <db>
+//	    Print the changes feed as JSON lines.
+//	security <db>
+//	    Print the security object.
+//	diff <db1> <db2>
+//	    Compare the leaf revisions of the documents in two databases,
+//	    listing the documents only in db1 with "-", only in db2 with "+",
+//	    and with different leaf revisions with "~". The exit status is 1 if
+//	    the databases differ.
+//	export [-o file] [-format tar.gz|zip] <db> [docid...]
+//	    Write the database, or only the named documents, to an archive,
+//	    preserving its on-disk layout. The archive is written to standard
+//	    output, unless -o is given. The format defaults to zip if the output
+//	    file ends in .zip, and tar.gz otherwise.
+//	import <db> [file]
+//	    Create the database from an archive written by export, or by hand,
+//	    read from file, or standard input if omitted or "-". The archive is
+//	    validated before the database is created.
+//	dump [-bulk-docs] [-o file] <db> [docid...]
+//	    Write every leaf revision of the database's documents, or only the
+//	    named ones, with their histories and attachments, as JSON lines, or
+//	    with -bulk-docs, as a _bulk_docs request body.
+//	load <db> [file]
+//	    Store the documents in a dump, a couchbackup file or a _bulk_docs
+//	    request body, read from file, or standard input if omitted or "-",
+//	    keeping their revisions. The database is created if need be.
+//	serve [-addr host:port] [-cors origins]
+//	    Serve the databases over HTTP, with the CouchDB API, on
+//	    localhost:5984 unless -addr is given, until interrupted. Browsers
+//	    may make cross-origin requests from the comma-separated origins
+//	    given with -cors, or from any, with "*".
+//
+// The root directory, in which databases are stored, defaults to the current
+// directory.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+
+	fs "github.com/go-kivik/fsdb/v4"
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	status := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(status)
+}
+
+// env is the environment in which a command runs.
+type env struct {
+	root   string
+	client driver.Client
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, e *env, args []string) error
+}
+
+var commands = map[string]command{
+	"ls": {
+		usage: "ls [db]",
+		run:   ls,
+	},
+	"get": {
+		usage: "get [-rev rev] [-revs] [-conflicts] <db> <docid>",
+		run:   get,
+	},
+	"put": {
+		usage: "put <db> <docid> [file]",
+		run:   put,
+	},
+	"delete": {
+		usage: "delete [-rev rev] <db> <docid>",
+		run:   deleteDoc,
+	},
+	"revs": {
+		usage: "revs <db> <docid>",
+		run:   revs,
+	},
+	"compact": {
+		usage: "compact <db>",
+		run:   compact,
+	},
+	"fsck": {
+		usage: "fsck [-repair] [db...]",
+		run:   fsck,
+	},
+	"changes": {
+		usage: "changes <db>",
+		run:   changes,
+	},
+	"security": {
+		usage: "security <db>",
+		run:   security,
+	},
+	"diff": {
+		usage: "diff <db1> <db2>",
+		run:   diff,
+	},
+	"export": {
+		usage: "export [-o file] [-format tar.gz|zip] <db> [docid...]",
+		run:   export,
+	},
+	"import": {
+		usage: "import <db> [file]",
+		run:   importDB,
+	},
+	"dump": {
+		usage: "dump [-bulk-docs] [-o file] <db> [docid...]",
+		run:   dump,
+	},
+	"load": {
+		usage: "load <db> [file]",
+		run:   load,
+	},
+	"serve": {
+		usage: "serve [-addr host:port] [-cors origins]",
+		run:   serve,
+	},
+}
+
+var (
+	// errUsage is returned by a command when its arguments are invalid.
+	errUsage = errors.New("usage")
+	// errFailed is returned by a command which has already reported why it
+	// failed.
+	errFailed = errors.New("failed")
+)
+
+// run runs the command line args, returning the exit status: 0 on success, 1
+// if the command failed, or 2 if it was used incorrectly.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fsdb", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	root := flags.String("root", ".", "the `dir`ectory in which databases are stored")
+	flags.Usage = func() { usage(flags, stderr) }
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	name := flags.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "fsdb: unknown command %q\n", name)
+		flags.Usage()
+		return 2
+	}
+	client, err := fs.NewDriver(filesystem.Default()).NewClient(*root, kivik.Params(nil))
+	if err != nil {
+		fmt.Fprintf(stderr, "fsdb: %s\n", err)
+		return 1
+	}
+	e := &env{root: *root, client: client, stdin: stdin, stdout: stdout, stderr: stderr}
+	switch err := cmd.run(ctx, e, flags.Args()[1:]); {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(stderr, "usage: fsdb %s\n", cmd.usage)
+		return 2
+	case errors.Is(err, errFailed):
+		return 1
+	default:
+		fmt.Fprintf(stderr, "fsdb %s: %s\n", name, err)
+		return 1
+	}
+}
+
+func usage(flags *flag.FlagSet, w io.Writer) {
+	fmt.Fprintln(w, "usage: fsdb [-root dir] <command> [arguments]")
+	fmt.Fprintln(w, "\nflags:")
+	flags.PrintDefaults()
+	fmt.Fprintln(w, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", commands[name].usage)
+	}
+}
+
+// parseFlags parses the command's flags from args, returning its remaining
+// arguments, of which there must be at least min.
+func parseFlags(flags *flag.FlagSet, e *env, args []string, min int) ([]string, error) {
+	flags.SetOutput(e.stderr)
+	if err := flags.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if flags.NArg() < min {
+		return nil, errUsage
+	}
+	return flags.Args(), nil
+}
+
+// openDB opens the named database, which must exist.
+func openDB(ctx context.Context, e *env, dbName string) (driver.DB, error) {
+	exists, err := e.client.DBExists(ctx, dbName, kivik.Params(nil))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("database %s not found", dbName)
+	}
+	return e.client.DB(dbName, kivik.Params(nil))
+}
+
+// printJSON writes v to standard output as indented JSON.
+func printJSON(e *env, v interface{}) error {
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeOutput calls write with the named file, or standard output if name is
+// empty. The file is removed if write fails.
+func writeOutput(e *env, name string, write func(io.Writer) error) error {
+	if name == "" {
+		return write(e.stdout)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(name)
+	}
+	return err
+}
+
+// readInput calls read with the named file, or standard input if name is
+// empty or "-".
+func readInput(e *env, name string, read func(io.Reader) error) error {
+	if name == "" || name == "-" {
+		return read(e.stdin)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	return read(f)
+}
+
+// inputArg returns the optional input file named after the database in args.
+func inputArg(args []string) string {
+	if len(args) < 2 {
+		return ""
+	}
+	return args[1]
+}
@@ -0,0 +1,134 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	fs "github.com/go-kivik/fsdb/v4"
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+)
+
+// testRoot returns a temporary directory holding a database named src, with
+// documents foo and bar, and a document named conflict, whose revisions
+// 2-bbb and 2-ccc conflict.
+func testRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	c, err := fs.NewDriver(filesystem.Default()).NewClient(root, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := c.CreateDB(ctx, "src", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.DB("src", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := []map[string]interface{}{
+		{"_id": "foo", "_rev": "1-aaa", "value": "foo"},
+		{"_id": "bar", "_rev": "1-bbb", "value": "bar"},
+		{"_id": "conflict", "_rev": "2-bbb", "_revisions": map[string]interface{}{"start": 2, "ids": []string{"bbb", "aaa"}}},
+		{"_id": "conflict", "_rev": "2-ccc", "_revisions": map[string]interface{}{"start": 2, "ids": []string{"ccc", "aaa"}}},
+	}
+	for _, doc := range docs {
+		if _, err := d.Put(ctx, doc["_id"].(string), doc, kivik.Param("new_edits", false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// fsdb runs the command line args against root, returning its standard
+// output and error, and exit status.
+func fsdb(t *testing.T, root, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	status := run(context.Background(), append([]string{"-root", root}, args...), strings.NewReader(stdin), stdout, stderr)
+	return stdout.String(), stderr.String(), status
+}
+
+func TestRun(t *testing.T) {
+	type tt struct {
+		args   []string
+		stdin  string
+		status int
+		stderr string
+	}
+	tests := testy.NewTable()
+	tests.Add("no command", tt{
+		status: 2,
+		stderr: "usage: fsdb [-root dir] <command> [arguments]",
+	})
+	tests.Add("unknown command", tt{
+		args:   []string{"frobnicate"},
+		status: 2,
+		stderr: `fsdb: unknown command "frobnicate"`,
+	})
+	tests.Add("export without db", tt{
+		args:   []string{"export"},
+		status: 2,
+		stderr: "usage: fsdb export [-o file] [-format tar.gz|zip] <db> [docid...]",
+	})
+	tests.Add("export missing db", tt{
+		args:   []string{"export", "missing"},
+		status: 1,
+		stderr: "fsdb export: database missing not found",
+	})
+	tests.Add("export missing doc", tt{
+		args:   []string{"export", "src", "baz"},
+		status: 1,
+		stderr: "fsdb export: document baz not found",
+	})
+	tests.Add("import too many args", tt{
+		args:   []string{"import", "dst", "a", "b"},
+		status: 2,
+		stderr: "usage: fsdb import <db> [file]",
+	})
+	tests.Add("import invalid archive", tt{
+		args:   []string{"import", "dst"},
+		stdin:  "not an archive",
+		status: 1,
+		stderr: "fsdb import: unrecognized archive format",
+	})
+
+	tests.Add("dump missing db", tt{
+		args:   []string{"dump", "missing"},
+		status: 1,
+		stderr: "fsdb dump: database missing not found",
+	})
+	tests.Add("load failures", tt{
+		args:   []string{"load", "dst", "-"},
+		stdin:  `{"_id":"foo","_rev":"1-aaa"}` + "\n" + `{"_id":"bar"}`,
+		status: 1,
+		stderr: "bar : _rev required with new_edits=false\nloaded 1 of 2 documents\nfsdb load: 1 documents could not be stored",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		_, stderr, status := fsdb(t, testRoot(t), tt.stdin, tt.args...)
+		if status != tt.status {
+			t.Errorf("Unexpected exit status: %d, stderr: %s", status, stderr)
+		}
+		if !strings.Contains(stderr, tt.stderr) {
+			t.Errorf("Unexpected stderr: %s", stderr)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	fs "github.com/go-kivik/fsdb/v4"
+	"github.com/go-kivik/kivik/v4"
+)
+
+// shutdownTimeout is how long serve waits for requests in progress, such as
+// changes feeds, to finish once interrupted.
+const shutdownTimeout = 5 * time.Second
+
+func serve(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:5984", "the `host:port` on which to listen")
+	cors := flags.String("cors", "", "a comma-separated list of `origins` allowed to make cross-origin requests, or * for any")
+	args, err := parseFlags(flags, e, args, 0)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return errUsage
+	}
+	opts := map[string]interface{}{}
+	if *cors != "" {
+		opts["cors_origins"] = strings.Split(*cors, ",")
+	}
+	h, err := fs.NewHandler(e.client, kivik.Params(opts))
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: time.Minute,
+	}
+	fmt.Fprintf(e.stderr, "fsdb: serving %s on http://%s/\n", e.root, ln.Addr())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		_ = srv.Close()
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
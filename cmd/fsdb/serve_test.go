@@ -0,0 +1,69 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	root := testRoot(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stderr, stderrW := io.Pipe()
+	status := make(chan int, 1)
+	go func() {
+		status <- run(ctx, []string{"-root", root, "serve", "-addr", "127.0.0.1:0"}, strings.NewReader(""), io.Discard, stderrW)
+		_ = stderrW.Close()
+	}()
+	line, err := bufio.NewReader(stderr).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = io.Copy(io.Discard, stderr) }()
+	i := strings.Index(line, "http://")
+	if i < 0 {
+		t.Fatalf("Unexpected output: %s", line)
+	}
+	url := strings.TrimSpace(line[i:])
+	res, err := http.Get(url + "src/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&doc)
+	_ = res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["_rev"] != "1-aaa" || doc["value"] != "foo" {
+		t.Errorf("Unexpected document: %v", doc)
+	}
+	cancel()
+	if s := <-status; s != 0 {
+		t.Errorf("Unexpected exit status: %d", s)
+	}
+}
+
+func TestServeUsage(t *testing.T) {
+	_, stderr, status := fsdb(t, testRoot(t), "", "serve", "extra")
+	if status != 2 || !strings.Contains(stderr, "usage: fsdb serve [-addr host:port] [-cors origins]") {
+		t.Errorf("Unexpected result: %d %s", status, stderr)
+	}
+}
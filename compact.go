@@ -14,6 +14,8 @@ package fs
 
 import (
 	"context"
+	"net/http"
+	"path/filepath"
 	"strings"
 
 	"github.com/go-kivik/fsdb/v4/cdb"
@@ -24,17 +26,18 @@ import (
 
 type docIndex map[string]*cdb.Document
 
-func (i docIndex) readIndex(ctx context.Context, fs filesystem.Filesystem, path string) error {
-	dir, err := fs.Open(path)
-	if err != nil {
-		return kerr(err)
-	}
-	files, err := dir.Readdir(-1)
+// readIndex reads every document in the database at path. Skipped files are
+// reported to warn, if not nil. In lint mode, that is when warn is not nil,
+// documents which can't be decoded are also skipped, and reported, rather
+// than failing.
+func (i docIndex) readIndex(ctx context.Context, fs filesystem.Filesystem, path string, warn func(Warning)) error {
+	files, err := fs.ReadDir(path)
 	if err != nil {
 		return kerr(err)
 	}
 
 	c := cdb.New(path, fs)
+	c.SetWarner(warn)
 
 	var docID string
 	for _, info := range files {
@@ -46,20 +49,37 @@ func (i docIndex) readIndex(ctx context.Context, fs filesystem.Filesystem, path
 			id, _, ok := decode.ExplodeFilename(info.Name())
 			if !ok {
 				// ignore unrecognized files
+				if !strings.HasPrefix(info.Name(), ".tmp.") {
+					report(warn, cdb.WarnStrayFile, filepath.Join(path, info.Name()), "not in a registered format")
+				}
 				continue
 			}
 			docID = id
+		case info.IsDir() && (info.Name() == lockDirName || info.Name() == cdb.JournalDirName):
+			continue
 		case info.IsDir() && info.Name()[0] == '.':
 			docID = strings.TrimPrefix(info.Name(), ".")
 		default:
 			continue
 		}
+		docID = cdb.UnescapeID(docID)
+		if docID == "" || ignoreDocID(docID) {
+			// Skip special files, such as _security and _meta
+			if docID != "" && !isSpecialDocID(docID) {
+				report(warn, cdb.WarnStrayFile, filepath.Join(path, info.Name()), "invalid document ID: %s", docID)
+			}
+			continue
+		}
 		if _, ok := i[docID]; ok {
 			// We've already read this one
 			continue
 		}
 		doc, err := c.OpenDocID(docID, kivik.Params(nil))
 		if err != nil {
+			if warn != nil && kivik.HTTPStatus(err) != http.StatusNotFound {
+				report(warn, cdb.WarnUndecodable, filepath.Join(path, info.Name()), "%s", err)
+				continue
+			}
 			return err
 		}
 		i[docID] = doc
@@ -67,13 +87,26 @@ func (i docIndex) readIndex(ctx context.Context, fs filesystem.Filesystem, path
 	return nil
 }
 
+// Compact compacts the database. Document updates are excluded while
+// compaction runs, and any interrupted updates are recovered first.
 func (d *db) Compact(ctx context.Context) error {
-	return d.compact(ctx, filesystem.Default())
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	unlock, err := d.lockDB(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := d.cdb.RecoverAll(); err != nil {
+		return err
+	}
+	return d.compact(ctx, d.fsys())
 }
 
 func (d *db) compact(ctx context.Context, fs filesystem.Filesystem) error {
 	docs := docIndex{}
-	if err := docs.readIndex(ctx, fs, d.path()); err != nil {
+	if err := docs.readIndex(ctx, fs, d.path(), d.warn); err != nil {
 		return err
 	}
 	for _, doc := range docs {
@@ -24,6 +24,7 @@ import (
 	"gitlab.com/flimzy/testy"
 
 	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
 )
 
 func TestCompact(t *testing.T) {
@@ -57,7 +58,7 @@ func TestCompact(t *testing.T) {
 	})
 	tests.Add("permission denied", tt{
 		fs: &filesystem.MockFS{
-			OpenFunc: func(_ string) (filesystem.File, error) {
+			ReadDirFunc: func(_ string) ([]os.FileInfo, error) {
 				return nil, statusError{status: http.StatusForbidden, error: errors.New("permission denied")}
 			},
 		},
@@ -132,3 +133,58 @@ func TestCompact(t *testing.T) {
 		}
 	})
 }
+
+func TestCompactOmittedRevisions(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	ctx := context.Background()
+	writer, err := (&fsDriver{}).NewClient(tmpdir, kivik.Param("omit_revisions", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.CreateDB(ctx, "db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	wdb, err := writer.DB("db", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var revs []string
+	rev := ""
+	for _, value := range []string{"bar", "baz", "qux"} {
+		doc := map[string]string{"value": value}
+		if rev != "" {
+			doc["_rev"] = rev
+		}
+		rev, err = wdb.Put(ctx, "foo", doc, kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		revs = append(revs, rev)
+	}
+
+	// Compacted by a client which doesn't set omit_revisions
+	c, err := (&fsDriver{}).NewClient(tmpdir, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.DB("db", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, rev := range revs[:2] {
+		if _, err := os.Stat(filepath.Join(tmpdir, "db", ".foo", rev+".json")); !os.IsNotExist(err) {
+			t.Errorf("Expected superseded revision %s to be compacted away, got %v", rev, err)
+		}
+	}
+	doc, err := d.(*db).cdb.OpenDocRevs("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaves := doc.Leaves(); len(leaves) != 1 || leaves[0].Rev.String() != revs[2] {
+		t.Errorf("Expected only %s as a leaf, got %v", revs[2], leaves)
+	}
+}
@@ -0,0 +1,198 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// increment adds one to the count field of docID, retrying on conflict.
+func increment(ctx context.Context, d driver.DB, docID string) error {
+	for {
+		doc, err := d.Get(ctx, docID, kivik.Params(nil))
+		if err != nil {
+			return err
+		}
+		var body map[string]interface{}
+		err = json.NewDecoder(doc.Body).Decode(&body)
+		_ = doc.Body.Close()
+		if err != nil {
+			return err
+		}
+		body["count"] = body["count"].(float64) + 1
+		_, err = d.Put(ctx, docID, body, kivik.Params(nil))
+		if kivik.HTTPStatus(err) == http.StatusConflict {
+			continue
+		}
+		return err
+	}
+}
+
+func TestConcurrentClient(t *testing.T) {
+	type tt struct {
+		fs   filesystem.Filesystem
+		root string
+	}
+	tests := testy.NewTable()
+	tests.Add("default", func(t *testing.T) interface{} {
+		tmpdir := tempDir(t)
+		tests.Cleanup(func() error {
+			return os.RemoveAll(tmpdir)
+		})
+		return tt{
+			fs:   filesystem.Default(),
+			root: tmpdir,
+		}
+	})
+	tests.Add("memfs", func(t *testing.T) interface{} {
+		fs := filesystem.NewMemFS()
+		if err := fs.Mkdir("/root", 0o777); err != nil {
+			t.Fatal(err)
+		}
+		return tt{
+			fs:   fs,
+			root: "/root",
+		}
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		testConcurrentClient(t, tt.fs, tt.root)
+	})
+}
+
+func testConcurrentClient(t *testing.T, fs filesystem.Filesystem, root string) {
+	const (
+		writers    = 8
+		increments = 10
+		readers    = 4
+	)
+	ctx := context.Background()
+	c, err := (&fsDriver{fs: fs}).NewClient(root, kivik.Param("lock_timeout", "30s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDB(ctx, "db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	newDB := func() (driver.DB, error) {
+		return c.DB("db", kivik.Params(nil))
+	}
+	d, err := newDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Put(ctx, "counter", map[string]interface{}{"count": 0}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Workers report failures on errs, as t.Fatal may only be called from
+	// the test goroutine.
+	errs := make(chan error, writers+readers+1)
+	done := make(chan struct{})
+	var wg, background sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := newDB()
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < increments; j++ {
+				if err := increment(ctx, d, "counter"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < readers; i++ {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			d, err := newDB()
+			if err != nil {
+				errs <- err
+				return
+			}
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				doc, err := d.Get(ctx, "counter", kivik.Params(nil))
+				if err != nil {
+					errs <- fmt.Errorf("Get failed: %w", err)
+					return
+				}
+				_ = doc.Body.Close()
+				if _, err := d.(driver.RevGetter).GetRev(ctx, "counter", kivik.Params(nil)); err != nil {
+					errs <- fmt.Errorf("GetRev failed: %w", err)
+					return
+				}
+			}
+		}()
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		d, err := newDB()
+		if err != nil {
+			errs <- err
+			return
+		}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := d.Compact(ctx); err != nil {
+				errs <- fmt.Errorf("Compact failed: %w", err)
+				return
+			}
+			// Give writers a chance, as compaction takes precedence.
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	close(done)
+	background.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	doc := getDoc(t, d.(*db), "counter", nil)
+	if count := doc["count"].(float64); count != writers*increments {
+		t.Errorf("Expected count of %d, got %v", writers*increments, count)
+	}
+}
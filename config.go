@@ -0,0 +1,85 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+)
+
+// Config holds the settings of a database, as recorded in its metadata file.
+type Config = cdb.Meta
+
+// DBConfiger is implemented by the databases of this driver.
+type DBConfiger interface {
+	// Config returns the database's settings, with defaults filled in for
+	// those unset.
+	Config(ctx context.Context) (*Config, error)
+	// SetRevsLimit sets the number of ancestors recorded in the history of
+	// each new revision.
+	SetRevsLimit(ctx context.Context, limit int) error
+}
+
+var _ DBConfiger = &db{}
+
+// Config returns the database's settings, with defaults filled in for those
+// unset.
+func (d *db) Config(context.Context) (*Config, error) {
+	meta, err := d.cdb.ReadMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta.RevsLimit == 0 {
+		meta.RevsLimit = cdb.DefaultRevsLimit
+	}
+	if meta.Format == "" {
+		meta.Format = d.cdb.Format()
+	}
+	if meta.Hashing == "" {
+		meta.Hashing = cdb.HashFSDB
+	}
+	return meta, nil
+}
+
+// SetRevsLimit sets the number of ancestors recorded in the history of each
+// new revision, and records it in the database's metadata file. Existing
+// revisions are unchanged.
+func (d *db) SetRevsLimit(ctx context.Context, limit int) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	unlock, err := d.lockDB(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	meta, err := d.cdb.ReadMeta()
+	if err != nil {
+		return err
+	}
+	meta.RevsLimit = limit
+	if err := d.cdb.WriteMeta(meta); err != nil {
+		return err
+	}
+	d.applyMeta(meta)
+	return nil
+}
+
+// applyMeta applies the database settings which are not overridden when the
+// database is opened.
+func (d *db) applyMeta(meta *cdb.Meta) {
+	_ = d.cdb.SetHashing(meta.Hashing)     // Validated by ReadMeta
+	_ = d.cdb.SetRevsLimit(meta.RevsLimit) // Validated by ReadMeta
+	d.partitioned = meta.Partitioned
+}
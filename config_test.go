@@ -0,0 +1,246 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/kivik/v4"
+)
+
+func openTestDB(t *testing.T, root, dbName string, createOpts kivik.Option) *db {
+	t.Helper()
+	c, err := (&fsDriver{}).NewClient(root, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if createOpts != nil {
+		if err := c.CreateDB(context.Background(), dbName, createOpts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := c.DB(dbName, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.(*db)
+}
+
+func TestConfig(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+
+	d := openTestDB(t, tmpdir, "db", kivik.Param("hashing", "couchdb"))
+	config, err := d.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Created == nil || len(config.UUID) != 32 {
+		t.Errorf("Unexpected creation time and UUID: %v, %s", config.Created, config.UUID)
+	}
+	config.Created, config.UUID = nil, ""
+	want := &Config{
+		RevsLimit: cdb.DefaultRevsLimit,
+		Format:    "json",
+		Hashing:   cdb.HashCouchDB,
+	}
+	if d := testy.DiffInterface(want, config); d != nil {
+		t.Error(d)
+	}
+
+	// A database created by an older version, without a metadata file
+	if err := os.Mkdir(filepath.Join(tmpdir, "legacy"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	legacy := openTestDB(t, tmpdir, "legacy", nil)
+	config, err = legacy.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.Hashing = cdb.HashFSDB
+	if d := testy.DiffInterface(want, config); d != nil {
+		t.Error(d)
+	}
+}
+
+func TestSetRevsLimit(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	ctx := context.Background()
+
+	d := openTestDB(t, tmpdir, "db", kivik.Params(nil))
+	if err := d.SetRevsLimit(ctx, -1); kivik.HTTPStatus(err) != http.StatusBadRequest {
+		t.Errorf("Unexpected error for a negative limit: %v", err)
+	}
+	if err := d.SetRevsLimit(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit persists, and is honored by a newly opened database.
+	d = openTestDB(t, tmpdir, "db", nil)
+	config, err := d.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RevsLimit != 2 {
+		t.Errorf("Unexpected revs_limit: %d", config.RevsLimit)
+	}
+	rev := ""
+	for i := 0; i < 4; i++ {
+		doc := map[string]interface{}{"i": i}
+		if rev != "" {
+			doc["_rev"] = rev
+		}
+		if rev, err = d.Put(ctx, "foo", doc, kivik.Params(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := d.Get(ctx, "foo", kivik.Param("revs", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Revisions cdb.RevHistory `json:"_revisions"`
+	}
+	if err := json.NewDecoder(got.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Revisions.Start != 4 || len(body.Revisions.IDs) != 2 {
+		t.Errorf("Unexpected revision history: %+v", body.Revisions)
+	}
+}
+
+func TestPartitioned(t *testing.T) {
+	type tt struct {
+		docID  string
+		copy   bool
+		status int
+		err    string
+	}
+	tests := testy.NewTable()
+	tests.Add("partitioned", tt{
+		docID: "part:foo",
+	})
+	tests.Add("no partition", tt{
+		docID:  "foo",
+		status: http.StatusBadRequest,
+		err:    "doc id must be of form partition:id",
+	})
+	tests.Add("empty partition", tt{
+		docID:  ":foo",
+		status: http.StatusBadRequest,
+		err:    "doc id must be of form partition:id",
+	})
+	tests.Add("design doc", tt{
+		docID: "_design/foo",
+	})
+	tests.Add("local doc", tt{
+		docID: "_local/foo",
+	})
+	tests.Add("copy without partition", tt{
+		docID:  "bar",
+		copy:   true,
+		status: http.StatusBadRequest,
+		err:    "doc id must be of form partition:id",
+	})
+	tests.Add("copy", tt{
+		docID: "part:bar",
+		copy:  true,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		tmpdir := tempDir(t)
+		defer rmdir(t, tmpdir)
+		ctx := context.Background()
+		d := openTestDB(t, tmpdir, "db", kivik.Param("partitioned", true))
+		var err error
+		if tt.copy {
+			if _, err := d.Put(ctx, "part:foo", map[string]string{}, kivik.Params(nil)); err != nil {
+				t.Fatal(err)
+			}
+			_, err = d.Copy(ctx, tt.docID, "part:foo", kivik.Params(nil))
+		} else {
+			_, err = d.Put(ctx, tt.docID, map[string]string{}, kivik.Params(nil))
+		}
+		testy.StatusError(t, tt.err, tt.status, err)
+	})
+}
+
+func TestDBExists(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	files := map[string]string{
+		"legacy/foo.json":      `{"_rev":"1-a"}`,
+		"empty/":               "",
+		"stray/README.md":      "read me",
+		"annotated/README.md":  "read me",
+		"annotated/_meta.json": "{}",
+		"file.txt":             "",
+	}
+	for name, content := range files {
+		path := filepath.Join(tmpdir, name)
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0o777); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := (&fsDriver{}).NewClient(tmpdir, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDB(context.Background(), "created", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"annotated": true,
+		"created":   true,
+		"empty":     true,
+		"legacy":    true,
+		"missing":   false,
+		"stray":     false,
+		"file.txt":  false,
+	}
+	for dbName, exists := range want {
+		got, err := c.DBExists(context.Background(), dbName, kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != exists {
+			t.Errorf("DBExists(%q) = %t", dbName, got)
+		}
+	}
+	dbs, err := c.AllDBs(context.Background(), kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffInterface([]string{"annotated", "created", "empty", "legacy"}, dbs); d != nil {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,85 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+var _ driver.Copier = &db{}
+
+// parseDestination splits a CouchDB-style Destination, which may include a
+// target revision, as in "docid?rev=1-xxx", into its parts.
+func parseDestination(dest string) (docID, rev string) {
+	if i := strings.LastIndex(dest, "?rev="); i >= 0 {
+		return dest[:i], dest[i+len("?rev="):]
+	}
+	return dest, ""
+}
+
+// Copy copies the winning revision of sourceID, or the revision specified by
+// the rev option, to targetID. To overwrite an existing document, the target
+// rev must be given as part of targetID, as with CouchDB's Destination header:
+// "docid?rev=1-xxx". Attachment files are hard-linked, rather than copied,
+// where the filesystem allows.
+func (d *db) Copy(ctx context.Context, targetID, sourceID string, options driver.Options) (string, error) {
+	if sourceID == "" {
+		return "", statusError{status: http.StatusBadRequest, error: errors.New("no source docid specified")}
+	}
+	targetID, targetRev := parseDestination(targetID)
+	if targetID == "" {
+		return "", statusError{status: http.StatusBadRequest, error: errors.New("no target docid specified")}
+	}
+	if err := validateID(targetID); err != nil {
+		return "", err
+	}
+	if d.partitioned {
+		if err := validatePartition(targetID); err != nil {
+			return "", err
+		}
+	}
+	fs, err := d.writeCDB(options)
+	if err != nil {
+		return "", err
+	}
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	unlock, err := d.lockDoc(ctx, targetID, opts)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	source, err := fs.OpenDocID(sourceID, options)
+	if err != nil {
+		return "", err
+	}
+	rev := source.Revisions[0].Copy()
+	doc, err := fs.OpenDocID(targetID, kivik.Params(nil))
+	switch {
+	case kivik.HTTPStatus(err) == http.StatusNotFound:
+		doc = fs.NewDocument(targetID)
+	case err != nil:
+		return "", err
+	}
+	addOpts := kivik.Params(nil)
+	if targetRev != "" {
+		addOpts = kivik.Rev(targetRev)
+	}
+	return doc.AddRevision(ctx, rev, addOpts)
+}
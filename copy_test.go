@@ -0,0 +1,169 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+)
+
+func TestParseDestination(t *testing.T) {
+	type tt struct {
+		dest, docID, rev string
+	}
+	tests := testy.NewTable()
+	tests.Add("doc id only", tt{"foo", "foo", ""})
+	tests.Add("with rev", tt{"foo?rev=1-xxx", "foo", "1-xxx"})
+	tests.Add("ddoc with rev", tt{"_design/foo?rev=2-yyy", "_design/foo", "2-yyy"})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		docID, rev := parseDestination(tt.dest)
+		if docID != tt.docID || rev != tt.rev {
+			t.Errorf("Unexpected result: %s, %s", docID, rev)
+		}
+	})
+}
+
+func TestCopy(t *testing.T) {
+	type tt struct {
+		path             string
+		target, source   string
+		options          kivik.Option
+		status           int
+		err              string
+		wantValue        string
+		wantAtts         []string
+		wantLinkedSource string
+	}
+	tests := testy.NewTable()
+	tests.Add("no source", tt{
+		path:   "doesntmatter",
+		target: "foo",
+		status: http.StatusBadRequest,
+		err:    "no source docid specified",
+	})
+	tests.Add("invalid target", tt{
+		path:   "doesntmatter",
+		target: "_foo",
+		source: "foo",
+		status: http.StatusBadRequest,
+		err:    "only reserved document ids may start with underscore",
+	})
+	tests.Add("source not found", func(t *testing.T) interface{} {
+		tmpdir := copyDir(t, "testdata/db_foo", 1)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		return tt{
+			path:   tmpdir,
+			target: "newdoc",
+			source: "notfound",
+			status: http.StatusNotFound,
+			err:    "missing",
+		}
+	})
+	tests.Add("copy with attachment", func(t *testing.T) interface{} {
+		tmpdir := copyDir(t, "testdata/db_foo", 1)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		return tt{
+			path:             tmpdir,
+			target:           "newdoc",
+			source:           "withattach",
+			wantValue:        "bar",
+			wantAtts:         []string{"foo.txt"},
+			wantLinkedSource: filepath.Join(tmpdir, "db_foo", "withattach", "foo.txt"),
+		}
+	})
+	tests.Add("copy old rev", func(t *testing.T) interface{} {
+		tmpdir := copyDir(t, "testdata/db_foo", 1)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		return tt{
+			path:             tmpdir,
+			target:           "newdoc",
+			source:           "withattach",
+			options:          kivik.Rev("1-xxxxxxxxxx"),
+			wantValue:        "bar",
+			wantAtts:         []string{"foo.txt"},
+			wantLinkedSource: filepath.Join(tmpdir, "db_foo", ".withattach", "1-xxxxxxxxxx", "foo.txt"),
+		}
+	})
+	tests.Add("existing target without rev", func(t *testing.T) interface{} {
+		tmpdir := copyDir(t, "testdata/db_foo", 1)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		return tt{
+			path:   tmpdir,
+			target: "noattach",
+			source: "withattach",
+			status: http.StatusConflict,
+			err:    "document update conflict",
+		}
+	})
+	tests.Add("overwrite existing target", func(t *testing.T) interface{} {
+		tmpdir := copyDir(t, "testdata/db_foo", 1)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		return tt{
+			path:      tmpdir,
+			target:    "noattach?rev=1-xxxxxxxxxx",
+			source:    "withattach",
+			wantValue: "bar",
+			wantAtts:  []string{"foo.txt"},
+		}
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		c := &client{root: tt.path, fs: filesystem.Default()}
+		db, err := c.newDB("db_foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := tt.options
+		if opts == nil {
+			opts = kivik.Params(nil)
+		}
+		rev, err := db.Copy(context.Background(), tt.target, tt.source, opts)
+		testy.StatusError(t, tt.err, tt.status, err)
+		targetID, _ := parseDestination(tt.target)
+		doc := getDoc(t, db, targetID, nil)
+		if doc["_rev"] != rev {
+			t.Errorf("Unexpected rev: %v", doc["_rev"])
+		}
+		if doc["foo"] != tt.wantValue {
+			t.Errorf("Unexpected value: %v", doc["foo"])
+		}
+		atts, _ := doc["_attachments"].(map[string]interface{})
+		for _, filename := range tt.wantAtts {
+			if _, ok := atts[filename]; !ok {
+				t.Errorf("Attachment %s not copied", filename)
+			}
+		}
+		if tt.wantLinkedSource != "" {
+			source, err := os.Stat(tt.wantLinkedSource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target, err := os.Stat(filepath.Join(tt.path, "db_foo", targetID, tt.wantAtts[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(source, target) {
+				t.Errorf("Attachment was copied, not linked")
+			}
+		}
+	})
+}
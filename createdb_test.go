@@ -13,13 +13,19 @@
 package fs
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
 
 	"gitlab.com/flimzy/testy"
 
 	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
 	"github.com/go-kivik/kivik/v4/driver"
 )
 
@@ -41,8 +47,11 @@ func TestCreateDB(t *testing.T) {
 				Vendor:      Vendor,
 				RawResponse: json.RawMessage(fmt.Sprintf(`{"version":"%s","vendor":{"name":"%s"}}`, Version, Vendor)),
 			},
-			root: "testdata",
-			fs:   filesystem.Default(),
+			root:         "testdata",
+			fs:           filesystem.Default(),
+			syncer:       filesystem.NewSyncer(filesystem.Default()),
+			locks:        &lockRegistry{},
+			replications: &replicationRegistry{},
 		},
 	})
 
@@ -54,3 +63,151 @@ func TestCreateDB(t *testing.T) {
 		}
 	})
 }
+
+// metaReplacements mask the creation time and UUID of new databases.
+var metaReplacements = []testy.Replacement{
+	{Regexp: regexp.MustCompile(`"created": "[^"]+"`), Replacement: `"created": "X"`},
+	{Regexp: regexp.MustCompile(`"uuid": "[0-9a-f]{32}"`), Replacement: `"uuid": "X"`},
+}
+
+func TestCreateDBHashing(t *testing.T) {
+	type tt struct {
+		clientOpts kivik.Option
+		createOpts kivik.Option
+		wantMeta   string
+		wantRev    string
+		status     int
+		err        string
+	}
+	tests := testy.NewTable()
+	tests.Add("default", tt{
+		wantMeta: "{\n  \"hashing\": \"fsdb\",\n  \"created\": \"X\",\n  \"uuid\": \"X\"\n}\n",
+		wantRev:  "1-04edfaf9abdaed3c0accf6c463e78fd4",
+	})
+	tests.Add("client couchdb", tt{
+		clientOpts: kivik.Param("hashing", "couchdb"),
+		wantMeta:   "{\n  \"hashing\": \"couchdb\",\n  \"created\": \"X\",\n  \"uuid\": \"X\"\n}\n",
+		wantRev:    "1-4c6114c65e295552ab1019e2b046b10e",
+	})
+	tests.Add("create overrides client", tt{
+		clientOpts: kivik.Param("hashing", "couchdb"),
+		createOpts: kivik.Param("hashing", "fsdb"),
+		wantMeta:   "{\n  \"hashing\": \"fsdb\",\n  \"created\": \"X\",\n  \"uuid\": \"X\"\n}\n",
+		wantRev:    "1-04edfaf9abdaed3c0accf6c463e78fd4",
+	})
+	tests.Add("invalid hashing", tt{
+		createOpts: kivik.Param("hashing", "sha1"),
+		status:     http.StatusBadRequest,
+		err:        "unsupported hashing mode: sha1",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		tmpdir := tempDir(t)
+		defer rmdir(t, tmpdir)
+		clientOpts, createOpts := tt.clientOpts, tt.createOpts
+		if clientOpts == nil {
+			clientOpts = kivik.Params(nil)
+		}
+		if createOpts == nil {
+			createOpts = kivik.Params(nil)
+		}
+		c, err := (&fsDriver{}).NewClient(tmpdir, clientOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.CreateDB(context.Background(), "db", createOpts)
+		testy.StatusError(t, tt.err, tt.status, err)
+		meta, err := os.ReadFile(filepath.Join(tmpdir, "db", "_meta.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffText(tt.wantMeta, string(meta), metaReplacements...); d != nil {
+			t.Error(d)
+		}
+		d, err := c.DB("db", kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rev, err := d.Put(context.Background(), "foo", map[string]string{"foo": "bar"}, kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev != tt.wantRev {
+			t.Errorf("Unexpected rev: %s", rev)
+		}
+	})
+}
+
+func TestCreateDBSettings(t *testing.T) {
+	type tt struct {
+		clientOpts kivik.Option
+		createOpts kivik.Option
+		files      map[string]string
+		wantMeta   string
+		status     int
+		err        string
+	}
+	tests := testy.NewTable()
+	tests.Add("format and partitioned", tt{
+		createOpts: kivik.Params(map[string]interface{}{"format": "yaml", "partitioned": true}),
+		wantMeta:   "{\n  \"format\": \"yaml\",\n  \"hashing\": \"fsdb\",\n  \"partitioned\": true,\n  \"created\": \"X\",\n  \"uuid\": \"X\"\n}\n",
+	})
+	tests.Add("client format", tt{
+		clientOpts: kivik.Param("format", "toml"),
+		wantMeta:   "{\n  \"format\": \"toml\",\n  \"hashing\": \"fsdb\",\n  \"created\": \"X\",\n  \"uuid\": \"X\"\n}\n",
+	})
+	tests.Add("invalid format", tt{
+		createOpts: kivik.Param("format", "xml"),
+		status:     http.StatusBadRequest,
+		err:        "unsupported format: xml",
+	})
+	tests.Add("invalid partitioned", tt{
+		createOpts: kivik.Param("partitioned", "maybe"),
+		status:     http.StatusBadRequest,
+		err:        "invalid value for partitioned: maybe",
+	})
+	tests.Add("stray directory", tt{
+		files:  map[string]string{"db/README.md": "read me"},
+		status: http.StatusPreconditionFailed,
+		err:    "exists, but is not a database",
+	})
+	tests.Add("existing database", tt{
+		files:  map[string]string{"db/foo.json": `{"_rev":"1-a"}`},
+		status: http.StatusPreconditionFailed,
+		err:    "database already exists",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		tmpdir := tempDir(t)
+		defer rmdir(t, tmpdir)
+		for name, content := range tt.files {
+			path := filepath.Join(tmpdir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		clientOpts, createOpts := tt.clientOpts, tt.createOpts
+		if clientOpts == nil {
+			clientOpts = kivik.Params(nil)
+		}
+		if createOpts == nil {
+			createOpts = kivik.Params(nil)
+		}
+		c, err := (&fsDriver{}).NewClient(tmpdir, clientOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.CreateDB(context.Background(), "db", createOpts)
+		testy.StatusErrorRE(t, tt.err, tt.status, err)
+		meta, err := os.ReadFile(filepath.Join(tmpdir, "db", "_meta.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffText(tt.wantMeta, string(meta), metaReplacements...); d != nil {
+			t.Error(d)
+		}
+	})
+}
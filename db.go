@@ -28,6 +28,8 @@ type db struct {
 	dbPath, dbName string
 	fs             filesystem.Filesystem
 	cdb            *cdb.FS
+	// partitioned is true if document IDs must have the form partition:id.
+	partitioned bool
 }
 
 var _ driver.DB = &db{}
@@ -38,9 +40,12 @@ func (d *db) path(parts ...string) string {
 	return filepath.Join(append([]string{d.dbPath}, parts...)...)
 }
 
-func (d *db) AllDocs(context.Context, driver.Options) (driver.Rows, error) {
-	// FIXME: Unimplemented
-	return nil, notYetImplemented
+// fsys returns the filesystem through which the database is accessed.
+func (d *db) fsys() filesystem.Filesystem {
+	if d.fs == nil {
+		return filesystem.Default()
+	}
+	return d.fs
 }
 
 func (d *db) Query(context.Context, string, string, driver.Options) (driver.Rows, error) {
@@ -49,50 +54,42 @@ func (d *db) Query(context.Context, string, string, driver.Options) (driver.Rows
 }
 
 func (d *db) CreateDoc(context.Context, interface{}, driver.Options) (docID, rev string, err error) {
+	if err := d.checkWritable(); err != nil {
+		return "", "", err
+	}
 	// FIXME: Unimplemented
 	return "", "", notYetImplemented
 }
 
-func (d *db) Delete(context.Context, string, driver.Options) (newRev string, err error) {
-	// FIXME: Unimplemented
-	return "", notYetImplemented
-}
-
 func (d *db) Stats(context.Context) (*driver.DBStats, error) {
 	// FIXME: Unimplemented
 	return nil, notYetImplemented
 }
 
 func (d *db) CompactView(context.Context, string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
 	// FIXME: Unimplemented
 	return notYetImplemented
 }
 
 func (d *db) ViewCleanup(context.Context) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
 	// FIXME: Unimplemented
 	return notYetImplemented
 }
 
 func (d *db) BulkDocs(context.Context, []interface{}) ([]driver.BulkResult, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
 	// FIXME: Unimplemented
 	return nil, notYetImplemented
 }
 
-func (d *db) PutAttachment(context.Context, string, *driver.Attachment, driver.Options) (string, error) {
-	// FIXME: Unimplemented
-	return "", notYetImplemented
-}
-
-func (d *db) GetAttachment(context.Context, string, string, driver.Options) (*driver.Attachment, error) {
-	// FIXME: Unimplemented
-	return nil, notYetImplemented
-}
-
-func (d *db) DeleteAttachment(context.Context, string, string, driver.Options) (newRev string, err error) {
-	// FIXME: Unimplemented
-	return "", notYetImplemented
-}
-
 func (d *db) Close() error {
 	return nil
 }
@@ -0,0 +1,40 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// Delete deletes the document by adding a deleted revision, with no other
+// content, as a child of the revision given by the rev option. Without the
+// rev option, it fails with a conflict if the document exists.
+func (d *db) Delete(ctx context.Context, docID string, options driver.Options) (string, error) {
+	if err := d.checkWritable(); err != nil {
+		return "", err
+	}
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	if rev, _ := opts["rev"].(string); rev == "" {
+		if _, err := d.GetRev(ctx, docID, kivik.Params(nil)); err != nil {
+			return "", err
+		}
+		return "", statusError{status: http.StatusConflict, error: errors.New("document update conflict")}
+	}
+	return d.Put(ctx, docID, map[string]interface{}{"_deleted": true}, options)
+}
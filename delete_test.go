@@ -0,0 +1,91 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/kivik/v4"
+)
+
+func TestDelete(t *testing.T) {
+	type tt struct {
+		id     string
+		rev    string
+		status int
+		err    string
+	}
+	tests := testy.NewTable()
+	tests.Add("winner", tt{
+		id:  "bar",
+		rev: "winner",
+	})
+	tests.Add("no rev", tt{
+		id:     "bar",
+		status: http.StatusConflict,
+		err:    "document update conflict",
+	})
+	tests.Add("stale rev", tt{
+		id:     "foo",
+		rev:    "1-",
+		status: http.StatusConflict,
+		err:    "document update conflict",
+	})
+	tests.Add("missing doc", tt{
+		id:     "missing",
+		status: http.StatusNotFound,
+		err:    "missing",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		c, _ := archiveTestClient(t)
+		d, err := c.DB("src", kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		rev := tt.rev
+		switch rev {
+		case "winner", "1-":
+			winner, err := d.(*db).GetRev(ctx, tt.id, kivik.Params(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev == "winner" {
+				rev = winner
+			} else {
+				doc, err := d.(*db).cdb.OpenDocRevs(tt.id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rev = doc.Revisions[len(doc.Revisions)-1].Rev.String()
+			}
+		}
+		opts := kivik.Params(nil)
+		if rev != "" {
+			opts = kivik.Rev(rev)
+		}
+		newRev, err := d.Delete(ctx, tt.id, opts)
+		testy.StatusError(t, tt.err, tt.status, err)
+		if _, err := d.Get(ctx, tt.id, kivik.Params(nil)); kivik.HTTPStatus(err) != http.StatusNotFound {
+			t.Errorf("Expected document to be deleted, got %v", err)
+		}
+		if _, err := d.Get(ctx, tt.id, kivik.Rev(newRev)); err != nil {
+			t.Errorf("Expected the tombstone to be readable: %s", err)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/kivik/v4"
+)
+
+func TestDestroyDB(t *testing.T) {
+	type tt struct {
+		clientOpts kivik.Option
+		options    kivik.Option
+		files      map[string]string
+		want       []string
+		status     int
+		err        string
+	}
+	tests := testy.NewTable()
+	tests.Add("success", tt{
+		files: map[string]string{
+			"db/foo.json":   `{"_rev":"1-a"}`,
+			"db/_meta.json": `{}`,
+		},
+	})
+	tests.Add("missing", tt{
+		status: http.StatusNotFound,
+		err:    "^database does not exist$",
+	})
+	tests.Add("file", tt{
+		files:  map[string]string{"db": "not a database"},
+		status: http.StatusNotFound,
+		err:    "^database does not exist$",
+	})
+	tests.Add("unrecognized files", tt{
+		files: map[string]string{
+			"db/foo.json":  `{"_rev":"1-a"}`,
+			"db/README.md": "read me",
+		},
+		status: http.StatusPreconditionFailed,
+		err:    "contains unrecognized files, and was left unchanged: README.md$",
+	})
+	tests.Add("force", tt{
+		options: kivik.Param("force", true),
+		files: map[string]string{
+			"db/foo.json":  `{"_rev":"1-a"}`,
+			"db/README.md": "read me",
+		},
+	})
+	tests.Add("invalid force", tt{
+		options: kivik.Param("force", "please"),
+		files:   map[string]string{"db/foo.json": `{"_rev":"1-a"}`},
+		status:  http.StatusBadRequest,
+		err:     "^invalid value for force: please$",
+	})
+	tests.Add("trash", tt{
+		options: kivik.Param("trash", "_trash"),
+		files:   map[string]string{"db/foo.json": `{"_rev":"1-a"}`},
+		want:    []string{"_trash/", "_trash/db.*/", `_trash/db.*/foo.json={"_rev":"1-a"}`},
+	})
+	tests.Add("client trash", tt{
+		clientOpts: kivik.Param("trash", "_trash"),
+		files:      map[string]string{"db/foo.json": `{"_rev":"1-a"}`},
+		want:       []string{"_trash/", "_trash/db.*/", `_trash/db.*/foo.json={"_rev":"1-a"}`},
+	})
+	tests.Add("invalid trash", tt{
+		options: kivik.Param("trash", 3),
+		files:   map[string]string{"db/foo.json": `{"_rev":"1-a"}`},
+		status:  http.StatusBadRequest,
+		err:     "^invalid value for trash: 3$",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		tmpdir := tempDir(t)
+		defer rmdir(t, tmpdir)
+		for name, content := range tt.files {
+			path := filepath.Join(tmpdir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		clientOpts, options := tt.clientOpts, tt.options
+		if clientOpts == nil {
+			clientOpts = kivik.Params(nil)
+		}
+		if options == nil {
+			options = kivik.Params(nil)
+		}
+		c, err := (&fsDriver{}).NewClient(tmpdir, clientOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.DestroyDB(context.Background(), "db", options)
+		testy.StatusErrorRE(t, tt.err, tt.status, err)
+		var got []string
+		err = filepath.Walk(tmpdir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || path == tmpdir {
+				return err
+			}
+			rel, _ := filepath.Rel(tmpdir, path)
+			rel = filepath.ToSlash(rel)
+			// Mask the time at which the database was trashed.
+			if i := strings.Index(rel, "db."); i >= 0 {
+				rel = rel[:i+3] + "*" + rel[i+3+len("20060102T150405.000000000Z"):]
+			}
+			if info.IsDir() {
+				got = append(got, rel+"/")
+				return nil
+			}
+			content, err := os.ReadFile(path)
+			got = append(got, rel+"="+string(content))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffInterface(tt.want, got); d != nil {
+			t.Error(d)
+		}
+	})
+}
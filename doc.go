@@ -39,6 +39,39 @@ For example:
 
 would look for document files in `/home/usr/some/path/foo`.
 
+To store databases somewhere other than the local disk, register a driver
+created by NewDriver with an alternative filesystem. All disk access,
+including creating, listing and destroying databases, goes through it. For
+tests, filesystem.NewMemFS provides one held entirely in memory, so that
+tests needn't touch the disk, and may run in parallel:
+
+	kivik.Register("memfs", fs.NewDriver(filesystem.NewMemFS()))
+	client, err := kivik.New("memfs", "/")
+
+Databases may also be served read-only from any io/fs.FS, such as fixtures
+embedded in a test binary, with a driver created by NewReadOnlyDriver. The
+all: prefix is needed for go:embed to include revisions directories and
+files such as _security.json, whose names begin with '.' or '_':
+
+	//go:embed all:testdata
+	var fixtures embed.FS
+
+	kivik.Register("fixtures", fs.NewReadOnlyDriver(fixtures))
+	client, err := kivik.New("fixtures", "testdata")
+
+Reads, including AllDocs, the changes feed, RevsDiff and Security, work as
+usual, while every write fails with 405 Method Not Allowed.
+
+For tests which write to a fixture, filesystem.NewOverlay layers a writable
+filesystem, such as a MemFS, or a scratch directory given to
+filesystem.NewDirFS, over a pristine fixture, which is never modified. Each
+test gets a writable view instantly, without copying the fixture, and the
+overlay's Changes and Discard methods list or throw away what it wrote:
+
+	overlay := filesystem.NewOverlay(filesystem.Default(), filesystem.NewMemFS())
+	kivik.Register("overlay", fs.NewDriver(overlay))
+	client, err := kivik.New("overlay", "/path/to/fixtures")
+
 # Connection Strings
 
 This driver supports three types of connection strings to the New() method:
@@ -52,6 +85,205 @@ This driver supports three types of connection strings to the New() method:
     client-level methods, such as AllDBs(), are unavailable, when using an empty
     connection string.
 
+# Document Formats
+
+Documents may be stored as JSON (`.json`), YAML (`.yaml` or `.yml`), TOML
+(`.toml`) or JSON5 (`.json5`) files. TOML datetimes are read as strings, in RFC
+3339 format, as JSON has no datetime type, and as TOML has no null, documents
+containing null values cannot be written as TOML. JSON5 documents are written
+as plain, indented JSON, which is also valid JSON5.
+New revisions of an existing document are written in the format of its
+winning revision, so hand-written YAML documents remain YAML after an update.
+New documents are written as JSON, unless the "format" option, passed to
+kivik.New or to DB, names another extension, such as "yaml".
+
+JSON documents are written on a single line, unless the "json_indent" option,
+passed to kivik.New, gives an indent, either as a number of spaces or as a
+string such as "\t". They are then pretty-printed, with the _id and _rev keys
+first, followed by the rest in sorted order, so that changes make for readable
+diffs when a database is kept under version control. In that case, the
+"omit_revisions" option may also be set, to leave the _revisions history out of
+each winning revision's file. The history of any revision read without one is
+inferred from its parent, the one revision with the preceding sequence number,
+if there is only one, so other clients, and compaction, need not set the
+option to read such a database.
+
+Support for other formats may be added by registering a codec for their file
+extension with the Register function of the cdb/decode package. Files with a
+registered extension are then read, and written, like any other document.
+
+# Database Settings
+
+CreateDB records a database's settings in a `_meta.json` file within it: the
+default document format, the revision hashing mode described below, whether
+the database is partitioned, the number of ancestors recorded in each
+revision's history (revs_limit, 1000 by default), the time the database was
+created, and a random UUID which identifies it. CreateDB accepts the "format",
+"hashing" and "partitioned" options. In a partitioned database, the IDs of
+documents other than design and local documents must have the form
+"partition:id". The databases of this driver implement DBConfiger, through
+which the settings may be read, and revs_limit changed.
+
+A directory is considered a database if it contains a `_meta.json` file. A
+directory without one, such as a database created by an older version of this
+driver, is considered a database only if it contains nothing but documents,
+revisions, attachments, and the driver's own files, so that DBExists and
+AllDBs ignore unrelated directories within the root path.
+
+For the same reason, DestroyDB removes only what the driver recognizes. If the
+database's directory contains anything else, such as after pointing the
+client at the wrong path, DestroyDB leaves it unchanged, and returns an error
+listing the unrecognized entries. Pass the "force" option, with the value
+true, to remove the directory regardless. With the "trash" option, passed to
+kivik.New or DestroyDB, set to a directory, relative to the root path if not
+absolute, databases are moved there instead of being removed, named for the
+database followed by the time of their destruction, and can be restored by
+moving them back.
+
+# Revision IDs
+
+A database's revision hashing mode determines the algorithm by which revision
+IDs are generated. By default, a
+revision's ID is derived from the MD5 sum of its JSON representation, which
+differs from CouchDB's algorithm, so the same edit results in different
+revision IDs in fsdb and in CouchDB. Pass the "hashing" option, with the value
+"couchdb", to kivik.New or CreateDB, to create databases which generate
+revision IDs as CouchDB does. Identical edits then result in identical
+revision IDs, provided the document was sent to CouchDB with its keys in
+sorted order, as Go's JSON encoder writes them. Databases without a
+`_meta.json` file, such as those created by older versions, use the default.
+
+# Replication
+
+The client's Replicate method replicates between two databases on the local
+filesystem. Source and target may be database names relative to the client's
+root, absolute paths, or file:// URLs. Replications run in the background, and
+are listed by GetReplications until deleted. The continuous, create_target,
+doc_ids and filter options are supported. Filters may be "_doc_ids", or a Go
+function of type ReplicationFilter; JavaScript filter functions are not
+supported.
+
+To replicate to or from a database managed by another Kivik driver, such as a
+CouchDB server, use the package-level Replicate function, which accepts any
+driver.DB as source or target.
+
+Checkpoints are stored in _local documents on both source and target, and a
+continuous replication updates them only when it has replicated something. As
+this driver's changes feed has no sequence IDs, a replication from a database
+on the local filesystem reads every document, and copies only the revisions
+missing from the target.
+
+# Durability
+
+By default, writes are not synced to stable storage when they return. The
+modified files and directories are instead synced by the next call to Flush,
+or automatically once enough of them are pending. Pass the "full_commit"
+option to kivik.New, with a value of true, to sync file contents and their
+directories before each write returns.
+
+The X-Couch-Full-Commit option (OptionFullCommit) overrides the client
+default for a single write, and the batch=ok option defers syncing of a write
+even when full_commit is enabled.
+
+# Locking
+
+Document updates take an advisory lock (flock) on a per-document lock file,
+so that concurrent writers, even in separate processes, receive a 409 Conflict
+rather than silently overwriting each other's changes. Compaction takes an
+exclusive lock on the whole database. Lock files are kept in the `._locks`
+directory of the database while in use, and removed when released.
+
+Within a process, goroutines sharing a client also coordinate through
+in-process locks, which additionally exclude reads by Get, GetRev and BulkGet
+while a document is being updated. Databases obtained from the same client
+share these locks; separate clients, like separate processes, rely on the
+lock files alone.
+
+A writer waits up to 10 seconds for a lock, before failing with 503 Service
+Unavailable. The "lock_timeout" option, passed to kivik.New or to a single
+write, overrides this, as a time.Duration or a string such as "500ms".
+Locking against other processes is supported on Linux, macOS and the BSDs.
+
+# Crash Recovery
+
+Promoting a new winning revision takes several renames. These are first
+recorded in a journal, in the `._journal` directory of the database, so that
+an update interrupted part way through is completed, or if that isn't
+possible, undone, by the next update of the same document, when the database
+is next opened with DB, or before compaction.
+
+A write interrupted by a crash or power loss may leave temporary files, or a
+document whose main file doesn't hold its winning revision. The Fsck methods
+of the client and of each database (see ClientFscker and DBFscker) report
+such issues, and fix them where possible when passed the "repair" option with
+a value of true. Attachments whose content doesn't match their digest are
+reported, but can't be repaired.
+
+# Archives
+
+A database, or some of its documents, may be exported to a tar.gz or zip
+archive of its on-disk layout with the database's Export method (see
+DBExporter), and imported as a new database with the client's Import method
+(see ClientImporter). Before the new database is created, the archive is
+checked for paths outside of the database and unrecognized files, and by
+Fsck, so that revision files must match their _rev fields, and attachments
+their digests. The fsdb command, in cmd/fsdb, does the same from the command
+line:
+
+	fsdb -root /var/lib/dbs export -o users.tar.gz users
+	fsdb -root /srv/dbs import users users.tar.gz
+
+# Dumps
+
+For interoperability with CouchDB and its tools, a database's Dump method
+(see DBDumper) writes every leaf revision, with its history, as with
+revs=true, and its attachments inlined, as JSON lines, or with the
+"dump_format" option set to "bulk_docs", as a _bulk_docs request body. Its
+Load method (see DBLoader) stores such a dump, or a couchbackup file, with
+new_edits=false, so that revision histories and conflicts survive the round
+trip. The fsdb command's dump and load subcommands do the same.
+
+# The fsdb Command
+
+The fsdb command, in cmd/fsdb, inspects and maintains databases from the
+command line, using the same packages as the driver. Besides export, import,
+dump and load, it lists databases and documents, gets, puts and deletes
+documents, prints revision trees and changes feeds, compacts, checks and
+repairs databases, and compares the leaf revisions of two databases:
+
+	fsdb -root /var/lib/dbs revs users org.couchdb.user:bob
+	fsdb -root /var/lib/dbs fsck -repair users
+
+# HTTP Server
+
+NewHandler returns an http.Handler serving a client's databases with the
+CouchDB API, so that PouchDB, the CouchDB replicator or curl can be pointed
+at a directory of databases. The fsdb serve command runs one:
+
+	fsdb -root ./fixtures serve -addr localhost:5984 -cors '*'
+
+The server endpoints /, /_all_dbs and /_up are supported, as are database
+info, creation and deletion, and these endpoints of each database:
+
+  - documents, including _local and _design documents, with GET, HEAD, PUT,
+    DELETE and COPY, and POST to the database, which generates an ID
+  - attachments, with GET, HEAD, PUT and DELETE
+  - _all_docs, _bulk_docs, _bulk_get, _revs_diff, _security, _compact and
+    _ensure_full_commit
+  - _changes, with normal, longpoll and continuous feeds, and the _doc_ids
+    and _selector filters
+  - _find, which scans every document, as CouchDB does without an index
+
+Documents are written and read as multipart/related, with attachments
+following the JSON, when the client asks, as the CouchDB replicator does, and
+the open_revs parameter is supported, with JSON responses.
+
+As the filesystem records no update sequence, the handler numbers changes
+itself, by rescanning a database on each _changes request, and every poll
+interval while a feed waits. Sequence IDs are only valid for the life of the
+handler; a client presenting one from an earlier run, as after a restart,
+starts again from the beginning, which costs only a _revs_diff per document.
+
 # Handling of Filenames
 
 CouchDB allows databases and document IDs to contain a slash (/)
@@ -64,5 +296,17 @@ as conservatively as possible. The escaping rules are:
     (i.e. '%2F' or '%2f')
   - When escaping a literal slash (/) or a literal percent sign (%), are
     escaped using standard URL escaping. No other characters are escaped.
+
+# Lint Mode
+
+Files which don't fit this layout, such as those in unregistered formats, or
+with names that can't be unescaped, are skipped silently. To learn why a
+document or database doesn't appear, pass the "lint" option to kivik.New. Set
+to true, warnings about skipped files are collected by AllDBs, the changes
+feed, compaction and document reads, and returned by the client's Warnings
+method (see ClientLinter). Set to a func(fs.Warning), each warning is passed
+to it instead. Only the first 1000 warnings since the last call to Warnings
+are kept. In lint mode, the changes feed, AllDocs and compaction also skip
+documents which can't be decoded, with a warning, rather than failing.
 */
 package fs
@@ -0,0 +1,279 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// The dump formats supported by Dump.
+const (
+	// DumpNDJSON writes one document per line, as by couchdb-dump.
+	DumpNDJSON = "ndjson"
+	// DumpBulkDocs writes a single _bulk_docs request body, with new_edits
+	// set to false.
+	DumpBulkDocs = "bulk_docs"
+)
+
+// DBDumper is implemented by the databases of this driver.
+type DBDumper interface {
+	// Dump writes every revision needed to reproduce the database, or the
+	// documents named by the doc_ids option, to w as JSON, in the format
+	// selected by the dump_format option, DumpNDJSON, the default, or
+	// DumpBulkDocs.
+	Dump(ctx context.Context, w io.Writer, options driver.Options) error
+}
+
+// DBLoader is implemented by the databases of this driver.
+type DBLoader interface {
+	// Load stores the documents read from r, as written by Dump, couchbackup
+	// or as a _bulk_docs request body, with their revision histories.
+	Load(ctx context.Context, r io.Reader, options driver.Options) (*LoadResult, error)
+}
+
+var (
+	_ DBDumper = &db{}
+	_ DBLoader = &db{}
+)
+
+// Dump writes the leaf revisions of each document, the winner and any
+// conflicts, including deleted ones, to w, with their revision histories, as
+// with revs=true, and their attachments inlined, so that loading them with
+// new_edits=false reproduces the database. Local documents are omitted.
+//
+// With the dump_format option set to "ndjson", the default, each revision is
+// written as a JSON object on its own line. With "bulk_docs", a single
+// {"new_edits":false,"docs":[...]} object is written, as accepted by
+// CouchDB's _bulk_docs endpoint. The doc_ids option limits the dump to the
+// named documents.
+func (d *db) Dump(ctx context.Context, w io.Writer, options driver.Options) error {
+	opts := map[string]interface{}{}
+	if options != nil {
+		options.Apply(opts)
+	}
+	format, err := stringOption(opts, "dump_format")
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "":
+		format = DumpNDJSON
+	case DumpNDJSON, DumpBulkDocs:
+	default:
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("unsupported dump format: %s", format)}
+	}
+	docIDs, err := d.dumpDocIDs(opts)
+	if err != nil {
+		return err
+	}
+	sep := []byte("\n")
+	if format == DumpBulkDocs {
+		if _, err := io.WriteString(w, `{"new_edits":false,"docs":[`+"\n"); err != nil {
+			return err
+		}
+		sep = []byte(",\n")
+	}
+	first := true
+	for _, docID := range docIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		revs, err := d.dumpDoc(ctx, docID)
+		if err != nil {
+			return err
+		}
+		for _, rev := range revs {
+			if format == DumpBulkDocs && !first {
+				if _, err := w.Write(sep); err != nil {
+					return err
+				}
+			}
+			first = false
+			if _, err := w.Write(rev); err != nil {
+				return err
+			}
+			if format == DumpNDJSON {
+				if _, err := w.Write(sep); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if format == DumpBulkDocs {
+		_, err = io.WriteString(w, "\n]}\n")
+	}
+	return err
+}
+
+// dumpDocIDs returns the documents to dump: those named by the doc_ids
+// option, which must exist, or else all of them.
+func (d *db) dumpDocIDs(opts map[string]interface{}) ([]string, error) {
+	ids, ok := opts["doc_ids"]
+	if !ok {
+		return d.docIDs()
+	}
+	docIDs, err := toStrings(ids)
+	if err != nil {
+		return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid doc_ids: %w", err)}
+	}
+	return docIDs, nil
+}
+
+// dumpDoc returns the leaf revisions of the document, encoded as JSON.
+func (d *db) dumpDoc(ctx context.Context, docID string) ([][]byte, error) {
+	unlock, err := d.readLockDoc(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	doc, err := d.cdb.OpenDocRevs(docID)
+	if err != nil {
+		if kivik.HTTPStatus(err) == http.StatusNotFound {
+			return nil, statusError{status: http.StatusNotFound, error: fmt.Errorf("document %s not found", docID)}
+		}
+		return nil, err
+	}
+	leaves := doc.Leaves()
+	revs := make([][]byte, 0, len(leaves))
+	for _, rev := range leaves {
+		body, err := json.Marshal(&cdb.Document{
+			ID:        doc.ID,
+			Revisions: cdb.Revisions{rev},
+			Options: map[string]interface{}{
+				"revs":          true,
+				"attachments":   true,
+				"header:accept": "application/json",
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, body)
+	}
+	return revs, nil
+}
+
+// LoadResult summarizes a completed Load.
+type LoadResult struct {
+	DocsRead         int64         `json:"docs_read"`
+	DocsWritten      int64         `json:"docs_written"`
+	DocWriteFailures int64         `json:"doc_write_failures"`
+	Failures         []LoadFailure `json:"failures,omitempty"`
+}
+
+// LoadFailure is a document revision which Load could not store.
+type LoadFailure struct {
+	ID    string `json:"id"`
+	Rev   string `json:"rev"`
+	Error string `json:"error"`
+}
+
+// Load reads JSON values from r, and stores the documents they hold with
+// new_edits=false, keeping their revision IDs and histories, as given in
+// _revisions. Each value may be a document, an array of documents, as
+// written by couchbackup, or a _bulk_docs request body, with the documents
+// in its docs field, so the output of Dump, in either format, is accepted.
+// Attachments must be inlined, with their content in the data field, unless
+// they're already stored in the database.
+//
+// A document which can't be stored, such as one without an _id or _rev, is
+// counted as a failure in the result, and loading continues. Invalid JSON
+// ends the load with an error.
+func (d *db) Load(ctx context.Context, r io.Reader, options driver.Options) (*LoadResult, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	result := &LoadResult{}
+	dec := json.NewDecoder(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		var value json.RawMessage
+		err := dec.Decode(&value)
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid JSON after %d documents: %w", result.DocsRead, err)}
+		}
+		docs, err := loadDocs(value)
+		if err != nil {
+			return result, err
+		}
+		for _, doc := range docs {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+			d.loadDoc(ctx, doc, result)
+		}
+	}
+}
+
+// loadDocs returns the documents held by a JSON value read by Load.
+func loadDocs(value json.RawMessage) ([]map[string]interface{}, error) {
+	value = bytes.TrimSpace(value)
+	if len(value) > 0 && value[0] == '[' {
+		var docs []map[string]interface{}
+		if err := json.Unmarshal(value, &docs); err != nil {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid documents: %w", err)}
+		}
+		return docs, nil
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid document: %w", err)}
+	}
+	if _, isDoc := doc["_id"]; isDoc {
+		return []map[string]interface{}{doc}, nil
+	}
+	if _, ok := doc["docs"]; ok {
+		var body struct {
+			Docs []map[string]interface{} `json:"docs"`
+		}
+		if err := json.Unmarshal(value, &body); err != nil {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid _bulk_docs body: %w", err)}
+		}
+		return body.Docs, nil
+	}
+	return []map[string]interface{}{doc}, nil
+}
+
+// loadDoc stores doc with new_edits=false, and records the outcome in result.
+func (d *db) loadDoc(ctx context.Context, doc map[string]interface{}, result *LoadResult) {
+	result.DocsRead++
+	docID, _ := doc["_id"].(string)
+	rev, _ := doc["_rev"].(string)
+	var err error
+	if docID == "" {
+		err = errors.New("document id missing")
+	} else {
+		_, err = d.Put(ctx, docID, doc, kivik.Param("new_edits", false))
+	}
+	if err != nil {
+		result.DocWriteFailures++
+		result.Failures = append(result.Failures, LoadFailure{ID: docID, Rev: rev, Error: err.Error()})
+		return
+	}
+	result.DocsWritten++
+}
@@ -0,0 +1,260 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+)
+
+// dumpTestClient returns an in-memory client with an empty database named
+// copy, and a database named src, holding a document with an attachment
+// added in its second revision, a deleted document, a document with a
+// conflict, and a local document, which Dump omits.
+func dumpTestClient(t *testing.T) *client {
+	t.Helper()
+	c, err := NewDriver(filesystem.NewMemFS()).NewClient("/", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{"src", "copy"} {
+		if err := c.CreateDB(ctx, name, kivik.Params(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := c.DB("src", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(docID string, doc map[string]interface{}, options kivik.Option) string {
+		t.Helper()
+		rev, err := d.Put(ctx, docID, doc, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rev
+	}
+	rev := put("att", map[string]interface{}{"value": 1}, kivik.Params(nil))
+	put("att", map[string]interface{}{
+		"_rev":  rev,
+		"value": 2,
+		"_attachments": map[string]interface{}{
+			"foo.txt": map[string]interface{}{
+				"content_type": "text/plain",
+				"data":         []byte("Testing"),
+			},
+		},
+	}, kivik.Params(nil))
+	rev = put("deleted", map[string]interface{}{"value": 3}, kivik.Params(nil))
+	put("deleted", map[string]interface{}{"_rev": rev, "_deleted": true}, kivik.Params(nil))
+	oldEdits := kivik.Param("new_edits", false)
+	put("conflict", map[string]interface{}{
+		"_rev":       "2-bbb",
+		"_revisions": map[string]interface{}{"start": 2, "ids": []string{"bbb", "aaa"}},
+		"value":      "b",
+	}, oldEdits)
+	put("conflict", map[string]interface{}{
+		"_rev":       "2-ccc",
+		"_revisions": map[string]interface{}{"start": 2, "ids": []string{"ccc", "aaa"}},
+		"value":      "c",
+	}, oldEdits)
+	put("_local/checkpoint", map[string]interface{}{"value": 4}, kivik.Params(nil))
+	return c.(*client)
+}
+
+func dumpDB(t *testing.T, c *client, dbName string, options kivik.Option) (string, error) {
+	t.Helper()
+	d, err := c.DB(dbName, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = d.(DBDumper).Dump(context.Background(), buf, options)
+	return buf.String(), err
+}
+
+func loadDB(t *testing.T, c *client, dbName, input string) (*LoadResult, error) {
+	t.Helper()
+	d, err := c.DB(dbName, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.(DBLoader).Load(context.Background(), strings.NewReader(input), kivik.Params(nil))
+}
+
+func TestDump(t *testing.T) {
+	type tt struct {
+		options kivik.Option
+		want    []string
+		status  int
+		err     string
+	}
+	tests := testy.NewTable()
+	tests.Add("ndjson", tt{
+		options: kivik.Params(nil),
+		want:    []string{"att 2-", "conflict 2-ccc", "conflict 2-bbb", "deleted 2-"},
+	})
+	tests.Add("bulk_docs", tt{
+		options: kivik.Param("dump_format", DumpBulkDocs),
+		want:    []string{"att 2-", "conflict 2-ccc", "conflict 2-bbb", "deleted 2-"},
+	})
+	tests.Add("doc_ids", tt{
+		options: kivik.Param("doc_ids", []string{"conflict"}),
+		want:    []string{"conflict 2-ccc", "conflict 2-bbb"},
+	})
+	tests.Add("missing doc_id", tt{
+		options: kivik.Param("doc_ids", []string{"missing"}),
+		status:  http.StatusNotFound,
+		err:     "document missing not found",
+	})
+	tests.Add("unsupported format", tt{
+		options: kivik.Param("dump_format", "csv"),
+		status:  http.StatusBadRequest,
+		err:     "unsupported dump format: csv",
+	})
+
+	c := dumpTestClient(t)
+	tests.Run(t, func(t *testing.T, tt tt) {
+		out, err := dumpDB(t, c, "src", tt.options)
+		testy.StatusError(t, tt.err, tt.status, err)
+		var docs []map[string]interface{}
+		if strings.HasPrefix(out, "{\"new_edits\":false") {
+			var body struct {
+				NewEdits *bool                    `json:"new_edits"`
+				Docs     []map[string]interface{} `json:"docs"`
+			}
+			if err := json.Unmarshal([]byte(out), &body); err != nil {
+				t.Fatal(err)
+			}
+			docs = body.Docs
+		} else {
+			for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+				var doc map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &doc); err != nil {
+					t.Fatalf("Invalid line %q: %s", line, err)
+				}
+				docs = append(docs, doc)
+			}
+		}
+		if n := strings.Count(out, `"_revisions"`); n != len(docs) {
+			t.Errorf("Expected _revisions once per document, found %d for %d", n, len(docs))
+		}
+		got := make([]string, 0, len(docs))
+		for i, doc := range docs {
+			rev, _ := doc["_rev"].(string)
+			if strings.HasSuffix(tt.want[i], "-") {
+				rev = rev[:2]
+			}
+			got = append(got, doc["_id"].(string)+" "+rev)
+			if _, ok := doc["_revisions"]; !ok {
+				t.Errorf("Expected _revisions for %s", doc["_id"])
+			}
+			if doc["_id"] == "att" {
+				att := doc["_attachments"].(map[string]interface{})["foo.txt"].(map[string]interface{})
+				if att["data"] != "VGVzdGluZw==" {
+					t.Errorf("Expected inline attachment, got: %v", att)
+				}
+			}
+		}
+		if d := testy.DiffInterface(tt.want, got); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestDumpLoad(t *testing.T) {
+	tests := testy.NewTable()
+	tests.Add("ndjson", DumpNDJSON)
+	tests.Add("bulk_docs", DumpBulkDocs)
+
+	tests.Run(t, func(t *testing.T, format string) {
+		c := dumpTestClient(t)
+		want, err := dumpDB(t, c, "src", kivik.Param("dump_format", format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := loadDB(t, c, "copy", want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.DocsRead != 4 || result.DocsWritten != 4 || result.DocWriteFailures != 0 {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+		got, err := dumpDB(t, c, "copy", kivik.Param("dump_format", format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffText(want, got); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestLoad(t *testing.T) {
+	type tt struct {
+		input  string
+		want   *LoadResult
+		status int
+		err    string
+	}
+	tests := testy.NewTable()
+	tests.Add("couchbackup", tt{
+		input: `[{"_id":"a","_rev":"1-aaa"},{"_id":"b","_rev":"1-bbb"}]
+[{"_id":"c","_rev":"1-ccc"}]
+`,
+		want: &LoadResult{DocsRead: 3, DocsWritten: 3},
+	})
+	tests.Add("failures", tt{
+		input: `{"_id":"a","_rev":"1-aaa"}
+{"_rev":"1-bbb"}
+{"_id":"c"}
+`,
+		want: &LoadResult{
+			DocsRead:         3,
+			DocsWritten:      1,
+			DocWriteFailures: 2,
+			Failures: []LoadFailure{
+				{Rev: "1-bbb", Error: "document id missing"},
+				{ID: "c", Error: "_rev required with new_edits=false"},
+			},
+		},
+	})
+	tests.Add("invalid JSON", tt{
+		input:  `{"_id":"a","_rev":"1-aaa"}` + "\n{",
+		status: http.StatusBadRequest,
+		err:    "invalid JSON after 1 documents: unexpected EOF",
+	})
+	tests.Add("invalid document", tt{
+		input:  `"foo"`,
+		status: http.StatusBadRequest,
+		err:    "invalid document: json: cannot unmarshal string into Go value of type map[string]interface {}",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		result, err := loadDB(t, dumpTestClient(t), "copy", tt.input)
+		testy.StatusError(t, tt.err, tt.status, err)
+		if d := testy.DiffInterface(tt.want, result); d != nil {
+			t.Error(d)
+		}
+	})
+}
@@ -29,7 +29,7 @@ func kerr(err error) error {
 	if os.IsNotExist(err) {
 		return statusError{status: http.StatusNotFound, error: err}
 	}
-	if os.IsPermission(err) {
+	if errors.Is(err, os.ErrPermission) {
 		return statusError{status: http.StatusForbidden, error: err}
 	}
 	return err
@@ -0,0 +1,138 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// dirFS is a Filesystem on the local disk, confined to a directory.
+type dirFS struct {
+	dir string
+}
+
+var _ Filesystem = &dirFS{}
+
+// NewDirFS returns a Filesystem on the local disk, which resolves every path,
+// absolute or relative, within dir, as if dir were the root directory. It may
+// serve as the upper layer of an Overlay, to keep a test's changes on disk for
+// inspection. Errors and file names report paths as given, not as resolved.
+func NewDirFS(dir string) Filesystem {
+	return &dirFS{dir: dir}
+}
+
+// resolve returns the path on disk for name.
+func (fs *dirFS) resolve(name string) string {
+	return filepath.Join(fs.dir, filepath.FromSlash(cleanPath(name)))
+}
+
+// pathErr replaces the resolved paths in err with those given.
+func pathErr(err error, name string) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return &os.PathError{Op: pe.Op, Path: name, Err: pe.Err}
+	}
+	return err
+}
+
+func linkErr(err error, oldname, newname string) error {
+	if le, ok := err.(*os.LinkError); ok {
+		return &os.LinkError{Op: le.Op, Old: oldname, New: newname, Err: le.Err}
+	}
+	return err
+}
+
+func (fs *dirFS) Mkdir(name string, perm os.FileMode) error {
+	return pathErr(os.Mkdir(fs.resolve(name), perm), name)
+}
+
+func (fs *dirFS) MkdirAll(path string, perm os.FileMode) error {
+	return pathErr(os.MkdirAll(fs.resolve(path), perm), path)
+}
+
+func (fs *dirFS) Open(name string) (File, error) {
+	f, err := os.Open(fs.resolve(name))
+	if err != nil {
+		return nil, pathErr(err, name)
+	}
+	return &dirFile{File: f, name: name}, nil
+}
+
+func (fs *dirFS) Create(name string) (File, error) {
+	f, err := os.Create(fs.resolve(name))
+	if err != nil {
+		return nil, pathErr(err, name)
+	}
+	return &dirFile{File: f, name: name}, nil
+}
+
+func (fs *dirFS) Stat(name string) (os.FileInfo, error) {
+	info, err := os.Stat(fs.resolve(name))
+	return info, pathErr(err, name)
+}
+
+func (fs *dirFS) TempFile(dir, pattern string) (File, error) {
+	f, err := os.CreateTemp(fs.resolve(dir), pattern)
+	if err != nil {
+		return nil, pathErr(err, filepath.Join(dir, pattern))
+	}
+	return &dirFile{File: f, name: filepath.Join(dir, filepath.Base(f.Name()))}, nil
+}
+
+func (fs *dirFS) Rename(oldpath, newpath string) error {
+	return linkErr(os.Rename(fs.resolve(oldpath), fs.resolve(newpath)), oldpath, newpath)
+}
+
+func (fs *dirFS) Remove(name string) error {
+	return pathErr(os.Remove(fs.resolve(name)), name)
+}
+
+func (fs *dirFS) RemoveAll(path string) error {
+	return pathErr(os.RemoveAll(fs.resolve(path)), path)
+}
+
+func (fs *dirFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	f, err := os.Open(fs.resolve(dirname))
+	if err != nil {
+		return nil, pathErr(err, dirname)
+	}
+	defer f.Close() // nolint: errcheck
+	list, err := f.Readdir(-1)
+	if err != nil {
+		return nil, pathErr(err, dirname)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+func (fs *dirFS) Chmod(name string, mode os.FileMode) error {
+	return pathErr(os.Chmod(fs.resolve(name), mode), name)
+}
+
+func (fs *dirFS) Link(oldname, newname string) error {
+	return linkErr(os.Link(fs.resolve(oldname), fs.resolve(newname)), oldname, newname)
+}
+
+// dirFile is an open file in a dirFS, named by the path given, rather than
+// the resolved one. As it embeds an *os.File, it can be locked.
+type dirFile struct {
+	*os.File
+	name string
+}
+
+var _ File = &dirFile{}
+
+func (f *dirFile) Name() string {
+	return f.name
+}
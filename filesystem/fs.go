@@ -16,6 +16,7 @@ package filesystem
 import (
 	"io"
 	"os"
+	"sort"
 )
 
 // Filesystem is a filesystem implemenatation.
@@ -28,6 +29,12 @@ type Filesystem interface {
 	TempFile(dir, pattern string) (File, error)
 	Rename(oldpath, newpath string) error
 	Remove(name string) error
+	// RemoveAll removes path and any children it contains, without following
+	// symbolic links. It returns nil if path does not exist.
+	RemoveAll(path string) error
+	// ReadDir returns the entries of the directory dirname, sorted by name.
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	Chmod(name string, mode os.FileMode) error
 	Link(oldname, newname string) error
 }
 
@@ -67,6 +74,28 @@ func (fs *defaultFS) Remove(name string) error {
 	return os.Remove(name)
 }
 
+func (fs *defaultFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (fs *defaultFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	f, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	list, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+func (fs *defaultFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
 func (fs *defaultFS) Link(oldname, newname string) error {
 	return os.Link(oldname, newname)
 }
@@ -81,6 +110,7 @@ type File interface {
 	Name() string
 	Readdir(int) ([]os.FileInfo, error)
 	Stat() (os.FileInfo, error)
+	Sync() error
 }
 
 type defaultFile struct {
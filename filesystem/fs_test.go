@@ -11,3 +11,34 @@
 // the License.
 
 package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+func TestDefaultReadDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"c", "a"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "b"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := Default().ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if d := testy.DiffInterface([]string{"a", "b", "c"}, names); d != nil {
+		t.Error(d)
+	}
+}
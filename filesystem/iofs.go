@@ -0,0 +1,192 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package filesystem
+
+import (
+	"io"
+	iofs "io/fs"
+	"os"
+	"syscall"
+)
+
+// ErrReadOnly is returned by the write methods of a read-only filesystem. It
+// matches fs.ErrPermission, as reported by errors.Is.
+var ErrReadOnly error = readOnlyError{}
+
+type readOnlyError struct{}
+
+func (readOnlyError) Error() string        { return "read-only filesystem" }
+func (readOnlyError) Is(target error) bool { return target == iofs.ErrPermission }
+
+// readOnlyer is implemented by filesystems which can't be written to.
+type readOnlyer interface {
+	ReadOnly() bool
+}
+
+// IsReadOnly returns true if fs can't be written to, in which case all of its
+// write methods fail with ErrReadOnly.
+func IsReadOnly(fs Filesystem) bool {
+	ro, ok := fs.(readOnlyer)
+	return ok && ro.ReadOnly()
+}
+
+// ioFS is a read-only Filesystem backed by an io/fs.FS.
+type ioFS struct {
+	fsys iofs.FS
+}
+
+var _ Filesystem = &ioFS{}
+
+// NewIOFS returns a read-only Filesystem backed by fsys, such as an embed.FS,
+// a zip.Reader, or a testing/fstest.MapFS. As with MemFS, paths are resolved
+// against the root of fsys, so "/foo", "./foo" and "foo" all name the same
+// file. Write methods fail with ErrReadOnly.
+func NewIOFS(fsys iofs.FS) Filesystem {
+	return &ioFS{fsys: fsys}
+}
+
+// ReadOnly returns true.
+func (fs *ioFS) ReadOnly() bool { return true }
+
+// fsPath converts name to a path valid for io/fs.
+func fsPath(name string) string {
+	name = cleanPath(name)
+	if name == "/" {
+		return "."
+	}
+	return name[1:]
+}
+
+func readOnly(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: ErrReadOnly}
+}
+
+func (fs *ioFS) Mkdir(name string, _ os.FileMode) error {
+	return readOnly("mkdir", name)
+}
+
+func (fs *ioFS) MkdirAll(path string, _ os.FileMode) error {
+	return readOnly("mkdir", path)
+}
+
+func (fs *ioFS) Open(name string) (File, error) {
+	f, err := fs.fsys.Open(fsPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return &ioFile{File: f, name: name}, nil
+}
+
+func (fs *ioFS) Create(name string) (File, error) {
+	return nil, readOnly("open", name)
+}
+
+func (fs *ioFS) Stat(name string) (os.FileInfo, error) {
+	return iofs.Stat(fs.fsys, fsPath(name))
+}
+
+func (fs *ioFS) TempFile(dir, pattern string) (File, error) {
+	return nil, readOnly("createtemp", dir+"/"+pattern)
+}
+
+func (fs *ioFS) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrReadOnly}
+}
+
+func (fs *ioFS) Remove(name string) error {
+	return readOnly("remove", name)
+}
+
+func (fs *ioFS) RemoveAll(path string) error {
+	return readOnly("unlinkat", path)
+}
+
+func (fs *ioFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entries, err := iofs.ReadDir(fs.fsys, fsPath(dirname))
+	if err != nil {
+		return nil, err
+	}
+	return dirEntryInfos(entries)
+}
+
+func (fs *ioFS) Chmod(name string, _ os.FileMode) error {
+	return readOnly("chmod", name)
+}
+
+func (fs *ioFS) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: ErrReadOnly}
+}
+
+func dirEntryInfos(entries []iofs.DirEntry) ([]os.FileInfo, error) {
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ioFile is an open file or directory in an ioFS. Seeking and ReadAt are
+// supported only if the underlying file supports them, as do the files of
+// embed.FS and testing/fstest.MapFS.
+type ioFile struct {
+	iofs.File
+	name string
+}
+
+var _ File = &ioFile{}
+
+func (f *ioFile) Name() string {
+	return f.name
+}
+
+func (f *ioFile) Write([]byte) (int, error) {
+	return 0, readOnly("write", f.name)
+}
+
+func (f *ioFile) ReadAt(p []byte, off int64) (int, error) {
+	r, ok := f.File.(io.ReaderAt)
+	if !ok {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	return r.ReadAt(p, off)
+}
+
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	return s.Seek(offset, whence)
+}
+
+func (f *ioFile) Readdir(n int) ([]os.FileInfo, error) {
+	d, ok := f.File.(iofs.ReadDirFile)
+	if !ok {
+		return nil, &os.PathError{Op: "readdirent", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	entries, err := d.ReadDir(n)
+	infos, infoErr := dirEntryInfos(entries)
+	if err == nil {
+		err = infoErr
+	}
+	return infos, err
+}
+
+// Sync does nothing, as there are never any writes to flush.
+func (f *ioFile) Sync() error {
+	return nil
+}
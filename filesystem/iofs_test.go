@@ -0,0 +1,157 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package filesystem
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"gitlab.com/flimzy/testy"
+)
+
+func testIOFS() Filesystem {
+	return NewIOFS(fstest.MapFS{
+		"a/b.txt": {Data: []byte("b")},
+		"a/c":     {Mode: iofs.ModeDir | 0o755},
+		"d.txt":   {Data: []byte("d")},
+	})
+}
+
+func TestIOFSRead(t *testing.T) {
+	fs := testIOFS()
+	for _, name := range []string{"/a/b.txt", "a/b.txt", "./a/../a/b.txt"} {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = f.Close()
+		if string(content) != "b" {
+			t.Errorf("Unexpected content of %s: %q", name, content)
+		}
+		if f.Name() != name {
+			t.Errorf("Unexpected name: %s", f.Name())
+		}
+	}
+	infos, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if d := testy.DiffInterface([]string{"a", "d.txt"}, names); d != nil {
+		t.Error(d)
+	}
+	info, err := fs.Stat("a/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Errorf("Expected a directory")
+	}
+	if _, err := fs.Stat("missing"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error for a missing file: %v", err)
+	}
+}
+
+func TestIOFSFile(t *testing.T) {
+	fs := testIOFS()
+	f, err := fs.Open("d.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() // nolint: errcheck
+	buf := make([]byte, 1)
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "d" {
+		t.Errorf("Unexpected ReadAt result: %q, %v", buf, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Error(err)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Unexpected error writing: %v", err)
+	}
+	if _, err := f.Readdir(-1); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("Unexpected error reading a file as a directory: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Error(err)
+	}
+	dir, err := fs.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close() // nolint: errcheck
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Errorf("Expected 2 entries, got %d", len(infos))
+	}
+}
+
+func TestIOFSWrite(t *testing.T) {
+	type tt struct {
+		op func() error
+	}
+	fs := testIOFS()
+	tests := testy.NewTable()
+	tests.Add("mkdir", tt{op: func() error { return fs.Mkdir("e", 0o777) }})
+	tests.Add("mkdirall", tt{op: func() error { return fs.MkdirAll("e/f", 0o777) }})
+	tests.Add("create", tt{op: func() error {
+		_, err := fs.Create("e.txt")
+		return err
+	}})
+	tests.Add("tempfile", tt{op: func() error {
+		_, err := fs.TempFile("a", "tmp")
+		return err
+	}})
+	tests.Add("rename", tt{op: func() error { return fs.Rename("d.txt", "e.txt") }})
+	tests.Add("remove", tt{op: func() error { return fs.Remove("d.txt") }})
+	tests.Add("removeall", tt{op: func() error { return fs.RemoveAll("a") }})
+	tests.Add("chmod", tt{op: func() error { return fs.Chmod("d.txt", 0o600) }})
+	tests.Add("link", tt{op: func() error { return fs.Link("d.txt", "e.txt") }})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		err := tt.op()
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if !errors.Is(err, iofs.ErrPermission) {
+			t.Errorf("Expected a permission error")
+		}
+	})
+}
+
+func TestIsReadOnly(t *testing.T) {
+	if !IsReadOnly(testIOFS()) {
+		t.Error("Expected an io/fs filesystem to be read-only")
+	}
+	if !IsReadOnly(NewSyncer(testIOFS()).Wrap(true)) {
+		t.Error("Expected a wrapped io/fs filesystem to be read-only")
+	}
+	if IsReadOnly(Default()) || IsReadOnly(NewMemFS()) {
+		t.Error("Expected a writable filesystem")
+	}
+}
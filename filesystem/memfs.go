@@ -0,0 +1,572 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package filesystem
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memInode is a file or directory in a MemFS. Hard links share an inode.
+type memInode struct {
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+	// children holds the entries of a directory, by name.
+	children map[string]*memInode
+}
+
+func (n *memInode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+// MemFS is a Filesystem held entirely in memory, for fast, hermetic tests.
+// Relative paths are resolved against the root directory, and symbolic links
+// are not supported. It is safe for concurrent use.
+type MemFS struct {
+	mu   sync.RWMutex
+	root *memInode
+}
+
+var _ Filesystem = &MemFS{}
+
+// NewMemFS returns a new, empty, in-memory filesystem.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		root: newDir(0o777),
+	}
+}
+
+func newDir(perm os.FileMode) *memInode {
+	return &memInode{
+		mode:     os.ModeDir | perm.Perm(),
+		modTime:  time.Now(),
+		children: map[string]*memInode{},
+	}
+}
+
+// cleanPath returns name, cleaned, as an absolute, slash-separated path.
+func cleanPath(name string) string {
+	return filepath.ToSlash(filepath.Clean("/" + name))
+}
+
+// split returns the elements of name, cleaned, relative to the root.
+func split(name string) []string {
+	name = cleanPath(name)
+	if name == "/" {
+		return nil
+	}
+	return strings.Split(name[1:], "/")
+}
+
+// lookup returns the inode at name. It must be called with fs.mu held.
+func (fs *MemFS) lookup(op, name string) (*memInode, error) {
+	node := fs.root
+	for _, elem := range split(name) {
+		if !node.isDir() {
+			return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		child, ok := node.children[elem]
+		if !ok {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// parent returns the directory which holds name, and the base name of name.
+// It must be called with fs.mu held.
+func (fs *MemFS) parent(op, name string) (*memInode, string, error) {
+	elems := split(name)
+	if len(elems) == 0 {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	}
+	dir, err := fs.lookup(op, strings.Join(elems[:len(elems)-1], "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.isDir() {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return dir, elems[len(elems)-1], nil
+}
+
+// Mkdir creates the directory name, whose parent must exist.
+func (fs *MemFS) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dir, base, err := fs.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.children[base]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	dir.children[base] = newDir(perm)
+	dir.modTime = time.Now()
+	return nil
+}
+
+// MkdirAll creates the directory path, along with any missing parents.
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node := fs.root
+	for _, elem := range split(path) {
+		if !node.isDir() {
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		child, ok := node.children[elem]
+		if !ok {
+			child = newDir(perm)
+			node.children[elem] = child
+			node.modTime = time.Now()
+		}
+		node = child
+	}
+	if !node.isDir() {
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// Open opens the file or directory name for reading.
+func (fs *MemFS) Open(name string) (File, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	node, err := fs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{fs: fs, node: node, name: name}, nil
+}
+
+// Create creates or truncates the file name, opening it for reading and
+// writing.
+func (fs *MemFS) Create(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.create("open", name, false)
+}
+
+// create creates the file name, or truncates it unless exclusive is true. It
+// must be called with fs.mu held.
+func (fs *MemFS) create(op, name string, exclusive bool) (File, error) {
+	dir, base, err := fs.parent(op, name)
+	if err != nil {
+		return nil, err
+	}
+	node, ok := dir.children[base]
+	switch {
+	case ok && exclusive:
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	case ok && node.isDir():
+		return nil, &os.PathError{Op: op, Path: name, Err: syscall.EISDIR}
+	case ok:
+		node.data = nil
+		node.modTime = time.Now()
+	default:
+		node = &memInode{mode: 0o666, modTime: time.Now()}
+		dir.children[base] = node
+		dir.modTime = node.modTime
+	}
+	return &memFile{fs: fs, node: node, name: name, writable: true}, nil
+}
+
+// Stat returns a FileInfo describing name.
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	node, err := fs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return newMemFileInfo(path.Base(cleanPath(name)), node), nil
+}
+
+// TempFile creates a new file in dir, as os.CreateTemp does, with a name
+// formed from pattern by replacing its last "*", or by appending, with a
+// random string. If dir is empty, os.TempDir() is used.
+func (fs *MemFS) TempFile(dir, pattern string) (File, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix) // nolint: gosec
+		f, err := fs.create("createtemp", name, true)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+}
+
+// Rename renames oldpath to newpath, atomically, replacing newpath if it
+// exists, as os.Rename does on Unix systems.
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	oldDir, oldBase, err := fs.parent("rename", oldpath)
+	if err != nil {
+		return linkErr(underlying(err))
+	}
+	node, ok := oldDir.children[oldBase]
+	if !ok {
+		return linkErr(os.ErrNotExist)
+	}
+	newDir, newBase, err := fs.parent("rename", newpath)
+	if err != nil {
+		return linkErr(underlying(err))
+	}
+	if node.isDir() && strings.HasPrefix(cleanPath(newpath), cleanPath(oldpath)+"/") {
+		// A directory can't be moved into itself.
+		return linkErr(syscall.EINVAL)
+	}
+	if existing, ok := newDir.children[newBase]; ok {
+		if existing == node {
+			return nil
+		}
+		switch {
+		case existing.isDir() && !node.isDir():
+			return linkErr(syscall.EISDIR)
+		case !existing.isDir() && node.isDir():
+			return linkErr(syscall.ENOTDIR)
+		case existing.isDir() && len(existing.children) > 0:
+			return linkErr(syscall.ENOTEMPTY)
+		}
+	}
+	delete(oldDir.children, oldBase)
+	newDir.children[newBase] = node
+	now := time.Now()
+	oldDir.modTime, newDir.modTime = now, now
+	return nil
+}
+
+// Remove removes the file or empty directory name.
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dir, base, err := fs.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	node, ok := dir.children[base]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if node.isDir() && len(node.children) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(dir.children, base)
+	dir.modTime = time.Now()
+	return nil
+}
+
+// RemoveAll removes path and any children it contains. It returns nil if
+// path does not exist.
+func (fs *MemFS) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dir, base, err := fs.parent("removeall", path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.children[base]; ok {
+		delete(dir.children, base)
+		dir.modTime = time.Now()
+	}
+	return nil
+}
+
+// ReadDir returns the entries of the directory dirname, sorted by name.
+func (fs *MemFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	f, err := fs.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	return f.Readdir(-1)
+}
+
+// Chmod changes the permission bits of name.
+func (fs *MemFS) Chmod(name string, mode os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, err := fs.lookup("chmod", name)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode.Type() | mode.Perm()
+	return nil
+}
+
+// Link creates newname as a hard link to the file oldname. Writes through
+// either name are visible through the other.
+func (fs *MemFS) Link(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	node, err := fs.lookup("link", oldname)
+	if err != nil {
+		return linkErr(underlying(err))
+	}
+	if node.isDir() {
+		return linkErr(syscall.EPERM)
+	}
+	dir, base, err := fs.parent("link", newname)
+	if err != nil {
+		return linkErr(underlying(err))
+	}
+	if _, ok := dir.children[base]; ok {
+		return linkErr(os.ErrExist)
+	}
+	dir.children[base] = node
+	dir.modTime = time.Now()
+	return nil
+}
+
+// underlying returns the error wrapped by a *os.PathError.
+func underlying(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+// memFile is an open file or directory in a MemFS.
+type memFile struct {
+	fs       *MemFS
+	node     *memInode
+	name     string
+	writable bool
+
+	mu     sync.Mutex
+	offset int64
+	closed bool
+	// entries holds the directory entries yet to be returned by Readdir.
+	entries []os.FileInfo
+	listed  bool
+}
+
+var _ File = &memFile{}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) check(op string) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt("read", p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt("read", p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *memFile) readAt(op string, p []byte, off int64) (int, error) {
+	if err := f.check(op); err != nil {
+		return 0, err
+	}
+	if f.node.isDir() {
+		return 0, &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, f.node.data[off:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("seek"); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.fs.mu.RLock()
+		offset += int64(len(f.node.data))
+		f.fs.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Readdir returns the directory's entries, in sorted order, as
+// os.File.Readdir does.
+func (f *memFile) Readdir(n int) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("readdir"); err != nil {
+		return nil, err
+	}
+	if !f.node.isDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if !f.listed {
+		f.fs.mu.RLock()
+		for name, child := range f.node.children {
+			f.entries = append(f.entries, newMemFileInfo(name, child))
+		}
+		f.fs.mu.RUnlock()
+		sort.Slice(f.entries, func(i, j int) bool { return f.entries[i].Name() < f.entries[j].Name() })
+		f.listed = true
+	}
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		if entries == nil {
+			entries = []os.FileInfo{}
+		}
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	return newMemFileInfo(path.Base(cleanPath(f.name)), f.node), nil
+}
+
+// Sync does nothing, as a MemFS has no stable storage.
+func (f *memFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.check("sync")
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("close"); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+// memFileInfo describes a file in a MemFS, as at the time it was created.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	// node identifies the file, and is returned by Sys.
+	node *memInode
+}
+
+var _ os.FileInfo = &memFileInfo{}
+
+func newMemFileInfo(name string, node *memInode) *memFileInfo {
+	return &memFileInfo{
+		name:    name,
+		size:    int64(len(node.data)),
+		mode:    node.mode,
+		modTime: node.modTime,
+		node:    node,
+	}
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return i.node }
@@ -0,0 +1,482 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+// memFiles returns the files and directories in fs, with the contents of
+// files, in the style of the journal tests.
+func memFiles(t *testing.T, fs Filesystem) []string {
+	t.Helper()
+	var result []string
+	var walk func(dir string)
+	walk = func(dir string) {
+		f, err := fs.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := f.Readdir(-1)
+		_ = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range entries {
+			path := strings.TrimPrefix(dir+"/"+info.Name(), "//")
+			path = strings.TrimPrefix(path, "/")
+			if info.IsDir() {
+				result = append(result, path+"/")
+				walk("/" + path)
+				continue
+			}
+			result = append(result, path+"="+string(readMem(t, fs, path)))
+		}
+	}
+	walk("/")
+	return result
+}
+
+func readMem(t *testing.T, fs Filesystem, name string) []byte {
+	t.Helper()
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() // nolint: errcheck
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func writeMem(t *testing.T, fs Filesystem, name, content string) {
+	t.Helper()
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	type tt struct {
+		// op is applied to a filesystem holding a/b.txt="b", a/c/ and d.txt="d".
+		op   func(*MemFS) error
+		want []string
+		err  error
+	}
+	tests := testy.NewTable()
+	tests.Add("mkdir", tt{
+		op:   func(fs *MemFS) error { return fs.Mkdir("a/e", 0o777) },
+		want: []string{"a/", "a/b.txt=b", "a/c/", "a/e/", "d.txt=d"},
+	})
+	tests.Add("mkdir exists", tt{
+		op:  func(fs *MemFS) error { return fs.Mkdir("a/c", 0o777) },
+		err: os.ErrExist,
+	})
+	tests.Add("mkdir no parent", tt{
+		op:  func(fs *MemFS) error { return fs.Mkdir("x/y", 0o777) },
+		err: os.ErrNotExist,
+	})
+	tests.Add("mkdir in file", tt{
+		op:  func(fs *MemFS) error { return fs.Mkdir("d.txt/y", 0o777) },
+		err: syscall.ENOTDIR,
+	})
+	tests.Add("mkdirall", tt{
+		op:   func(fs *MemFS) error { return fs.MkdirAll("/a/c/x/y", 0o777) },
+		want: []string{"a/", "a/b.txt=b", "a/c/", "a/c/x/", "a/c/x/y/", "d.txt=d"},
+	})
+	tests.Add("mkdirall exists", tt{
+		op:   func(fs *MemFS) error { return fs.MkdirAll("a/c", 0o777) },
+		want: []string{"a/", "a/b.txt=b", "a/c/", "d.txt=d"},
+	})
+	tests.Add("mkdirall file", tt{
+		op:  func(fs *MemFS) error { return fs.MkdirAll("a/b.txt", 0o777) },
+		err: syscall.ENOTDIR,
+	})
+	tests.Add("create truncates", tt{
+		op: func(fs *MemFS) error {
+			f, err := fs.Create("d.txt")
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		},
+		want: []string{"a/", "a/b.txt=b", "a/c/", "d.txt="},
+	})
+	tests.Add("create directory", tt{
+		op: func(fs *MemFS) error {
+			_, err := fs.Create("a/c")
+			return err
+		},
+		err: syscall.EISDIR,
+	})
+	tests.Add("rename file", tt{
+		op:   func(fs *MemFS) error { return fs.Rename("d.txt", "a/c/d.txt") },
+		want: []string{"a/", "a/b.txt=b", "a/c/", "a/c/d.txt=d"},
+	})
+	tests.Add("rename replaces file", tt{
+		op:   func(fs *MemFS) error { return fs.Rename("d.txt", "a/b.txt") },
+		want: []string{"a/", "a/b.txt=d", "a/c/"},
+	})
+	tests.Add("rename directory", tt{
+		op:   func(fs *MemFS) error { return fs.Rename("a", "e") },
+		want: []string{"d.txt=d", "e/", "e/b.txt=b", "e/c/"},
+	})
+	tests.Add("rename replaces empty directory", tt{
+		op: func(fs *MemFS) error {
+			if err := fs.Mkdir("e", 0o777); err != nil {
+				return err
+			}
+			return fs.Rename("a", "e")
+		},
+		want: []string{"d.txt=d", "e/", "e/b.txt=b", "e/c/"},
+	})
+	tests.Add("rename over non-empty directory", tt{
+		op: func(fs *MemFS) error {
+			if err := fs.Mkdir("e", 0o777); err != nil {
+				return err
+			}
+			return fs.Rename("e", "a")
+		},
+		err: syscall.ENOTEMPTY,
+	})
+	tests.Add("rename file over directory", tt{
+		op:  func(fs *MemFS) error { return fs.Rename("d.txt", "a/c") },
+		err: syscall.EISDIR,
+	})
+	tests.Add("rename directory into itself", tt{
+		op:  func(fs *MemFS) error { return fs.Rename("a", "a/c/a") },
+		err: syscall.EINVAL,
+	})
+	tests.Add("rename missing", tt{
+		op:  func(fs *MemFS) error { return fs.Rename("x", "y") },
+		err: os.ErrNotExist,
+	})
+	tests.Add("remove file", tt{
+		op:   func(fs *MemFS) error { return fs.Remove("a/b.txt") },
+		want: []string{"a/", "a/c/", "d.txt=d"},
+	})
+	tests.Add("remove empty directory", tt{
+		op:   func(fs *MemFS) error { return fs.Remove("a/c") },
+		want: []string{"a/", "a/b.txt=b", "d.txt=d"},
+	})
+	tests.Add("remove non-empty directory", tt{
+		op:  func(fs *MemFS) error { return fs.Remove("a") },
+		err: syscall.ENOTEMPTY,
+	})
+	tests.Add("remove missing", tt{
+		op:  func(fs *MemFS) error { return fs.Remove("x") },
+		err: os.ErrNotExist,
+	})
+	tests.Add("removeall directory", tt{
+		op:   func(fs *MemFS) error { return fs.RemoveAll("a") },
+		want: []string{"d.txt=d"},
+	})
+	tests.Add("removeall file", tt{
+		op:   func(fs *MemFS) error { return fs.RemoveAll("d.txt") },
+		want: []string{"a/", "a/b.txt=b", "a/c/"},
+	})
+	tests.Add("removeall missing", tt{
+		op:   func(fs *MemFS) error { return fs.RemoveAll("x/y") },
+		want: []string{"a/", "a/b.txt=b", "a/c/", "d.txt=d"},
+	})
+	tests.Add("link", tt{
+		op:   func(fs *MemFS) error { return fs.Link("d.txt", "a/c/e.txt") },
+		want: []string{"a/", "a/b.txt=b", "a/c/", "a/c/e.txt=d", "d.txt=d"},
+	})
+	tests.Add("link shares contents", tt{
+		op: func(fs *MemFS) error {
+			if err := fs.Link("d.txt", "e.txt"); err != nil {
+				return err
+			}
+			f, err := fs.Create("e.txt")
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write([]byte("e")); err != nil {
+				return err
+			}
+			return f.Close()
+		},
+		want: []string{"a/", "a/b.txt=b", "a/c/", "d.txt=e", "e.txt=e"},
+	})
+	tests.Add("link exists", tt{
+		op:  func(fs *MemFS) error { return fs.Link("d.txt", "a/b.txt") },
+		err: os.ErrExist,
+	})
+	tests.Add("link directory", tt{
+		op:  func(fs *MemFS) error { return fs.Link("a", "e") },
+		err: syscall.EPERM,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		t.Parallel()
+		fs := NewMemFS()
+		if err := fs.MkdirAll("a/c", 0o777); err != nil {
+			t.Fatal(err)
+		}
+		writeMem(t, fs, "a/b.txt", "b")
+		writeMem(t, fs, "d.txt", "d")
+		err := tt.op(fs)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err != nil {
+			return
+		}
+		if d := testy.DiffInterface(tt.want, memFiles(t, fs)); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestMemFSFile(t *testing.T) {
+	fs := NewMemFS()
+	f, err := fs.Create("/foo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, "hello world"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, "there"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Unexpected error closing twice: %v", err)
+	}
+
+	f, err = fs.Open("foo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() // nolint: errcheck
+	if _, err := f.Write([]byte("x")); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Unexpected error writing a read-only file: %v", err)
+	}
+	buf := make([]byte, 5)
+	if n, err := f.ReadAt(buf, 6); err != nil || string(buf[:n]) != "there" {
+		t.Errorf("Unexpected ReadAt result: %q, %v", buf[:n], err)
+	}
+	if n, err := f.ReadAt(buf, 8); err != io.EOF || string(buf[:n]) != "ere" {
+		t.Errorf("Unexpected short ReadAt result: %q, %v", buf[:n], err)
+	}
+	if pos, err := f.Seek(-5, io.SeekEnd); err != nil || pos != 6 {
+		t.Errorf("Unexpected Seek result: %d, %v", pos, err)
+	}
+	content, err := io.ReadAll(f)
+	if err != nil || string(content) != "there" {
+		t.Errorf("Unexpected content: %q, %v", content, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "foo.txt" || info.Size() != 11 || info.IsDir() || info.Mode() != 0o666 {
+		t.Errorf("Unexpected file info: %s %d %s", info.Name(), info.Size(), info.Mode())
+	}
+	if _, err := f.Readdir(-1); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("Unexpected error reading a file as a directory: %v", err)
+	}
+}
+
+func TestMemFSReaddir(t *testing.T) {
+	fs := NewMemFS()
+	if err := fs.MkdirAll("dir", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"c", "a", "b"} {
+		writeMem(t, fs, "dir/"+name, name)
+	}
+	d, err := fs.Open("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close() // nolint: errcheck
+	var names []string
+	for {
+		entries, err := d.Readdir(2)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range entries {
+			names = append(names, info.Name())
+		}
+	}
+	if d := testy.DiffInterface([]string{"a", "b", "c"}, names); d != nil {
+		t.Error(d)
+	}
+	info, err := fs.Stat("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Name() != "dir" {
+		t.Errorf("Unexpected directory info: %s %s", info.Name(), info.Mode())
+	}
+}
+
+func TestMemFSReadDir(t *testing.T) {
+	fs := NewMemFS()
+	if err := fs.MkdirAll("dir/b", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	writeMem(t, fs, "dir/c", "c")
+	writeMem(t, fs, "dir/a", "a")
+	infos, err := fs.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if d := testy.DiffInterface([]string{"a", "b", "c"}, names); d != nil {
+		t.Error(d)
+	}
+	if _, err := fs.ReadDir("dir/a"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("Unexpected error reading a file as a directory: %v", err)
+	}
+	if _, err := fs.ReadDir("missing"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error reading a missing directory: %v", err)
+	}
+}
+
+func TestMemFSChmod(t *testing.T) {
+	fs := NewMemFS()
+	writeMem(t, fs, "foo", "foo")
+	if err := fs.Chmod("foo", 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("dir", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chmod("dir", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0o600 {
+		t.Errorf("Unexpected file mode: %s", info.Mode())
+	}
+	info, err = fs.Stat("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != os.ModeDir|0o700 {
+		t.Errorf("Unexpected directory mode: %s", info.Mode())
+	}
+	if err := fs.Chmod("missing", 0o600); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error changing mode of a missing file: %v", err)
+	}
+}
+
+func TestMemFSTempFile(t *testing.T) {
+	fs := NewMemFS()
+	if err := fs.MkdirAll("tmp", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]struct{}{}
+	for i := 0; i < 100; i++ {
+		f, err := fs.TempFile("tmp", ".tmp.foo.*.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = f.Close()
+		name := f.Name()
+		if !strings.HasPrefix(name, "tmp/.tmp.foo.") || !strings.HasSuffix(name, ".json") {
+			t.Errorf("Unexpected name: %s", name)
+		}
+		names[name] = struct{}{}
+	}
+	if len(names) != 100 {
+		t.Errorf("Expected 100 distinct names, got %d", len(names))
+	}
+	if _, err := fs.TempFile("missing", "x"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for a missing directory: %v", err)
+	}
+}
+
+// TestMemFSRenameAtomic checks that concurrent readers see either the old or
+// the new contents, never a missing or partial file.
+func TestMemFSRenameAtomic(t *testing.T) {
+	fs := NewMemFS()
+	if err := fs.MkdirAll(os.TempDir(), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	writeMem(t, fs, "doc.json", "x")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			f, err := fs.TempFile("", ".tmp.*")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, _ = f.Write([]byte(strings.Repeat("x", i)))
+			_ = f.Close()
+			if err := fs.Rename(f.Name(), "doc.json"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			f, err := fs.Open("doc.json")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			content, err := io.ReadAll(f)
+			_ = f.Close()
+			if err != nil || len(content) == 0 || strings.Trim(string(content), "x") != "" {
+				t.Errorf("Unexpected content: %q, %v", content, err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
@@ -16,15 +16,18 @@ import "os"
 
 // MockFS allows mocking a filesystem.
 type MockFS struct {
-	MkdirFunc    func(string, os.FileMode) error
-	MkdirAllFunc func(string, os.FileMode) error
-	CreateFunc   func(string) (File, error)
-	OpenFunc     func(string) (File, error)
-	StatFunc     func(string) (os.FileInfo, error)
-	TempFileFunc func(string, string) (File, error)
-	RenameFunc   func(string, string) error
-	RemoveFunc   func(string) error
-	LinkFunc     func(string, string) error
+	MkdirFunc     func(string, os.FileMode) error
+	MkdirAllFunc  func(string, os.FileMode) error
+	CreateFunc    func(string) (File, error)
+	OpenFunc      func(string) (File, error)
+	StatFunc      func(string) (os.FileInfo, error)
+	TempFileFunc  func(string, string) (File, error)
+	RenameFunc    func(string, string) error
+	RemoveFunc    func(string) error
+	RemoveAllFunc func(string) error
+	ReadDirFunc   func(string) ([]os.FileInfo, error)
+	ChmodFunc     func(string, os.FileMode) error
+	LinkFunc      func(string, string) error
 }
 
 var _ Filesystem = &MockFS{}
@@ -69,6 +72,21 @@ func (fs *MockFS) Remove(name string) error {
 	return fs.RemoveFunc(name)
 }
 
+// RemoveAll calls fs.RemoveAllFunc
+func (fs *MockFS) RemoveAll(path string) error {
+	return fs.RemoveAllFunc(path)
+}
+
+// ReadDir calls fs.ReadDirFunc
+func (fs *MockFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return fs.ReadDirFunc(dirname)
+}
+
+// Chmod calls fs.ChmodFunc
+func (fs *MockFS) Chmod(name string, mode os.FileMode) error {
+	return fs.ChmodFunc(name, mode)
+}
+
 // Link calls fs.LinkFunc
 func (fs *MockFS) Link(oldname, newname string) error {
 	return fs.LinkFunc(oldname, newname)
@@ -0,0 +1,797 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// whiteoutPrefix is prepended to the name of a file in the upper layer of
+	// an Overlay, to record the deletion of the file of that name in the lower
+	// layer. Document IDs may not begin with an underscore, so no revisions
+	// directory can ever have such a name.
+	whiteoutPrefix = "._wh."
+	// opaqueMarker is the name of a file in a directory of the upper layer,
+	// recording that the directory replaced the one of the same name in the
+	// lower layer, whose contents are hidden.
+	opaqueMarker = "._opaque"
+)
+
+func isMarker(name string) bool {
+	return name == opaqueMarker || strings.HasPrefix(name, whiteoutPrefix)
+}
+
+func whiteout(name string) string {
+	return filepath.Join(filepath.Dir(name), whiteoutPrefix+filepath.Base(name))
+}
+
+// notExist returns true if err reports that a file doesn't exist, including
+// because a parent is not a directory.
+func notExist(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// ancestors returns name, cleaned, preceded by each of its parents, from the
+// top down, excluding the root.
+func ancestors(name string) []string {
+	var result []string
+	for p := filepath.Clean(name); p != "." && p != filepath.Dir(p); p = filepath.Dir(p) {
+		result = append([]string{p}, result...)
+	}
+	return result
+}
+
+// Overlay is a copy-on-write Filesystem, which layers a writable upper
+// filesystem, such as a MemFS or a directory created by NewDirFS, over a lower
+// one, which is never modified. Files are copied up from the lower layer when
+// first modified, and deletions are recorded by whiteout files in the upper
+// layer, which are hidden from directory listings. This gives each test a
+// writable view of a pristine fixture, without copying it, whose changes can
+// be listed with Changes, and thrown away with Discard. Both layers are
+// accessed with the same paths. It is safe for concurrent use.
+type Overlay struct {
+	mu    sync.RWMutex
+	lower Filesystem
+	upper Filesystem
+}
+
+var _ Filesystem = &Overlay{}
+
+// NewOverlay returns an Overlay of upper over lower.
+func NewOverlay(lower, upper Filesystem) *Overlay {
+	return &Overlay{
+		lower: lower,
+		upper: upper,
+	}
+}
+
+// exists returns true if name exists in fs.
+func exists(fs Filesystem, name string) (bool, error) {
+	_, err := fs.Stat(name)
+	if notExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// lowerVisible returns true if the entry for name in the lower layer, if any,
+// is not hidden by a whiteout, by an opaque directory, or by a file in the
+// upper layer in place of one of its parents.
+func (o *Overlay) lowerVisible(name string) (bool, error) {
+	name = filepath.Clean(name)
+	for _, p := range ancestors(name) {
+		if wh, err := exists(o.upper, whiteout(p)); wh || err != nil {
+			return false, err
+		}
+		if p == name {
+			break
+		}
+		info, err := o.upper.Stat(p)
+		if notExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if !info.IsDir() {
+			return false, nil
+		}
+		if opaque, err := exists(o.upper, filepath.Join(p, opaqueMarker)); opaque || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// lowerHas returns true if name exists, and is visible, in the lower layer.
+func (o *Overlay) lowerHas(name string) (bool, error) {
+	visible, err := o.lowerVisible(name)
+	if !visible || err != nil {
+		return false, err
+	}
+	return exists(o.lower, name)
+}
+
+// stat returns the FileInfo for name, and whether it's in the upper layer.
+func (o *Overlay) stat(name string) (os.FileInfo, bool, error) {
+	if isMarker(filepath.Base(name)) {
+		return nil, false, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	info, err := o.upper.Stat(name)
+	if err == nil {
+		return info, true, nil
+	}
+	if !notExist(err) {
+		return nil, false, err
+	}
+	visible, err := o.lowerVisible(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if !visible {
+		return nil, false, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	info, err = o.lower.Stat(name)
+	return info, false, err
+}
+
+// readDir returns the merged entries of the directory dirname, sorted by
+// name.
+func (o *Overlay) readDir(dirname string) ([]os.FileInfo, error) {
+	info, inUpper, err := o.stat(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: dirname, Err: syscall.ENOTDIR}
+	}
+	entries := make(map[string]os.FileInfo)
+	hidden := make(map[string]bool)
+	opaque := false
+	if inUpper {
+		list, err := o.upper.ReadDir(dirname)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range list {
+			switch name := entry.Name(); {
+			case name == opaqueMarker:
+				opaque = true
+			case strings.HasPrefix(name, whiteoutPrefix):
+				hidden[strings.TrimPrefix(name, whiteoutPrefix)] = true
+			default:
+				entries[name] = entry
+			}
+		}
+	}
+	visible, err := o.lowerVisible(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if visible && !opaque {
+		list, err := o.lower.ReadDir(dirname)
+		if err != nil && !notExist(err) {
+			return nil, err
+		}
+		for _, entry := range list {
+			if _, ok := entries[entry.Name()]; !ok && !hidden[entry.Name()] {
+				entries[entry.Name()] = entry
+			}
+		}
+	}
+	result := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+// copyUpParents creates the parents of name in the upper layer, as they
+// exist in the overlay.
+func (o *Overlay) copyUpParents(name string) error {
+	for _, p := range ancestors(filepath.Dir(filepath.Clean(name))) {
+		info, inUpper, err := o.stat(p)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+		}
+		if inUpper {
+			continue
+		}
+		if err := o.upper.Mkdir(p, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyUp copies name into the upper layer, if it isn't there already. The
+// contents of a directory are not copied.
+func (o *Overlay) copyUp(name string) error {
+	info, inUpper, err := o.stat(name)
+	if err != nil || inUpper {
+		return err
+	}
+	if err := o.copyUpParents(name); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return o.upper.Mkdir(name, info.Mode().Perm())
+	}
+	src, err := o.lower.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close() // nolint: errcheck
+	dst, err := o.upper.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return o.upper.Chmod(name, info.Mode().Perm())
+}
+
+// copyUpTree copies name, and everything within it, into the upper layer.
+func (o *Overlay) copyUpTree(name string) error {
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	info, err := o.upper.Stat(name)
+	if err != nil || !info.IsDir() {
+		return err
+	}
+	entries, err := o.readDir(name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := o.copyUpTree(filepath.Join(name, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeWhiteout removes the whiteout for name, if any, returning true if
+// there was one.
+func (o *Overlay) removeWhiteout(name string) (bool, error) {
+	err := o.upper.Remove(whiteout(name))
+	if notExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// hideLower records the deletion of name, if it exists in the lower layer.
+func (o *Overlay) hideLower(name string) error {
+	has, err := o.lowerHas(name)
+	if !has || err != nil {
+		return err
+	}
+	if err := o.copyUpParents(name); err != nil {
+		return err
+	}
+	f, err := o.upper.Create(whiteout(name))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// makeOpaque hides the contents of the directory name in the lower layer.
+func (o *Overlay) makeOpaque(name string) error {
+	f, err := o.upper.Create(filepath.Join(name, opaqueMarker))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Mkdir creates the directory name.
+func (o *Overlay) Mkdir(name string, perm os.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.mkdir(name, perm)
+}
+
+func (o *Overlay) mkdir(name string, perm os.FileMode) error {
+	_, _, err := o.stat(name)
+	if err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if !notExist(err) {
+		return err
+	}
+	if err := o.copyUpParents(name); err != nil {
+		return err
+	}
+	if err := o.upper.Mkdir(name, perm); err != nil {
+		return err
+	}
+	replaced, err := o.removeWhiteout(name)
+	if !replaced || err != nil {
+		return err
+	}
+	return o.makeOpaque(name)
+}
+
+// MkdirAll creates the directory path, and any parents that don't yet exist.
+func (o *Overlay) MkdirAll(path string, perm os.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, p := range ancestors(path) {
+		info, _, err := o.stat(p)
+		if err == nil {
+			if !info.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+			}
+			continue
+		}
+		if !notExist(err) {
+			return err
+		}
+		if err := o.mkdir(p, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open opens name for reading, from whichever layer holds it. The listing of
+// a directory merges both layers.
+func (o *Overlay) Open(name string) (File, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	info, inUpper, err := o.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	layer := o.lower
+	if inUpper {
+		layer = o.upper
+	}
+	f, err := layer.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &overlayDir{File: f, o: o, name: name}, nil
+	}
+	return f, nil
+}
+
+// Create creates or truncates name in the upper layer.
+func (o *Overlay) Create(name string) (File, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	info, _, err := o.stat(name)
+	if err == nil && info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	if err != nil && !notExist(err) {
+		return nil, err
+	}
+	if err := o.copyUpParents(name); err != nil {
+		return nil, err
+	}
+	if _, err := o.removeWhiteout(name); err != nil {
+		return nil, err
+	}
+	return o.upper.Create(name)
+}
+
+// Stat returns the FileInfo for name, from whichever layer holds it.
+func (o *Overlay) Stat(name string) (os.FileInfo, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	info, _, err := o.stat(name)
+	return info, err
+}
+
+// TempFile creates a new temporary file in dir, in the upper layer.
+func (o *Overlay) TempFile(dir, pattern string) (File, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.copyUp(dir); err != nil {
+		return nil, err
+	}
+	return o.upper.TempFile(dir, pattern)
+}
+
+// Rename renames oldpath to newpath, copying oldpath, and everything within
+// it, into the upper layer first.
+func (o *Overlay) Rename(oldpath, newpath string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: underlying(err)}
+	}
+	oldInfo, _, err := o.stat(oldpath)
+	if err != nil {
+		return linkErr(err)
+	}
+	if filepath.Clean(oldpath) == filepath.Clean(newpath) {
+		return nil
+	}
+	if oldInfo.IsDir() && strings.HasPrefix(filepath.Clean(newpath), filepath.Clean(oldpath)+string(filepath.Separator)) {
+		return linkErr(syscall.EINVAL)
+	}
+	newInfo, newInUpper, err := o.stat(newpath)
+	switch {
+	case err == nil && oldInfo.IsDir() && !newInfo.IsDir():
+		return linkErr(syscall.ENOTDIR)
+	case err == nil && !oldInfo.IsDir() && newInfo.IsDir():
+		return linkErr(syscall.EISDIR)
+	case err == nil && newInfo.IsDir():
+		entries, err := o.readDir(newpath)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return linkErr(syscall.ENOTEMPTY)
+		}
+		if newInUpper {
+			// Only markers remain.
+			if err := o.upper.RemoveAll(newpath); err != nil {
+				return err
+			}
+		}
+	case err != nil && !notExist(err):
+		return err
+	}
+	if err := o.copyUpTree(oldpath); err != nil {
+		return err
+	}
+	if err := o.copyUpParents(newpath); err != nil {
+		return err
+	}
+	if _, err := o.removeWhiteout(newpath); err != nil {
+		return err
+	}
+	if err := o.upper.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if oldInfo.IsDir() {
+		if has, err := o.lowerHas(newpath); has || err != nil {
+			if err != nil {
+				return err
+			}
+			if err := o.makeOpaque(newpath); err != nil {
+				return err
+			}
+		}
+	}
+	return o.hideLower(oldpath)
+}
+
+// Remove removes the file or empty directory name.
+func (o *Overlay) Remove(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	info, inUpper, err := o.stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := o.readDir(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if inUpper {
+		// A directory may still hold markers.
+		if err := o.upper.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	return o.hideLower(name)
+}
+
+// RemoveAll removes path and any children it contains. It returns nil if
+// path does not exist.
+func (o *Overlay) RemoveAll(path string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, inUpper, err := o.stat(path)
+	if notExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if inUpper {
+		if err := o.upper.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return o.hideLower(path)
+}
+
+// ReadDir returns the merged entries of the directory dirname, sorted by
+// name.
+func (o *Overlay) ReadDir(dirname string) ([]os.FileInfo, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.readDir(dirname)
+}
+
+// Chmod changes the mode of name, after copying it into the upper layer.
+func (o *Overlay) Chmod(name string, mode os.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	return o.upper.Chmod(name, mode)
+}
+
+// Link creates newname as a hard link to oldname, after copying oldname into
+// the upper layer.
+func (o *Overlay) Link(oldname, newname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: underlying(err)}
+	}
+	info, _, err := o.stat(oldname)
+	if err != nil {
+		return linkErr(err)
+	}
+	if info.IsDir() {
+		return linkErr(syscall.EPERM)
+	}
+	if _, _, err := o.stat(newname); err == nil {
+		return linkErr(os.ErrExist)
+	} else if !notExist(err) {
+		return err
+	}
+	if err := o.copyUp(oldname); err != nil {
+		return err
+	}
+	if err := o.copyUpParents(newname); err != nil {
+		return err
+	}
+	if _, err := o.removeWhiteout(newname); err != nil {
+		return err
+	}
+	return o.upper.Link(oldname, newname)
+}
+
+// overlayDir is an open directory in an Overlay, whose listing merges both
+// layers.
+type overlayDir struct {
+	File
+	o    *Overlay
+	name string
+
+	mu      sync.Mutex
+	read    bool
+	entries []os.FileInfo
+}
+
+func (d *overlayDir) Readdir(n int) ([]os.FileInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.read {
+		d.o.mu.RLock()
+		entries, err := d.o.readDir(d.name)
+		d.o.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// ChangeKind identifies the kind of a Change.
+type ChangeKind int
+
+// The kinds of change reported by Overlay.Changes.
+const (
+	// Added means the path doesn't exist in the lower layer.
+	Added ChangeKind = iota
+	// Modified means the path exists in the lower layer, with different
+	// contents, permissions or type.
+	Modified
+	// Deleted means the path exists only in the lower layer.
+	Deleted
+)
+
+// Change describes a path which differs between the layers of an Overlay.
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+// String returns the path, prefixed by A, M or D for the kind of change.
+func (c Change) String() string {
+	return string("AMD"[c.Kind]) + " " + c.Path
+}
+
+// Changes returns the paths within dir which differ between the overlay and
+// its lower layer, sorted by path. Everything within an added directory is
+// listed, but not the contents of a deleted one.
+func (o *Overlay) Changes(dir string) ([]Change, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	var changes []Change
+	if err := o.changes(filepath.Clean(dir), &changes); err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+func (o *Overlay) changes(dir string, changes *[]Change) error {
+	entries, err := o.upper.ReadDir(dir)
+	if notExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(entries))
+	opaque := false
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		if name == opaqueMarker {
+			opaque = true
+			continue
+		}
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			target := filepath.Join(dir, strings.TrimPrefix(name, whiteoutPrefix))
+			if has, err := exists(o.lower, target); has || err != nil {
+				if err != nil {
+					return err
+				}
+				*changes = append(*changes, Change{Path: target, Kind: Deleted})
+			}
+			present[strings.TrimPrefix(name, whiteoutPrefix)] = true
+			continue
+		}
+		present[name] = true
+		lowerInfo, err := o.lower.Stat(path)
+		if err != nil && !notExist(err) {
+			return err
+		}
+		switch {
+		case err != nil:
+			*changes = append(*changes, Change{Path: path, Kind: Added})
+		case entry.IsDir() != lowerInfo.IsDir():
+			*changes = append(*changes, Change{Path: path, Kind: Modified})
+		case !entry.IsDir():
+			same, err := o.sameFile(path, entry, lowerInfo)
+			if err != nil {
+				return err
+			}
+			if !same {
+				*changes = append(*changes, Change{Path: path, Kind: Modified})
+			}
+		}
+		if entry.IsDir() {
+			if err := o.changes(path, changes); err != nil {
+				return err
+			}
+		}
+	}
+	if !opaque {
+		return nil
+	}
+	lowerEntries, err := o.lower.ReadDir(dir)
+	if err != nil && !notExist(err) {
+		return err
+	}
+	for _, entry := range lowerEntries {
+		if !present[entry.Name()] {
+			*changes = append(*changes, Change{Path: filepath.Join(dir, entry.Name()), Kind: Deleted})
+		}
+	}
+	return nil
+}
+
+// sameFile returns true if the file at path has the same contents and
+// permissions in both layers.
+func (o *Overlay) sameFile(path string, upperInfo, lowerInfo os.FileInfo) (bool, error) {
+	if upperInfo.Size() != lowerInfo.Size() || upperInfo.Mode().Perm() != lowerInfo.Mode().Perm() {
+		return false, nil
+	}
+	upperData, err := readAll(o.upper, path)
+	if err != nil {
+		return false, err
+	}
+	lowerData, err := readAll(o.lower, path)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(upperData, lowerData), nil
+}
+
+func readAll(fs Filesystem, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	return io.ReadAll(f)
+}
+
+// Discard throws away every change within dir, restoring the view of the
+// lower layer.
+func (o *Overlay) Discard(dir string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, err := o.removeWhiteout(dir); err != nil {
+		return err
+	}
+	upperInfo, err := o.upper.Stat(dir)
+	if notExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lowerInfo, err := o.lower.Stat(dir)
+	if err != nil && !notExist(err) {
+		return err
+	}
+	if err != nil || !upperInfo.IsDir() || !lowerInfo.IsDir() {
+		return o.upper.RemoveAll(dir)
+	}
+	// Keep the directory itself, which may be the root.
+	entries, err := o.upper.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := o.upper.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+// testOverlay returns an overlay of an empty MemFS over a MemFS holding
+// a/b.txt="b", a/c/ and d.txt="d".
+func testOverlay(t *testing.T) (o *Overlay, lower *MemFS) {
+	t.Helper()
+	lower = NewMemFS()
+	if err := lower.MkdirAll("a/c", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	writeMem(t, lower, "a/b.txt", "b")
+	writeMem(t, lower, "d.txt", "d")
+	return NewOverlay(lower, NewMemFS()), lower
+}
+
+func TestOverlay(t *testing.T) {
+	type tt struct {
+		op      func(*Overlay) error
+		want    []string
+		changes []string
+		err     error
+	}
+	tests := testy.NewTable()
+	tests.Add("no changes", tt{
+		op:   func(*Overlay) error { return nil },
+		want: []string{"a/", "a/b.txt=b", "a/c/", "d.txt=d"},
+	})
+	tests.Add("create", tt{
+		op: func(o *Overlay) error {
+			return writeOverlay(o, "a/c/e.txt", "e")
+		},
+		want:    []string{"a/", "a/b.txt=b", "a/c/", "a/c/e.txt=e", "d.txt=d"},
+		changes: []string{"A /a/c/e.txt"},
+	})
+	tests.Add("overwrite lower file", tt{
+		op:      func(o *Overlay) error { return writeOverlay(o, "d.txt", "x") },
+		want:    []string{"a/", "a/b.txt=b", "a/c/", "d.txt=x"},
+		changes: []string{"M /d.txt"},
+	})
+	tests.Add("remove lower file", tt{
+		op:      func(o *Overlay) error { return o.Remove("a/b.txt") },
+		want:    []string{"a/", "a/c/", "d.txt=d"},
+		changes: []string{"D /a/b.txt"},
+	})
+	tests.Add("remove and recreate unchanged", tt{
+		op: func(o *Overlay) error {
+			if err := o.Remove("d.txt"); err != nil {
+				return err
+			}
+			return writeOverlay(o, "d.txt", "d")
+		},
+		want: []string{"a/", "a/b.txt=b", "a/c/", "d.txt=d"},
+	})
+	tests.Add("remove non-empty lower directory", tt{
+		op:  func(o *Overlay) error { return o.Remove("a") },
+		err: syscall.ENOTEMPTY,
+	})
+	tests.Add("remove emptied lower directory", tt{
+		op: func(o *Overlay) error {
+			if err := o.Remove("a/b.txt"); err != nil {
+				return err
+			}
+			if err := o.Remove("a/c"); err != nil {
+				return err
+			}
+			return o.Remove("a")
+		},
+		want:    []string{"d.txt=d"},
+		changes: []string{"D /a"},
+	})
+	tests.Add("removeall lower directory", tt{
+		op:      func(o *Overlay) error { return o.RemoveAll("a") },
+		want:    []string{"d.txt=d"},
+		changes: []string{"D /a"},
+	})
+	tests.Add("removeall missing", tt{
+		op:   func(o *Overlay) error { return o.RemoveAll("x") },
+		want: []string{"a/", "a/b.txt=b", "a/c/", "d.txt=d"},
+	})
+	tests.Add("replace lower directory", tt{
+		op: func(o *Overlay) error {
+			if err := o.RemoveAll("a"); err != nil {
+				return err
+			}
+			return o.Mkdir("a", 0o777)
+		},
+		want:    []string{"a/", "d.txt=d"},
+		changes: []string{"D /a/b.txt", "D /a/c"},
+	})
+	tests.Add("mkdir exists", tt{
+		op:  func(o *Overlay) error { return o.Mkdir("a/c", 0o777) },
+		err: os.ErrExist,
+	})
+	tests.Add("mkdirall", tt{
+		op:      func(o *Overlay) error { return o.MkdirAll("/a/c/x/y", 0o777) },
+		want:    []string{"a/", "a/b.txt=b", "a/c/", "a/c/x/", "a/c/x/y/", "d.txt=d"},
+		changes: []string{"A /a/c/x", "A /a/c/x/y"},
+	})
+	tests.Add("mkdirall file", tt{
+		op:  func(o *Overlay) error { return o.MkdirAll("d.txt/x", 0o777) },
+		err: syscall.ENOTDIR,
+	})
+	tests.Add("create in deleted directory", tt{
+		op: func(o *Overlay) error {
+			if err := o.RemoveAll("a"); err != nil {
+				return err
+			}
+			return writeOverlay(o, "a/x", "x")
+		},
+		err: os.ErrNotExist,
+	})
+	tests.Add("create directory", tt{
+		op: func(o *Overlay) error {
+			_, err := o.Create("a/c")
+			return err
+		},
+		err: syscall.EISDIR,
+	})
+	tests.Add("rename lower file", tt{
+		op:      func(o *Overlay) error { return o.Rename("d.txt", "a/c/d.txt") },
+		want:    []string{"a/", "a/b.txt=b", "a/c/", "a/c/d.txt=d"},
+		changes: []string{"A /a/c/d.txt", "D /d.txt"},
+	})
+	tests.Add("rename over lower file", tt{
+		op:      func(o *Overlay) error { return o.Rename("d.txt", "a/b.txt") },
+		want:    []string{"a/", "a/b.txt=d", "a/c/"},
+		changes: []string{"M /a/b.txt", "D /d.txt"},
+	})
+	tests.Add("rename lower directory", tt{
+		op:      func(o *Overlay) error { return o.Rename("a", "e") },
+		want:    []string{"d.txt=d", "e/", "e/b.txt=b", "e/c/"},
+		changes: []string{"D /a", "A /e", "A /e/b.txt", "A /e/c"},
+	})
+	tests.Add("rename directory over empty lower directory", tt{
+		op: func(o *Overlay) error {
+			if err := o.MkdirAll("e/f", 0o777); err != nil {
+				return err
+			}
+			return o.Rename("e", "a/c")
+		},
+		want:    []string{"a/", "a/b.txt=b", "a/c/", "a/c/f/", "d.txt=d"},
+		changes: []string{"A /a/c/f"},
+	})
+	tests.Add("rename over non-empty lower directory", tt{
+		op: func(o *Overlay) error {
+			if err := o.Mkdir("e", 0o777); err != nil {
+				return err
+			}
+			return o.Rename("e", "a")
+		},
+		err: syscall.ENOTEMPTY,
+	})
+	tests.Add("rename directory into itself", tt{
+		op:  func(o *Overlay) error { return o.Rename("a", "a/c/a") },
+		err: syscall.EINVAL,
+	})
+	tests.Add("link lower file", tt{
+		op:      func(o *Overlay) error { return o.Link("d.txt", "a/e.txt") },
+		want:    []string{"a/", "a/b.txt=b", "a/c/", "a/e.txt=d", "d.txt=d"},
+		changes: []string{"A /a/e.txt"},
+	})
+	tests.Add("link exists", tt{
+		op:  func(o *Overlay) error { return o.Link("d.txt", "a/b.txt") },
+		err: os.ErrExist,
+	})
+	tests.Add("chmod lower file", tt{
+		op:      func(o *Overlay) error { return o.Chmod("d.txt", 0o600) },
+		want:    []string{"a/", "a/b.txt=b", "a/c/", "d.txt=d"},
+		changes: []string{"M /d.txt"},
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		t.Parallel()
+		o, lower := testOverlay(t)
+		err := tt.op(o)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if d := testy.DiffInterface([]string{"a/", "a/b.txt=b", "a/c/", "d.txt=d"}, memFiles(t, lower)); d != nil {
+			t.Errorf("Lower layer modified: %s", d)
+		}
+		if err != nil {
+			return
+		}
+		if d := testy.DiffInterface(tt.want, memFiles(t, o)); d != nil {
+			t.Error(d)
+		}
+		changes, err := o.Changes("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range changes {
+			got = append(got, c.String())
+		}
+		if d := testy.DiffInterface(tt.changes, got); d != nil {
+			t.Errorf("Unexpected changes: %s", d)
+		}
+	})
+}
+
+func writeOverlay(o *Overlay, name, content string) error {
+	f, err := o.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func TestOverlayReaddir(t *testing.T) {
+	o, _ := testOverlay(t)
+	if err := writeOverlay(o, "a/a.txt", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Remove("a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := o.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close() // nolint: errcheck
+	var names []string
+	for {
+		entries, err := d.Readdir(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range entries {
+			names = append(names, info.Name())
+		}
+	}
+	if d := testy.DiffInterface([]string{"a.txt", "c"}, names); d != nil {
+		t.Error(d)
+	}
+	if _, err := o.Stat(whiteout("a/b.txt")); !os.IsNotExist(err) {
+		t.Errorf("Whiteout should be hidden: %v", err)
+	}
+}
+
+func TestOverlayDiscard(t *testing.T) {
+	o, _ := testOverlay(t)
+	if err := o.RemoveAll("a/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeOverlay(o, "a/e.txt", "e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeOverlay(o, "d.txt", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Discard("a"); err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffInterface([]string{"a/", "a/b.txt=b", "a/c/", "d.txt=x"}, memFiles(t, o)); d != nil {
+		t.Error(d)
+	}
+	if err := o.Discard("/"); err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffInterface([]string{"a/", "a/b.txt=b", "a/c/", "d.txt=d"}, memFiles(t, o)); d != nil {
+		t.Error(d)
+	}
+}
+
+func TestOverlayTempFile(t *testing.T) {
+	o, lower := testOverlay(t)
+	f, err := o.TempFile("a/c", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("t")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Rename(f.Name(), "d.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readMem(t, o, "d.txt")); got != "t" {
+		t.Errorf("Unexpected content: %q", got)
+	}
+	if got := string(readMem(t, lower, "d.txt")); got != "d" {
+		t.Errorf("Lower layer modified: %q", got)
+	}
+}
+
+func TestDirFS(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewDirFS(dir)
+	if err := fs.MkdirAll("/x/y", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create("x/y/z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name() != "x/y/z" {
+		t.Errorf("Unexpected name: %s", f.Name())
+	}
+	if _, err := f.Write([]byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, "x", "y", "z")); err != nil || string(content) != "z" {
+		t.Errorf("Unexpected content on disk: %q, %v", content, err)
+	}
+	tmp, err := fs.TempFile("/x", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = tmp.Close()
+	if filepath.Dir(tmp.Name()) != "/x" {
+		t.Errorf("Unexpected temp file name: %s", tmp.Name())
+	}
+	if err := fs.Rename(tmp.Name(), "/x/t"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("../../x/t"); err != nil {
+		t.Errorf("Expected path to be confined to the directory: %s", err)
+	}
+	_, err = fs.Stat("/missing")
+	if err == nil || err.Error() != "stat /missing: no such file or directory" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	infos, err := fs.ReadDir("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name() != "t" || infos[1].Name() != "y" {
+		t.Errorf("Unexpected entries: %v", infos)
+	}
+}
@@ -0,0 +1,278 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// maxPending is the number of pending files after which a Syncer flushes
+// automatically, to bound the work left for an explicit Sync.
+const maxPending = 1000
+
+// Syncer flushes writes made through the filesystems returned by Wrap to
+// stable storage.
+type Syncer struct {
+	fs Filesystem
+
+	mu    sync.Mutex
+	files map[string]struct{}
+	dirs  map[string]struct{}
+}
+
+// NewSyncer returns a new Syncer for fs.
+func NewSyncer(fs Filesystem) *Syncer {
+	return &Syncer{
+		fs:    fs,
+		files: map[string]struct{}{},
+		dirs:  map[string]struct{}{},
+	}
+}
+
+// Wrap returns a Filesystem which tracks writes, for durability. When
+// immediate is true, file contents are synced before the file is closed, and
+// directories are synced after each entry is created, renamed or removed, so
+// that every change is durable once the call returns. Otherwise, the modified
+// files and directories are recorded, to be synced by a later call to Sync.
+func (s *Syncer) Wrap(immediate bool) Filesystem {
+	return &syncFS{
+		Filesystem: s.fs,
+		s:          s,
+		immediate:  immediate,
+	}
+}
+
+// Sync syncs all pending files, followed by their directories.
+func (s *Syncer) Sync() error {
+	s.mu.Lock()
+	files, dirs := s.files, s.dirs
+	s.files = map[string]struct{}{}
+	s.dirs = map[string]struct{}{}
+	s.mu.Unlock()
+	for name := range files {
+		if err := s.syncFile(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for dir := range dirs {
+		if err := s.syncDir(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Syncer) syncFile(name string) error {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs the directory dir. Some filesystems do not support syncing
+// directories; this is not considered an error.
+func (s *Syncer) syncDir(dir string) error {
+	err := s.syncFile(dir)
+	if errors.Is(err, syscall.EINVAL) {
+		return nil
+	}
+	return err
+}
+
+func (s *Syncer) addFile(name string) error {
+	s.mu.Lock()
+	s.files[name] = struct{}{}
+	s.dirs[filepath.Dir(name)] = struct{}{}
+	full := len(s.files) >= maxPending
+	s.mu.Unlock()
+	if full {
+		return s.Sync()
+	}
+	return nil
+}
+
+func (s *Syncer) addDirs(dirs ...string) {
+	s.mu.Lock()
+	for _, dir := range dirs {
+		s.dirs[dir] = struct{}{}
+	}
+	s.mu.Unlock()
+}
+
+func (s *Syncer) renamed(oldpath, newpath string) {
+	s.mu.Lock()
+	if _, ok := s.files[oldpath]; ok {
+		delete(s.files, oldpath)
+		s.files[newpath] = struct{}{}
+	}
+	s.dirs[filepath.Dir(oldpath)] = struct{}{}
+	s.dirs[filepath.Dir(newpath)] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *Syncer) removed(name string) {
+	s.mu.Lock()
+	delete(s.files, name)
+	delete(s.dirs, name)
+	s.dirs[filepath.Dir(name)] = struct{}{}
+	s.mu.Unlock()
+}
+
+type syncFS struct {
+	Filesystem
+	s         *Syncer
+	immediate bool
+}
+
+var _ Filesystem = &syncFS{}
+
+// ReadOnly reports whether the wrapped filesystem is read-only.
+func (fs *syncFS) ReadOnly() bool {
+	return IsReadOnly(fs.Filesystem)
+}
+
+// dirsChanged syncs dirs now, or records them for later.
+func (fs *syncFS) dirsChanged(dirs ...string) error {
+	if !fs.immediate {
+		fs.s.addDirs(dirs...)
+		return nil
+	}
+	for _, dir := range dirs {
+		if err := fs.s.syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *syncFS) Mkdir(name string, perm os.FileMode) error {
+	if err := fs.Filesystem.Mkdir(name, perm); err != nil {
+		return err
+	}
+	return fs.dirsChanged(filepath.Dir(name))
+}
+
+func (fs *syncFS) MkdirAll(path string, perm os.FileMode) error {
+	// Find the directories which will be created, so that their parents can
+	// be synced.
+	var parents []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := fs.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		parents = append(parents, parent)
+		if parent == dir {
+			break
+		}
+	}
+	if err := fs.Filesystem.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	return fs.dirsChanged(parents...)
+}
+
+func (fs *syncFS) Create(name string) (File, error) {
+	f, err := fs.Filesystem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.dirsChanged(filepath.Dir(name)); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &syncFile{File: f, fs: fs}, nil
+}
+
+func (fs *syncFS) TempFile(dir, pattern string) (File, error) {
+	f, err := fs.Filesystem.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &syncFile{File: f, fs: fs}, nil
+}
+
+func (fs *syncFS) Rename(oldpath, newpath string) error {
+	if err := fs.Filesystem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if !fs.immediate {
+		fs.s.renamed(oldpath, newpath)
+		return nil
+	}
+	dirs := []string{filepath.Dir(newpath)}
+	if dir := filepath.Dir(oldpath); dir != dirs[0] {
+		dirs = append(dirs, dir)
+	}
+	return fs.dirsChanged(dirs...)
+}
+
+func (fs *syncFS) RemoveAll(path string) error {
+	if err := fs.Filesystem.RemoveAll(path); err != nil {
+		return err
+	}
+	if !fs.immediate {
+		fs.s.removed(path)
+		return nil
+	}
+	return fs.dirsChanged(filepath.Dir(path))
+}
+
+func (fs *syncFS) Remove(name string) error {
+	if err := fs.Filesystem.Remove(name); err != nil {
+		return err
+	}
+	if !fs.immediate {
+		fs.s.removed(name)
+		return nil
+	}
+	return fs.dirsChanged(filepath.Dir(name))
+}
+
+func (fs *syncFS) Link(oldname, newname string) error {
+	if err := fs.Filesystem.Link(oldname, newname); err != nil {
+		return err
+	}
+	return fs.dirsChanged(filepath.Dir(newname))
+}
+
+// syncFile is a file opened for writing through a syncFS.
+type syncFile struct {
+	File
+	fs *syncFS
+}
+
+// Close syncs the file contents before closing it in immediate mode, so that
+// the contents are durable before the file is renamed into place.
+func (f *syncFile) Close() error {
+	if !f.fs.immediate {
+		if err := f.File.Close(); err != nil {
+			return err
+		}
+		return f.fs.s.addFile(f.Name())
+	}
+	if err := f.File.Sync(); err != nil {
+		_ = f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
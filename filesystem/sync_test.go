@@ -0,0 +1,146 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+// recordFS records the names of files synced.
+type recordFS struct {
+	Filesystem
+	synced *[]string
+}
+
+func (fs *recordFS) Open(name string) (File, error) {
+	f, err := fs.Filesystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &recordFile{File: f, synced: fs.synced}, nil
+}
+
+func (fs *recordFS) TempFile(dir, pattern string) (File, error) {
+	f, err := fs.Filesystem.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &recordFile{File: f, synced: fs.synced}, nil
+}
+
+type recordFile struct {
+	File
+	synced *[]string
+}
+
+func (f *recordFile) Sync() error {
+	*f.synced = append(*f.synced, f.Name())
+	return f.File.Sync()
+}
+
+func TestSyncer(t *testing.T) {
+	type tt struct {
+		immediate bool
+		remove    bool
+		// want lists the files synced by the write itself, and by the
+		// subsequent call to Sync.
+		want, wantSync []string
+	}
+	tests := testy.NewTable()
+	tests.Add("deferred", tt{
+		wantSync: []string{"{dir}", "{dir}/foo.json"},
+	})
+	tests.Add("deferred, removed", tt{
+		remove:   true,
+		wantSync: []string{"{dir}"},
+	})
+	tests.Add("immediate", tt{
+		immediate: true,
+		want:      []string{"{dir}", "{tmp}"},
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		dir := t.TempDir()
+		var synced []string
+		s := NewSyncer(&recordFS{Filesystem: Default(), synced: &synced})
+		fs := s.Wrap(tt.immediate)
+		f, err := fs.TempFile(dir, ".tmp.foo.json-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmp := f.Name()
+		if _, err := f.Write([]byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		target := filepath.Join(dir, "foo.json")
+		if err := fs.Rename(tmp, target); err != nil {
+			t.Fatal(err)
+		}
+		if tt.remove {
+			if err := fs.Remove(target); err != nil {
+				t.Fatal(err)
+			}
+		}
+		replace := func(names []string) []string {
+			var result []string
+			for _, name := range names {
+				switch name {
+				case dir:
+					name = "{dir}"
+				case tmp:
+					name = "{tmp}"
+				case target:
+					name = "{dir}/foo.json"
+				}
+				result = append(result, name)
+			}
+			sort.Strings(result)
+			return result
+		}
+		if d := testy.DiffInterface(tt.want, replace(synced)); d != nil {
+			t.Errorf("Unexpected syncs during write:\n%s", d)
+		}
+		synced = synced[:0]
+		if err := s.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffInterface(tt.wantSync, replace(synced)); d != nil {
+			t.Errorf("Unexpected syncs during Sync:\n%s", d)
+		}
+	})
+}
+
+func TestSyncerMkdirAll(t *testing.T) {
+	dir := t.TempDir()
+	var synced []string
+	fs := NewSyncer(&recordFS{Filesystem: Default(), synced: &synced}).Wrap(true)
+	if err := fs.MkdirAll(filepath.Join(dir, "a", "b"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(synced)
+	want := []string{dir, filepath.Join(dir, "a")}
+	if d := testy.DiffInterface(want, synced); d != nil {
+		t.Error(d)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "b")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,586 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// matcher reports whether a document, decoded from JSON, matches a Mango
+// selector.
+type matcher func(doc interface{}) bool
+
+// fieldMatcher reports whether the value of a field, which may be missing,
+// matches a condition.
+type fieldMatcher func(value interface{}, ok bool) bool
+
+// compileSelector compiles a Mango selector. The combination operators $and,
+// $or, $nor and $not, and the condition operators $eq, $ne, $gt, $gte, $lt,
+// $lte, $exists, $type, $in, $nin, $size, $mod, $regex, $all, $elemMatch and
+// $allMatch are supported, as are implicit equality and dotted field paths.
+func compileSelector(selector interface{}) (matcher, error) {
+	sel, ok := selector.(map[string]interface{})
+	if !ok {
+		return nil, badSelector("selector must be an object: %v", selector)
+	}
+	matchers := make([]matcher, 0, len(sel))
+	for key, value := range sel {
+		var m matcher
+		var err error
+		if strings.HasPrefix(key, "$") {
+			m, err = compileCombination(key, value)
+		} else {
+			var fm fieldMatcher
+			fm, err = compileCondition(value)
+			path := splitFieldPath(key)
+			m = func(doc interface{}) bool {
+				v, ok := fieldValue(doc, path)
+				return fm(v, ok)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return func(doc interface{}) bool {
+		for _, m := range matchers {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func badSelector(format string, args ...interface{}) error {
+	return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid selector: "+format, args...)}
+}
+
+// compileCombination compiles a combination operator of a selector.
+func compileCombination(op string, value interface{}) (matcher, error) {
+	if op == "$not" {
+		m, err := compileSelector(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc interface{}) bool { return !m(doc) }, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, badSelector("%s requires an array", op)
+	}
+	matchers := make([]matcher, len(list))
+	for i, sel := range list {
+		var err error
+		if matchers[i], err = compileSelector(sel); err != nil {
+			return nil, err
+		}
+	}
+	switch op {
+	case "$and":
+		return func(doc interface{}) bool {
+			for _, m := range matchers {
+				if !m(doc) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case "$or", "$nor":
+		want := op == "$or"
+		return func(doc interface{}) bool {
+			for _, m := range matchers {
+				if m(doc) {
+					return want
+				}
+			}
+			return !want
+		}, nil
+	}
+	return nil, badSelector("unknown operator %s", op)
+}
+
+// compileCondition compiles the condition on a field. An object whose keys
+// are all operators is a set of conditions on the field; any other object is
+// a selector on the field's sub-fields, and any other value is a test for
+// equality.
+func compileCondition(value interface{}) (fieldMatcher, error) {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return func(v interface{}, ok bool) bool { return ok && collate(v, value) == 0 }, nil
+	}
+	operators := len(obj) > 0
+	for key := range obj {
+		if !strings.HasPrefix(key, "$") {
+			operators = false
+			break
+		}
+	}
+	if !operators {
+		m, err := compileSelector(obj)
+		if err != nil {
+			return nil, err
+		}
+		return func(v interface{}, ok bool) bool {
+			_, isObj := v.(map[string]interface{})
+			return isObj && m(v)
+		}, nil
+	}
+	matchers := make([]fieldMatcher, 0, len(obj))
+	for op, arg := range obj {
+		fm, err := compileOperator(op, arg)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, fm)
+	}
+	return func(v interface{}, ok bool) bool {
+		for _, fm := range matchers {
+			if !fm(v, ok) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileOperator compiles a single condition operator.
+func compileOperator(op string, arg interface{}) (fieldMatcher, error) {
+	compare := func(test func(int) bool) fieldMatcher {
+		return func(v interface{}, ok bool) bool { return ok && test(collate(v, arg)) }
+	}
+	switch op {
+	case "$eq":
+		return compare(func(c int) bool { return c == 0 }), nil
+	case "$ne":
+		return compare(func(c int) bool { return c != 0 }), nil
+	case "$gt":
+		return compare(func(c int) bool { return c > 0 }), nil
+	case "$gte":
+		return compare(func(c int) bool { return c >= 0 }), nil
+	case "$lt":
+		return compare(func(c int) bool { return c < 0 }), nil
+	case "$lte":
+		return compare(func(c int) bool { return c <= 0 }), nil
+	case "$exists":
+		want, ok := arg.(bool)
+		if !ok {
+			return nil, badSelector("$exists requires a boolean")
+		}
+		return func(_ interface{}, ok bool) bool { return ok == want }, nil
+	case "$type":
+		want, ok := arg.(string)
+		if !ok {
+			return nil, badSelector("$type requires a string")
+		}
+		return func(v interface{}, ok bool) bool { return ok && jsonType(v) == want }, nil
+	case "$in", "$nin":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return nil, badSelector("%s requires an array", op)
+		}
+		want := op == "$in"
+		return func(v interface{}, ok bool) bool {
+			if !ok {
+				return false
+			}
+			for _, item := range list {
+				if collate(v, item) == 0 {
+					return want
+				}
+			}
+			return !want
+		}, nil
+	case "$size":
+		size, ok := arg.(float64)
+		if !ok {
+			return nil, badSelector("$size requires a number")
+		}
+		return func(v interface{}, _ bool) bool {
+			list, ok := v.([]interface{})
+			return ok && float64(len(list)) == size
+		}, nil
+	case "$mod":
+		args, ok := arg.([]interface{})
+		if !ok || len(args) != 2 {
+			return nil, badSelector("$mod requires an array of a divisor and a remainder")
+		}
+		divisor, ok1 := args[0].(float64)
+		remainder, ok2 := args[1].(float64)
+		if !ok1 || !ok2 || divisor == 0 || divisor != math.Trunc(divisor) || remainder != math.Trunc(remainder) {
+			return nil, badSelector("$mod requires a non-zero integer divisor and an integer remainder")
+		}
+		return func(v interface{}, _ bool) bool {
+			n, ok := v.(float64)
+			return ok && n == math.Trunc(n) && int64(n)%int64(divisor) == int64(remainder)
+		}, nil
+	case "$regex":
+		pattern, ok := arg.(string)
+		if !ok {
+			return nil, badSelector("$regex requires a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, badSelector("%s", err)
+		}
+		return func(v interface{}, _ bool) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		}, nil
+	case "$all":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return nil, badSelector("$all requires an array")
+		}
+		return func(v interface{}, _ bool) bool {
+			values, ok := v.([]interface{})
+			if !ok {
+				return false
+			}
+		next:
+			for _, want := range list {
+				for _, value := range values {
+					if collate(value, want) == 0 {
+						continue next
+					}
+				}
+				return false
+			}
+			return true
+		}, nil
+	case "$elemMatch", "$allMatch":
+		fm, err := compileCondition(arg)
+		if err != nil {
+			return nil, err
+		}
+		all := op == "$allMatch"
+		return func(v interface{}, _ bool) bool {
+			values, ok := v.([]interface{})
+			if !ok || (all && len(values) == 0) {
+				return false
+			}
+			for _, value := range values {
+				if fm(value, true) != all {
+					return !all
+				}
+			}
+			return all
+		}, nil
+	case "$not":
+		fm, err := compileCondition(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(v interface{}, ok bool) bool { return ok && !fm(v, ok) }, nil
+	case "$and", "$or", "$nor":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return nil, badSelector("%s requires an array", op)
+		}
+		matchers := make([]fieldMatcher, len(list))
+		for i, cond := range list {
+			var err error
+			if matchers[i], err = compileCondition(cond); err != nil {
+				return nil, err
+			}
+		}
+		return func(v interface{}, ok bool) bool {
+			for _, fm := range matchers {
+				matched := fm(v, ok)
+				switch {
+				case op == "$and" && !matched:
+					return false
+				case op != "$and" && matched:
+					return op == "$or"
+				}
+			}
+			return op != "$or"
+		}, nil
+	}
+	return nil, badSelector("unknown operator %s", op)
+}
+
+// splitFieldPath splits a dotted field path, in which a literal dot may be
+// escaped with a backslash.
+func splitFieldPath(path string) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\\' && i+1 < len(path) && path[i+1] == '.':
+			part.WriteByte('.')
+			i++
+		case path[i] == '.':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(path[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// fieldValue returns the value at path in doc, and whether it exists.
+func fieldValue(doc interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// jsonType returns the name of the JSON type of v, as used by $type.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// collationRank orders the JSON types, as CouchDB does.
+func collationRank(v interface{}) int {
+	switch t := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if t {
+			return 2
+		}
+		return 1
+	case float64:
+		return 3
+	case string:
+		return 4
+	case []interface{}:
+		return 5
+	}
+	return 6
+}
+
+// collate compares two JSON values in CouchDB's collation order, except that
+// strings are compared by bytes, rather than by Unicode collation. It returns
+// a negative number if a sorts before b, a positive one if after, and 0 if
+// they are equal.
+func collate(a, b interface{}) int {
+	if ra, rb := collationRank(a), collationRank(b); ra != rb {
+		return ra - rb
+	}
+	switch ta := a.(type) {
+	case float64:
+		tb := b.(float64)
+		switch {
+		case ta < tb:
+			return -1
+		case ta > tb:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(ta, b.(string))
+	case []interface{}:
+		tb := b.([]interface{})
+		for i := 0; i < len(ta) && i < len(tb); i++ {
+			if c := collate(ta[i], tb[i]); c != 0 {
+				return c
+			}
+		}
+		return len(ta) - len(tb)
+	case map[string]interface{}:
+		tb := b.(map[string]interface{})
+		ka, kb := objectKeys(ta), objectKeys(tb)
+		for i := 0; i < len(ka) && i < len(kb); i++ {
+			if c := strings.Compare(ka[i], kb[i]); c != 0 {
+				return c
+			}
+			if c := collate(ta[ka[i]], tb[kb[i]]); c != 0 {
+				return c
+			}
+		}
+		return len(ka) - len(kb)
+	}
+	return 0
+}
+
+// objectKeys returns the keys of obj, sorted.
+func objectKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// findRequest is the body of a _find request.
+type findRequest struct {
+	Selector interface{}   `json:"selector"`
+	Limit    *int          `json:"limit"`
+	Skip     int           `json:"skip"`
+	Sort     []interface{} `json:"sort"`
+	Fields   []string      `json:"fields"`
+}
+
+// sortField is a field by which _find results are sorted.
+type sortField struct {
+	path       []string
+	descending bool
+}
+
+func parseSort(fields []interface{}) ([]sortField, error) {
+	result := make([]sortField, 0, len(fields))
+next:
+	for _, field := range fields {
+		switch t := field.(type) {
+		case string:
+			result = append(result, sortField{path: splitFieldPath(t)})
+			continue
+		case map[string]interface{}:
+			for name, dir := range t {
+				if len(t) == 1 && (dir == "asc" || dir == "desc") {
+					result = append(result, sortField{path: splitFieldPath(name), descending: dir == "desc"})
+					continue next
+				}
+			}
+		}
+		return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid sort field: %v", field)}
+	}
+	return result, nil
+}
+
+// find answers a Mango query by scanning all documents, as CouchDB does
+// without a usable index.
+func (h *handler) find(w http.ResponseWriter, r *http.Request, d driver.DB) error {
+	if err := allowMethods(r, http.MethodPost); err != nil {
+		return err
+	}
+	var req findRequest
+	if err := decodeBody(r, &req); err != nil {
+		return err
+	}
+	if req.Selector == nil {
+		return statusError{status: http.StatusBadRequest, error: errors.New("selector missing")}
+	}
+	match, err := compileSelector(req.Selector)
+	if err != nil {
+		return err
+	}
+	sortFields, err := parseSort(req.Sort)
+	if err != nil {
+		return err
+	}
+	limit := 25
+	if req.Limit != nil {
+		limit = *req.Limit
+	}
+	rows, err := d.AllDocs(r.Context(), kivik.Param("include_docs", true))
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	docs := make([]map[string]interface{}, 0)
+	for {
+		row := new(driver.Row)
+		if err := rows.Next(row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if strings.HasPrefix(row.ID, "_design/") || row.Doc == nil {
+			continue
+		}
+		var doc map[string]interface{}
+		if err := json.NewDecoder(row.Doc).Decode(&doc); err != nil {
+			return err
+		}
+		if match(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, field := range sortFields {
+			a, _ := fieldValue(docs[i], field.path)
+			b, _ := fieldValue(docs[j], field.path)
+			if c := collate(a, b); c != 0 {
+				return (c < 0) != field.descending
+			}
+		}
+		return false
+	})
+	if req.Skip > len(docs) {
+		req.Skip = len(docs)
+	}
+	docs = docs[req.Skip:]
+	if limit >= 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+	if len(req.Fields) > 0 {
+		for i, doc := range docs {
+			docs[i] = projectFields(doc, req.Fields)
+		}
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"docs":     docs,
+		"bookmark": "nil",
+		"warning":  "No matching index found, create an index to optimize query time.",
+	})
+}
+
+// projectFields returns a copy of doc with only the given fields.
+func projectFields(doc map[string]interface{}, fields []string) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, field := range fields {
+		path := splitFieldPath(field)
+		value, ok := fieldValue(doc, path)
+		if !ok {
+			continue
+		}
+		target := result
+		for _, key := range path[:len(path)-1] {
+			next, ok := target[key].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				target[key] = next
+			}
+			target = next
+		}
+		target[path[len(path)-1]] = value
+	}
+	return result
+}
@@ -0,0 +1,194 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+)
+
+func TestCompileSelector(t *testing.T) {
+	type tt struct {
+		selector string
+		// matches are the IDs of the matching docs.
+		matches []string
+		status  int
+		err     string
+	}
+	docs := []string{
+		`{"_id":"a","name":"Alice","age":30,"tags":["x","y"],"address":{"city":"Oslo"}}`,
+		`{"_id":"b","name":"Bob","age":25,"tags":["y"],"address":{"city":"Rome"}}`,
+		`{"_id":"c","name":"Carol","age":null,"scores":[80,95]}`,
+	}
+	tests := testy.NewTable()
+	tests.Add("implicit equality", tt{
+		selector: `{"name":"Bob"}`,
+		matches:  []string{"b"},
+	})
+	tests.Add("dotted path", tt{
+		selector: `{"address.city":"Oslo"}`,
+		matches:  []string{"a"},
+	})
+	tests.Add("nested selector", tt{
+		selector: `{"address":{"city":"Rome"}}`,
+		matches:  []string{"b"},
+	})
+	tests.Add("comparisons", tt{
+		selector: `{"age":{"$gt":20,"$lt":30}}`,
+		matches:  []string{"b"},
+	})
+	tests.Add("null sorts before numbers", tt{
+		selector: `{"age":{"$lt":0}}`,
+		matches:  []string{"c"},
+	})
+	tests.Add("ne skips missing fields", tt{
+		selector: `{"address.city":{"$ne":"Oslo"}}`,
+		matches:  []string{"b"},
+	})
+	tests.Add("exists", tt{
+		selector: `{"scores":{"$exists":false}}`,
+		matches:  []string{"a", "b"},
+	})
+	tests.Add("type", tt{
+		selector: `{"age":{"$type":"null"}}`,
+		matches:  []string{"c"},
+	})
+	tests.Add("in", tt{
+		selector: `{"name":{"$in":["Alice","Carol"]}}`,
+		matches:  []string{"a", "c"},
+	})
+	tests.Add("nin", tt{
+		selector: `{"name":{"$nin":["Alice","Carol"]}}`,
+		matches:  []string{"b"},
+	})
+	tests.Add("size", tt{
+		selector: `{"tags":{"$size":1}}`,
+		matches:  []string{"b"},
+	})
+	tests.Add("mod", tt{
+		selector: `{"age":{"$mod":[10,5]}}`,
+		matches:  []string{"b"},
+	})
+	tests.Add("regex", tt{
+		selector: `{"name":{"$regex":"^[AB]"}}`,
+		matches:  []string{"a", "b"},
+	})
+	tests.Add("all", tt{
+		selector: `{"tags":{"$all":["x","y"]}}`,
+		matches:  []string{"a"},
+	})
+	tests.Add("elemMatch", tt{
+		selector: `{"scores":{"$elemMatch":{"$gte":90}}}`,
+		matches:  []string{"c"},
+	})
+	tests.Add("allMatch", tt{
+		selector: `{"tags":{"$allMatch":{"$eq":"y"}}}`,
+		matches:  []string{"b"},
+	})
+	tests.Add("or", tt{
+		selector: `{"$or":[{"name":"Alice"},{"age":25}]}`,
+		matches:  []string{"a", "b"},
+	})
+	tests.Add("nor", tt{
+		selector: `{"$nor":[{"name":"Alice"},{"age":25}]}`,
+		matches:  []string{"c"},
+	})
+	tests.Add("and with not", tt{
+		selector: `{"$and":[{"tags":{"$exists":true}},{"$not":{"name":"Alice"}}]}`,
+		matches:  []string{"b"},
+	})
+	tests.Add("not condition", tt{
+		selector: `{"age":{"$not":{"$gt":26}}}`,
+		matches:  []string{"b", "c"},
+	})
+	tests.Add("or condition", tt{
+		selector: `{"age":{"$or":[{"$lt":26},{"$gt":29}]}}`,
+		matches:  []string{"a", "b", "c"},
+	})
+	tests.Add("escaped dot", tt{
+		selector: `{"address\\.city":"Oslo"}`,
+		matches:  []string{},
+	})
+	tests.Add("unknown operator", tt{
+		selector: `{"age":{"$near":1}}`,
+		status:   http.StatusBadRequest,
+		err:      "invalid selector: unknown operator $near",
+	})
+	tests.Add("invalid regex", tt{
+		selector: `{"name":{"$regex":"("}}`,
+		status:   http.StatusBadRequest,
+		err:      "invalid selector: error parsing regexp: missing closing ): `(`",
+	})
+	tests.Add("not an object", tt{
+		selector: `[]`,
+		status:   http.StatusBadRequest,
+		err:      "invalid selector: selector must be an object: []",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		var selector interface{}
+		if err := json.Unmarshal([]byte(tt.selector), &selector); err != nil {
+			t.Fatal(err)
+		}
+		match, err := compileSelector(selector)
+		testy.StatusError(t, tt.err, tt.status, err)
+		matches := []string{}
+		for _, raw := range docs {
+			var doc map[string]interface{}
+			if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+				t.Fatal(err)
+			}
+			if match(doc) {
+				matches = append(matches, doc["_id"].(string))
+			}
+		}
+		if d := testy.DiffInterface(tt.matches, matches); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestCollate(t *testing.T) {
+	ordered := `[null, false, true, -1, 2, "A", "a", "b", [], [1], [1, 2], {}, {"a": 1}, {"b": 0}]`
+	var values []interface{}
+	if err := json.Unmarshal([]byte(ordered), &values); err != nil {
+		t.Fatal(err)
+	}
+	for i, a := range values {
+		for j, b := range values {
+			c := collate(a, b)
+			if (i < j && c >= 0) || (i == j && c != 0) || (i > j && c <= 0) {
+				t.Errorf("Unexpected collation of %v and %v: %d", a, b, c)
+			}
+		}
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	var fields []interface{}
+	_ = json.Unmarshal([]byte(`["a.b", {"c": "desc"}]`), &fields)
+	result, err := parseSort(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sortField{{path: []string{"a", "b"}}, {path: []string{"c"}, descending: true}}
+	if d := testy.DiffInterface(want, result); d != nil {
+		t.Error(d)
+	}
+	_ = json.Unmarshal([]byte(`[{"c": "up"}]`), &fields)
+	_, err = parseSort(fields)
+	testy.StatusError(t, "invalid sort field: map[c:up]", http.StatusBadRequest, err)
+}
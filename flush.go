@@ -0,0 +1,85 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// OptionFullCommit may be passed to a write, with a value of true or false, to
+// override the client's full_commit option for that write.
+const OptionFullCommit = "X-Couch-Full-Commit"
+
+var _ driver.Flusher = &db{}
+
+// Flush syncs all writes not yet synced to stable storage.
+func (d *db) Flush(_ context.Context) error {
+	if d.syncer == nil {
+		return nil
+	}
+	return d.syncer.Sync()
+}
+
+// boolOption returns the boolean value of opts[key], which may be a bool
+// or a string.
+func boolOption(opts map[string]interface{}, key string) (bool, error) {
+	switch t := opts[key].(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return t, nil
+	case string:
+		v, err := strconv.ParseBool(t)
+		if err != nil {
+			return false, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %s", key, t)}
+		}
+		return v, nil
+	default:
+		return false, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %v", key, t)}
+	}
+}
+
+// writeCDB returns the cdb.FS through which a write with the given options is
+// made. A write with batch=ok is never synced immediately, and
+// OptionFullCommit overrides the client's default. Writes to a read-only
+// database fail with 405 Method Not Allowed.
+func (d *db) writeCDB(options driver.Options) (*cdb.FS, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	if d.syncer == nil {
+		return d.cdb, nil
+	}
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	fullCommit := d.fullCommit
+	if _, ok := opts[OptionFullCommit]; ok {
+		var err error
+		if fullCommit, err = boolOption(opts, OptionFullCommit); err != nil {
+			return nil, err
+		}
+	}
+	if batch, _ := opts["batch"].(string); batch == "ok" {
+		fullCommit = false
+	}
+	if fullCommit == d.fullCommit {
+		return d.cdb, nil
+	}
+	return d.cdb.WithFilesystem(d.syncer.Wrap(fullCommit)), nil
+}
@@ -0,0 +1,230 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+)
+
+func TestWriteCDB(t *testing.T) {
+	type tt struct {
+		clientOpts kivik.Option
+		options    kivik.Option
+		status     int
+		err        string
+		// shared is true if the db's default cdb.FS is expected.
+		shared bool
+	}
+	tests := testy.NewTable()
+	tests.Add("default", tt{
+		options: kivik.Params(nil),
+		shared:  true,
+	})
+	tests.Add("full commit", tt{
+		options: kivik.Param(OptionFullCommit, true),
+	})
+	tests.Add("full commit string", tt{
+		options: kivik.Param(OptionFullCommit, "true"),
+	})
+	tests.Add("invalid full commit", tt{
+		options: kivik.Param(OptionFullCommit, "chicken"),
+		status:  http.StatusBadRequest,
+		err:     "invalid value for X-Couch-Full-Commit: chicken",
+	})
+	tests.Add("client full commit", tt{
+		clientOpts: kivik.Param("full_commit", true),
+		options:    kivik.Params(nil),
+		shared:     true,
+	})
+	tests.Add("client full commit, disabled for call", tt{
+		clientOpts: kivik.Param("full_commit", true),
+		options:    kivik.Param(OptionFullCommit, false),
+	})
+	tests.Add("client full commit, batch", tt{
+		clientOpts: kivik.Param("full_commit", true),
+		options:    kivik.Param("batch", "ok"),
+	})
+	tests.Add("full commit and batch", tt{
+		options: kivik.Params(map[string]interface{}{
+			OptionFullCommit: true,
+			"batch":          "ok",
+		}),
+		shared: true,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		clientOpts := tt.clientOpts
+		if clientOpts == nil {
+			clientOpts = kivik.Params(nil)
+		}
+		c, err := (&fsDriver{}).NewClient("testdata", clientOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := c.(*client).newDB("db_foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, err := d.writeCDB(tt.options)
+		testy.StatusError(t, tt.err, tt.status, err)
+		if shared := fs == d.cdb; shared != tt.shared {
+			t.Errorf("Unexpected cdb.FS; shared = %t", shared)
+		}
+	})
+}
+
+func TestNewClientInvalidFullCommit(t *testing.T) {
+	_, err := (&fsDriver{}).NewClient("testdata", kivik.Param("full_commit", 3))
+	testy.StatusError(t, "invalid value for full_commit: 3", http.StatusBadRequest, err)
+}
+
+func TestFlush(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	c, err := (&fsDriver{}).NewClient(tmpdir, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDB(context.Background(), "foo", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.(*client).newDB("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for docID, options := range map[string]kivik.Option{
+		"batch":       kivik.Param("batch", "ok"),
+		"full_commit": kivik.Param(OptionFullCommit, true),
+	} {
+		if _, err := d.Put(context.Background(), docID, map[string]string{"foo": "bar"}, options); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// syncRecordFS records the names of files synced.
+type syncRecordFS struct {
+	filesystem.Filesystem
+	synced map[string]bool
+}
+
+func (fs *syncRecordFS) Create(name string) (filesystem.File, error) {
+	f, err := fs.Filesystem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &syncRecordFile{File: f, synced: fs.synced}, nil
+}
+
+func (fs *syncRecordFS) Open(name string) (filesystem.File, error) {
+	f, err := fs.Filesystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &syncRecordFile{File: f, synced: fs.synced}, nil
+}
+
+type syncRecordFile struct {
+	filesystem.File
+	synced map[string]bool
+}
+
+func (f *syncRecordFile) Sync() error {
+	f.synced[f.Name()] = true
+	return f.File.Sync()
+}
+
+func TestDBFilesystemSynced(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	fs := &syncRecordFS{Filesystem: filesystem.Default(), synced: map[string]bool{}}
+	c, err := NewDriver(fs).NewClient(tmpdir, kivik.Param("full_commit", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDB(context.Background(), "foo", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.(*client).newDB("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(d.path(), "bar.json")
+	f, err := d.fsys().Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.synced[name] {
+		t.Errorf("%s was not synced", name)
+	}
+}
+
+func TestCreateDBSynced(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	fs := &syncRecordFS{Filesystem: filesystem.Default(), synced: map[string]bool{}}
+	c, err := NewDriver(fs).NewClient(tmpdir, kivik.Param("full_commit", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDB(context.Background(), "foo", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	// The new database directory, in the root, and the metadata file, in the
+	// database directory, are only durable once their directories are synced.
+	for _, dir := range []string{tmpdir, filepath.Join(tmpdir, "foo")} {
+		if !fs.synced[dir] {
+			t.Errorf("%s was not synced", dir)
+		}
+	}
+}
+
+// Lock files must bypass the syncing filesystem, to remain lockable.
+func TestLockFileUnsynced(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	c, err := (&fsDriver{}).NewClient(tmpdir, kivik.Param("full_commit", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDB(context.Background(), "foo", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.(*client).newDB("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := d.lock(context.Background(), "db", true, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.f.(fder); !ok {
+		t.Errorf("lock file %T has no file descriptor", l.f)
+	}
+	l.unlock()
+}
@@ -23,8 +23,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/fsdb/v4/cdb/decode"
 	"github.com/go-kivik/fsdb/v4/filesystem"
 	"github.com/go-kivik/kivik/v4"
 	"github.com/go-kivik/kivik/v4/driver"
@@ -38,6 +40,15 @@ type fsDriver struct {
 
 var _ driver.Driver = &fsDriver{}
 
+// NewDriver returns a driver which accesses databases through fs, such as an
+// in-memory filesystem for tests, rather than the local disk. It may be
+// registered under a name of the caller's choosing:
+//
+//	kivik.Register("memfs", fs.NewDriver(filesystem.NewMemFS()))
+func NewDriver(fs filesystem.Filesystem) driver.Driver {
+	return &fsDriver{fs: fs}
+}
+
 // Identifying constants
 const (
 	Version = "0.0.1"
@@ -52,6 +63,37 @@ type client struct {
 	version *driver.Version
 	root    string
 	fs      filesystem.Filesystem
+
+	// syncer tracks writes for durability. When nil, writes are never synced.
+	syncer *filesystem.Syncer
+	// fullCommit causes every write to be synced before it returns.
+	fullCommit bool
+	// format is the extension in which new documents are written, unless
+	// overridden when opening a database. Empty means JSON.
+	format string
+	// jsonIndent is the indent with which JSON documents are pretty-printed.
+	// Empty means they are written on a single line.
+	jsonIndent string
+	// omitRevisions omits the revision history from winning revisions.
+	omitRevisions bool
+	// hashing is the revision hashing mode of new databases, unless overridden
+	// when creating them. Empty means cdb.HashFSDB.
+	hashing string
+	// trash is the directory into which destroyed databases are moved, unless
+	// overridden when destroying them. Empty means they are removed.
+	trash string
+	// warn receives warnings about skipped files in lint mode. When nil,
+	// files are skipped silently.
+	warn func(Warning)
+	// warnings collects the warnings returned by Warnings.
+	warnings *warningLog
+	// lockTimeout is the maximum time to wait for a lock. Zero means the
+	// default.
+	lockTimeout time.Duration
+	// locks holds in-process locks. When nil, only lock files are used.
+	locks *lockRegistry
+
+	replications *replicationRegistry
 }
 
 var _ driver.Client = &client{}
@@ -70,11 +112,47 @@ func parseFileURL(dir string) (string, error) {
 	return parsed.Path, nil
 }
 
-func (d *fsDriver) NewClient(dir string, _ driver.Options) (driver.Client, error) {
+func (d *fsDriver) NewClient(dir string, options driver.Options) (driver.Client, error) {
 	path, err := parseFileURL(dir)
 	if err != nil {
 		return nil, err
 	}
+	opts := map[string]interface{}{}
+	if options != nil {
+		options.Apply(opts)
+	}
+	fullCommit, err := boolOption(opts, "full_commit")
+	if err != nil {
+		return nil, err
+	}
+	lockTimeout, err := durationOption(opts, "lock_timeout")
+	if err != nil {
+		return nil, err
+	}
+	format, err := formatOption(opts)
+	if err != nil {
+		return nil, err
+	}
+	jsonIndent, err := indentOption(opts, "json_indent")
+	if err != nil {
+		return nil, err
+	}
+	omitRevisions, err := boolOption(opts, "omit_revisions")
+	if err != nil {
+		return nil, err
+	}
+	hashing, err := hashingOption(opts)
+	if err != nil {
+		return nil, err
+	}
+	trash, err := stringOption(opts, "trash")
+	if err != nil {
+		return nil, err
+	}
+	warn, warnings, err := lintOption(opts)
+	if err != nil {
+		return nil, err
+	}
 	fs := d.fs
 	if fs == nil {
 		fs = filesystem.Default()
@@ -85,8 +163,20 @@ func (d *fsDriver) NewClient(dir string, _ driver.Options) (driver.Client, error
 			Vendor:      Vendor,
 			RawResponse: json.RawMessage(fmt.Sprintf(`{"version":"%s","vendor":{"name":"%s"}}`, Version, Vendor)),
 		},
-		fs:   fs,
-		root: path,
+		fs:            fs,
+		root:          path,
+		syncer:        filesystem.NewSyncer(fs),
+		fullCommit:    fullCommit,
+		format:        format,
+		jsonIndent:    jsonIndent,
+		omitRevisions: omitRevisions,
+		hashing:       hashing,
+		trash:         trash,
+		warn:          warn,
+		warnings:      warnings,
+		lockTimeout:   lockTimeout,
+		locks:         &lockRegistry{},
+		replications:  &replicationRegistry{},
 	}, nil
 }
 
@@ -99,19 +189,44 @@ func (c *client) Version(_ context.Context) (*driver.Version, error) {
 var validDBNameRE = regexp.MustCompile("^[a-z_][a-z0-9_$()+/-]*$")
 
 // AllDBs returns a list of all DBs present in the configured root dir.
+// Directories which aren't databases, as determined by DBExists, are skipped,
+// as are files, with a warning in lint mode, and the trash directory.
 func (c *client) AllDBs(context.Context, driver.Options) ([]string, error) {
 	if c.root == "" {
 		return nil, statusError{status: http.StatusBadRequest, error: errors.New("no root path provided")}
 	}
-	files, err := os.ReadDir(c.root)
+	files, err := c.fs.ReadDir(c.root)
 	if err != nil {
 		return nil, err
 	}
 	filenames := make([]string, 0, len(files))
 	for _, file := range files {
+		path := filepath.Join(c.root, file.Name())
+		if !file.IsDir() {
+			c.warnf(cdb.WarnStrayFile, path, "not a directory")
+			continue
+		}
+		if path == c.trashPath() {
+			continue
+		}
 		dbname := cdb.UnescapeID(file.Name())
 		if !validDBNameRE.MatchString(dbname) {
-			// FIXME #64: Add option to warn about non-matching files?
+			c.warnf(cdb.WarnInvalidDBName, path, "invalid database name: %s", dbname)
+			continue
+		}
+		fs := cdb.New(path, c.fs)
+		isDB, err := fs.IsDB()
+		if err != nil {
+			return nil, err
+		}
+		if !isDB {
+			if c.warn != nil {
+				unknown, err := fs.Unrecognized()
+				if err != nil {
+					return nil, err
+				}
+				c.warnf(cdb.WarnNotDatabase, path, "no %s, and unrecognized contents: %s", cdb.MetaFileName, strings.Join(unknown, ", "))
+			}
 			continue
 		}
 		filenames = append(filenames, cdb.EscapeID(file.Name()))
@@ -119,8 +234,24 @@ func (c *client) AllDBs(context.Context, driver.Options) ([]string, error) {
 	return filenames, nil
 }
 
-// CreateDB creates a database
+// CreateDB creates a database, and records its settings, along with its
+// creation time and a new UUID, in its metadata file. The format option sets
+// the extension in which new documents are written, the hashing option sets
+// the revision hashing mode, "fsdb" or "couchdb", overriding the client's
+// defaults, and the partitioned option requires document IDs of the form
+// partition:id.
 func (c *client) CreateDB(ctx context.Context, dbName string, options driver.Options) error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	opts := map[string]interface{}{}
+	if options != nil {
+		options.Apply(opts)
+	}
+	meta, err := c.newMeta(opts)
+	if err != nil {
+		return err
+	}
 	exists, err := c.DBExists(ctx, dbName, options)
 	if err != nil {
 		return err
@@ -128,36 +259,223 @@ func (c *client) CreateDB(ctx context.Context, dbName string, options driver.Opt
 	if exists {
 		return statusError{status: http.StatusPreconditionFailed, error: errors.New("database already exists")}
 	}
-	return os.Mkdir(filepath.Join(c.root, cdb.EscapeID(dbName)), dirMode)
+	return c.createDBPath(filepath.Join(c.root, cdb.EscapeID(dbName)), meta)
 }
 
-// DBExistsreturns true if the database exists.
-func (c *client) DBExists(_ context.Context, dbName string, _ driver.Options) (bool, error) {
-	_, err := os.Stat(filepath.Join(c.root, cdb.EscapeID(dbName)))
-	if err == nil {
-		return true, nil
+// newMeta returns the settings for a new database, from the CreateDB options
+// and the client's defaults.
+func (c *client) newMeta(opts map[string]interface{}) (*cdb.Meta, error) {
+	format, err := formatOption(opts)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = c.format
+	}
+	hashing, err := hashingOption(opts)
+	if err != nil {
+		return nil, err
 	}
-	if os.IsNotExist(err) {
-		return false, nil
+	if hashing == "" {
+		hashing = c.hashing
 	}
-	return false, err
+	if hashing == "" {
+		hashing = cdb.HashFSDB
+	}
+	partitioned, err := boolOption(opts, "partitioned")
+	if err != nil {
+		return nil, err
+	}
+	meta, err := cdb.NewMeta()
+	if err != nil {
+		return nil, err
+	}
+	meta.Format = format
+	meta.Hashing = hashing
+	meta.Partitioned = partitioned
+	return meta, nil
 }
 
-// DestroyDB destroys the database
-func (c *client) DestroyDB(ctx context.Context, dbName string, options driver.Options) error {
-	exists, err := c.DBExists(ctx, dbName, options)
+// createDBPath creates the database directory at path, and writes its
+// metadata file.
+func (c *client) createDBPath(path string, meta *cdb.Meta) error {
+	fs := c.syncFS()
+	if err := fs.Mkdir(path, dirMode); err != nil {
+		if os.IsExist(err) {
+			return statusError{status: http.StatusPreconditionFailed, error: fmt.Errorf("%s exists, but is not a database", path)}
+		}
+		return err
+	}
+	return cdb.New(path, fs).WriteMeta(meta)
+}
+
+// DBExists returns true if the database exists. A directory is a database if
+// it has a metadata file or, for databases created by older versions of this
+// driver, if it contains only files and directories the driver recognizes.
+func (c *client) DBExists(_ context.Context, dbName string, _ driver.Options) (bool, error) {
+	return cdb.New(filepath.Join(c.root, cdb.EscapeID(dbName)), c.fs).IsDB()
+}
+
+// DestroyDB destroys the database, removing only the files and directories
+// the driver recognizes. If the database contains anything else, it is left
+// unchanged, and an error listing the unrecognized entries is returned, unless
+// the force option is true. With the trash option, or the client's, set to a
+// directory, relative to the client's root path, the database is moved there
+// instead, so that it can be restored by moving it back.
+func (c *client) DestroyDB(_ context.Context, dbName string, options driver.Options) error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	opts := map[string]interface{}{}
+	if options != nil {
+		options.Apply(opts)
+	}
+	force, err := boolOption(opts, "force")
 	if err != nil {
 		return err
 	}
-	if !exists {
+	trash, err := stringOption(opts, "trash")
+	if err != nil {
+		return err
+	}
+	if trash == "" {
+		trash = c.trashPath()
+	} else if !filepath.IsAbs(trash) {
+		trash = filepath.Join(c.root, trash)
+	}
+	path := filepath.Join(c.root, cdb.EscapeID(dbName))
+	// Rather than DBExists, which would report a directory with unrecognized
+	// contents as missing, check only for a directory, so that the error
+	// lists what was found there.
+	if info, err := c.fs.Stat(path); err != nil || !info.IsDir() {
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
 		return statusError{status: http.StatusNotFound, error: errors.New("database does not exist")}
 	}
-	// FIXME #65: Be safer here about unrecognized files
-	return os.RemoveAll(filepath.Join(c.root, cdb.EscapeID(dbName)))
+	fs := cdb.New(path, c.fs)
+	if trash != "" {
+		_, err := fs.Trash(trash, force)
+		return err
+	}
+	return fs.Destroy(force)
+}
+
+// formatOption returns the value of the format option, which must name a
+// supported file extension, or the empty string if unset.
+func formatOption(opts map[string]interface{}) (string, error) {
+	switch t := opts["format"].(type) {
+	case nil:
+		return "", nil
+	case string:
+		if !decode.CanEncode(t) {
+			return "", statusError{status: http.StatusBadRequest, error: fmt.Errorf("unsupported format: %s", t)}
+		}
+		return t, nil
+	default:
+		return "", statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for format: %v", t)}
+	}
+}
+
+// trashPath returns the path of the client's trash directory, or the empty
+// string if unset.
+func (c *client) trashPath() string {
+	if c.trash == "" || filepath.IsAbs(c.trash) {
+		return c.trash
+	}
+	return filepath.Join(c.root, c.trash)
+}
+
+// stringOption returns the value of the named string option, or the empty
+// string if unset.
+func stringOption(opts map[string]interface{}, key string) (string, error) {
+	switch t := opts[key].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	default:
+		return "", statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %v", key, t)}
+	}
+}
+
+// hashingOption returns the value of the hashing option, which must name a
+// revision hashing mode, or the empty string if unset.
+func hashingOption(opts map[string]interface{}) (string, error) {
+	switch t := opts["hashing"].(type) {
+	case nil:
+		return "", nil
+	case string:
+		if t != cdb.HashFSDB && t != cdb.HashCouchDB {
+			return "", statusError{status: http.StatusBadRequest, error: fmt.Errorf("unsupported hashing mode: %s", t)}
+		}
+		return t, nil
+	default:
+		return "", statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for hashing: %v", t)}
+	}
+}
+
+// indentOption returns the value of the named indent option, which may be
+// given as a number of spaces, or as a string of spaces and tabs.
+func indentOption(opts map[string]interface{}, key string) (string, error) {
+	switch t := opts[key].(type) {
+	case nil:
+		return "", nil
+	case int:
+		if t < 0 {
+			return "", statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %d", key, t)}
+		}
+		return strings.Repeat(" ", t), nil
+	case string:
+		if strings.Trim(t, " \t") != "" {
+			return "", statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %q", key, t)}
+		}
+		return t, nil
+	default:
+		return "", statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %v", key, t)}
+	}
+}
+
+// DB returns the named database. The first time the client opens it, any
+// updates which were interrupted by a crash are recovered. The format option
+// sets the extension, such as "json" or "yaml", in which new documents are
+// written, overriding the database's settings. The remaining settings, such
+// as the revision hashing mode, are read from the database's metadata file.
+func (c *client) DB(dbName string, options driver.Options) (driver.DB, error) {
+	opts := map[string]interface{}{}
+	if options != nil {
+		options.Apply(opts)
+	}
+	format, err := formatOption(opts)
+	if err != nil {
+		return nil, err
+	}
+	path, name, err := c.dbPath(dbName)
+	if err != nil {
+		return nil, err
+	}
+	return c.openDBPath(path, name, format)
 }
 
-func (c *client) DB(dbName string, _ driver.Options) (driver.DB, error) {
-	return c.newDB(dbName)
+// openDBPath opens the database at path, as DB does, with the given format
+// overriding the database's settings if not empty.
+func (c *client) openDBPath(path, name, format string) (*db, error) {
+	d := c.newDBPath(path, name)
+	meta, err := d.cdb.ReadMeta()
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = meta.Format
+	}
+	if format != "" {
+		_ = d.cdb.SetFormat(format) // Already validated
+	}
+	d.applyMeta(meta)
+	if err := d.recoverOnce(context.Background()); err != nil {
+		return nil, err
+	}
+	return d, nil
 }
 
 // dbPath returns the full DB path and the dbname.
@@ -189,11 +507,32 @@ func (c *client) newDB(dbname string) (*db, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &db{
+	return c.newDBPath(path, name), nil
+}
+
+// syncFS returns the filesystem through which the client writes, which syncs
+// writes according to the client's full commit setting.
+func (c *client) syncFS() filesystem.Filesystem {
+	if c.syncer == nil {
+		return c.fs
+	}
+	return c.syncer.Wrap(c.fullCommit)
+}
+
+func (c *client) newDBPath(path, name string) *db {
+	fs := c.syncFS()
+	d := &db{
 		client: c,
 		dbPath: path,
 		dbName: name,
-		fs:     c.fs,
-		cdb:    cdb.New(path, c.fs),
-	}, nil
+		fs:     fs,
+		cdb:    cdb.New(path, fs),
+	}
+	if c.format != "" {
+		_ = d.cdb.SetFormat(c.format) // Validated by NewClient
+	}
+	_ = d.cdb.SetJSONIndent(c.jsonIndent) // Validated by NewClient
+	d.cdb.SetOmitRevisions(c.omitRevisions)
+	d.cdb.SetWarner(c.warn)
+	return d
 }
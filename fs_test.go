@@ -15,11 +15,16 @@ package fs
 import (
 	"context"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"gitlab.com/flimzy/testy"
 
+	"github.com/go-kivik/fsdb/v4/filesystem"
 	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
 )
 
 func TestAllDBs(t *testing.T) {
@@ -42,6 +47,7 @@ func TestAllDBs(t *testing.T) {
 			"compact_split_atts",
 			"db_att",
 			"db_bar",
+			"db_bulkget",
 			"db_foo",
 			"db_nonascii",
 			"db_put",
@@ -146,3 +152,292 @@ func TestClientnewDB(t *testing.T) {
 		}
 	})
 }
+
+func TestClientDBFormat(t *testing.T) {
+	type tt struct {
+		clientOpts kivik.Option
+		dbOpts     kivik.Option
+		want       string
+		status     int
+		err        string
+	}
+	tests := testy.NewTable()
+	tests.Add("default", tt{
+		want: "foo.json",
+	})
+	tests.Add("client yaml", tt{
+		clientOpts: kivik.Param("format", "yaml"),
+		want:       "foo.yaml",
+	})
+	tests.Add("db overrides client", tt{
+		clientOpts: kivik.Param("format", "yaml"),
+		dbOpts:     kivik.Param("format", "json"),
+		want:       "foo.json",
+	})
+	tests.Add("invalid client format", tt{
+		clientOpts: kivik.Param("format", "xml"),
+		status:     http.StatusBadRequest,
+		err:        "unsupported format: xml",
+	})
+	tests.Add("invalid db format", tt{
+		dbOpts: kivik.Param("format", 1),
+		status: http.StatusBadRequest,
+		err:    "invalid value for format: 1",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		tmpdir := tempDir(t)
+		defer rmdir(t, tmpdir)
+		if err := os.Mkdir(filepath.Join(tmpdir, "db"), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		clientOpts, dbOpts := tt.clientOpts, tt.dbOpts
+		if clientOpts == nil {
+			clientOpts = kivik.Params(nil)
+		}
+		if dbOpts == nil {
+			dbOpts = kivik.Params(nil)
+		}
+		c, err := (&fsDriver{}).NewClient(tmpdir, clientOpts)
+		if err == nil {
+			var d driver.DB
+			d, err = c.DB("db", dbOpts)
+			if err == nil {
+				_, err = d.Put(context.Background(), "foo", map[string]string{"foo": "bar"}, kivik.Params(nil))
+			}
+		}
+		testy.StatusError(t, tt.err, tt.status, err)
+		if _, err := os.Stat(filepath.Join(tmpdir, "db", tt.want)); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestClientOutputOptions(t *testing.T) {
+	type tt struct {
+		opts   kivik.Option
+		want   string
+		status int
+		err    string
+	}
+	tests := testy.NewTable()
+	tests.Add("default", tt{
+		opts: kivik.Params(nil),
+		want: `{"_rev":"1-04edfaf9abdaed3c0accf6c463e78fd4","_revisions":{"start":1,"ids":["04edfaf9abdaed3c0accf6c463e78fd4"]},"foo":"bar"}` + "\n",
+	})
+	tests.Add("indent", tt{
+		opts: kivik.Params(map[string]interface{}{
+			"json_indent":    2,
+			"omit_revisions": true,
+		}),
+		want: "{\n  \"_rev\": \"1-04edfaf9abdaed3c0accf6c463e78fd4\",\n  \"foo\": \"bar\"\n}\n",
+	})
+	tests.Add("invalid indent", tt{
+		opts:   kivik.Param("json_indent", "--"),
+		status: http.StatusBadRequest,
+		err:    `invalid value for json_indent: "--"`,
+	})
+	tests.Add("invalid omit_revisions", tt{
+		opts:   kivik.Param("omit_revisions", "maybe"),
+		status: http.StatusBadRequest,
+		err:    "invalid value for omit_revisions: maybe",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		tmpdir := tempDir(t)
+		defer rmdir(t, tmpdir)
+		if err := os.Mkdir(filepath.Join(tmpdir, "db"), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		c, err := (&fsDriver{}).NewClient(tmpdir, tt.opts)
+		if err == nil {
+			var d driver.DB
+			d, err = c.DB("db", kivik.Params(nil))
+			if err == nil {
+				_, err = d.Put(context.Background(), "foo", map[string]string{"foo": "bar"}, kivik.Params(nil))
+			}
+		}
+		testy.StatusError(t, tt.err, tt.status, err)
+		got, err := os.ReadFile(filepath.Join(tmpdir, "db", "foo.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffText(tt.want, string(got)); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+func TestNewDriver(t *testing.T) {
+	t.Parallel()
+	const root = "/fsdb-memfs-test"
+	mem := filesystem.NewMemFS()
+	if err := mem.MkdirAll(root+"/db", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewDriver(mem).NewClient(root, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.DB("db", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rev, err := d.Put(ctx, "foo", map[string]string{"foo": "bar"}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Put(ctx, "foo", map[string]string{"foo": "baz", "_rev": rev}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := d.Get(ctx, "foo", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffAsJSON(map[string]string{"_id": "foo", "_rev": doc.Rev, "foo": "baz"}, doc.Body); d != nil {
+		t.Error(d)
+	}
+	if _, err := mem.Stat(root + "/db/.foo/" + rev + ".json"); err != nil {
+		t.Errorf("Old revision not in memory: %s", err)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("Unexpected access to disk: %v", err)
+	}
+}
+
+func TestNewDriverEndToEnd(t *testing.T) {
+	t.Parallel()
+	const root = "/fsdb-memfs-e2e"
+	mem := filesystem.NewMemFS()
+	if err := mem.MkdirAll(root, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewDriver(mem).NewClient(root, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := c.CreateDB(ctx, "db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := c.DBExists(ctx, "db", kivik.Params(nil)); err != nil || !exists {
+		t.Fatalf("Expected database to exist: %v", err)
+	}
+	dbs, err := c.AllDBs(ctx, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffInterface([]string{"db"}, dbs); d != nil {
+		t.Error(d)
+	}
+	d, err := c.DB("db", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := d.Put(ctx, "foo", map[string]string{"foo": "bar"}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Put(ctx, "foo", map[string]string{"foo": "baz", "_rev": rev}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat(root + "/db/.foo/" + rev + ".json"); !os.IsNotExist(err) {
+		t.Errorf("Expected old revision to be compacted: %v", err)
+	}
+	changes, err := d.Changes(ctx, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for {
+		ch := new(driver.Change)
+		if err := changes.Next(ch); err != nil {
+			break
+		}
+		ids = append(ids, ch.ID)
+	}
+	if d := testy.DiffInterface([]string{"foo"}, ids); d != nil {
+		t.Error(d)
+	}
+	if err := c.DestroyDB(ctx, "db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat(root + "/db"); !os.IsNotExist(err) {
+		t.Errorf("Expected database to be destroyed: %v", err)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("Unexpected access to disk: %v", err)
+	}
+}
+
+func TestNewDriverOverlay(t *testing.T) {
+	t.Parallel()
+	root, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay := filesystem.NewOverlay(filesystem.Default(), filesystem.NewMemFS())
+	c, err := NewDriver(overlay).NewClient(root, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.DB("db_foo", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	before, err := os.ReadFile(filepath.Join(root, "db_foo", "noattach.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Put(ctx, "noattach", map[string]string{"_rev": "1-xxxxxxxxxx", "foo": "baz"}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Put(ctx, "bar", map[string]string{"bar": "baz"}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := overlay.Changes(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		c.Path = strings.TrimPrefix(c.Path, root)
+		got = append(got, c.String())
+	}
+	want := []string{
+		"A /db_foo/.noattach",
+		"A /db_foo/.noattach/1-xxxxxxxxxx.json",
+		"A /db_foo/bar",
+		"A /db_foo/bar.json",
+		"A /db_foo/noattach",
+		"M /db_foo/noattach.json",
+	}
+	if d := testy.DiffInterface(want, got); d != nil {
+		t.Error(d)
+	}
+	doc, err := d.Get(ctx, "noattach", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(doc.Rev, "2-") {
+		t.Errorf("Unexpected rev: %s", doc.Rev)
+	}
+	after, err := os.ReadFile(filepath.Join(root, "db_foo", "noattach.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Errorf("Fixture modified on disk")
+	}
+	if err := overlay.Discard(root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ctx, "bar", kivik.Params(nil)); kivik.HTTPStatus(err) != http.StatusNotFound {
+		t.Errorf("Expected changes to be discarded: %v", err)
+	}
+}
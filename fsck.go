@@ -0,0 +1,95 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// Issue is a problem found by Fsck.
+type Issue = cdb.Issue
+
+// DBFscker is implemented by the databases of this driver.
+type DBFscker interface {
+	// Fsck checks the database for inconsistencies, such as those left behind
+	// by interrupted writes. With the repair option set to true, each issue
+	// is also fixed where possible.
+	Fsck(ctx context.Context, options driver.Options) ([]Issue, error)
+}
+
+// ClientFscker is implemented by the clients of this driver.
+type ClientFscker interface {
+	// Fsck checks every database, returning the issues found in each, by
+	// database name.
+	Fsck(ctx context.Context, options driver.Options) (map[string][]Issue, error)
+}
+
+var (
+	_ DBFscker     = &db{}
+	_ ClientFscker = &client{}
+)
+
+// Fsck checks the database for inconsistencies, such as those left behind by
+// interrupted writes. With the repair option set to true, each issue is also
+// fixed where possible. Document updates are excluded while the check runs.
+func (d *db) Fsck(ctx context.Context, options driver.Options) ([]Issue, error) {
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	repair, err := boolOption(opts, "repair")
+	if err != nil {
+		return nil, err
+	}
+	fs := d.cdb
+	if repair {
+		if fs, err = d.writeCDB(options); err != nil {
+			return nil, err
+		}
+	}
+	unlock, err := d.lockDB(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return fs.Fsck(ctx, repair)
+}
+
+// Fsck checks every database returned by AllDBs, returning the issues found
+// in each, by database name. Databases without issues are omitted.
+func (c *client) Fsck(ctx context.Context, options driver.Options) (map[string][]Issue, error) {
+	dbs, err := c.AllDBs(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]Issue)
+	for _, dbName := range dbs {
+		path, name, err := c.dbPath(dbName)
+		if err != nil {
+			return nil, err
+		}
+		d, err := c.openDBPath(path, name, "")
+		if err != nil {
+			return nil, err
+		}
+		issues, err := d.Fsck(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		if len(issues) > 0 {
+			result[dbName] = issues
+		}
+	}
+	return result, nil
+}
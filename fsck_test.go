@@ -0,0 +1,69 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+)
+
+func TestClientFsck(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	c, err := (&fsDriver{fs: filesystem.Default()}).NewClient(tmpdir, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"clean", "dirty"} {
+		if err := c.CreateDB(ctx, name, kivik.Params(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpFile := filepath.Join(tmpdir, "dirty", ".tmp.foo.json-123")
+	if err := os.WriteFile(tmpFile, []byte(`{}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := c.(*client).Fsck(ctx, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || len(issues["dirty"]) != 1 {
+		t.Fatalf("Unexpected issues: %v", issues)
+	}
+	if issue := issues["dirty"][0]; issue.Kind != cdb.IssueTempFile || issue.Fixed {
+		t.Errorf("Unexpected issue: %s", issue)
+	}
+
+	d, err := c.DB("dirty", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed, err := d.(DBFscker).Fsck(ctx, kivik.Param("repair", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixed) != 1 || !fixed[0].Fixed {
+		t.Errorf("Expected one fixed issue, got: %v", fixed)
+	}
+	if _, err := os.Stat(tmpFile); !os.IsNotExist(err) {
+		t.Errorf("Expected temp file to be removed, got: %v", err)
+	}
+}
@@ -31,12 +31,17 @@ import (
 // - local_seq
 // - meta
 // - open_revs
-func (d *db) Get(_ context.Context, docID string, options driver.Options) (*driver.Document, error) {
+func (d *db) Get(ctx context.Context, docID string, options driver.Options) (*driver.Document, error) {
 	opts := map[string]interface{}{}
 	options.Apply(opts)
 	if docID == "" {
 		return nil, statusError{status: http.StatusBadRequest, error: errors.New("no docid specified")}
 	}
+	unlock, err := d.readLockDoc(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	doc, err := d.cdb.OpenDocID(docID, options)
 	if err != nil {
 		return nil, err
@@ -56,3 +61,23 @@ func (d *db) Get(_ context.Context, docID string, options driver.Options) (*driv
 		Attachments: attsIter,
 	}, nil
 }
+
+var _ driver.RevGetter = &db{}
+
+// GetRev returns the winning rev of the requested document, or if the rev
+// option is given, confirms that it exists. Only revision filenames and the
+// _rev field of the relevant document files are read.
+func (d *db) GetRev(ctx context.Context, docID string, options driver.Options) (string, error) {
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	if docID == "" {
+		return "", statusError{status: http.StatusBadRequest, error: errors.New("no docid specified")}
+	}
+	unlock, err := d.readLockDoc(ctx, docID)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	rev, _ := opts["rev"].(string)
+	return d.cdb.GetRev(docID, rev)
+}
@@ -17,6 +17,7 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"strings"
 	"testing"
 
 	"gitlab.com/flimzy/testy"
@@ -434,3 +435,102 @@ func TestGet(t *testing.T) {
 		}
 	})
 }
+
+func TestGetRev(t *testing.T) {
+	type tt struct {
+		path, dbname string
+		id           string
+		options      kivik.Option
+		want         string
+		status       int
+		err          string
+	}
+	tests := testy.NewTable()
+	tests.Add("no id", tt{
+		dbname: "foo",
+		status: http.StatusBadRequest,
+		err:    "no docid specified",
+	})
+	tests.Add("not found", tt{
+		path:   "testdata",
+		dbname: "db_foo",
+		id:     "notfound",
+		status: http.StatusNotFound,
+		err:    "missing",
+	})
+	tests.Add("winning rev", tt{
+		path:   "testdata",
+		dbname: "db_foo",
+		id:     "withattach",
+		want:   "2-yyyyyyyyy",
+	})
+	tests.Add("yaml", tt{
+		path:   "testdata",
+		dbname: "db_foo",
+		id:     "yamltest",
+		want:   "3-",
+	})
+	tests.Add("int rev", tt{
+		path:   "testdata",
+		dbname: "db_foo",
+		id:     "intrev",
+		want:   "6-",
+	})
+	tests.Add("deleted", tt{
+		path:   "testdata",
+		dbname: "db_foo",
+		id:     "deleted",
+		status: http.StatusNotFound,
+		err:    "deleted",
+	})
+	tests.Add("specific rev", tt{
+		path:    "testdata",
+		dbname:  "db_foo",
+		id:      "withattach",
+		options: kivik.Rev("1-xxxxxxxxxx"),
+		want:    "1-xxxxxxxxxx",
+	})
+	tests.Add("no winner", tt{
+		path:   "testdata",
+		dbname: "get_nowinner",
+		id:     "bar",
+		want:   "2-yyy",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		c := &client{root: tt.path, fs: filesystem.Default()}
+		db, err := c.newDB(tt.dbname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := tt.options
+		if opts == nil {
+			opts = kivik.Params(nil)
+		}
+		rev, err := db.GetRev(context.Background(), tt.id, opts)
+		testy.StatusError(t, tt.err, tt.status, err)
+		if rev != tt.want {
+			t.Errorf("Unexpected rev: %s", rev)
+		}
+	})
+}
+
+func TestGetRevsOnce(t *testing.T) {
+	c := &client{root: "testdata", fs: filesystem.Default()}
+	db, err := c.newDB("db_foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := db.Get(context.Background(), "withrevs", kivik.Param("revs", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer doc.Body.Close() // nolint: errcheck
+	body, err := io.ReadAll(doc.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(body), `"_revisions"`); n != 1 {
+		t.Errorf("Expected _revisions once, found %d times in:\n%s", n, body)
+	}
+}
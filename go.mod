@@ -4,9 +4,11 @@ module github.com/go-kivik/fsdb/v4
 go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/go-kivik/kivik/v4 v4.0.0-20230918092746-102b906e0679
 	github.com/icza/dyno v0.0.0-20230330125955-09f820a8d9c0
 	github.com/otiai10/copy v1.10.0
+	github.com/titanous/json5 v1.0.0
 	gitlab.com/flimzy/testy v0.12.6
 	gopkg.in/yaml.v2 v2.4.0
 )
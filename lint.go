@@ -0,0 +1,100 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+)
+
+// Warning describes a file skipped in lint mode.
+type Warning = cdb.Warning
+
+// ClientLinter is implemented by the clients of this driver.
+type ClientLinter interface {
+	// Warnings returns the warnings collected in lint mode since the last
+	// call, and clears them.
+	Warnings() []Warning
+}
+
+var _ ClientLinter = &client{}
+
+// maxWarnings is the number of warnings kept for Warnings. Any more are
+// dropped, so that a client which never calls Warnings doesn't grow without
+// bound.
+const maxWarnings = 1000
+
+// warningLog collects the warnings reported in lint mode.
+type warningLog struct {
+	mu       sync.Mutex
+	warnings []Warning
+}
+
+func (l *warningLog) add(w Warning) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.warnings) < maxWarnings {
+		l.warnings = append(l.warnings, w)
+	}
+}
+
+// Warnings returns the warnings collected, with the lint option set to true,
+// since the last call, and clears them. At most maxWarnings are kept between
+// calls. Without the lint option, or with it set to a callback, it returns
+// nil.
+func (c *client) Warnings() []Warning {
+	if c.warnings == nil {
+		return nil
+	}
+	c.warnings.mu.Lock()
+	defer c.warnings.mu.Unlock()
+	warnings := c.warnings.warnings
+	c.warnings.warnings = nil
+	return warnings
+}
+
+// lintOption returns the function to which warnings are reported, according
+// to the lint option, which may be true, to collect them for Warnings, or a
+// func(Warning), to which each is passed. The warningLog is nil unless
+// warnings are collected.
+func lintOption(opts map[string]interface{}) (func(Warning), *warningLog, error) {
+	if warn, ok := opts["lint"].(func(Warning)); ok {
+		return warn, nil, nil
+	}
+	lint, err := boolOption(opts, "lint")
+	if err != nil || !lint {
+		return nil, nil, err
+	}
+	log := &warningLog{}
+	return log.add, log, nil
+}
+
+// warnf reports a warning in lint mode.
+func (c *client) warnf(kind cdb.WarningKind, path, format string, args ...interface{}) {
+	report(c.warn, kind, path, format, args...)
+}
+
+// report passes a warning to warn, if not nil.
+func report(warn func(Warning), kind cdb.WarningKind, path, format string, args ...interface{}) {
+	if warn != nil {
+		warn(Warning{Kind: kind, Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// isSpecialDocID returns true if docID names one of the special files of a
+// database, which are expected in a scan, but are not documents.
+func isSpecialDocID(docID string) bool {
+	return docID == "_security" || docID+".json" == cdb.MetaFileName
+}
@@ -0,0 +1,254 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// lintRoot is a root path with one database, containing a variety of files
+// which are skipped, alongside files which aren't databases.
+var lintRoot = map[string]string{
+	"db/_meta.json":         `{}`,
+	"db/_security.json":     `{}`,
+	"db/foo.json":           `{"_rev":"1-a"}`,
+	"db/.foo/1-a.json":      `{"_rev":"1-a"}`,
+	"db/.foo/notarev.json":  `{}`,
+	"db/.foo/notes.txt":     "notes",
+	"db/broken.json":        `{"_rev":`,
+	"db/%zz.json":           `{}`,
+	"db/_other.json":        `{}`,
+	"db/README.md":          "read me",
+	"db/.tmp.bar.json.1234": "",
+	"Photos/a.jpg":          "jpeg",
+	"notes/README.md":       "read me",
+	"notes.txt":             "notes",
+}
+
+func writeLintRoot(t *testing.T) string {
+	t.Helper()
+	tmpdir := tempDir(t)
+	for name, content := range lintRoot {
+		path := filepath.Join(tmpdir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tmpdir
+}
+
+// warningStrings returns the warnings as strings, relative to root, in sorted
+// order.
+func warningStrings(root string, warnings []Warning) []string {
+	result := make([]string, 0, len(warnings))
+	for _, w := range warnings {
+		w.Path = filepath.ToSlash(strings.TrimPrefix(w.Path, root+string(filepath.Separator)))
+		result = append(result, w.String())
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestLint(t *testing.T) {
+	tmpdir := writeLintRoot(t)
+	defer rmdir(t, tmpdir)
+	ctx := context.Background()
+	c, err := (&fsDriver{}).NewClient(tmpdir, kivik.Param("lint", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	linter := c.(ClientLinter)
+
+	dbs, err := c.AllDBs(ctx, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffInterface([]string{"db"}, dbs); d != nil {
+		t.Error(d)
+	}
+	want := []string{
+		"invalid_db_name: Photos: invalid database name: Photos",
+		"not_a_database: notes: no _meta.json, and unrecognized contents: README.md",
+		"stray_file: notes.txt: not a directory",
+	}
+	if d := testy.DiffInterface(want, warningStrings(tmpdir, linter.Warnings())); d != nil {
+		t.Errorf("AllDBs: %s", d)
+	}
+	if got := linter.Warnings(); got != nil {
+		t.Errorf("Warnings not cleared: %v", got)
+	}
+
+	d, err := c.DB("db", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := d.Changes(ctx, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	ch := &driver.Change{}
+	for {
+		if err := changes.Next(ch); err != nil {
+			if err == io.EOF {
+				break
+			}
+			t.Fatal(err)
+		}
+		ids = append(ids, ch.ID)
+	}
+	if d := testy.DiffInterface([]string{"foo"}, ids); d != nil {
+		t.Error(d)
+	}
+	want = []string{
+		`bad_filename: db/%zz.json: invalid URL escape "%zz"`,
+		"stray_file: db/README.md: not in a registered format",
+		"stray_file: db/_other.json: invalid document ID: _other",
+		"undecodable: db/broken.json: unexpected EOF",
+	}
+	if d := testy.DiffInterface(want, warningStrings(tmpdir, linter.Warnings())); d != nil {
+		t.Errorf("Changes: %s", d)
+	}
+
+	if err := d.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"stray_file: db/.foo/notarev.json: name is not a revision ID",
+		"stray_file: db/.foo/notes.txt: not in a registered format",
+		"stray_file: db/README.md: not in a registered format",
+		"stray_file: db/_other.json: invalid document ID: _other",
+		"undecodable: db/broken.json: unexpected EOF",
+	}
+	if d := testy.DiffInterface(want, warningStrings(tmpdir, linter.Warnings())); d != nil {
+		t.Errorf("Compact: %s", d)
+	}
+}
+
+func TestLintCompactDesignDoc(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	files := map[string]string{
+		"db/_meta.json":              `{}`,
+		"db/_design%2Ffoo.json":      `{"_rev":"2-b","_revisions":{"start":2,"ids":["b","a"]}}`,
+		"db/._design%2Ffoo/1-a.json": `{"_rev":"1-a"}`,
+		"db/_local%2Fbar.json":       `{"_rev":"1-a"}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(tmpdir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := (&fsDriver{}).NewClient(tmpdir, kivik.Param("lint", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.DB("db", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.(ClientLinter).Warnings(); got != nil {
+		t.Errorf("Unexpected warnings: %v", warningStrings(tmpdir, got))
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, "db", "._design%2Ffoo", "1-a.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected the design doc's old revision to be compacted, got: %v", err)
+	}
+}
+
+func TestWarningLogLimit(t *testing.T) {
+	log := &warningLog{}
+	for i := 0; i < maxWarnings+10; i++ {
+		log.add(Warning{Kind: cdb.WarnStrayFile, Path: "foo"})
+	}
+	c := &client{warnings: log}
+	if got := len(c.Warnings()); got != maxWarnings {
+		t.Errorf("Expected %d warnings, got %d", maxWarnings, got)
+	}
+	if got := c.Warnings(); got != nil {
+		t.Errorf("Warnings not cleared: %v", got)
+	}
+}
+
+func TestLintCallback(t *testing.T) {
+	tmpdir := writeLintRoot(t)
+	defer rmdir(t, tmpdir)
+	var warnings []Warning
+	c, err := (&fsDriver{}).NewClient(tmpdir, kivik.Param("lint", func(w Warning) {
+		warnings = append(warnings, w)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AllDBs(context.Background(), kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 3 {
+		t.Errorf("Unexpected warnings: %v", warnings)
+	}
+	if got := c.(ClientLinter).Warnings(); got != nil {
+		t.Errorf("Unexpected collected warnings: %v", got)
+	}
+}
+
+func TestLintDisabled(t *testing.T) {
+	tmpdir := writeLintRoot(t)
+	defer rmdir(t, tmpdir)
+	c, err := (&fsDriver{}).NewClient(tmpdir, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.DB("db", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := d.Changes(context.Background(), kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without lint mode, an undecodable document ends the feed.
+	ch := &driver.Change{}
+	for err == nil {
+		err = changes.Next(ch)
+	}
+	if err == io.EOF {
+		t.Error("expected a decoding error")
+	}
+}
+
+func TestLintOption(t *testing.T) {
+	_, err := (&fsDriver{}).NewClient("", kivik.Param("lint", "maybe"))
+	testy.StatusError(t, "invalid value for lint: maybe", http.StatusBadRequest, err)
+}
@@ -0,0 +1,518 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/fsdb/v4/filesystem"
+)
+
+const (
+	// lockDirName is the directory, within a database, which holds lock
+	// files while they are in use. As document IDs may not begin with an
+	// underscore, it cannot collide with a document's revisions directory.
+	lockDirName = cdb.LockDirName
+	// dbLockName is the lock file name for the database-level lock.
+	dbLockName = "_db"
+
+	defaultLockTimeout = 10 * time.Second
+	lockRetryInterval  = 10 * time.Millisecond
+)
+
+var errLockTimeout = errors.New("lock timeout")
+
+// lockRegistry holds the in-process locks of a client, keyed by lock file
+// path, so that goroutines sharing the client exclude each other even where
+// lock files can't be locked, as on filesystems without file descriptors.
+type lockRegistry struct {
+	mu    sync.Mutex
+	locks map[string]*rwLock
+	// recovered holds the paths of databases whose journals have been
+	// recovered, so that this is done only once.
+	recovered map[string]bool
+}
+
+// isRecovered reports whether the database at path has been recovered.
+func (r *lockRegistry) isRecovered(path string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.recovered[path]
+}
+
+// setRecovered records that the database at path has been recovered.
+func (r *lockRegistry) setRecovered(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.recovered == nil {
+		r.recovered = make(map[string]bool)
+	}
+	r.recovered[path] = true
+}
+
+// rwLock is a reader/writer lock which can be abandoned by a waiter.
+type rwLock struct {
+	// refs counts holders and waiters, and is guarded by lockRegistry.mu.
+	refs int
+
+	mu      sync.Mutex
+	readers int
+	writer  bool
+	// waiting counts waiting writers, which take precedence over new readers
+	// so that a steady stream of readers can't starve them.
+	waiting int
+	// changed is closed, and replaced, when the lock state changes.
+	changed chan struct{}
+}
+
+// lock acquires the lock for key, waiting until deadline. The returned
+// function releases it.
+func (r *lockRegistry) lock(ctx context.Context, key string, exclusive bool, deadline time.Time) (func(), error) {
+	r.mu.Lock()
+	l, ok := r.locks[key]
+	if !ok {
+		if r.locks == nil {
+			r.locks = make(map[string]*rwLock)
+		}
+		l = &rwLock{changed: make(chan struct{})}
+		r.locks[key] = l
+	}
+	l.refs++
+	r.mu.Unlock()
+
+	done := func() {
+		r.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(r.locks, key)
+		}
+		r.mu.Unlock()
+	}
+	if err := l.lock(ctx, exclusive, deadline); err != nil {
+		done()
+		return nil, err
+	}
+	return func() {
+		l.unlock(exclusive)
+		done()
+	}, nil
+}
+
+func (l *rwLock) lock(ctx context.Context, exclusive bool, deadline time.Time) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	waiting := false
+	defer func() {
+		if waiting {
+			l.mu.Lock()
+			l.waiting--
+			l.notify()
+			l.mu.Unlock()
+		}
+	}()
+	for {
+		l.mu.Lock()
+		switch {
+		case exclusive && !l.writer && l.readers == 0:
+			l.writer = true
+			l.mu.Unlock()
+			return nil
+		case !exclusive && !l.writer && l.waiting == 0:
+			l.readers++
+			l.mu.Unlock()
+			return nil
+		case exclusive && !waiting:
+			waiting = true
+			l.waiting++
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return errLockTimeout
+		}
+	}
+}
+
+// notify wakes all waiters. l.mu must be held.
+func (l *rwLock) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *rwLock) unlock(exclusive bool) {
+	l.mu.Lock()
+	if exclusive {
+		l.writer = false
+	} else {
+		l.readers--
+	}
+	l.notify()
+	l.mu.Unlock()
+}
+
+// fileLock is an advisory lock held on a lock file.
+type fileLock struct {
+	fs        filesystem.Filesystem
+	f         filesystem.File
+	path      string
+	exclusive bool
+	// release releases the in-process lock.
+	release func()
+}
+
+// fder is implemented by files backed by an OS file descriptor, such as
+// *os.File. Files which do not implement it cannot be locked against other
+// processes.
+type fder interface {
+	Fd() uintptr
+}
+
+// durationOption returns the value of opts[key] as a time.Duration, which may
+// be given as a time.Duration or as a string understood by time.ParseDuration.
+func durationOption(opts map[string]interface{}, key string) (time.Duration, error) {
+	switch t := opts[key].(type) {
+	case nil:
+		return 0, nil
+	case time.Duration:
+		return t, nil
+	case string:
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return 0, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %s", key, t)}
+		}
+		return d, nil
+	default:
+		return 0, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for %s: %v", key, t)}
+	}
+}
+
+// lockTimeout returns the lock timeout to use with the given options.
+func (d *db) lockTimeout(opts map[string]interface{}) (time.Duration, error) {
+	timeout, err := durationOption(opts, "lock_timeout")
+	if err != nil || timeout > 0 {
+		return timeout, err
+	}
+	if d.client.lockTimeout > 0 {
+		return d.client.lockTimeout, nil
+	}
+	return defaultLockTimeout, nil
+}
+
+// lockDoc acquires the locks needed to update docID: a shared lock on the
+// database, so that compaction can't run concurrently, and an exclusive lock
+// on the document. The returned function releases both locks. An interrupted
+// update of docID is recovered once the locks are held.
+func (d *db) lockDoc(ctx context.Context, docID string, opts map[string]interface{}) (func(), error) {
+	timeout, err := d.lockTimeout(opts)
+	if err != nil {
+		return nil, err
+	}
+	dbLock, err := d.lock(ctx, dbLockName, false, timeout)
+	if err != nil {
+		return nil, err
+	}
+	docLock, err := d.lock(ctx, cdb.EscapeID(docID), true, timeout)
+	if err != nil {
+		dbLock.unlock()
+		return nil, err
+	}
+	unlock := func() {
+		docLock.unlock()
+		dbLock.unlock()
+	}
+	// Complete any update interrupted by a crash, before this one begins.
+	if err := d.cdb.Recover(docID); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// recover completes any updates interrupted by a crash, as recorded in the
+// database's journal, taking the same locks as a document update.
+func (d *db) recover(ctx context.Context) error {
+	docIDs, err := d.cdb.PendingJournals()
+	if err != nil {
+		return err
+	}
+	for _, docID := range docIDs {
+		unlock, err := d.lockDoc(ctx, docID, nil)
+		if err != nil {
+			return err
+		}
+		unlock()
+	}
+	return nil
+}
+
+// recoverOnce runs recover the first time the database is opened by the
+// client. Updates interrupted later, by other processes, are completed as
+// their documents are next updated, or the database compacted.
+func (d *db) recoverOnce(ctx context.Context) error {
+	if d.locks == nil {
+		return d.recover(ctx)
+	}
+	if d.locks.isRecovered(d.dbPath) {
+		return nil
+	}
+	if err := d.recover(ctx); err != nil {
+		return err
+	}
+	d.locks.setRecovered(d.dbPath)
+	return nil
+}
+
+// readLockDoc acquires shared in-process locks on the database and on docID,
+// so that reads within this process never observe a partially persisted
+// update. Other processes are not excluded, as reads take no lock files.
+func (d *db) readLockDoc(ctx context.Context, docID string) (func(), error) {
+	if d.locks == nil {
+		return func() {}, nil
+	}
+	timeout, err := d.lockTimeout(nil)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	releaseDB, err := d.locks.lock(ctx, d.lockPath(dbLockName), false, deadline)
+	if err != nil {
+		return nil, inProcessLockError(err, dbLockName)
+	}
+	releaseDoc, err := d.locks.lock(ctx, d.lockPath(cdb.EscapeID(docID)), false, deadline)
+	if err != nil {
+		releaseDB()
+		return nil, inProcessLockError(err, cdb.EscapeID(docID))
+	}
+	return func() {
+		releaseDoc()
+		releaseDB()
+	}, nil
+}
+
+// lockDB acquires an exclusive lock on the database, excluding all document
+// updates until the returned function is called.
+func (d *db) lockDB(ctx context.Context, opts map[string]interface{}) (func(), error) {
+	timeout, err := d.lockTimeout(opts)
+	if err != nil {
+		return nil, err
+	}
+	l, err := d.lock(ctx, dbLockName, true, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return l.unlock, nil
+}
+
+func (d *db) lockPath(name string) string {
+	return filepath.Join(d.dbPath, lockDirName, name+".lock")
+}
+
+func lockTimeoutError(name string) error {
+	return statusError{status: http.StatusServiceUnavailable, error: fmt.Errorf("timed out waiting for lock on %s", name)}
+}
+
+// inProcessLockError converts an error returned by lockRegistry.lock for the
+// named lock.
+func inProcessLockError(err error, name string) error {
+	if err == errLockTimeout {
+		return lockTimeoutError(name)
+	}
+	return err
+}
+
+// lockFS returns the filesystem holding lock files. Lock files are opened
+// without the syncing wrapper, which would hide the file descriptor needed to
+// flock them, and need no durability anyway.
+func (d *db) lockFS() filesystem.Filesystem {
+	if d.client.fs == nil {
+		return filesystem.Default()
+	}
+	return d.client.fs
+}
+
+// lock acquires a lock on the named lock file, waiting up to timeout for it
+// to become available. A timeout is reported as 503 Service Unavailable. The
+// in-process lock is acquired first, so that goroutines sharing a client
+// queue for the lock rather than polling the lock file.
+func (d *db) lock(ctx context.Context, name string, exclusive bool, timeout time.Duration) (*fileLock, error) {
+	fs := d.lockFS()
+	path := d.lockPath(name)
+	deadline := time.Now().Add(timeout)
+	release := func() {}
+	if d.locks != nil {
+		var err error
+		release, err = d.locks.lock(ctx, path, exclusive, deadline)
+		if err != nil {
+			return nil, inProcessLockError(err, name)
+		}
+	}
+	if filesystem.IsReadOnly(fs) {
+		// A read-only database can't be modified by any process, so no lock
+		// file is needed, or could be created.
+		return &fileLock{release: release}, nil
+	}
+	for {
+		l, err := tryLockFile(fs, path, exclusive)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if l != nil {
+			l.release = release
+			return l, nil
+		}
+		if time.Now().After(deadline) {
+			release()
+			return nil, lockTimeoutError(name)
+		}
+		select {
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// tryLockFile attempts to lock the file at path without blocking. It returns
+// a nil lock if the lock is held elsewhere.
+func tryLockFile(fs filesystem.Filesystem, path string, exclusive bool) (*fileLock, error) {
+	if err := fs.MkdirAll(filepath.Dir(path), dirMode); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	l, err := openLockFile(fs, path, exclusive)
+	if os.IsNotExist(err) {
+		// The lock directory was removed by another process as it was
+		// released. Try again.
+		return nil, nil
+	}
+	return l, err
+}
+
+// openLockFile attempts to lock the file at path, in an existing directory,
+// without blocking. It returns a nil lock if the lock is held elsewhere.
+func openLockFile(fs filesystem.Filesystem, path string, exclusive bool) (*fileLock, error) {
+	f, err := fs.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &fileLock{fs: fs, f: f, path: path, exclusive: exclusive, release: func() {}}
+	fd, ok := f.(fder)
+	if !ok {
+		return l, nil
+	}
+	locked, err := tryLock(fd.Fd(), exclusive)
+	if err != nil || !locked {
+		_ = f.Close()
+		return nil, err
+	}
+	// The lock file may have been removed, by the previous holder, between
+	// opening and locking it; in that case, the lock is worthless.
+	fi, err := f.Stat()
+	if err != nil {
+		_ = unlock(fd.Fd())
+		_ = f.Close()
+		return nil, err
+	}
+	if pi, err := fs.Stat(path); err != nil || !os.SameFile(fi, pi) {
+		_ = unlock(fd.Fd())
+		_ = f.Close()
+		return nil, nil
+	}
+	return l, nil
+}
+
+// unlock releases the lock. The lock file, and the lock directory, are
+// removed by the last holder of the lock, so that no trace of locking is left
+// in the database. To find out whether it is the last holder, a process
+// releases its lock, then, holding the lock's guard, tries to lock the lock
+// file exclusively; converting a shared lock to an exclusive one is not
+// atomic, and would let two holders each see the other's lock.
+func (l *fileLock) unlock() {
+	defer l.release()
+	if l.f == nil {
+		return
+	}
+	fd, ok := l.f.(fder)
+	if !ok {
+		_ = l.f.Close()
+		_ = l.fs.Remove(l.path)
+		_ = l.fs.Remove(filepath.Dir(l.path))
+		return
+	}
+	_ = unlock(fd.Fd())
+	defer l.f.Close() // nolint: errcheck
+	guard, err := lockGuard(l.fs, l.path)
+	if err != nil {
+		// Either the lock directory has already been removed, or the lock
+		// file is left behind, to be removed by a later holder.
+		return
+	}
+	if l.isLast(fd) {
+		_ = l.fs.Remove(l.path)
+	}
+	_ = unlock(fd.Fd())
+	guard.remove()
+	_ = l.fs.Remove(filepath.Dir(l.path))
+}
+
+// isLast locks the lock file exclusively, and reports whether that succeeded,
+// meaning that no other process holds the lock, and that the lock file is
+// still in place.
+func (l *fileLock) isLast(fd fder) bool {
+	if locked, err := tryLock(fd.Fd(), true); err != nil || !locked {
+		return false
+	}
+	fi, err := l.f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := l.fs.Stat(l.path)
+	return err == nil && os.SameFile(fi, pi)
+}
+
+// lockGuard acquires the guard of the lock file at path, which is held while
+// deciding whether to remove the lock file. As the guard is held only
+// briefly, it is waited for without a timeout. The lock directory is not
+// recreated if it has been removed, along with the lock file.
+func lockGuard(fs filesystem.Filesystem, path string) (*fileLock, error) {
+	for {
+		guard, err := openLockFile(fs, path+".guard", true)
+		if err != nil || guard != nil {
+			return guard, err
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// remove removes the lock file, then releases the lock. It is used for
+// guards, which are only ever held exclusively.
+func (l *fileLock) remove() {
+	_ = l.fs.Remove(l.path)
+	if fd, ok := l.f.(fder); ok {
+		_ = unlock(fd.Fd())
+	}
+	_ = l.f.Close()
+}
@@ -0,0 +1,212 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/kivik/v4"
+)
+
+func TestPutLocked(t *testing.T) {
+	type tt struct {
+		name      string
+		exclusive bool
+		status    int
+		err       string
+	}
+	tests := testy.NewTable()
+	tests.Add("document locked", tt{
+		name:      "foo",
+		exclusive: true,
+		status:    http.StatusServiceUnavailable,
+		err:       "timed out waiting for lock on foo",
+	})
+	tests.Add("database locked", tt{
+		name:      dbLockName,
+		exclusive: true,
+		status:    http.StatusServiceUnavailable,
+		err:       "timed out waiting for lock on _db",
+	})
+	tests.Add("database shared", tt{
+		name: dbLockName,
+	})
+	tests.Add("other document locked", tt{
+		name:      "bar",
+		exclusive: true,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		tmpdir := tempDir(t)
+		defer rmdir(t, tmpdir)
+		d := newTestDB(t, tmpdir, "db")
+		l, err := d.lock(context.Background(), tt.name, tt.exclusive, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.unlock()
+		_, err = newTestDB(t, tmpdir, "db").Put(context.Background(), "foo", map[string]string{"foo": "bar"}, kivik.Param("lock_timeout", "20ms"))
+		testy.StatusError(t, tt.err, tt.status, err)
+	})
+}
+
+func TestLockCleanup(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	d := newTestDB(t, tmpdir, "db")
+	if _, err := d.Put(context.Background(), "foo", map[string]string{"foo": "bar"}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(d.dbPath, lockDirName)); !os.IsNotExist(err) {
+		t.Errorf("Expected lock directory to be removed, got: %v", err)
+	}
+}
+
+func TestSharedLockCleanup(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	ctx := context.Background()
+	// Each lock is taken through its own client, as by separate processes.
+	d1, d2 := newTestDB(t, tmpdir, "db"), newTestDB(t, tmpdir, "db")
+	l1, err := d1.lock(ctx, dbLockName, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := d2.lock(ctx, dbLockName, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l1.unlock()
+	if _, err := os.Stat(d2.lockPath(dbLockName)); err != nil {
+		t.Errorf("Expected lock file to remain while shared, got: %v", err)
+	}
+	l2.unlock()
+	if _, err := os.Stat(filepath.Join(d1.dbPath, lockDirName)); !os.IsNotExist(err) {
+		t.Errorf("Expected lock directory to be removed, got: %v", err)
+	}
+}
+
+func TestRecoverOnOpen(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	d := newTestDB(t, tmpdir, "db")
+	rev, err := d.Put(context.Background(), "foo", map[string]string{"foo": "bar"}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash before the new winner was moved into place.
+	revPath := filepath.Join(d.dbPath, ".foo", rev+".json")
+	if err := os.Mkdir(filepath.Dir(revPath), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(d.dbPath, "foo.json"), revPath); err != nil {
+		t.Fatal(err)
+	}
+	journal := filepath.Join(d.dbPath, cdb.JournalDirName, "foo.json")
+	if err := os.Mkdir(filepath.Dir(journal), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"id":"foo","ops":[{"op":"rename","from":".foo/` + rev + `.json","to":"foo.json"}]}`
+	if err := os.WriteFile(journal, []byte(body), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.client.DB("db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(d.dbPath, cdb.JournalDirName)); !os.IsNotExist(err) {
+		t.Errorf("Expected journal directory to be removed, got: %v", err)
+	}
+	if doc := getDoc(t, d, "foo", nil); doc["_rev"] != rev {
+		t.Errorf("Unexpected rev after recovery: %v", doc["_rev"])
+	}
+}
+
+func TestRecoverOnce(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	c, err := (&fsDriver{}).NewClient(tmpdir, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDB(context.Background(), "db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DB("db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	// A journal for a missing document, which recovery simply discards.
+	journal := filepath.Join(tmpdir, "db", cdb.JournalDirName, "foo.json")
+	if err := os.Mkdir(filepath.Dir(journal), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(journal, []byte(`{"id":"foo","ops":[]}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.DB("db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journal); err != nil {
+		t.Errorf("Expected journal to be left for the next update, got: %v", err)
+	}
+	c2, err := (&fsDriver{}).NewClient(tmpdir, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.DB("db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Errorf("Expected journal to be recovered by a new client, got: %v", err)
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	rev, err := newTestDB(t, tmpdir, "db").Put(context.Background(), "foo", map[string]string{"foo": "bar"}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers = 10
+	statuses := make(chan int, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		// Each writer has its own client, as would separate processes.
+		go func(i int) {
+			defer wg.Done()
+			_, err := newTestDB(t, tmpdir, "db").Put(context.Background(), "foo", map[string]interface{}{"_rev": rev, "writer": i}, kivik.Params(nil))
+			statuses <- kivik.HTTPStatus(err)
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	want := map[int]int{0: 1, http.StatusConflict: writers - 1}
+	if d := testy.DiffInterface(want, counts); d != nil {
+		t.Error(d)
+	}
+}
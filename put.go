@@ -21,7 +21,6 @@ import (
 	"strings"
 
 	"github.com/go-kivik/fsdb/v4/cdb"
-	"github.com/go-kivik/fsdb/v4/cdb/decode"
 	"github.com/go-kivik/kivik/v4"
 	"github.com/go-kivik/kivik/v4/driver"
 )
@@ -30,27 +29,28 @@ func filename2id(filename string) (string, error) {
 	return url.PathUnescape(filename)
 }
 
-type metaDoc struct {
-	Rev     cdb.RevID `json:"_rev" yaml:"_rev"`
-	Deleted bool      `json:"_deleted" yaml:"_deleted"`
-}
-
 func (d *db) metadata(docID, ext string) (rev string, deleted bool, err error) {
-	f, err := os.Open(d.path(docID))
+	f, err := d.fsys().Open(d.path(docID))
 	if err != nil {
 		if os.IsNotExist(err) {
 			err = nil
 		}
 		return "", false, err
 	}
-	md := new(metaDoc)
-	err = decode.Decode(f, ext, md)
-	return md.Rev.String(), md.Deleted, err
+	defer f.Close() // nolint: errcheck
+	md, err := cdb.ReadMetaDoc(f, ext)
+	if err != nil {
+		return "", false, err
+	}
+	return md.Rev.String(), md.Deleted, nil
 }
 
 var reservedPrefixes = []string{"_local/", "_design/"}
 
 func validateID(id string) error {
+	if id == "" {
+		return statusError{status: http.StatusBadRequest, error: errors.New("document id must not be empty")}
+	}
 	if id[0] != '_' {
 		return nil
 	}
@@ -62,30 +62,59 @@ func validateID(id string) error {
 	return statusError{status: http.StatusBadRequest, error: errors.New("only reserved document ids may start with underscore")}
 }
 
+// validatePartition returns an error if id has no partition, other than for
+// design and local documents.
+func validatePartition(id string) error {
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return nil
+		}
+	}
+	if i := strings.Index(id, ":"); i > 0 && i < len(id)-1 {
+		return nil
+	}
+	return statusError{status: http.StatusBadRequest, error: errors.New("doc id must be of form partition:id")}
+}
+
 /*
 TODO:
 URL query params:
-batch
 new_edits
 
 output_format?
-
-X-Couch-Full-Commit header/option
 */
 
 func (d *db) Put(ctx context.Context, docID string, i interface{}, options driver.Options) (string, error) {
 	if err := validateID(docID); err != nil {
 		return "", err
 	}
-	rev, err := d.cdb.NewRevision(i)
+	if d.partitioned {
+		if err := validatePartition(docID); err != nil {
+			return "", err
+		}
+	}
+	fs, err := d.writeCDB(options)
+	if err != nil {
+		return "", err
+	}
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	unlock, err := d.lockDoc(ctx, docID, opts)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	rev, err := fs.NewRevision(i)
 	if err != nil {
 		return "", err
 	}
-	doc, err := d.cdb.OpenDocID(docID, options)
+	// All revisions are opened, even if the rev option names one, so that the
+	// new revision is checked against, and persisted with, every leaf.
+	doc, err := fs.OpenDocID(docID, kivik.Params(nil))
 	switch {
 	case kivik.HTTPStatus(err) == http.StatusNotFound:
 		// Crate new doc
-		doc = d.cdb.NewDocument(docID)
+		doc = fs.NewDocument(docID)
 	case err != nil:
 		return "", err
 	}
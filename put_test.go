@@ -14,6 +14,7 @@ package fs
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -45,6 +46,13 @@ func TestPut(t *testing.T) {
 		status: http.StatusBadRequest,
 		err:    "only reserved document ids may start with underscore",
 	})
+	tests.Add("empty docID", tt{
+		path:   "doesntmatter",
+		dbname: "doesntmatter",
+		id:     "",
+		status: http.StatusBadRequest,
+		err:    "document id must not be empty",
+	})
 	tests.Add("invalid document", tt{
 		path:   "doesntmatter",
 		dbname: "doesntmatter",
@@ -285,3 +293,124 @@ func TestPut(t *testing.T) {
 		}
 	})
 }
+
+func TestPutAttachmentStubs(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	if err := os.Mkdir(filepath.Join(tmpdir, "foo"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	c := &client{root: tmpdir}
+	db, err := c.newDB("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rev1, err := db.Put(ctx, "foo", map[string]interface{}{
+		"_attachments": map[string]interface{}{
+			"foo.txt": map[string]interface{}{
+				"content_type": "text/plain",
+				"data":         []byte("Testing"),
+			},
+		},
+	}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev2, err := db.Put(ctx, "foo", map[string]interface{}{
+		"_rev": rev1,
+		"foo":  "bar",
+		"_attachments": map[string]interface{}{
+			"foo.txt": map[string]interface{}{"stub": true},
+		},
+	}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both the new winner, and the revision it replaced, must still find the
+	// attachment.
+	for _, rev := range []string{"", rev1, rev2} {
+		doc, err := db.Get(ctx, "foo", kivik.Params(map[string]interface{}{
+			"rev":           rev,
+			"attachments":   true,
+			"header:accept": "application/json",
+		}))
+		if err != nil {
+			t.Fatalf("rev %q: %s", rev, err)
+		}
+		var body struct {
+			Attachments map[string]struct {
+				Data []byte `json:"data"`
+			} `json:"_attachments"`
+		}
+		if err := json.NewDecoder(doc.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(body.Attachments["foo.txt"].Data); got != "Testing" {
+			t.Errorf("rev %q: Unexpected attachment content: %q", rev, got)
+		}
+	}
+	_, err = db.Put(ctx, "foo", map[string]interface{}{
+		"_rev": rev2,
+		"_attachments": map[string]interface{}{
+			"bar.txt": map[string]interface{}{"stub": true},
+		},
+	}, kivik.Params(nil))
+	testy.StatusError(t, "invalid attachment stub for bar.txt", http.StatusPreconditionFailed, err)
+}
+
+func TestPutRevOption(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	if err := os.Mkdir(filepath.Join(tmpdir, "foo"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	c := &client{root: tmpdir}
+	db, err := c.newDB("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rev1, err := db.Put(ctx, "foo", map[string]string{"foo": "bar"}, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A conflicting winner, which the rev option doesn't name.
+	const winner = "1-ffffffffffffffffffffffffffffffff"
+	if _, err := db.Put(ctx, "foo", map[string]string{"_rev": winner}, kivik.Param("new_edits", false)); err != nil {
+		t.Fatal(err)
+	}
+	rev2, err := db.Put(ctx, "foo", map[string]string{"_rev": rev1}, kivik.Param("rev", rev1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := db.cdb.OpenDocID("foo", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leaves []string
+	for _, rev := range doc.Leaves() {
+		leaves = append(leaves, rev.Rev.String())
+	}
+	if d := testy.DiffInterface([]string{rev2, winner}, leaves); d != nil {
+		t.Error(d)
+	}
+}
+
+func TestPutTOMLNull(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	c, err := (&fsDriver{}).NewClient(tmpdir, kivik.Param("format", "toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDB(context.Background(), "db", kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.DB("db", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Put(context.Background(), "foo", map[string]interface{}{"foo": nil}, kivik.Params(nil))
+	testy.StatusError(t, "toml: cannot encode null value of .foo", http.StatusBadRequest, err)
+}
@@ -0,0 +1,46 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"errors"
+	iofs "io/fs"
+	"net/http"
+
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+var errReadOnly = statusError{status: http.StatusMethodNotAllowed, error: errors.New("database is read-only")}
+
+// NewReadOnlyDriver returns a driver which serves the databases in fsys, such
+// as an embed.FS holding test fixtures, read-only. Reads work as usual, while
+// every write fails with 405 Method Not Allowed. The connection string names
+// the root directory within fsys:
+//
+//	//go:embed all:testdata
+//	var fixtures embed.FS
+//
+//	kivik.Register("fixtures", fs.NewReadOnlyDriver(fixtures))
+//	client, err := kivik.New("fixtures", "testdata")
+func NewReadOnlyDriver(fsys iofs.FS) driver.Driver {
+	return NewDriver(filesystem.NewIOFS(fsys))
+}
+
+// checkWritable returns a 405 error if the client's filesystem is read-only.
+func (c *client) checkWritable() error {
+	if filesystem.IsReadOnly(c.fs) {
+		return errReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// readOnlyFixture is a database, as might be embedded with //go:embed.
+var readOnlyFixture = fstest.MapFS{
+	"db/_meta.json":      {Data: []byte(`{"hashing":"fsdb"}`)},
+	"db/_security.json":  {Data: []byte(`{"admins":{"names":["bob"]}}`)},
+	"db/foo.json":        {Data: []byte(`{"_id":"foo","_rev":"2-bbb","_revisions":{"start":2,"ids":["bbb","aaa"]},"foo":"bar"}`)},
+	"db/.foo/1-aaa.json": {Data: []byte(`{"_id":"foo","_rev":"1-aaa","foo":"old"}`)},
+	"db/bar.json":        {Data: []byte(`{"_id":"bar","_rev":"1-ccc","bar":true}`)},
+	"db/deleted.json":    {Data: []byte(`{"_id":"deleted","_rev":"2-ddd","_deleted":true}`)},
+}
+
+func readOnlyClient(t *testing.T) *client {
+	t.Helper()
+	c, err := NewReadOnlyDriver(readOnlyFixture).NewClient("/", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*client)
+}
+
+func readOnlyDB(t *testing.T) *db {
+	t.Helper()
+	d, err := readOnlyClient(t).DB("db", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.(*db)
+}
+
+func TestReadOnlyReads(t *testing.T) {
+	c := readOnlyClient(t)
+	ctx := context.Background()
+	dbs, err := c.AllDBs(ctx, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffInterface([]string{"db"}, dbs); d != nil {
+		t.Errorf("AllDBs: %s", d)
+	}
+	d := readOnlyDB(t)
+
+	doc, err := d.Get(ctx, "foo", kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffAsJSON(map[string]string{"_id": "foo", "_rev": "2-bbb", "foo": "bar"}, doc.Body); d != nil {
+		t.Errorf("Get: %s", d)
+	}
+
+	rows, err := d.AllDocs(ctx, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for {
+		row := new(driver.Row)
+		if err := rows.Next(row); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, row.ID)
+	}
+	if d := testy.DiffInterface([]string{"bar", "foo"}, ids); d != nil {
+		t.Errorf("AllDocs: %s", d)
+	}
+
+	changes, err := d.Changes(ctx, kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = nil
+	for {
+		ch := new(driver.Change)
+		if err := changes.Next(ch); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, ch.ID)
+	}
+	sort.Strings(ids)
+	if d := testy.DiffInterface([]string{"bar", "deleted", "foo"}, ids); d != nil {
+		t.Errorf("Changes: %s", d)
+	}
+
+	diff, err := d.RevsDiff(ctx, map[string][]string{"foo": {"1-aaa", "3-ccc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := new(driver.Row)
+	if err := diff.Next(row); err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffAsJSON(map[string][]string{"missing": {"3-ccc"}}, row.Value); d != nil {
+		t.Errorf("RevsDiff: %s", d)
+	}
+
+	sec, err := d.Security(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secJSON, _ := json.Marshal(sec)
+	if d := testy.DiffAsJSON([]byte(`{"admins":{"names":["bob"]}}`), secJSON); d != nil {
+		t.Errorf("Security: %s", d)
+	}
+
+	if _, err := d.Fsck(ctx, kivik.Params(nil)); err != nil {
+		t.Errorf("Fsck: %s", err)
+	}
+}
+
+func TestReadOnlyWrites(t *testing.T) {
+	type tt struct {
+		op func(*testing.T) error
+	}
+	ctx := context.Background()
+	tests := testy.NewTable()
+	tests.Add("CreateDB", tt{op: func(t *testing.T) error {
+		return readOnlyClient(t).CreateDB(ctx, "new", kivik.Params(nil))
+	}})
+	tests.Add("DestroyDB", tt{op: func(t *testing.T) error {
+		return readOnlyClient(t).DestroyDB(ctx, "db", kivik.Params(nil))
+	}})
+	tests.Add("Replicate", tt{op: func(t *testing.T) error {
+		_, err := readOnlyClient(t).Replicate(ctx, "copy", "db", kivik.Params(nil))
+		return err
+	}})
+	tests.Add("Put", tt{op: func(t *testing.T) error {
+		_, err := readOnlyDB(t).Put(ctx, "foo", map[string]string{"_rev": "2-bbb"}, kivik.Params(nil))
+		return err
+	}})
+	tests.Add("Copy", tt{op: func(t *testing.T) error {
+		_, err := readOnlyDB(t).Copy(ctx, "baz", "foo", kivik.Params(nil))
+		return err
+	}})
+	tests.Add("CreateDoc", tt{op: func(t *testing.T) error {
+		_, _, err := readOnlyDB(t).CreateDoc(ctx, map[string]string{}, kivik.Params(nil))
+		return err
+	}})
+	tests.Add("Delete", tt{op: func(t *testing.T) error {
+		_, err := readOnlyDB(t).Delete(ctx, "foo", kivik.Rev("2-bbb"))
+		return err
+	}})
+	tests.Add("BulkDocs", tt{op: func(t *testing.T) error {
+		_, err := readOnlyDB(t).BulkDocs(ctx, []interface{}{map[string]string{}})
+		return err
+	}})
+	tests.Add("PutAttachment", tt{op: func(t *testing.T) error {
+		_, err := readOnlyDB(t).PutAttachment(ctx, "foo", &driver.Attachment{Filename: "x.txt"}, kivik.Rev("2-bbb"))
+		return err
+	}})
+	tests.Add("DeleteAttachment", tt{op: func(t *testing.T) error {
+		_, err := readOnlyDB(t).DeleteAttachment(ctx, "foo", "x.txt", kivik.Rev("2-bbb"))
+		return err
+	}})
+	tests.Add("SetSecurity", tt{op: func(t *testing.T) error {
+		return readOnlyDB(t).SetSecurity(ctx, &driver.Security{})
+	}})
+	tests.Add("Compact", tt{op: func(t *testing.T) error {
+		return readOnlyDB(t).Compact(ctx)
+	}})
+	tests.Add("CompactView", tt{op: func(t *testing.T) error {
+		return readOnlyDB(t).CompactView(ctx, "_design/foo")
+	}})
+	tests.Add("ViewCleanup", tt{op: func(t *testing.T) error {
+		return readOnlyDB(t).ViewCleanup(ctx)
+	}})
+	tests.Add("SetRevsLimit", tt{op: func(t *testing.T) error {
+		return readOnlyDB(t).SetRevsLimit(ctx, 10)
+	}})
+	tests.Add("Fsck repair", tt{op: func(t *testing.T) error {
+		_, err := readOnlyDB(t).Fsck(ctx, kivik.Param("repair", true))
+		return err
+	}})
+	tests.Add("Load", tt{op: func(t *testing.T) error {
+		_, err := readOnlyDB(t).Load(ctx, strings.NewReader(""), kivik.Params(nil))
+		return err
+	}})
+	tests.Add("Import", tt{op: func(t *testing.T) error {
+		return readOnlyClient(t).Import(ctx, "imported", strings.NewReader(""), kivik.Params(nil))
+	}})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		testy.StatusError(t, "database is read-only", http.StatusMethodNotAllowed, tt.op(t))
+	})
+}
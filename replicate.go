@@ -0,0 +1,741 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+var _ driver.ClientReplicator = &client{}
+
+// Replication states, as reported by a replication's State method.
+const (
+	replicationTriggered = "triggered"
+	replicationComplete  = "completed"
+	replicationError     = "error"
+)
+
+const (
+	// replicationBatchSize is the number of changes passed to RevsDiff at once.
+	replicationBatchSize = 100
+	// defaultPollInterval is the delay between passes of a continuous
+	// replication.
+	defaultPollInterval = time.Second
+	// checkpointHistorySize is the number of sessions retained in a
+	// checkpoint document.
+	checkpointHistorySize = 5
+)
+
+// ReplicationFilter may be passed as the "filter" option to Replicate, to
+// select which document revisions are replicated. It is called with the
+// document ID and the decoded body of each missing revision, and should return
+// true if the revision is to be written to the target.
+type ReplicationFilter func(docID string, doc map[string]interface{}) bool
+
+// ReplicationResult summarizes a completed replication. For a continuous
+// replication, the counts are totals over all passes so far, while each
+// checkpoint history entry records the counts of a single pass.
+type ReplicationResult struct {
+	DocsRead         int64     `json:"docs_read"`
+	DocsWritten      int64     `json:"docs_written"`
+	DocWriteFailures int64     `json:"doc_write_failures"`
+	StartTime        time.Time `json:"start_time"`
+	EndTime          time.Time `json:"end_time"`
+	LastSeq          string    `json:"recorded_seq"`
+}
+
+// Replicate performs a one-off replication from source to target, either of
+// which may be any Kivik driver database. The source must support the Changes
+// and Get methods; if the target implements driver.RevsDiffer, it is used to
+// determine which revisions are missing.
+//
+// Supported options:
+//
+//   - doc_ids:        A list of document IDs to replicate.
+//   - filter:         Either "_doc_ids", or a ReplicationFilter.
+//   - replication_id: If set, checkpoints are stored in _local/{id} on both
+//     the source and target, recording the history of the replications.
+//     Sources whose changes feeds report sequence IDs are then read from the
+//     last checkpoint on. As this driver's changes feed does not, fsdb
+//     sources are read in full by each replication, of which only the
+//     revisions missing from the target are copied.
+//
+// The continuous option is only supported by the client-level Replicate method.
+func Replicate(ctx context.Context, target, source driver.DB, options driver.Options) (*ReplicationResult, error) {
+	opts := map[string]interface{}{}
+	if options != nil {
+		options.Apply(opts)
+	}
+	r, err := newReplicator(target, source, opts)
+	if err != nil {
+		return nil, err
+	}
+	r.id, _ = opts["replication_id"].(string)
+	if err := r.run(ctx); err != nil {
+		return nil, err
+	}
+	return r.result(), nil
+}
+
+type replicator struct {
+	id             string
+	source, target driver.DB
+	docIDs         map[string]struct{}
+	filter         ReplicationFilter
+	// checkpointed is true once a pass has written a checkpoint, after which
+	// passes that replicate nothing, as when a continuous replication is
+	// idle, leave it as it is.
+	checkpointed bool
+
+	mu    sync.Mutex
+	stats ReplicationResult
+}
+
+func newReplicator(target, source driver.DB, opts map[string]interface{}) (*replicator, error) {
+	r := &replicator{
+		source: source,
+		target: target,
+	}
+	switch t := opts["filter"].(type) {
+	case nil:
+	case ReplicationFilter:
+		r.filter = t
+	case func(string, map[string]interface{}) bool:
+		r.filter = t
+	case string:
+		if t != "_doc_ids" {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("unsupported replication filter '%s'", t)}
+		}
+	default:
+		return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid replication filter of type %T", t)}
+	}
+	if ids, ok := opts["doc_ids"]; ok {
+		docIDs, err := toStrings(ids)
+		if err != nil {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid doc_ids: %w", err)}
+		}
+		r.docIDs = make(map[string]struct{}, len(docIDs))
+		for _, id := range docIDs {
+			r.docIDs[id] = struct{}{}
+		}
+	}
+	return r, nil
+}
+
+func toStrings(i interface{}) ([]string, error) {
+	if t, ok := i.([]string); ok {
+		return t, nil
+	}
+	encoded, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	err = json.Unmarshal(encoded, &result)
+	return result, err
+}
+
+func (r *replicator) result() *ReplicationResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := r.stats
+	return &result
+}
+
+// run performs a single replication pass, from the last checkpoint to the
+// current end of the source changes feed.
+func (r *replicator) run(ctx context.Context) error {
+	r.mu.Lock()
+	r.stats.StartTime = time.Now()
+	start := r.stats
+	r.mu.Unlock()
+	cp, err := r.readCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	lastSeq, err := r.replicate(ctx, cp.SourceLastSeq)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.stats.EndTime = time.Now()
+	r.stats.LastSeq = lastSeq
+	idle := r.stats.DocsRead == start.DocsRead
+	r.mu.Unlock()
+	if r.checkpointed && idle && lastSeq == cp.SourceLastSeq {
+		return nil
+	}
+	if err := r.writeCheckpoint(ctx, cp, &start); err != nil {
+		return err
+	}
+	r.checkpointed = true
+	return nil
+}
+
+func (r *replicator) replicate(ctx context.Context, since string) (string, error) {
+	params := map[string]interface{}{"style": "all_docs"}
+	if since != "" {
+		params["since"] = since
+	}
+	changes, err := r.source.Changes(ctx, kivik.Params(params))
+	if err != nil {
+		return "", err
+	}
+	defer changes.Close() // nolint: errcheck
+	batch := make(map[string][]string, replicationBatchSize)
+	ch := new(driver.Change)
+	for {
+		err := changes.Next(ch)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(ch.ID, "_local/") {
+			continue
+		}
+		if r.docIDs != nil {
+			if _, ok := r.docIDs[ch.ID]; !ok {
+				continue
+			}
+		}
+		batch[ch.ID] = append(batch[ch.ID], ch.Changes...)
+		if len(batch) >= replicationBatchSize {
+			if err := r.replicateBatch(ctx, batch); err != nil {
+				return "", err
+			}
+			batch = make(map[string][]string, replicationBatchSize)
+		}
+	}
+	if err := r.replicateBatch(ctx, batch); err != nil {
+		return "", err
+	}
+	return changes.LastSeq(), nil
+}
+
+func (r *replicator) replicateBatch(ctx context.Context, batch map[string][]string) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	missing, err := r.revsDiff(ctx, batch)
+	if err != nil {
+		return err
+	}
+	docIDs := make([]string, 0, len(missing))
+	for docID := range missing {
+		docIDs = append(docIDs, docID)
+	}
+	sort.Strings(docIDs)
+	for _, docID := range docIDs {
+		for _, rev := range missing[docID] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			doc, err := r.readRev(ctx, docID, rev)
+			if err != nil {
+				return err
+			}
+			r.mu.Lock()
+			r.stats.DocsRead++
+			r.mu.Unlock()
+			if r.filter != nil && !r.filter(docID, doc) {
+				continue
+			}
+			_, err = r.target.Put(ctx, docID, doc, kivik.Param("new_edits", false))
+			r.mu.Lock()
+			if err != nil {
+				r.stats.DocWriteFailures++
+			} else {
+				r.stats.DocsWritten++
+			}
+			r.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// revsDiff returns the revisions in revmap which are missing from the target.
+func (r *replicator) revsDiff(ctx context.Context, revmap map[string][]string) (map[string][]string, error) {
+	missing := make(map[string][]string, len(revmap))
+	differ, ok := r.target.(driver.RevsDiffer)
+	if !ok {
+		for docID, revs := range revmap {
+			for _, rev := range revs {
+				_, err := r.target.Get(ctx, docID, kivik.Rev(rev))
+				switch {
+				case kivik.HTTPStatus(err) == http.StatusNotFound:
+					missing[docID] = append(missing[docID], rev)
+				case err != nil:
+					return nil, err
+				}
+			}
+		}
+		return missing, nil
+	}
+	rows, err := differ.RevsDiff(ctx, revmap)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	row := new(driver.Row)
+	for {
+		err := rows.Next(row)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var value struct {
+			Missing []string `json:"missing"`
+		}
+		if err := json.NewDecoder(row.Value).Decode(&value); err != nil {
+			return nil, err
+		}
+		missing[row.ID] = value.Missing
+	}
+	return missing, nil
+}
+
+// readRev reads the requested revision from the source, including its
+// revision history, and with all attachments inlined.
+func (r *replicator) readRev(ctx context.Context, docID, rev string) (map[string]interface{}, error) {
+	doc, err := r.source.Get(ctx, docID, kivik.Params(map[string]interface{}{
+		"rev":           rev,
+		"revs":          true,
+		"attachments":   true,
+		"header:accept": "application/json",
+	}))
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Body.Close() // nolint: errcheck
+	var body map[string]interface{}
+	if err := json.NewDecoder(doc.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if doc.Attachments == nil {
+		return body, nil
+	}
+	defer doc.Attachments.Close() // nolint: errcheck
+	atts, _ := body["_attachments"].(map[string]interface{})
+	if atts == nil {
+		atts = map[string]interface{}{}
+	}
+	att := new(driver.Attachment)
+	for {
+		err := doc.Attachments.Next(att)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(att.Content)
+		_ = att.Content.Close()
+		if err != nil {
+			return nil, err
+		}
+		atts[att.Filename] = map[string]interface{}{
+			"content_type": att.ContentType,
+			"data":         base64.StdEncoding.EncodeToString(content),
+		}
+	}
+	body["_attachments"] = atts
+	return body, nil
+}
+
+type checkpointHistory struct {
+	StartTime        time.Time `json:"start_time"`
+	EndTime          time.Time `json:"end_time"`
+	RecordedSeq      string    `json:"recorded_seq"`
+	DocsRead         int64     `json:"docs_read"`
+	DocsWritten      int64     `json:"docs_written"`
+	DocWriteFailures int64     `json:"doc_write_failures"`
+}
+
+// checkpoint is stored as _local/{replication_id} on source and target.
+type checkpoint struct {
+	SourceLastSeq string              `json:"source_last_seq"`
+	History       []checkpointHistory `json:"history"`
+
+	sourceRev, targetRev string
+}
+
+func (r *replicator) checkpointID() string {
+	return "_local/" + r.id
+}
+
+func readCheckpoint(ctx context.Context, d driver.DB, docID string) (*checkpoint, string, error) {
+	doc, err := d.Get(ctx, docID, kivik.Params(nil))
+	if kivik.HTTPStatus(err) == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer doc.Body.Close() // nolint: errcheck
+	cp := new(checkpoint)
+	if err := json.NewDecoder(doc.Body).Decode(cp); err != nil {
+		return nil, "", err
+	}
+	return cp, doc.Rev, nil
+}
+
+// readCheckpoint reads the checkpoints from source and target. The recorded
+// sequence is only trusted if both agree.
+func (r *replicator) readCheckpoint(ctx context.Context) (*checkpoint, error) {
+	cp := new(checkpoint)
+	if r.id == "" {
+		return cp, nil
+	}
+	target, targetRev, err := readCheckpoint(ctx, r.target, r.checkpointID())
+	if err != nil {
+		return nil, err
+	}
+	source, sourceRev, err := readCheckpoint(ctx, r.source, r.checkpointID())
+	if err != nil {
+		return nil, err
+	}
+	cp.sourceRev, cp.targetRev = sourceRev, targetRev
+	if target != nil {
+		cp.History = target.History
+		if source != nil && source.SourceLastSeq == target.SourceLastSeq {
+			cp.SourceLastSeq = target.SourceLastSeq
+		}
+	}
+	return cp, nil
+}
+
+// writeCheckpoint records the pass which began with the statistics start.
+func (r *replicator) writeCheckpoint(ctx context.Context, cp *checkpoint, start *ReplicationResult) error {
+	if r.id == "" {
+		return nil
+	}
+	result := r.result()
+	cp.SourceLastSeq = result.LastSeq
+	cp.History = append([]checkpointHistory{{
+		StartTime:        result.StartTime,
+		EndTime:          result.EndTime,
+		RecordedSeq:      result.LastSeq,
+		DocsRead:         result.DocsRead - start.DocsRead,
+		DocsWritten:      result.DocsWritten - start.DocsWritten,
+		DocWriteFailures: result.DocWriteFailures - start.DocWriteFailures,
+	}}, cp.History...)
+	if len(cp.History) > checkpointHistorySize {
+		cp.History = cp.History[:checkpointHistorySize]
+	}
+	doc := map[string]interface{}{
+		"source_last_seq": cp.SourceLastSeq,
+		"history":         cp.History,
+	}
+	if cp.targetRev != "" {
+		doc["_rev"] = cp.targetRev
+	}
+	rev, err := r.target.Put(ctx, r.checkpointID(), doc, kivik.Params(nil))
+	if err != nil {
+		return err
+	}
+	cp.targetRev = rev
+	delete(doc, "_rev")
+	if cp.sourceRev != "" {
+		doc["_rev"] = cp.sourceRev
+	}
+	// The source may well be read-only, so a failure here only means the
+	// next replication must start from scratch.
+	if rev, err := r.source.Put(ctx, r.checkpointID(), doc, kivik.Params(nil)); err == nil {
+		cp.sourceRev = rev
+	}
+	return nil
+}
+
+// replicationRegistry holds the replications started by a client.
+type replicationRegistry struct {
+	mu    sync.Mutex
+	repls map[string]*replication
+}
+
+// replication is a replication managed by the client.
+type replication struct {
+	id, source, target string
+	cancel             context.CancelFunc
+	done               chan struct{}
+	replicator         *replicator
+	client             *client
+
+	mu        sync.RWMutex
+	startTime time.Time
+	endTime   time.Time
+	state     string
+	err       error
+}
+
+var _ driver.Replication = &replication{}
+
+func (r *replication) ID() string     { return r.id }
+func (r *replication) Source() string { return r.source }
+func (r *replication) Target() string { return r.target }
+
+func (r *replication) StartTime() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.startTime
+}
+
+func (r *replication) EndTime() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.endTime
+}
+
+func (r *replication) State() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state
+}
+
+func (r *replication) Err() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.err
+}
+
+// Delete cancels the replication, if it is still running, and removes it from
+// the client's list of replications.
+func (r *replication) Delete(ctx context.Context) error {
+	r.cancel()
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	r.client.replications.mu.Lock()
+	delete(r.client.replications.repls, r.id)
+	r.client.replications.mu.Unlock()
+	return nil
+}
+
+// Update populates info with the current replication statistics.
+func (r *replication) Update(_ context.Context, info *driver.ReplicationInfo) error {
+	result := r.replicator.result()
+	info.DocsRead = result.DocsRead
+	info.DocsWritten = result.DocsWritten
+	info.DocWriteFailures = result.DocWriteFailures
+	if r.State() == replicationComplete {
+		info.Progress = 100
+	}
+	return nil
+}
+
+func (r *replication) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endTime = time.Now()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		r.state = replicationError
+		r.err = err
+		return
+	}
+	r.state = replicationComplete
+}
+
+func (r *replication) run(ctx context.Context, continuous bool, interval time.Duration) {
+	defer close(r.done)
+	for {
+		err := r.replicator.run(ctx)
+		if err != nil || !continuous {
+			r.finish(err)
+			return
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			r.finish(nil)
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// replicationID generates a deterministic ID for a replication, so that
+// checkpoints can be found by subsequent replications of the same databases.
+func replicationID(target, source string, opts map[string]interface{}) string {
+	parts := map[string]interface{}{
+		"source": source,
+		"target": target,
+	}
+	for _, key := range []string{"doc_ids", "filter"} {
+		if v, ok := opts[key]; ok {
+			parts[key] = fmt.Sprintf("%v", v)
+		}
+	}
+	data, _ := json.Marshal(parts)
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func pollInterval(opts map[string]interface{}) (time.Duration, error) {
+	switch t := opts["poll_interval"].(type) {
+	case nil:
+		return defaultPollInterval, nil
+	case time.Duration:
+		return t, nil
+	case int:
+		return time.Duration(t) * time.Millisecond, nil
+	case float64:
+		return time.Duration(t) * time.Millisecond, nil
+	case string:
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return 0, statusError{status: http.StatusBadRequest, error: err}
+		}
+		return d, nil
+	}
+	return 0, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid poll_interval of type %T", opts["poll_interval"])}
+}
+
+// replicationDB opens the database identified by dsn, which may be a
+// database name relative to the client root, an absolute path, or a file://
+// URL. If create is true, and the database doesn't exist, it is created first,
+// as by CreateDB.
+func (c *client) replicationDB(dsn string, create bool) (*db, error) {
+	path, name := "", ""
+	if c.root == "" || strings.HasPrefix(dsn, "file://") || filepath.IsAbs(dsn) {
+		var err error
+		if path, err = parseFileURL(dsn); err != nil {
+			return nil, err
+		}
+		name = filepath.Base(path)
+	} else {
+		var err error
+		if path, name, err = c.dbPath(dsn); err != nil {
+			return nil, err
+		}
+	}
+	_, err := c.fs.Stat(path)
+	if os.IsNotExist(err) && create {
+		meta, err := c.newMeta(map[string]interface{}{})
+		if err != nil {
+			return nil, err
+		}
+		if err := c.createDBPath(path, meta); err != nil {
+			return nil, kerr(err)
+		}
+		return c.openDBPath(path, name, "")
+	}
+	if err != nil {
+		return nil, kerr(err)
+	}
+	return c.openDBPath(path, name, "")
+}
+
+// Replicate starts a replication from sourceDSN to targetDSN, both of which
+// must be fsdb databases. To replicate to or from other drivers, use the
+// package-level Replicate function.
+//
+// In addition to the options accepted by the package-level Replicate, the
+// following options are supported:
+//
+//   - continuous:    If true, the replication repeats until cancelled.
+//   - poll_interval: The delay between passes of a continuous replication, as
+//     a time.Duration, a duration string, or a number of milliseconds.
+//   - create_target: If true, the target database is created if necessary.
+func (c *client) Replicate(_ context.Context, targetDSN, sourceDSN string, options driver.Options) (driver.Replication, error) {
+	if err := c.checkWritable(); err != nil {
+		return nil, err
+	}
+	opts := map[string]interface{}{}
+	if options != nil {
+		options.Apply(opts)
+	}
+	continuous, _ := opts["continuous"].(bool)
+	createTarget, _ := opts["create_target"].(bool)
+	interval, err := pollInterval(opts)
+	if err != nil {
+		return nil, err
+	}
+	source, err := c.replicationDB(sourceDSN, false)
+	if err != nil {
+		return nil, err
+	}
+	target, err := c.replicationDB(targetDSN, createTarget)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReplicator(target, source, opts)
+	if err != nil {
+		return nil, err
+	}
+	r.id = replicationID(target.dbPath, source.dbPath, opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	repl := &replication{
+		id:         r.id,
+		source:     sourceDSN,
+		target:     targetDSN,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		replicator: r,
+		client:     c,
+		startTime:  time.Now(),
+		state:      replicationTriggered,
+	}
+	c.replications.mu.Lock()
+	if existing, ok := c.replications.repls[repl.id]; ok && existing.State() == replicationTriggered {
+		c.replications.mu.Unlock()
+		cancel()
+		return nil, statusError{status: http.StatusConflict, error: errors.New("replication already running")}
+	}
+	if c.replications.repls == nil {
+		c.replications.repls = make(map[string]*replication)
+	}
+	c.replications.repls[repl.id] = repl
+	c.replications.mu.Unlock()
+	go repl.run(ctx, continuous, interval)
+	return repl, nil
+}
+
+// GetReplications returns the replications started by this client, which
+// have not been deleted, ordered by start time.
+func (c *client) GetReplications(context.Context, driver.Options) ([]driver.Replication, error) {
+	c.replications.mu.Lock()
+	repls := make([]*replication, 0, len(c.replications.repls))
+	for _, repl := range c.replications.repls {
+		repls = append(repls, repl)
+	}
+	c.replications.mu.Unlock()
+	sort.Slice(repls, func(i, j int) bool {
+		return repls[i].StartTime().Before(repls[j].StartTime())
+	})
+	result := make([]driver.Replication, len(repls))
+	for i, repl := range repls {
+		result[i] = repl
+	}
+	return result, nil
+}
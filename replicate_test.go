@@ -0,0 +1,366 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/fsdb/v4/cdb"
+	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4"
+)
+
+func newTestDB(t *testing.T, root, dbname string) *db {
+	t.Helper()
+	if err := os.Mkdir(filepath.Join(root, dbname), 0o777); err != nil && !os.IsExist(err) {
+		t.Fatal(err)
+	}
+	c := &client{root: root, fs: filesystem.Default()}
+	d, err := c.newDB(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func getDoc(t *testing.T, d *db, docID string, options kivik.Option) map[string]interface{} {
+	t.Helper()
+	if options == nil {
+		options = kivik.Params(nil)
+	}
+	doc, err := d.Get(context.Background(), docID, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer doc.Body.Close() // nolint: errcheck
+	var result map[string]interface{}
+	if err := json.NewDecoder(doc.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestReplicate(t *testing.T) {
+	type tt struct {
+		source, target *db
+		options        kivik.Option
+		status         int
+		err            string
+		docsWritten    int64
+		want           map[string]string
+		missing        []string
+		conflicts      map[string]string
+	}
+	tests := testy.NewTable()
+	tests.Add("unsupported filter", func(t *testing.T) interface{} {
+		tmpdir := tempDir(t)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		return tt{
+			source:  newTestDB(t, tmpdir, "source"),
+			target:  newTestDB(t, tmpdir, "target"),
+			options: kivik.Param("filter", "ddoc/filter"),
+			status:  http.StatusBadRequest,
+			err:     "unsupported replication filter 'ddoc/filter'",
+		}
+	})
+	tests.Add("all docs", func(t *testing.T) interface{} {
+		tmpdir := tempDir(t)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		source := newTestDB(t, tmpdir, "source")
+		for _, id := range []string{"foo", "bar"} {
+			if _, err := source.Put(context.Background(), id, map[string]string{"value": id}, kivik.Params(nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tt{
+			source:      source,
+			target:      newTestDB(t, tmpdir, "target"),
+			docsWritten: 2,
+			want:        map[string]string{"foo": "foo", "bar": "bar"},
+		}
+	})
+	tests.Add("doc_ids", func(t *testing.T) interface{} {
+		tmpdir := tempDir(t)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		source := newTestDB(t, tmpdir, "source")
+		for _, id := range []string{"foo", "bar"} {
+			if _, err := source.Put(context.Background(), id, map[string]string{"value": id}, kivik.Params(nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tt{
+			source: source,
+			target: newTestDB(t, tmpdir, "target"),
+			options: kivik.Params(map[string]interface{}{
+				"filter":  "_doc_ids",
+				"doc_ids": []string{"foo"},
+			}),
+			docsWritten: 1,
+			want:        map[string]string{"foo": "foo"},
+			missing:     []string{"bar"},
+		}
+	})
+	tests.Add("filter func", func(t *testing.T) interface{} {
+		tmpdir := tempDir(t)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		source := newTestDB(t, tmpdir, "source")
+		for _, id := range []string{"foo", "bar"} {
+			if _, err := source.Put(context.Background(), id, map[string]string{"value": id}, kivik.Params(nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tt{
+			source: source,
+			target: newTestDB(t, tmpdir, "target"),
+			options: kivik.Param("filter", ReplicationFilter(func(_ string, doc map[string]interface{}) bool {
+				return doc["value"] == "bar"
+			})),
+			docsWritten: 1,
+			want:        map[string]string{"bar": "bar"},
+			missing:     []string{"foo"},
+		}
+	})
+	tests.Add("updated doc", func(t *testing.T) interface{} {
+		tmpdir := tempDir(t)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		source := newTestDB(t, tmpdir, "source")
+		target := newTestDB(t, tmpdir, "target")
+		rev, err := source.Put(context.Background(), "foo", map[string]string{"value": "one"}, kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Replicate(context.Background(), target, source, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := source.Put(context.Background(), "foo", map[string]string{"value": "two", "_rev": rev}, kivik.Params(nil)); err != nil {
+			t.Fatal(err)
+		}
+		return tt{
+			source:      source,
+			target:      target,
+			docsWritten: 1,
+			want:        map[string]string{"foo": "two"},
+		}
+	})
+	tests.Add("conflicts", func(t *testing.T) interface{} {
+		tmpdir := tempDir(t)
+		tests.Cleanup(cleanTmpdir(tmpdir))
+		source := newTestDB(t, tmpdir, "source")
+		rev, err := source.Put(context.Background(), "foo", map[string]string{"value": "one"}, kivik.Params(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := source.Put(context.Background(), "foo", map[string]interface{}{
+			"value":      "two",
+			"_rev":       "2-zzz",
+			"_revisions": map[string]interface{}{"start": 2, "ids": []string{"zzz", "aaa"}},
+		}, kivik.Param("new_edits", false)); err != nil {
+			t.Fatal(err)
+		}
+		return tt{
+			source:      source,
+			target:      newTestDB(t, tmpdir, "target"),
+			docsWritten: 2,
+			want:        map[string]string{"foo": "two"},
+			conflicts:   map[string]string{"foo": rev},
+		}
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		result, err := Replicate(context.Background(), tt.target, tt.source, tt.options)
+		testy.StatusError(t, tt.err, tt.status, err)
+		if result.DocsWritten != tt.docsWritten {
+			t.Errorf("Unexpected docs written: %d", result.DocsWritten)
+		}
+		for docID, value := range tt.want {
+			doc := getDoc(t, tt.target, docID, nil)
+			if doc["value"] != value {
+				t.Errorf("Unexpected value for %s: %v", docID, doc["value"])
+			}
+			want := getDoc(t, tt.source, docID, nil)
+			if doc["_rev"] != want["_rev"] {
+				t.Errorf("Unexpected rev for %s: %v", docID, doc["_rev"])
+			}
+		}
+		for docID, rev := range tt.conflicts {
+			doc := getDoc(t, tt.target, docID, kivik.Rev(rev))
+			if doc["_rev"] != rev {
+				t.Errorf("Unexpected conflicting rev for %s: %v", docID, doc["_rev"])
+			}
+		}
+		for _, docID := range tt.missing {
+			_, err := tt.target.Get(context.Background(), docID, kivik.Params(nil))
+			if status := kivik.HTTPStatus(err); status != http.StatusNotFound {
+				t.Errorf("Expected %s to be missing, got status %d", docID, status)
+			}
+		}
+	})
+}
+
+func TestReplicateCheckpoint(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	source := newTestDB(t, tmpdir, "source")
+	target := newTestDB(t, tmpdir, "target")
+	if _, err := source.Put(context.Background(), "foo", map[string]string{"value": "foo"}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	opts := kivik.Param("replication_id", "test")
+	for i := 0; i < 2; i++ {
+		if _, err := Replicate(context.Background(), target, source, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []*db{source, target} {
+		cp := getDoc(t, d, "_local/test", nil)
+		history, _ := cp["history"].([]interface{})
+		if len(history) != 2 {
+			t.Errorf("Expected 2 history entries in %s, got %d", d.dbName, len(history))
+		}
+	}
+}
+
+func TestClientReplicate(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	source := newTestDB(t, tmpdir, "source")
+	if _, err := source.Put(context.Background(), "foo", map[string]string{"value": "foo"}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	c := &client{root: tmpdir, fs: filesystem.Default(), replications: &replicationRegistry{}}
+
+	if _, err := c.Replicate(context.Background(), "target", "source", nil); kivik.HTTPStatus(err) != http.StatusNotFound {
+		t.Fatalf("Expected missing target to be reported, got %v", err)
+	}
+
+	repl, err := c.Replicate(context.Background(), "target", "source", kivik.Param("create_target", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for repl.State() == replicationTriggered {
+		if time.Now().After(deadline) {
+			t.Fatal("replication did not complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if repl.State() != replicationComplete {
+		t.Fatalf("Unexpected state %s: %v", repl.State(), repl.Err())
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, "target", cdb.MetaFileName)); err != nil {
+		t.Errorf("Expected the created target to have a metadata file: %s", err)
+	}
+	doc := getDoc(t, newTestDB(t, tmpdir, "target"), "foo", nil)
+	if doc["value"] != "foo" {
+		t.Errorf("Unexpected document: %v", doc)
+	}
+
+	repls, err := c.GetReplications(context.Background(), kivik.Params(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repls) != 1 || repls[0].ID() != repl.ID() {
+		t.Errorf("Unexpected replications: %v", repls)
+	}
+	if err := repl.Delete(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if repls, _ := c.GetReplications(context.Background(), kivik.Params(nil)); len(repls) != 0 {
+		t.Errorf("Expected no replications after delete, got %d", len(repls))
+	}
+}
+
+func TestClientReplicateContinuous(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer rmdir(t, tmpdir)
+	source := newTestDB(t, tmpdir, "source")
+	target := newTestDB(t, tmpdir, "target")
+	c := &client{root: tmpdir, fs: filesystem.Default(), replications: &replicationRegistry{}}
+
+	repl, err := c.Replicate(context.Background(), "target", "source", kivik.Params(map[string]interface{}{
+		"continuous":    true,
+		"poll_interval": 10 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repl.Delete(context.Background()) // nolint: errcheck
+	if _, err := source.Put(context.Background(), "foo", map[string]string{"value": "foo"}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := target.Get(context.Background(), "foo", kivik.Params(nil))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("document never replicated: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := repl.State(); state != replicationTriggered {
+		t.Errorf("Unexpected state: %s", state)
+	}
+
+	// Once the document's pass is recorded, idle passes leave the checkpoint
+	// as it is.
+	cpID := "_local/" + repl.ID()
+	var rev interface{}
+	for rev == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("checkpoint never written")
+		}
+		time.Sleep(10 * time.Millisecond)
+		if _, err := target.Get(context.Background(), cpID, kivik.Params(nil)); err != nil {
+			continue
+		}
+		cp := getDoc(t, target, cpID, nil)
+		history, _ := cp["history"].([]interface{})
+		if latest, _ := history[0].(map[string]interface{}); latest["docs_written"] == float64(1) {
+			rev = cp["_rev"]
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if cp := getDoc(t, target, cpID, nil); cp["_rev"] != rev {
+		t.Errorf("Checkpoint updated by idle passes, from %v to %v", rev, cp["_rev"])
+	}
+
+	// The next pass's history entry counts only its own documents.
+	if _, err := source.Put(context.Background(), "bar", map[string]string{"value": "bar"}, kivik.Params(nil)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("second checkpoint never written")
+		}
+		time.Sleep(10 * time.Millisecond)
+		cp := getDoc(t, target, cpID, nil)
+		if cp["_rev"] == rev {
+			continue
+		}
+		history, _ := cp["history"].([]interface{})
+		if latest, _ := history[0].(map[string]interface{}); latest["docs_written"] != float64(1) {
+			t.Errorf("Unexpected docs_written for the second pass: %v", latest["docs_written"])
+		}
+		break
+	}
+}
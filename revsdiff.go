@@ -34,8 +34,10 @@ func toRevmap(i interface{}) (map[string][]string, error) {
 		return nil, statusError{status: http.StatusBadRequest, error: err}
 	}
 	revmap := make(map[string][]string)
-	err = json.Unmarshal(encoded, &revmap)
-	return revmap, statusError{status: http.StatusBadRequest, error: err}
+	if err := json.Unmarshal(encoded, &revmap); err != nil {
+		return nil, statusError{status: http.StatusBadRequest, error: err}
+	}
+	return revmap, nil
 }
 
 func (d *db) RevsDiff(ctx context.Context, revMap interface{}) (driver.Rows, error) {
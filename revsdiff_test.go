@@ -116,3 +116,13 @@ func TestRevsDiff(t *testing.T) {
 		}
 	})
 }
+
+func TestToRevmap(t *testing.T) {
+	revmap, err := toRevmap(map[string]interface{}{"foo": []interface{}{"1-aaa", "2-bbb"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := testy.DiffInterface(map[string][]string{"foo": {"1-aaa", "2-bbb"}}, revmap); d != nil {
+		t.Error(d)
+	}
+}
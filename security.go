@@ -23,6 +23,7 @@ package fs
 import (
 	"context"
 
+	"github.com/go-kivik/kivik/v4"
 	"github.com/go-kivik/kivik/v4/driver"
 )
 
@@ -30,7 +31,12 @@ func (d *db) Security(ctx context.Context) (*driver.Security, error) {
 	return d.cdb.ReadSecurity(ctx, d.path())
 }
 
-func (d *db) SetSecurity(_ context.Context, _ *driver.Security) error {
-	// FIXME: Unimplemented
-	return notYetImplemented
+// SetSecurity writes the security object to _security.{ext}, replacing the
+// existing one, in its format, if there is one.
+func (d *db) SetSecurity(ctx context.Context, security *driver.Security) error {
+	fs, err := d.writeCDB(kivik.Params(nil))
+	if err != nil {
+		return err
+	}
+	return fs.WriteSecurity(ctx, d.path(), security)
 }
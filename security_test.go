@@ -14,11 +14,14 @@ package fs
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"gitlab.com/flimzy/testy"
 
 	"github.com/go-kivik/fsdb/v4/filesystem"
+	"github.com/go-kivik/kivik/v4/driver"
 )
 
 func TestSecurity(t *testing.T) {
@@ -63,3 +66,56 @@ func TestSecurity(t *testing.T) {
 		}
 	})
 }
+
+func TestSetSecurity(t *testing.T) {
+	type tt struct {
+		path, dbname string
+		want         string
+	}
+	tests := testy.NewTable()
+	tests.Add("no security object", tt{
+		dbname: "foo",
+		want:   "_security.json",
+	})
+	tests.Add("existing yaml security obj", tt{
+		path:   "testdata",
+		dbname: "db_bar",
+		want:   "_security.yml",
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		var dir string
+		if tt.path == "" {
+			dir = tempDir(t)
+			if err := os.Mkdir(filepath.Join(dir, tt.dbname), 0o777); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			dir = copyDir(t, filepath.Join(tt.path, tt.dbname), 1)
+		}
+		defer rmdir(t, dir)
+		c := &client{root: dir}
+		db, err := c.newDB(tt.dbname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		sec := &driver.Security{
+			Admins:  driver.Members{Names: []string{"bob"}},
+			Members: driver.Members{Roles: []string{"users"}},
+		}
+		if err := db.SetSecurity(ctx, sec); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, tt.dbname, tt.want)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.Security(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := testy.DiffInterface(sec, got); d != nil {
+			t.Error(d)
+		}
+	})
+}
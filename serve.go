@@ -0,0 +1,443 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// defaultFeedTimeout is how long a longpoll or continuous changes feed waits
+// for changes, unless the timeout parameter is given, as with CouchDB.
+const defaultFeedTimeout = time.Minute
+
+// couchErrors are the CouchDB error names for HTTP statuses.
+var couchErrors = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusNotAcceptable:         "not_acceptable",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "file_exists",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "bad_content_type",
+	http.StatusNotImplemented:        "not_implemented",
+}
+
+type handler struct {
+	client       driver.Client
+	pollInterval time.Duration
+	// corsOrigins are the origins allowed by CORS, or "*" for any.
+	corsOrigins map[string]bool
+	// instance identifies the handler in the sequence IDs of its changes
+	// feeds, which are only meaningful to the handler that issued them.
+	instance string
+
+	mu   sync.Mutex
+	seqs map[string]*seqIndex
+}
+
+// NewHandler returns an http.Handler which serves the databases of c, which
+// is normally a client of this driver, with the parts of the CouchDB API
+// needed for CRUD and replication, so that PouchDB, the CouchDB replicator, or
+// curl can be pointed at a directory of databases. See the "HTTP Server"
+// section of the package documentation for the supported endpoints.
+//
+// Supported options:
+//
+//   - poll_interval: How often longpoll and continuous changes feeds check
+//     for changes. Defaults to one second.
+//   - cors_origins:  A list of origins from which browsers may make
+//     cross-origin requests, or "*" for any. By default, none may.
+func NewHandler(c driver.Client, options driver.Options) (http.Handler, error) {
+	opts := map[string]interface{}{}
+	options.Apply(opts)
+	interval, err := pollInterval(opts)
+	if err != nil {
+		return nil, err
+	}
+	h := &handler{
+		client:       c,
+		pollInterval: interval,
+		corsOrigins:  map[string]bool{},
+		seqs:         map[string]*seqIndex{},
+	}
+	if origins, ok := opts["cors_origins"]; ok {
+		list, err := toStrings(origins)
+		if err != nil {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for cors_origins: %v", origins)}
+		}
+		for _, origin := range list {
+			h.corsOrigins[origin] = true
+		}
+	}
+	instance := make([]byte, 4)
+	if _, err := rand.Read(instance); err != nil {
+		return nil, err
+	}
+	h.instance = hex.EncodeToString(instance)
+	return h, nil
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.cors(w, r) {
+		return
+	}
+	if err := h.serve(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// cors sets the CORS headers for requests from allowed origins, and returns
+// true if r was a preflight request, which has then been answered.
+func (h *handler) cors(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !(h.corsOrigins["*"] || h.corsOrigins[origin]) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Type, ETag")
+	w.Header().Add("Vary", "Origin")
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, COPY")
+	w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, Destination, If-Match, Origin, Referer, X-Requested-With")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (h *handler) serve(w http.ResponseWriter, r *http.Request) error {
+	path, err := pathSegments(r.URL)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		return h.serverInfo(w, r)
+	}
+	switch path[0] {
+	case "_all_dbs":
+		if err := allowMethods(r, http.MethodGet, http.MethodHead); err != nil {
+			return err
+		}
+		dbs, err := h.client.AllDBs(r.Context(), kivik.Params(nil))
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, dbs)
+	case "_up":
+		return writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+	if len(path) == 1 {
+		return h.serveDB(w, r, path[0])
+	}
+	d, err := h.db(r.Context(), path[0])
+	if err != nil {
+		return err
+	}
+	defer d.Close() // nolint: errcheck
+	dbName, path := path[0], path[1:]
+	switch path[0] {
+	case "_all_docs":
+		return h.allDocs(w, r, d)
+	case "_changes":
+		return h.changes(w, r, dbName, d)
+	case "_bulk_docs":
+		return h.bulkDocs(w, r, d)
+	case "_bulk_get":
+		return h.bulkGet(w, r, d)
+	case "_revs_diff":
+		return h.revsDiff(w, r, d)
+	case "_security":
+		return h.security(w, r, d)
+	case "_find":
+		return h.find(w, r, d)
+	case "_ensure_full_commit":
+		return h.ensureFullCommit(w, r, d)
+	case "_compact":
+		if err := allowMethods(r, http.MethodPost); err != nil {
+			return err
+		}
+		if err := d.Compact(r.Context()); err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusAccepted, map[string]bool{"ok": true})
+	case "_local", "_design":
+		if len(path) < 2 || path[1] == "" {
+			return statusError{status: http.StatusBadRequest, error: fmt.Errorf("%s document id missing", path[0])}
+		}
+		path = append([]string{path[0] + "/" + path[1]}, path[2:]...)
+	default:
+		if strings.HasPrefix(path[0], "_") {
+			return statusError{status: http.StatusNotImplemented, error: fmt.Errorf("%s is not supported", path[0])}
+		}
+	}
+	if len(path) == 1 {
+		return h.serveDoc(w, r, d, path[0])
+	}
+	return h.serveAttachment(w, r, d, path[0], strings.Join(path[1:], "/"))
+}
+
+// pathSegments returns the unescaped segments of the URL's path, so that
+// database names and document IDs may contain escaped slashes.
+func pathSegments(u *url.URL) ([]string, error) {
+	escaped := strings.Trim(u.EscapedPath(), "/")
+	if escaped == "" {
+		return nil, nil
+	}
+	segments := strings.Split(escaped, "/")
+	for i, segment := range segments {
+		var err error
+		if segments[i], err = url.PathUnescape(segment); err != nil {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid path: %w", err)}
+		}
+	}
+	return segments, nil
+}
+
+func (h *handler) serverInfo(w http.ResponseWriter, r *http.Request) error {
+	if err := allowMethods(r, http.MethodGet, http.MethodHead); err != nil {
+		return err
+	}
+	version, err := h.client.Version(r.Context())
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"couchdb": "Welcome",
+		"version": version.Version,
+		"vendor":  map[string]string{"name": version.Vendor},
+		"uuid":    h.instance,
+	})
+}
+
+// db returns the named database, which must exist.
+func (h *handler) db(ctx context.Context, dbName string) (driver.DB, error) {
+	exists, err := h.client.DBExists(ctx, dbName, kivik.Params(nil))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, statusError{status: http.StatusNotFound, error: errors.New("database does not exist")}
+	}
+	return h.client.DB(dbName, kivik.Params(nil))
+}
+
+func (h *handler) serveDB(w http.ResponseWriter, r *http.Request, dbName string) error {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return h.dbInfo(w, r, dbName)
+	case http.MethodPut:
+		if err := h.client.CreateDB(ctx, dbName, kivik.Params(queryOptions(r))); err != nil {
+			return err
+		}
+		h.dropSeqIndex(dbName)
+		return writeJSON(w, http.StatusCreated, map[string]bool{"ok": true})
+	case http.MethodDelete:
+		if err := h.client.DestroyDB(ctx, dbName, kivik.Params(nil)); err != nil {
+			return err
+		}
+		h.dropSeqIndex(dbName)
+		return writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	case http.MethodPost:
+		d, err := h.db(ctx, dbName)
+		if err != nil {
+			return err
+		}
+		defer d.Close() // nolint: errcheck
+		return h.postDoc(w, r, d)
+	}
+	return allowMethods(r, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodPost)
+}
+
+func (h *handler) dbInfo(w http.ResponseWriter, r *http.Request, dbName string) error {
+	d, err := h.db(r.Context(), dbName)
+	if err != nil {
+		return err
+	}
+	defer d.Close() // nolint: errcheck
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	idx, err := h.seqIndex(r.Context(), dbName, d)
+	if err != nil {
+		return err
+	}
+	docCount, delCount, seq := idx.counts()
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"db_name":             dbName,
+		"doc_count":           docCount,
+		"doc_del_count":       delCount,
+		"update_seq":          h.formatSeq(seq),
+		"purge_seq":           0,
+		"compact_running":     false,
+		"instance_start_time": "0",
+	})
+}
+
+func (h *handler) ensureFullCommit(w http.ResponseWriter, r *http.Request, d driver.DB) error {
+	if err := allowMethods(r, http.MethodPost); err != nil {
+		return err
+	}
+	if flusher, ok := d.(driver.Flusher); ok {
+		if err := flusher.Flush(r.Context()); err != nil {
+			return err
+		}
+	}
+	return writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"ok":                  true,
+		"instance_start_time": "0",
+	})
+}
+
+func (h *handler) security(w http.ResponseWriter, r *http.Request, d driver.DB) error {
+	secDB, ok := d.(driver.SecurityDB)
+	if !ok {
+		return statusError{status: http.StatusNotImplemented, error: errors.New("security objects are not supported")}
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		sec, err := secDB.Security(r.Context())
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, sec)
+	case http.MethodPut:
+		sec := new(driver.Security)
+		if err := decodeBody(r, sec); err != nil {
+			return err
+		}
+		if err := secDB.SetSecurity(r.Context(), sec); err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	}
+	return allowMethods(r, http.MethodGet, http.MethodHead, http.MethodPut)
+}
+
+// allowMethods returns a 405 Method Not Allowed error, unless r's method is
+// one of methods.
+func allowMethods(r *http.Request, methods ...string) error {
+	for _, method := range methods {
+		if r.Method == method {
+			return nil
+		}
+	}
+	return statusError{status: http.StatusMethodNotAllowed, error: fmt.Errorf("only %s allowed", strings.Join(methods, ","))}
+}
+
+// stringParams are the query parameters whose values are never JSON encoded.
+var stringParams = map[string]bool{
+	"rev":    true,
+	"since":  true,
+	"feed":   true,
+	"style":  true,
+	"filter": true,
+	"batch":  true,
+}
+
+// queryOptions converts r's query parameters to driver options. As with
+// CouchDB, values are JSON, except for those in stringParams, but values which
+// aren't valid JSON are taken as strings. Arrays of strings are converted to
+// []string.
+func queryOptions(r *http.Request) map[string]interface{} {
+	opts := map[string]interface{}{}
+	for key, values := range r.URL.Query() {
+		value := values[len(values)-1]
+		if stringParams[key] {
+			opts[key] = value
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			opts[key] = value
+			continue
+		}
+		if list, ok := v.([]interface{}); ok {
+			if strs, err := toStrings(list); err == nil {
+				v = strs
+			}
+		}
+		opts[key] = v
+	}
+	return opts
+}
+
+// decodeBody decodes the JSON request body into v.
+func decodeBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid request body: %w", err)}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// couchError returns the HTTP status and CouchDB error name for err.
+func couchError(err error) (int, string) {
+	status := kivik.HTTPStatus(err)
+	if name, ok := couchErrors[status]; ok {
+		return status, name
+	}
+	return status, "unknown_error"
+}
+
+// writeError writes err as a CouchDB error response.
+func writeError(w http.ResponseWriter, err error) {
+	status, name := couchError(err)
+	_ = writeJSON(w, status, map[string]string{
+		"error":  name,
+		"reason": err.Error(),
+	})
+}
+
+// newDocID returns a random document ID, for documents created without one.
+func newDocID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// copyBody copies the content of r to w, with the given status and content
+// type.
+func copyBody(w http.ResponseWriter, status int, contentType string, r io.Reader) error {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	_, err := io.Copy(w, r)
+	return err
+}
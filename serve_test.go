@@ -0,0 +1,641 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/flimzy/testy"
+
+	"github.com/go-kivik/kivik/v4"
+)
+
+func serveTestHandler(t *testing.T) http.Handler {
+	t.Helper()
+	c, _ := archiveTestClient(t)
+	h, err := NewHandler(c, kivik.Params(map[string]interface{}{
+		"poll_interval": 10 * time.Millisecond,
+		"cors_origins":  []string{"http://example.com"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// serveRequest makes a request of h, with headers given as name, value pairs.
+func serveRequest(h http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// serveJSON makes a request of h, which must return status, and decodes the
+// response.
+func serveJSON(t *testing.T, h http.Handler, status int, method, path, body string, headers ...string) map[string]interface{} {
+	t.Helper()
+	rec := serveRequest(h, method, path, body, headers...)
+	if rec.Code != status {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, status, rec.Code, rec.Body)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%s %s: %s: %s", method, path, err, rec.Body)
+	}
+	return result
+}
+
+func TestServe(t *testing.T) {
+	type tt struct {
+		method  string
+		path    string
+		body    string
+		headers []string
+		status  int
+		// want is the expected JSON response, with any values which vary
+		// replaced with "*".
+		want string
+	}
+	tests := testy.NewTable()
+	tests.Add("welcome", tt{
+		method: http.MethodGet,
+		path:   "/",
+		status: http.StatusOK,
+		want:   `{"couchdb":"Welcome","uuid":"*","vendor":{"name":"*"},"version":"*"}`,
+	})
+	tests.Add("all dbs", tt{
+		method: http.MethodGet,
+		path:   "/_all_dbs",
+		status: http.StatusOK,
+		want:   `["src"]`,
+	})
+	tests.Add("up", tt{
+		method: http.MethodGet,
+		path:   "/_up",
+		status: http.StatusOK,
+		want:   `{"status":"ok"}`,
+	})
+	tests.Add("db info", tt{
+		method: http.MethodGet,
+		path:   "/src",
+		status: http.StatusOK,
+		want:   `{"compact_running":false,"db_name":"src","doc_count":2,"doc_del_count":0,"instance_start_time":"0","purge_seq":0,"update_seq":"*"}`,
+	})
+	tests.Add("missing db", tt{
+		method: http.MethodGet,
+		path:   "/missing",
+		status: http.StatusNotFound,
+		want:   `{"error":"not_found","reason":"database does not exist"}`,
+	})
+	tests.Add("create db", tt{
+		method: http.MethodPut,
+		path:   "/new",
+		status: http.StatusCreated,
+		want:   `{"ok":true}`,
+	})
+	tests.Add("create existing db", tt{
+		method: http.MethodPut,
+		path:   "/src",
+		status: http.StatusPreconditionFailed,
+		want:   `{"error":"file_exists","reason":"*"}`,
+	})
+	tests.Add("destroy db", tt{
+		method: http.MethodDelete,
+		path:   "/src",
+		status: http.StatusOK,
+		want:   `{"ok":true}`,
+	})
+	tests.Add("get doc", tt{
+		method: http.MethodGet,
+		path:   "/src/bar",
+		status: http.StatusOK,
+		want:   `{"_id":"bar","_rev":"*","value":3}`,
+	})
+	tests.Add("missing doc", tt{
+		method: http.MethodGet,
+		path:   "/src/missing",
+		status: http.StatusNotFound,
+		want:   `{"error":"not_found","reason":"*"}`,
+	})
+	tests.Add("inline attachments", tt{
+		method: http.MethodGet,
+		path:   "/src/foo?attachments=true",
+		status: http.StatusOK,
+		want:   `{"_id":"foo","_rev":"*","_attachments":{"foo.txt":{"content_type":"text/plain","data":"VGVzdGluZw==","digest":"*","length":7,"revpos":2}},"value":2}`,
+	})
+	tests.Add("create doc", tt{
+		method: http.MethodPut,
+		path:   "/src/baz",
+		body:   `{"value":4}`,
+		status: http.StatusCreated,
+		want:   `{"ok":true,"id":"baz","rev":"*"}`,
+	})
+	tests.Add("update without rev", tt{
+		method: http.MethodPut,
+		path:   "/src/bar",
+		body:   `{"value":4}`,
+		status: http.StatusConflict,
+		want:   `{"error":"conflict","reason":"document update conflict"}`,
+	})
+	tests.Add("invalid body", tt{
+		method: http.MethodPut,
+		path:   "/src/baz",
+		body:   `[`,
+		status: http.StatusBadRequest,
+		want:   `{"error":"bad_request","reason":"*"}`,
+	})
+	tests.Add("delete without rev", tt{
+		method: http.MethodDelete,
+		path:   "/src/bar",
+		status: http.StatusConflict,
+		want:   `{"error":"conflict","reason":"document update conflict"}`,
+	})
+	tests.Add("local doc", tt{
+		method: http.MethodPut,
+		path:   "/src/_local/checkpoint",
+		body:   `{"last_seq":"1"}`,
+		status: http.StatusCreated,
+		want:   `{"ok":true,"id":"_local/checkpoint","rev":"*"}`,
+	})
+	tests.Add("design doc", tt{
+		method: http.MethodPut,
+		path:   "/src/_design/foo",
+		body:   `{"views":{}}`,
+		status: http.StatusCreated,
+		want:   `{"ok":true,"id":"_design/foo","rev":"*"}`,
+	})
+	tests.Add("escaped slash in doc id", tt{
+		method: http.MethodPut,
+		path:   "/src/a%2Fb",
+		body:   `{}`,
+		status: http.StatusCreated,
+		want:   `{"ok":true,"id":"a/b","rev":"*"}`,
+	})
+	tests.Add("unsupported endpoint", tt{
+		method: http.MethodGet,
+		path:   "/src/_design_docs",
+		status: http.StatusNotImplemented,
+		want:   `{"error":"not_implemented","reason":"_design_docs is not supported"}`,
+	})
+	tests.Add("method not allowed", tt{
+		method: http.MethodGet,
+		path:   "/src/_bulk_docs",
+		status: http.StatusMethodNotAllowed,
+		want:   `{"error":"method_not_allowed","reason":"only POST allowed"}`,
+	})
+	tests.Add("all docs", tt{
+		method: http.MethodGet,
+		path:   "/src/_all_docs",
+		status: http.StatusOK,
+		want:   `{"offset":0,"rows":[{"id":"bar","key":"bar","value":{"rev":"*"}},{"id":"foo","key":"foo","value":{"rev":"*"}}],"total_rows":2}`,
+	})
+	tests.Add("all docs with options", tt{
+		method: http.MethodGet,
+		path:   `/src/_all_docs?startkey="c"&include_docs=true`,
+		status: http.StatusOK,
+		want:   `{"offset":1,"rows":[{"id":"foo","key":"foo","value":{"rev":"*"},"doc":{"_id":"foo","_rev":"*","_attachments":"*","value":2}}],"total_rows":2}`,
+	})
+	tests.Add("all docs with keys", tt{
+		method: http.MethodPost,
+		path:   "/src/_all_docs",
+		body:   `{"keys":["foo","missing"]}`,
+		status: http.StatusOK,
+		want:   `{"offset":0,"rows":[{"id":"foo","key":"foo","value":{"rev":"*"}},{"key":"missing","error":"not_found"}],"total_rows":2}`,
+	})
+	tests.Add("security", tt{
+		method: http.MethodGet,
+		path:   "/src/_security",
+		status: http.StatusOK,
+		want:   `{"admins":{"names":["bob"]}}`,
+	})
+	tests.Add("set security", tt{
+		method: http.MethodPut,
+		path:   "/src/_security",
+		body:   `{"members":{"roles":["dev"]}}`,
+		status: http.StatusOK,
+		want:   `{"ok":true}`,
+	})
+	tests.Add("revs diff", tt{
+		method: http.MethodPost,
+		path:   "/src/_revs_diff",
+		body:   `{"bar":["1-abc"],"missing":["1-def"]}`,
+		status: http.StatusOK,
+		want:   `{"bar":{"missing":["1-abc"]},"missing":{"missing":["1-def"]}}`,
+	})
+	tests.Add("bulk docs", tt{
+		method: http.MethodPost,
+		path:   "/src/_bulk_docs",
+		body:   `{"docs":[{"_id":"new","value":5},{"_id":"bar","value":6}]}`,
+		status: http.StatusCreated,
+		want:   `[{"ok":true,"id":"new","rev":"*"},{"id":"bar","error":"conflict","reason":"document update conflict"}]`,
+	})
+	tests.Add("bulk docs, empty id", tt{
+		method: http.MethodPost,
+		path:   "/src/_bulk_docs",
+		body:   `{"docs":[{"_id":"","value":5}]}`,
+		status: http.StatusCreated,
+		want:   `[{"id":"","error":"bad_request","reason":"document id must not be empty"}]`,
+	})
+	tests.Add("post doc, empty id", tt{
+		method: http.MethodPost,
+		path:   "/src",
+		body:   `{"_id":"","value":5}`,
+		status: http.StatusBadRequest,
+		want:   `{"error":"bad_request","reason":"document id must not be empty"}`,
+	})
+	tests.Add("bulk docs, new_edits=false", tt{
+		method: http.MethodPost,
+		path:   "/src/_bulk_docs",
+		body:   `{"new_edits":false,"docs":[{"_id":"bar","_rev":"2-abc","_revisions":{"start":2,"ids":["abc","def"]},"value":6}]}`,
+		status: http.StatusCreated,
+		want:   `[]`,
+	})
+	tests.Add("bulk get", tt{
+		method: http.MethodPost,
+		path:   "/src/_bulk_get",
+		body:   `{"docs":[{"id":"bar"},{"id":"bar","rev":"1-abc"}]}`,
+		status: http.StatusOK,
+		want:   `{"results":[{"id":"bar","docs":[{"ok":{"_id":"bar","_rev":"*","_revisions":"*","value":3}}]},{"id":"bar","docs":[{"error":{"id":"bar","rev":"1-abc","error":"not_found","reason":"missing rev 1-abc"}}]}]}`,
+	})
+	tests.Add("open revs", tt{
+		method: http.MethodGet,
+		path:   `/src/bar?open_revs=["1-abc"]`,
+		status: http.StatusOK,
+		want:   `[{"missing":"1-abc"}]`,
+	})
+	tests.Add("find", tt{
+		method: http.MethodPost,
+		path:   "/src/_find",
+		body:   `{"selector":{"value":{"$gt":1}},"fields":["_id","value"],"sort":[{"value":"desc"}]}`,
+		status: http.StatusOK,
+		want:   `{"bookmark":"nil","docs":[{"_id":"bar","value":3},{"_id":"foo","value":2}],"warning":"*"}`,
+	})
+
+	tests.Run(t, func(t *testing.T, tt tt) {
+		h := serveTestHandler(t)
+		rec := serveRequest(h, tt.method, tt.path, tt.body, tt.headers...)
+		if rec.Code != tt.status {
+			t.Errorf("Unexpected status: %d", rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Unexpected Content-Type: %s", ct)
+		}
+		var want, got interface{}
+		if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %s", err, rec.Body)
+		}
+		if d := testy.DiffInterface(want, wildcard(want, got)); d != nil {
+			t.Error(d)
+		}
+	})
+}
+
+// wildcard returns got, with the values which are "*" in want replaced with
+// "*".
+func wildcard(want, got interface{}) interface{} {
+	switch w := want.(type) {
+	case string:
+		if w == "*" {
+			return "*"
+		}
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return got
+		}
+		result := make(map[string]interface{}, len(g))
+		for key, value := range g {
+			result[key] = wildcard(w[key], value)
+		}
+		return result
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return got
+		}
+		result := make([]interface{}, len(g))
+		for i, value := range g {
+			result[i] = wildcard(w[i], value)
+		}
+		return result
+	}
+	return got
+}
+
+func TestServeDocLifecycle(t *testing.T) {
+	h := serveTestHandler(t)
+	created := serveJSON(t, h, http.StatusCreated, http.MethodPost, "/src", `{"value":1}`)
+	id, rev1 := created["id"].(string), created["rev"].(string)
+	if len(id) != 32 {
+		t.Errorf("Unexpected generated ID: %s", id)
+	}
+	rec := serveRequest(h, http.MethodHead, "/src/"+id, "")
+	if etag := rec.Header().Get("ETag"); etag != `"`+rev1+`"` {
+		t.Errorf("Unexpected ETag: %s", etag)
+	}
+	if rec := serveRequest(h, http.MethodGet, "/src/"+id, "", "If-None-Match", `"`+rev1+`"`); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 Not Modified, got %d", rec.Code)
+	}
+	updated := serveJSON(t, h, http.StatusCreated, http.MethodPut, "/src/"+id+"?rev="+rev1, `{"value":2}`)
+	rev2 := updated["rev"].(string)
+	serveJSON(t, h, http.StatusConflict, http.MethodPut, "/src/"+id, `{"_rev":"`+rev1+`","value":3}`)
+	doc := serveJSON(t, h, http.StatusOK, http.MethodGet, "/src/"+id+"?rev="+rev1, "")
+	if doc["value"] != 1.0 {
+		t.Errorf("Unexpected old revision: %v", doc)
+	}
+	copied := serveJSON(t, h, http.StatusCreated, "COPY", "/src/"+id, "", "Destination", "copy")
+	if copied["id"] != "copy" {
+		t.Errorf("Unexpected copy result: %v", copied)
+	}
+	serveJSON(t, h, http.StatusOK, http.MethodDelete, "/src/"+id, "", "If-Match", `"`+rev2+`"`)
+	serveJSON(t, h, http.StatusNotFound, http.MethodGet, "/src/"+id, "")
+	doc = serveJSON(t, h, http.StatusOK, http.MethodGet, "/src/copy", "")
+	if doc["value"] != 2.0 {
+		t.Errorf("Unexpected copy: %v", doc)
+	}
+}
+
+func TestServeAttachments(t *testing.T) {
+	h := serveTestHandler(t)
+	rec := serveRequest(h, http.MethodGet, "/src/foo/foo.txt", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "Testing" || rec.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("Unexpected attachment: %d %s %s", rec.Code, rec.Header(), rec.Body)
+	}
+	rev := serveJSON(t, h, http.StatusOK, http.MethodGet, "/src/foo", "")["_rev"].(string)
+	rec = serveRequest(h, http.MethodPut, "/src/foo/bar.html?rev="+rev, "<p>bar</p>", "Content-Type", "text/html")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status putting attachment: %d %s", rec.Code, rec.Body)
+	}
+	var result map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &result)
+	rev = result["rev"].(string)
+	rec = serveRequest(h, http.MethodGet, "/src/foo/bar.html", "")
+	if rec.Body.String() != "<p>bar</p>" || rec.Header().Get("Content-Type") != "text/html" {
+		t.Errorf("Unexpected attachment: %s %s", rec.Header(), rec.Body)
+	}
+	rec = serveRequest(h, http.MethodHead, "/src/foo/foo.txt", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "7" || rec.Body.Len() != 0 {
+		t.Errorf("Unexpected HEAD response: %d %s %q", rec.Code, rec.Header(), rec.Body)
+	}
+	serveJSON(t, h, http.StatusOK, http.MethodDelete, "/src/foo/foo.txt?rev="+rev, "")
+	serveJSON(t, h, http.StatusNotFound, http.MethodGet, "/src/foo/foo.txt", "")
+	serveJSON(t, h, http.StatusNotFound, http.MethodGet, "/src/missing/foo.txt", "")
+}
+
+func TestServeMultipart(t *testing.T) {
+	h := serveTestHandler(t)
+	rec := serveRequest(h, http.MethodGet, "/src/foo?attachments=true", "", "Accept", "multipart/related")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %d %s", rec.Code, rec.Body)
+	}
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		t.Fatalf("Unexpected Content-Type: %s", rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.NewDecoder(part).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	att := doc["_attachments"].(map[string]interface{})["foo.txt"].(map[string]interface{})
+	if att["follows"] != true {
+		t.Errorf("Expected foo.txt to follow: %v", att)
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(part)
+	if part.FileName() != "foo.txt" || string(content) != "Testing" {
+		t.Errorf("Unexpected attachment part %s: %q", part.FileName(), content)
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("Expected no more parts, got %v", err)
+	}
+
+	// Store the same multipart body as a new document, as the CouchDB
+	// replicator does.
+	rec = serveRequest(h, http.MethodPut, "/src/copy?new_edits=false", body, "Content-Type", rec.Header().Get("Content-Type"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status: %d %s", rec.Code, rec.Body)
+	}
+	rec = serveRequest(h, http.MethodGet, "/src/copy/foo.txt", "")
+	if rec.Body.String() != "Testing" {
+		t.Errorf("Unexpected attachment content: %s", rec.Body)
+	}
+	doc = serveJSON(t, h, http.StatusOK, http.MethodGet, "/src/copy", "")
+	if doc["_rev"] != serveJSON(t, h, http.StatusOK, http.MethodGet, "/src/foo", "")["_rev"] {
+		t.Errorf("Expected the revision to be kept: %v", doc)
+	}
+}
+
+func TestServeOpenRevsAll(t *testing.T) {
+	h := serveTestHandler(t)
+	rev := serveJSON(t, h, http.StatusOK, http.MethodGet, "/src/bar", "")["_rev"].(string)
+	serveJSON(t, h, http.StatusCreated, http.MethodPut, "/src/bar?new_edits=false", `{"_rev":"2-zzz","_revisions":{"start":2,"ids":["zzz","aaa"]},"value":4}`)
+	rec := serveRequest(h, http.MethodGet, "/src/bar?open_revs=all", "")
+	var results []map[string]map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%s: %s", err, rec.Body)
+	}
+	revs := make([]string, len(results))
+	for i, result := range results {
+		revs[i], _ = result["ok"]["_rev"].(string)
+	}
+	if d := testy.DiffInterface([]string{"2-zzz", rev}, revs); d != nil {
+		t.Error(d)
+	}
+	serveJSON(t, h, http.StatusNotFound, http.MethodGet, "/src/missing?open_revs=all", "")
+}
+
+// changesResult is the response of a normal or longpoll changes feed.
+type changesResult struct {
+	Results []struct {
+		ID      string `json:"id"`
+		Seq     string `json:"seq"`
+		Deleted bool   `json:"deleted"`
+		Changes []struct {
+			Rev string `json:"rev"`
+		} `json:"changes"`
+		Doc map[string]interface{} `json:"doc"`
+	} `json:"results"`
+	LastSeq string `json:"last_seq"`
+}
+
+func (r *changesResult) ids() []string {
+	ids := make([]string, len(r.Results))
+	for i, result := range r.Results {
+		ids[i] = result.ID
+	}
+	return ids
+}
+
+func getChanges(t *testing.T, h http.Handler, method, path, body string) *changesResult {
+	t.Helper()
+	rec := serveRequest(h, method, path, body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %d %s", rec.Code, rec.Body)
+	}
+	result := new(changesResult)
+	if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+		t.Fatalf("%s: %s", err, rec.Body)
+	}
+	return result
+}
+
+func TestServeChanges(t *testing.T) {
+	h := serveTestHandler(t)
+	all := getChanges(t, h, http.MethodGet, "/src/_changes", "")
+	if d := testy.DiffInterface([]string{"bar", "foo"}, all.ids()); d != nil {
+		t.Error(d)
+	}
+	info := serveJSON(t, h, http.StatusOK, http.MethodGet, "/src", "")
+	if all.LastSeq != info["update_seq"] {
+		t.Errorf("Expected last_seq %s to be the update_seq %v", all.LastSeq, info["update_seq"])
+	}
+	if none := getChanges(t, h, http.MethodGet, "/src/_changes?since="+all.LastSeq, ""); len(none.Results) != 0 || none.LastSeq != all.LastSeq {
+		t.Errorf("Expected no changes, got %+v", none)
+	}
+	if foreign := getChanges(t, h, http.MethodGet, "/src/_changes?since=2-abcdef", ""); len(foreign.Results) != 2 {
+		t.Errorf("Expected all changes for a foreign seq, got %+v", foreign)
+	}
+	limited := getChanges(t, h, http.MethodGet, "/src/_changes?limit=1", "")
+	if d := testy.DiffInterface([]string{"bar"}, limited.ids()); d != nil {
+		t.Error(d)
+	}
+	rest := getChanges(t, h, http.MethodGet, "/src/_changes?since="+limited.LastSeq, "")
+	if d := testy.DiffInterface([]string{"foo"}, rest.ids()); d != nil {
+		t.Error(d)
+	}
+
+	rev := all.Results[0].Changes[0].Rev
+	serveJSON(t, h, http.StatusOK, http.MethodDelete, "/src/bar?rev="+rev, "")
+	deleted := getChanges(t, h, http.MethodGet, "/src/_changes?include_docs=true&since="+all.LastSeq, "")
+	if len(deleted.Results) != 1 || !deleted.Results[0].Deleted || deleted.Results[0].Doc["_deleted"] != true {
+		t.Errorf("Expected bar to be deleted, got %+v", deleted)
+	}
+	info = serveJSON(t, h, http.StatusOK, http.MethodGet, "/src", "")
+	if info["doc_count"] != 1.0 || info["doc_del_count"] != 1.0 {
+		t.Errorf("Unexpected counts: %v", info)
+	}
+
+	byID := getChanges(t, h, http.MethodPost, "/src/_changes?filter=_doc_ids", `{"doc_ids":["foo"]}`)
+	if d := testy.DiffInterface([]string{"foo"}, byID.ids()); d != nil {
+		t.Error(d)
+	}
+	bySelector := getChanges(t, h, http.MethodPost, "/src/_changes?filter=_selector", `{"selector":{"value":2}}`)
+	if d := testy.DiffInterface([]string{"foo"}, bySelector.ids()); d != nil {
+		t.Error(d)
+	}
+	if bySelector.Results[0].Doc != nil {
+		t.Errorf("Expected no doc without include_docs")
+	}
+	serveJSON(t, h, http.StatusBadRequest, http.MethodGet, "/src/_changes?feed=eventsource", "")
+	serveJSON(t, h, http.StatusNotImplemented, http.MethodGet, "/src/_changes?filter=app/filter", "")
+}
+
+func TestServeChangesLongpoll(t *testing.T) {
+	h := serveTestHandler(t)
+	now := getChanges(t, h, http.MethodGet, "/src/_changes?feed=longpoll&since=now&timeout=20", "")
+	if len(now.Results) != 0 {
+		t.Errorf("Expected no changes before the timeout, got %+v", now)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		serveRequest(h, http.MethodPut, "/src/new", `{}`)
+	}()
+	changes := getChanges(t, h, http.MethodGet, "/src/_changes?feed=longpoll&since="+now.LastSeq, "")
+	if d := testy.DiffInterface([]string{"new"}, changes.ids()); d != nil {
+		t.Error(d)
+	}
+}
+
+func TestServeChangesContinuous(t *testing.T) {
+	h := serveTestHandler(t)
+	put := make(chan struct{})
+	go func() {
+		defer close(put)
+		time.Sleep(50 * time.Millisecond)
+		serveRequest(h, http.MethodPut, "/src/new", `{}`)
+	}()
+	rec := serveRequest(h, http.MethodGet, "/src/_changes?feed=continuous&limit=3&heartbeat=10", "")
+	// The feed may end before the update has released its locks.
+	<-put
+	var ids []string
+	var lastSeq string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		var row struct {
+			ID      string `json:"id"`
+			LastSeq string `json:"last_seq"`
+		}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatalf("%s: %q", err, line)
+		}
+		if row.LastSeq != "" {
+			lastSeq = row.LastSeq
+			continue
+		}
+		ids = append(ids, row.ID)
+	}
+	if d := testy.DiffInterface([]string{"bar", "foo", "new"}, ids); d != nil {
+		t.Error(d)
+	}
+	if !strings.Contains(rec.Body.String(), "}\n\n") {
+		t.Errorf("Expected a heartbeat while waiting: %q", rec.Body)
+	}
+	if info := serveJSON(t, h, http.StatusOK, http.MethodGet, "/src", ""); info["update_seq"] != lastSeq {
+		t.Errorf("Expected last_seq %s to be the update_seq %v", lastSeq, info["update_seq"])
+	}
+}
+
+func TestServeCORS(t *testing.T) {
+	h := serveTestHandler(t)
+	rec := serveRequest(h, http.MethodOptions, "/src", "", "Origin", "http://example.com", "Access-Control-Request-Method", "PUT")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "http://example.com" {
+		t.Errorf("Unexpected preflight response: %d %s", rec.Code, rec.Header())
+	}
+	rec = serveRequest(h, http.MethodGet, "/src", "", "Origin", "http://example.com")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "http://example.com" {
+		t.Errorf("Expected an allowed origin: %s", rec.Header())
+	}
+	rec = serveRequest(h, http.MethodGet, "/src", "", "Origin", "http://other.com")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected other origins not to be allowed: %s", rec.Header())
+	}
+}
@@ -0,0 +1,482 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+// seqIndex assigns update sequence numbers to the documents of a database,
+// which has none of its own. Each time the database is scanned, documents
+// whose leaf revisions or deleted status have changed since the last scan are
+// given the next sequence numbers. Sequence numbers are only meaningful for the
+// life of the handler; a client with a sequence ID from another instance
+// starts again from the beginning, as though the database had been recreated.
+type seqIndex struct {
+	mu   sync.Mutex
+	seq  int64
+	docs map[string]*seqEntry
+}
+
+type seqEntry struct {
+	id      string
+	seq     int64
+	revs    []string
+	deleted bool
+}
+
+func (e *seqEntry) changed(old *seqEntry) bool {
+	if old == nil || old.deleted != e.deleted || len(old.revs) != len(e.revs) {
+		return true
+	}
+	for i, rev := range e.revs {
+		if old.revs[i] != rev {
+			return true
+		}
+	}
+	return false
+}
+
+// seqIndex returns the sequence index of the database, brought up to date.
+func (h *handler) seqIndex(ctx context.Context, dbName string, d driver.DB) (*seqIndex, error) {
+	h.mu.Lock()
+	idx, ok := h.seqs[dbName]
+	if !ok {
+		idx = &seqIndex{docs: map[string]*seqEntry{}}
+		h.seqs[dbName] = idx
+	}
+	h.mu.Unlock()
+	return idx, idx.refresh(ctx, d)
+}
+
+// dropSeqIndex forgets the sequence index of a database which has been
+// created or destroyed.
+func (h *handler) dropSeqIndex(dbName string) {
+	h.mu.Lock()
+	delete(h.seqs, dbName)
+	h.mu.Unlock()
+}
+
+// refresh rescans the database.
+func (idx *seqIndex) refresh(ctx context.Context, d driver.DB) error {
+	changes, err := d.Changes(ctx, kivik.Param("style", "all_docs"))
+	if err != nil {
+		return err
+	}
+	defer changes.Close() // nolint: errcheck
+	var entries []*seqEntry
+	for {
+		ch := new(driver.Change)
+		if err := changes.Next(ch); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if strings.HasPrefix(ch.ID, "_local/") {
+			continue
+		}
+		entries = append(entries, &seqEntry{id: ch.ID, revs: ch.Changes, deleted: ch.Deleted})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	docs := make(map[string]*seqEntry, len(entries))
+	for _, entry := range entries {
+		old := idx.docs[entry.id]
+		if entry.changed(old) {
+			idx.seq++
+			entry.seq = idx.seq
+		} else {
+			entry = old
+		}
+		docs[entry.id] = entry
+	}
+	idx.docs = docs
+	return nil
+}
+
+// since returns the entries with sequence numbers greater than seq, in order,
+// and the current sequence number.
+func (idx *seqIndex) since(seq int64) ([]*seqEntry, int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var entries []*seqEntry
+	for _, entry := range idx.docs {
+		if entry.seq > seq {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries, idx.seq
+}
+
+// counts returns the numbers of live and deleted documents, and the current
+// sequence number.
+func (idx *seqIndex) counts() (docs, deleted int, seq int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, entry := range idx.docs {
+		if entry.deleted {
+			deleted++
+		} else {
+			docs++
+		}
+	}
+	return docs, deleted, idx.seq
+}
+
+func (h *handler) formatSeq(seq int64) string {
+	return strconv.FormatInt(seq, 10) + "-" + h.instance
+}
+
+// parseSeq returns the sequence number of a since parameter. Sequence IDs
+// issued by other instances are taken as 0.
+func (h *handler) parseSeq(since string, current int64) int64 {
+	if since == "now" {
+		return current
+	}
+	i := strings.Index(since, "-")
+	if i < 0 || since[i+1:] != h.instance {
+		return 0
+	}
+	seq, err := strconv.ParseInt(since[:i], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+// changesRow is a single result of the changes feed.
+type changesRow struct {
+	Seq     string              `json:"seq"`
+	ID      string              `json:"id"`
+	Changes []map[string]string `json:"changes"`
+	Deleted bool                `json:"deleted,omitempty"`
+	Doc     json.RawMessage     `json:"doc,omitempty"`
+}
+
+// changesFeed holds the parameters of a changes request.
+type changesFeed struct {
+	h           *handler
+	d           driver.DB
+	feed        string
+	allDocs     bool
+	includeDocs bool
+	limit       int
+	heartbeat   time.Duration
+	timeout     time.Duration
+	docIDs      map[string]bool
+	selector    matcher
+}
+
+// changes serves the changes feed. The normal, longpoll and continuous feeds
+// are supported, with the _doc_ids and _selector filters. Longpoll and
+// continuous feeds find changes by rescanning the database every poll
+// interval.
+func (h *handler) changes(w http.ResponseWriter, r *http.Request, dbName string, d driver.DB) error {
+	if err := allowMethods(r, http.MethodGet, http.MethodHead, http.MethodPost); err != nil {
+		return err
+	}
+	opts := queryOptions(r)
+	feed, err := h.newChangesFeed(r, d, opts)
+	if err != nil {
+		return err
+	}
+	idx, err := h.seqIndex(r.Context(), dbName, d)
+	if err != nil {
+		return err
+	}
+	_, current := idx.since(0)
+	since, _ := opts["since"].(string)
+	return feed.serve(w, r, idx, h.parseSeq(since, current))
+}
+
+func (h *handler) newChangesFeed(r *http.Request, d driver.DB, opts map[string]interface{}) (*changesFeed, error) {
+	f := &changesFeed{
+		h:       h,
+		d:       d,
+		feed:    "normal",
+		timeout: defaultFeedTimeout,
+	}
+	var err error
+	switch feed, _ := opts["feed"].(string); feed {
+	case "", "normal":
+	case "longpoll", "continuous":
+		f.feed = feed
+	default:
+		return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("unsupported feed: %s", feed)}
+	}
+	switch style, _ := opts["style"].(string); style {
+	case "", "main_only":
+	case "all_docs":
+		f.allDocs = true
+	default:
+		return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid style: %s", style)}
+	}
+	if f.includeDocs, err = boolOption(opts, "include_docs"); err != nil {
+		return nil, err
+	}
+	if f.limit, err = intOption(opts, "limit", -1); err != nil {
+		return nil, err
+	}
+	if timeout, ok := opts["timeout"]; ok {
+		ms, err := intOption(opts, "timeout", 0)
+		if err != nil {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for timeout: %v", timeout)}
+		}
+		f.timeout = time.Duration(ms) * time.Millisecond
+	}
+	switch heartbeat := opts["heartbeat"].(type) {
+	case nil:
+	case bool:
+		if heartbeat {
+			f.heartbeat = defaultFeedTimeout
+		}
+	default:
+		ms, err := intOption(opts, "heartbeat", 0)
+		if err != nil {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for heartbeat: %v", heartbeat)}
+		}
+		f.heartbeat = time.Duration(ms) * time.Millisecond
+	}
+	var body struct {
+		DocIDs   []string    `json:"doc_ids"`
+		Selector interface{} `json:"selector"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid request body: %w", err)}
+		}
+	}
+	if docIDs, ok := opts["doc_ids"]; ok {
+		if body.DocIDs, err = toStrings(docIDs); err != nil {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for doc_ids: %v", docIDs)}
+		}
+	}
+	switch filter, _ := opts["filter"].(string); filter {
+	case "", "_doc_ids":
+		if filter != "" && body.DocIDs == nil {
+			return nil, statusError{status: http.StatusBadRequest, error: errors.New("filter=_doc_ids requires doc_ids")}
+		}
+		if body.DocIDs != nil {
+			f.docIDs = make(map[string]bool, len(body.DocIDs))
+			for _, id := range body.DocIDs {
+				f.docIDs[id] = true
+			}
+		}
+	case "_selector":
+		if body.Selector == nil {
+			return nil, statusError{status: http.StatusBadRequest, error: errors.New("filter=_selector requires a selector")}
+		}
+		if f.selector, err = compileSelector(body.Selector); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, statusError{status: http.StatusNotImplemented, error: fmt.Errorf("filter %s is not supported", filter)}
+	}
+	return f, nil
+}
+
+// serve writes the changes since the sequence number since. A normal feed
+// ends at once; a longpoll feed once it has any results, and a continuous
+// feed when the limit is reached, or after the timeout, unless heartbeats are
+// requested.
+func (f *changesFeed) serve(w http.ResponseWriter, r *http.Request, idx *seqIndex, since int64) error {
+	ctx := r.Context()
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	streaming := f.feed != "normal"
+	if streaming {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		flush()
+	}
+	// fail reports an error after the response has begun, which can then only
+	// end the feed.
+	fail := func(err error) error {
+		if !streaming {
+			return err
+		}
+		status, name := couchError(err)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  name,
+			"reason": err.Error(),
+			"status": status,
+		})
+		return nil
+	}
+	var deadline <-chan time.Time
+	if f.heartbeat == 0 {
+		timer := time.NewTimer(f.timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var heartbeat <-chan time.Time
+	if f.heartbeat > 0 {
+		ticker := time.NewTicker(f.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	results := make([]*changesRow, 0)
+	lastSeq := since
+	sent := 0
+feed:
+	for {
+		entries, current := idx.since(lastSeq)
+		for _, entry := range entries {
+			if f.limit >= 0 && sent >= f.limit {
+				break feed
+			}
+			lastSeq = entry.seq
+			row, err := f.row(ctx, entry)
+			if err != nil {
+				return fail(err)
+			}
+			if row == nil {
+				continue
+			}
+			sent++
+			if f.feed == "continuous" {
+				if err := json.NewEncoder(w).Encode(row); err != nil {
+					return nil
+				}
+				flush()
+				continue
+			}
+			results = append(results, row)
+		}
+		lastSeq = current
+		if f.feed == "normal" || (f.feed == "longpoll" && sent > 0) || (f.limit >= 0 && sent >= f.limit) {
+			break
+		}
+		poll := time.NewTimer(f.h.pollInterval)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				poll.Stop()
+				return nil
+			case <-deadline:
+				poll.Stop()
+				break feed
+			case <-heartbeat:
+				if _, err := io.WriteString(w, "\n"); err != nil {
+					poll.Stop()
+					return nil
+				}
+				flush()
+			case <-poll.C:
+				break wait
+			}
+		}
+		if err := idx.refresh(ctx, f.d); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fail(err)
+		}
+	}
+	if f.feed == "continuous" {
+		return json.NewEncoder(w).Encode(map[string]interface{}{
+			"last_seq": f.h.formatSeq(lastSeq),
+			"pending":  0,
+		})
+	}
+	body := map[string]interface{}{
+		"results":  results,
+		"last_seq": f.h.formatSeq(lastSeq),
+		"pending":  0,
+	}
+	if streaming {
+		return json.NewEncoder(w).Encode(body)
+	}
+	return writeJSON(w, http.StatusOK, body)
+}
+
+// row returns the result row for entry, or nil if it is filtered out.
+func (f *changesFeed) row(ctx context.Context, entry *seqEntry) (*changesRow, error) {
+	if f.docIDs != nil && !f.docIDs[entry.id] {
+		return nil, nil
+	}
+	revs := entry.revs
+	if !f.allDocs && len(revs) > 1 {
+		revs = revs[:1]
+	}
+	row := &changesRow{
+		Seq:     f.h.formatSeq(entry.seq),
+		ID:      entry.id,
+		Changes: make([]map[string]string, len(revs)),
+		Deleted: entry.deleted,
+	}
+	for i, rev := range revs {
+		row.Changes[i] = map[string]string{"rev": rev}
+	}
+	if !f.includeDocs && f.selector == nil {
+		return row, nil
+	}
+	if entry.deleted {
+		if f.selector != nil {
+			return nil, nil
+		}
+		row.Doc, _ = json.Marshal(map[string]interface{}{
+			"_id":      entry.id,
+			"_rev":     entry.revs[0],
+			"_deleted": true,
+		})
+		return row, nil
+	}
+	doc, err := f.d.Get(ctx, entry.id, kivik.Params(nil))
+	if kivik.HTTPStatus(err) == http.StatusNotFound {
+		// Changed since the last scan; it will be reported again.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Body.Close() // nolint: errcheck
+	raw, err := io.ReadAll(doc.Body)
+	if err != nil {
+		return nil, err
+	}
+	if f.selector != nil {
+		var body interface{}
+		if err := json.Unmarshal(raw, &body); err != nil {
+			return nil, err
+		}
+		if !f.selector(body) {
+			return nil, nil
+		}
+	}
+	if f.includeDocs {
+		row.Doc = raw
+	}
+	return row, nil
+}
@@ -0,0 +1,691 @@
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/driver"
+)
+
+func (h *handler) serveDoc(w http.ResponseWriter, r *http.Request, d driver.DB, docID string) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return h.getDoc(w, r, d, docID)
+	case http.MethodPut:
+		return h.putDoc(w, r, d, docID)
+	case http.MethodDelete:
+		opts := revOptions(r)
+		rev, err := d.Delete(r.Context(), docID, kivik.Params(opts))
+		if err != nil {
+			return err
+		}
+		return writeDocResult(w, http.StatusOK, docID, rev)
+	case "COPY":
+		return h.copyDoc(w, r, d, docID)
+	}
+	return allowMethods(r, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, "COPY")
+}
+
+// getDoc writes the requested document. If attachment content is requested,
+// and the client accepts multipart/related, the content of attachments is
+// sent in parts following the document, as CouchDB does, rather than inline.
+func (h *handler) getDoc(w http.ResponseWriter, r *http.Request, d driver.DB, docID string) error {
+	opts := queryOptions(r)
+	if openRevs, ok := opts["open_revs"]; ok {
+		return h.openRevs(w, r, d, docID, openRevs, opts)
+	}
+	attachments, _ := opts["attachments"].(bool)
+	multipartDoc := attachments && strings.Contains(r.Header.Get("Accept"), "multipart/related")
+	if multipartDoc {
+		opts["header:accept"] = "multipart/related"
+	} else {
+		opts["header:accept"] = "application/json"
+	}
+	doc, err := d.Get(r.Context(), docID, kivik.Params(opts))
+	if err != nil {
+		return err
+	}
+	defer doc.Body.Close() // nolint: errcheck
+	var atts []*driver.Attachment
+	if doc.Attachments != nil {
+		defer doc.Attachments.Close() // nolint: errcheck
+		if atts, err = followingAttachmentContent(doc.Attachments); err != nil {
+			return err
+		}
+	}
+	etag := `"` + doc.Rev + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if len(atts) == 0 {
+		return copyBody(w, http.StatusOK, "application/json", doc.Body)
+	}
+	return writeMultipartDoc(w, doc.Body, atts)
+}
+
+// followingAttachmentContent returns those attachments whose content follows
+// the document, sorted by filename, which is the order in which they appear in
+// the document's JSON. The content of the others is closed.
+func followingAttachmentContent(iter driver.Attachments) ([]*driver.Attachment, error) {
+	var atts []*driver.Attachment
+	for {
+		att := new(driver.Attachment)
+		err := iter.Next(att)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !att.Follows {
+			_ = att.Content.Close()
+			continue
+		}
+		atts = append(atts, att)
+	}
+	sort.Slice(atts, func(i, j int) bool { return atts[i].Filename < atts[j].Filename })
+	return atts, nil
+}
+
+// writeMultipartDoc writes a multipart/related response, with the document as
+// the first part, followed by a part for each attachment.
+func writeMultipartDoc(w http.ResponseWriter, body io.Reader, atts []*driver.Attachment) error {
+	defer func() {
+		for _, att := range atts {
+			_ = att.Content.Close()
+		}
+	}()
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", mime.FormatMediaType("multipart/related", map[string]string{"boundary": mw.Boundary()}))
+	w.WriteHeader(http.StatusOK)
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, body); err != nil {
+		return err
+	}
+	for _, att := range atts {
+		header := textproto.MIMEHeader{
+			"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename})},
+			"Content-Type":        {att.ContentType},
+			"Content-Length":      {strconv.FormatInt(att.Size, 10)},
+		}
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, att.Content); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// openRevs writes the requested revisions of the document, or all of its
+// leaves, as a JSON array, as for the open_revs parameter in CouchDB.
+func (h *handler) openRevs(w http.ResponseWriter, r *http.Request, d driver.DB, docID string, openRevs interface{}, opts map[string]interface{}) error {
+	getter, ok := d.(driver.BulkGetter)
+	if !ok {
+		return statusError{status: http.StatusNotImplemented, error: errors.New("open_revs is not supported")}
+	}
+	var revs []string
+	if openRevs == "all" {
+		var err error
+		if revs, err = leafRevisions(r.Context(), d, docID); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if revs, err = toStrings(openRevs); err != nil {
+			return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid value for open_revs: %v", openRevs)}
+		}
+	}
+	attsSince, _ := opts["atts_since"].([]string)
+	refs := make([]driver.BulkGetReference, len(revs))
+	for i, rev := range revs {
+		refs[i] = driver.BulkGetReference{ID: docID, Rev: rev, AttsSince: attsSince}
+	}
+	rows, err := getter.BulkGet(r.Context(), refs, kivik.Params(opts))
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	results := make([]map[string]interface{}, 0, len(revs))
+	for _, rev := range revs {
+		row := new(driver.Row)
+		if err := rows.Next(row); err != nil {
+			return err
+		}
+		if row.Error != nil {
+			if kivik.HTTPStatus(row.Error) != http.StatusNotFound {
+				return row.Error
+			}
+			results = append(results, map[string]interface{}{"missing": rev})
+			continue
+		}
+		doc, err := readRaw(row.Doc)
+		if err != nil {
+			return err
+		}
+		results = append(results, map[string]interface{}{"ok": doc})
+	}
+	return writeJSON(w, http.StatusOK, results)
+}
+
+// leafRevisions returns the leaf revisions of the document, from the
+// all_docs style changes feed.
+func leafRevisions(ctx context.Context, d driver.DB, docID string) ([]string, error) {
+	changes, err := d.Changes(ctx, kivik.Param("style", "all_docs"))
+	if err != nil {
+		return nil, err
+	}
+	defer changes.Close() // nolint: errcheck
+	ch := new(driver.Change)
+	for {
+		if err := changes.Next(ch); err != nil {
+			if err == io.EOF {
+				return nil, statusError{status: http.StatusNotFound, error: errors.New("missing")}
+			}
+			return nil, err
+		}
+		if ch.ID == docID {
+			return ch.Changes, nil
+		}
+	}
+}
+
+func (h *handler) putDoc(w http.ResponseWriter, r *http.Request, d driver.DB, docID string) error {
+	doc, err := readDocBody(r)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_id")
+	opts := revOptions(r)
+	rev, err := d.Put(r.Context(), docID, doc, kivik.Params(opts))
+	if err != nil {
+		return err
+	}
+	status := http.StatusCreated
+	if opts["batch"] == "ok" {
+		status = http.StatusAccepted
+	}
+	return writeDocResult(w, status, docID, rev)
+}
+
+func (h *handler) postDoc(w http.ResponseWriter, r *http.Request, d driver.DB) error {
+	doc, err := readDocBody(r)
+	if err != nil {
+		return err
+	}
+	docID, err := bodyDocID(doc)
+	if err != nil {
+		return err
+	}
+	opts := queryOptions(r)
+	rev, err := d.Put(r.Context(), docID, doc, kivik.Params(opts))
+	if err != nil {
+		return err
+	}
+	status := http.StatusCreated
+	if opts["batch"] == "ok" {
+		status = http.StatusAccepted
+	}
+	return writeDocResult(w, status, docID, rev)
+}
+
+// bodyDocID removes and returns the _id field of doc, or a new document ID,
+// if it has none.
+func bodyDocID(doc map[string]json.RawMessage) (string, error) {
+	raw, ok := doc["_id"]
+	if !ok {
+		return newDocID()
+	}
+	delete(doc, "_id")
+	var docID string
+	if err := json.Unmarshal(raw, &docID); err != nil {
+		return "", statusError{status: http.StatusBadRequest, error: errors.New("invalid _id")}
+	}
+	if docID == "" {
+		return "", statusError{status: http.StatusBadRequest, error: errors.New("document id must not be empty")}
+	}
+	return docID, nil
+}
+
+func (h *handler) copyDoc(w http.ResponseWriter, r *http.Request, d driver.DB, docID string) error {
+	copier, ok := d.(driver.Copier)
+	if !ok {
+		return statusError{status: http.StatusNotImplemented, error: errors.New("COPY is not supported")}
+	}
+	dest := r.Header.Get("Destination")
+	if dest == "" {
+		return statusError{status: http.StatusBadRequest, error: errors.New("destination header is mandatory for COPY")}
+	}
+	rev, err := copier.Copy(r.Context(), dest, docID, kivik.Params(queryOptions(r)))
+	if err != nil {
+		return err
+	}
+	targetID, _ := parseDestination(dest)
+	return writeDocResult(w, http.StatusCreated, targetID, rev)
+}
+
+// revOptions returns the query options of r, with the rev option taken from
+// the If-Match header, if not given in the query.
+func revOptions(r *http.Request) map[string]interface{} {
+	opts := queryOptions(r)
+	if _, ok := opts["rev"]; !ok {
+		if rev := strings.Trim(r.Header.Get("If-Match"), `"`); rev != "" {
+			opts["rev"] = rev
+		}
+	}
+	return opts
+}
+
+func writeDocResult(w http.ResponseWriter, status int, docID, rev string) error {
+	w.Header().Set("ETag", `"`+rev+`"`)
+	return writeJSON(w, status, map[string]interface{}{
+		"ok":  true,
+		"id":  docID,
+		"rev": rev,
+	})
+}
+
+// readDocBody reads the document in the request body, which may be JSON, or
+// multipart/related, with the document's JSON as the first part, and the
+// content of its attachments marked with "follows" as the following parts.
+// Such attachments are converted to inline attachments.
+func readDocBody(r *http.Request) (map[string]json.RawMessage, error) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/related" {
+		var doc map[string]json.RawMessage
+		if err := decodeBody(r, &doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid multipart body: %w", err)}
+	}
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(part).Decode(&doc); err != nil {
+		return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid request body: %w", err)}
+	}
+	following, err := followingAttachments(doc["_attachments"])
+	if err != nil {
+		return nil, err
+	}
+	var atts map[string]map[string]interface{}
+	if len(following) > 0 {
+		if err := json.Unmarshal(doc["_attachments"], &atts); err != nil {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid _attachments: %w", err)}
+		}
+	}
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid multipart body: %w", err)}
+		}
+		filename := part.FileName()
+		if filename == "" {
+			if i >= len(following) {
+				return nil, statusError{status: http.StatusBadRequest, error: errors.New("unexpected attachment part")}
+			}
+			filename = following[i]
+		}
+		att, ok := atts[filename]
+		if !ok {
+			return nil, statusError{status: http.StatusBadRequest, error: fmt.Errorf("attachment %s not found in document", filename)}
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range []string{"follows", "length", "digest"} {
+			delete(att, key)
+		}
+		if _, ok := att["content_type"]; !ok {
+			att["content_type"] = part.Header.Get("Content-Type")
+		}
+		att["data"] = content
+	}
+	if atts != nil {
+		if doc["_attachments"], err = json.Marshal(atts); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// followingAttachments returns the names of the attachments marked with
+// "follows", in the order in which they appear.
+func followingAttachments(atts json.RawMessage) ([]string, error) {
+	if len(atts) == 0 {
+		return nil, nil
+	}
+	invalid := func(err error) error {
+		return statusError{status: http.StatusBadRequest, error: fmt.Errorf("invalid _attachments: %w", err)}
+	}
+	dec := json.NewDecoder(bytes.NewReader(atts))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, invalid(errors.New("not an object"))
+	}
+	var following []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, invalid(err)
+		}
+		var att struct {
+			Follows bool `json:"follows"`
+		}
+		if err := dec.Decode(&att); err != nil {
+			return nil, invalid(err)
+		}
+		if att.Follows {
+			following = append(following, tok.(string))
+		}
+	}
+	return following, nil
+}
+
+func (h *handler) serveAttachment(w http.ResponseWriter, r *http.Request, d driver.DB, docID, filename string) error {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		att, err := d.GetAttachment(ctx, docID, filename, kivik.Params(queryOptions(r)))
+		if err != nil {
+			return err
+		}
+		defer att.Content.Close() // nolint: errcheck
+		contentType := att.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(att.Size, 10))
+		if att.Digest != "" {
+			w.Header().Set("ETag", `"`+att.Digest+`"`)
+		}
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}
+		return copyBody(w, http.StatusOK, contentType, att.Content)
+	case http.MethodPut:
+		rev, err := d.PutAttachment(ctx, docID, &driver.Attachment{
+			Filename:    filename,
+			ContentType: r.Header.Get("Content-Type"),
+			Content:     r.Body,
+		}, kivik.Params(revOptions(r)))
+		if err != nil {
+			return err
+		}
+		return writeDocResult(w, http.StatusCreated, docID, rev)
+	case http.MethodDelete:
+		rev, err := d.DeleteAttachment(ctx, docID, filename, kivik.Params(revOptions(r)))
+		if err != nil {
+			return err
+		}
+		return writeDocResult(w, http.StatusOK, docID, rev)
+	}
+	return allowMethods(r, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+}
+
+type allDocsRow struct {
+	ID    string          `json:"id,omitempty"`
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Doc   json.RawMessage `json:"doc,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+func (h *handler) allDocs(w http.ResponseWriter, r *http.Request, d driver.DB) error {
+	opts := queryOptions(r)
+	var keys []string
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		var body struct {
+			Keys []string `json:"keys"`
+		}
+		if err := decodeBody(r, &body); err != nil {
+			return err
+		}
+		keys = body.Keys
+	default:
+		return allowMethods(r, http.MethodGet, http.MethodHead, http.MethodPost)
+	}
+	if keys != nil {
+		opts["limit"] = 0
+	}
+	rows, err := d.AllDocs(r.Context(), kivik.Params(opts))
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	result := make([]*allDocsRow, 0)
+	for {
+		row := new(driver.Row)
+		if err := rows.Next(row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		out := &allDocsRow{ID: row.ID, Key: row.Key}
+		if out.Value, err = readRaw(row.Value); err != nil {
+			return err
+		}
+		if out.Doc, err = readRaw(row.Doc); err != nil {
+			return err
+		}
+		result = append(result, out)
+	}
+	if keys != nil {
+		includeDocs, _ := opts["include_docs"].(bool)
+		if result, err = keyedRows(r.Context(), d, keys, includeDocs); err != nil {
+			return err
+		}
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_rows": rows.TotalRows(),
+		"offset":     rows.Offset(),
+		"rows":       result,
+	})
+}
+
+// keyedRows returns a row for each of keys, as for _all_docs with keys.
+func keyedRows(ctx context.Context, d driver.DB, keys []string, includeDocs bool) ([]*allDocsRow, error) {
+	result := make([]*allDocsRow, 0, len(keys))
+	for _, key := range keys {
+		rawKey, _ := json.Marshal(key)
+		doc, err := d.Get(ctx, key, kivik.Params(nil))
+		if kivik.HTTPStatus(err) == http.StatusNotFound {
+			result = append(result, &allDocsRow{Key: rawKey, Error: "not_found"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := &allDocsRow{ID: key, Key: rawKey}
+		row.Value, _ = json.Marshal(map[string]string{"rev": doc.Rev})
+		if includeDocs {
+			if row.Doc, err = readRaw(doc.Body); err != nil {
+				_ = doc.Body.Close()
+				return nil, err
+			}
+		}
+		_ = doc.Body.Close()
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+func (h *handler) bulkDocs(w http.ResponseWriter, r *http.Request, d driver.DB) error {
+	if err := allowMethods(r, http.MethodPost); err != nil {
+		return err
+	}
+	var body struct {
+		Docs     []map[string]json.RawMessage `json:"docs"`
+		NewEdits *bool                        `json:"new_edits"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	newEdits := body.NewEdits == nil || *body.NewEdits
+	opts := map[string]interface{}{}
+	if !newEdits {
+		opts["new_edits"] = false
+	}
+	results := make([]map[string]interface{}, 0, len(body.Docs))
+	for _, doc := range body.Docs {
+		docID, err := bodyDocID(doc)
+		var rev string
+		if err == nil {
+			rev, err = d.Put(r.Context(), docID, doc, kivik.Params(opts))
+		}
+		if err != nil {
+			_, name := couchError(err)
+			results = append(results, map[string]interface{}{
+				"id":     docID,
+				"error":  name,
+				"reason": err.Error(),
+			})
+			continue
+		}
+		if newEdits {
+			results = append(results, map[string]interface{}{
+				"ok":  true,
+				"id":  docID,
+				"rev": rev,
+			})
+		}
+	}
+	return writeJSON(w, http.StatusCreated, results)
+}
+
+func (h *handler) bulkGet(w http.ResponseWriter, r *http.Request, d driver.DB) error {
+	if err := allowMethods(r, http.MethodPost); err != nil {
+		return err
+	}
+	getter, ok := d.(driver.BulkGetter)
+	if !ok {
+		return statusError{status: http.StatusNotImplemented, error: errors.New("_bulk_get is not supported")}
+	}
+	var body struct {
+		Docs []driver.BulkGetReference `json:"docs"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	rows, err := getter.BulkGet(r.Context(), body.Docs, kivik.Params(queryOptions(r)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	results := make([]map[string]interface{}, 0, len(body.Docs))
+	for _, ref := range body.Docs {
+		row := new(driver.Row)
+		if err := rows.Next(row); err != nil {
+			return err
+		}
+		var result map[string]interface{}
+		if row.Error != nil {
+			_, name := couchError(row.Error)
+			result = map[string]interface{}{"error": map[string]string{
+				"id":     ref.ID,
+				"rev":    ref.Rev,
+				"error":  name,
+				"reason": row.Error.Error(),
+			}}
+		} else {
+			doc, err := readRaw(row.Doc)
+			if err != nil {
+				return err
+			}
+			result = map[string]interface{}{"ok": doc}
+		}
+		results = append(results, map[string]interface{}{
+			"id":   ref.ID,
+			"docs": []interface{}{result},
+		})
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+func (h *handler) revsDiff(w http.ResponseWriter, r *http.Request, d driver.DB) error {
+	if err := allowMethods(r, http.MethodPost); err != nil {
+		return err
+	}
+	differ, ok := d.(driver.RevsDiffer)
+	if !ok {
+		return statusError{status: http.StatusNotImplemented, error: errors.New("_revs_diff is not supported")}
+	}
+	var revMap map[string][]string
+	if err := decodeBody(r, &revMap); err != nil {
+		return err
+	}
+	rows, err := differ.RevsDiff(r.Context(), revMap)
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	result := map[string]json.RawMessage{}
+	for {
+		row := new(driver.Row)
+		if err := rows.Next(row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if result[row.ID], err = readRaw(row.Value); err != nil {
+			return err
+		}
+	}
+	return writeJSON(w, http.StatusOK, result)
+}
+
+// readRaw reads the JSON value from r, which may be nil.
+func readRaw(r io.Reader) (json.RawMessage, error) {
+	if r == nil {
+		return nil, nil
+	}
+	return io.ReadAll(r)
+}
@@ -27,9 +27,8 @@ func registerFSSuite() {
 		"CreateDB/RW/NoAuth.status":         http.StatusUnauthorized,
 		"CreateDB/RW/Admin/Recreate.status": http.StatusPreconditionFailed,
 
-		"AllDocs.skip": true, // FIXME: Not yet implemented
-		// "AllDocs/Admin.databases":  []string{"foo"},
-		// "AllDocs/Admin/foo.status": http.StatusNotFound,
+		"AllDocs/Admin.databases":  []string{"foo"},
+		"AllDocs/Admin/foo.status": http.StatusNotFound,
 
 		"DBExists/Admin.databases":       []string{"chicken"},
 		"DBExists/Admin/chicken.exists":  false,
@@ -41,15 +40,14 @@ func registerFSSuite() {
 		"Version.vendor":         "Kivik",
 		"Version.vendor_version": `^0\.0\.1$`,
 
-		// Replications not to be implemented
+		// The kiviktest replication tests replicate to/from remote servers,
+		// but this driver replicates only between local databases.
 		"GetReplications.skip": true,
 		"Replicate.skip":       true,
 
 		"Get/RW/group/Admin/bogus.status":  http.StatusNotFound,
 		"Get/RW/group/NoAuth/bogus.status": http.StatusNotFound,
 
-		"GetRev.skip":            true,                      // FIXME: Unimplemented
-		"Flush.skip":             true,                      // FIXME: Unimplemented
 		"Delete.skip":            true,                      // FIXME: Unimplemented
 		"Stats.skip":             true,                      // FIXME: Unimplemented
 		"CreateDoc.skip":         true,                      // FIXME: Unimplemented
@@ -57,7 +55,6 @@ func registerFSSuite() {
 		"Security.skip":          true,                      // FIXME: Unimplemented
 		"DBUpdates.status":       http.StatusNotImplemented, // FIXME: Unimplemented
 		"Changes.skip":           true,                      // FIXME: Unimplemented
-		"Copy.skip":              true,                      // FIXME: Unimplemented, depends on Get/Put or Copy
 		"BulkDocs.skip":          true,                      // FIXME: Unimplemented
 		"GetAttachment.skip":     true,                      // FIXME: Unimplemented
 		"GetAttachmentMeta.skip": true,                      // FIXME: Unimplemented